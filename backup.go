@@ -0,0 +1,341 @@
+// Copyright 2022 Daniel Erat.
+// All rights reserved.
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/derat/rendmail/rewrite"
+)
+
+// backupOptions describes how original versions of messages are saved.
+type backupOptions struct {
+	dir     string // directory in which messages are saved as individual files
+	maildir string // Maildir to which messages are delivered
+	mbox    string // mbox file to which messages are appended
+	record  bool   // add X-Rendmail-Backup fields to rewritten messages
+
+	onlyModified bool // only keep backups of messages that were modified
+	partsOnly    bool // only save deleted parts (see makePartsBackup)
+	index        bool // append entries describing backups to backupIndexName
+	dedup        bool // avoid storing duplicate backups (see dedupBackup)
+
+	sync     bool        // fsync local backups and their directories before committing
+	modeFlag string      // octal permissions for local backups
+	perm     os.FileMode // parsed from modeFlag by check
+
+	minFreeFlag string // minimum free space, e.g. "500M"
+	minFree     int64  // parsed from minFreeFlag by check
+	lowSpace    string // action when minFree isn't met: "tempfail" or "skip"
+
+	encryptRecipient string          // age recipient or OpenPGP public key file
+	encrypter        backupEncrypter // created from encryptRecipient by check
+	store            backupStore     // created by check if dir is a URL
+}
+
+// addBackupFlags adds flags to fs for configuring bk.
+func addBackupFlags(fs *flag.FlagSet, bk *backupOptions) {
+	fs.StringVar(&bk.dir, "backup-dir", "", "Directory or URL (s3://, gs://, webdav://, webdavs://) to which original, unmodified messages will be saved")
+	fs.StringVar(&bk.maildir, "backup-maildir", "", "Maildir to which original, unmodified messages will be delivered")
+	fs.StringVar(&bk.mbox, "backup-mbox", "", "mbox file to which original, unmodified messages will be appended")
+	fs.BoolVar(&bk.record, "record-backup", false, "Add X-Rendmail-Backup field identifying backup")
+	fs.StringVar(&bk.encryptRecipient, "backup-encrypt-recipient", "",
+		`Encrypt -backup-dir files to age recipient ("age1...") or OpenPGP public key file`)
+	fs.BoolVar(&bk.sync, "backup-fsync", false, "Sync local backups and their directories to disk before writing rewritten messages")
+	fs.StringVar(&bk.modeFlag, "backup-mode", "0600", "Octal permissions for local backup files")
+	fs.BoolVar(&bk.dedup, "backup-dedup", false, "Hard-link (or skip with -backup-mbox) backups identical to earlier ones")
+	fs.StringVar(&bk.lowSpace, "backup-low-space", "tempfail",
+		`Action when -backup-min-free isn't met ("tempfail" or "skip" with `+rewrite.BackupWarningField+`)`)
+	fs.StringVar(&bk.minFreeFlag, "backup-min-free", "", `Minimum free space on local backup filesystem (e.g. "500M")`)
+	fs.BoolVar(&bk.index, "backup-index", false, "Append a JSON line describing each backup to "+backupIndexName+" in the backup directory")
+	fs.BoolVar(&bk.onlyModified, "backup-only-modified", false, "Only save backups of messages that were modified")
+	fs.BoolVar(&bk.partsOnly, "backup-parts-only", false, "Only save deleted parts (with enough context to restore them) instead of whole messages")
+}
+
+// check returns an error if bk's flags are invalid.
+// It also loads the key for bk.encryptRecipient, creates bk.store, and sets bk.perm.
+func (bk *backupOptions) check() error {
+	var n int
+	for _, v := range []string{bk.dir, bk.maildir, bk.mbox} {
+		if v != "" {
+			n++
+		}
+	}
+	if n > 1 {
+		return errors.New("-backup-dir, -backup-maildir, and -backup-mbox are mutually exclusive")
+	}
+	if bk.dir != "" {
+		var err error
+		if bk.store, err = newBackupStore(bk.dir); err != nil {
+			return fmt.Errorf("-backup-dir: %v", err)
+		}
+	}
+	for _, f := range []struct {
+		name string
+		set  bool
+	}{
+		{"record-backup", bk.record},
+		{"backup-only-modified", bk.onlyModified},
+		{"backup-parts-only", bk.partsOnly},
+		{"backup-index", bk.index},
+		{"backup-fsync", bk.sync},
+		{"backup-dedup", bk.dedup},
+		{"backup-min-free", bk.minFreeFlag != ""},
+	} {
+		if f.set && !bk.enabled() {
+			return fmt.Errorf("-%v requires -backup-dir, -backup-maildir, or -backup-mbox", f.name)
+		}
+	}
+	if bk.index && bk.store != nil {
+		return errors.New("-backup-index requires a local -backup-dir")
+	}
+	if bk.dedup && bk.store != nil {
+		return errors.New("-backup-dedup requires a local -backup-dir")
+	}
+	if bk.minFreeFlag != "" {
+		var err error
+		if bk.minFree, err = parseByteSize(bk.minFreeFlag); err != nil {
+			return fmt.Errorf("bad -backup-min-free: %v", err)
+		}
+		if bk.store != nil {
+			return errors.New("-backup-min-free requires a local -backup-dir")
+		}
+	}
+	switch bk.lowSpace {
+	case "", "tempfail", "skip":
+	default:
+		return fmt.Errorf("bad -backup-low-space %q", bk.lowSpace)
+	}
+	if bk.modeFlag != "" {
+		mode, err := strconv.ParseUint(bk.modeFlag, 8, 32)
+		if err != nil || mode&^uint64(os.ModePerm) != 0 {
+			return fmt.Errorf("bad -backup-mode %q", bk.modeFlag)
+		}
+		bk.perm = os.FileMode(mode)
+	}
+	if bk.encryptRecipient != "" {
+		if bk.dir == "" {
+			return errors.New("-backup-encrypt-recipient requires -backup-dir")
+		}
+		var err error
+		if bk.encrypter, err = newBackupEncrypter(bk.encryptRecipient); err != nil {
+			return fmt.Errorf("-backup-encrypt-recipient: %v", err)
+		}
+	}
+	return nil
+}
+
+// enabled returns true if messages should be backed up.
+func (bk *backupOptions) enabled() bool {
+	return bk.dir != "" || bk.maildir != "" || bk.mbox != ""
+}
+
+// dirs returns the directories (or mbox file) that contain backups.
+func (bk *backupOptions) dirs() []string {
+	if bk.mbox != "" {
+		return []string{bk.mbox}
+	}
+	if bk.maildir != "" {
+		return []string{filepath.Join(bk.maildir, "new"), filepath.Join(bk.maildir, "cur")}
+	}
+	if bk.dir != "" {
+		return []string{bk.dir}
+	}
+	return nil
+}
+
+// fileMode returns the permissions to use for local backup files.
+func (bk *backupOptions) fileMode() os.FileMode {
+	if bk.perm == 0 {
+		return 0600
+	}
+	return bk.perm
+}
+
+// deferred returns true if backups can't be written until messages have been rewritten.
+func (bk *backupOptions) deferred() bool {
+	return bk.onlyModified || bk.partsOnly
+}
+
+// recordValue returns the value of the rewrite.BackupField header field for a backup of orig
+// that will be saved to p.
+func (bk *backupOptions) recordValue(p string, orig []byte) string {
+	if bk.partsOnly {
+		// The backup's contents aren't known until after the message is rewritten.
+		return backupRecord(p, nil)
+	}
+	return backupRecord(p, orig)
+}
+
+// finish saves a deferred backup to w (created by create). orig is the original message as
+// received, and decoded is the decompressed version of it that was rewritten to rewritten
+// (nil if rewriting failed). changed indicates whether the rewritten message differed.
+// If no backup is needed, w is aborted and an empty path is returned.
+func (bk *backupOptions) finish(w backupWriter, orig, decoded, rewritten []byte, changed bool) (string, error) {
+	if rewritten == nil {
+		return writeBackup(w, orig) // save the full message if rewriting failed
+	}
+	if bk.onlyModified && !changed {
+		w.abort()
+		return "", nil
+	}
+	if bk.partsOnly {
+		parts, err := makePartsBackup(decoded, rewritten)
+		if err != nil || parts == nil {
+			w.abort()
+			return "", err
+		}
+		return writeBackup(w, parts)
+	}
+	return writeBackup(w, orig)
+}
+
+// backupWriter is an io.Writer that saves the original version of a message.
+type backupWriter interface {
+	io.Writer
+	// path returns the path at which the backup will be saved.
+	path() string
+	// commit finishes saving the message and returns the backup's path.
+	commit() (string, error)
+	// abort discards the partially-written backup.
+	abort()
+}
+
+// create returns a new backupWriter for saving a message received at now.
+// A *lowSpaceError is returned if bk.minFree isn't met.
+func (bk *backupOptions) create(now time.Time) (backupWriter, error) {
+	if bk.minFree > 0 {
+		if err := bk.checkFreeSpace(); err != nil {
+			return nil, err
+		}
+	}
+	w, err := bk.createWriter(now)
+	if err != nil {
+		return nil, err
+	}
+	var dir string // only hash backups if deduplication is disabled
+	if bk.dedup {
+		dir = bk.hashDir()
+	}
+	return newDedupBackup(w, dir, bk.mbox == ""), nil
+}
+
+// createWriter is a helper for create that returns a backupWriter that doesn't
+// perform deduplication.
+func (bk *backupOptions) createWriter(now time.Time) (backupWriter, error) {
+	if bk.maildir != "" {
+		// Maildir deliveries are always synced.
+		d, err := newMaildirDelivery(bk.maildir, now)
+		if err != nil {
+			return nil, err
+		}
+		if err := d.f.Chmod(bk.fileMode()); err != nil {
+			d.abort()
+			return nil, err
+		}
+		return d, nil
+	}
+	if bk.mbox != "" {
+		return &mboxBackup{p: bk.mbox, now: now, perm: bk.fileMode(), sync: bk.sync}, nil
+	}
+	var ext string
+	if bk.encrypter != nil {
+		ext = bk.encrypter.ext()
+	}
+	var dst backupWriter
+	if bk.store != nil {
+		name, err := remoteBackupName(now, ext)
+		if err != nil {
+			return nil, err
+		}
+		dst = &remoteBackup{store: bk.store, name: name}
+	} else {
+		f, err := createBackupFile(bk.dir, now, ext)
+		if err != nil {
+			return nil, err
+		}
+		fb := &fileBackup{f, bk.sync}
+		if err := f.Chmod(bk.fileMode()); err != nil {
+			fb.abort()
+			return nil, err
+		}
+		dst = fb
+	}
+	if bk.encrypter == nil {
+		return dst, nil
+	}
+	enc, err := bk.encrypter.encrypt(dst)
+	if err != nil {
+		dst.abort()
+		return nil, err
+	}
+	return &encryptedBackup{dst, enc}, nil
+}
+
+// save saves the original message b (received at now) and returns the backup's path.
+func (bk *backupOptions) save(now time.Time, b []byte) (string, error) {
+	w, err := bk.create(now)
+	if err != nil {
+		return "", err
+	}
+	return writeBackup(w, b)
+}
+
+// writeBackup writes b to w and commits it, returning the backup's path.
+// w is aborted on failure.
+func writeBackup(w backupWriter, b []byte) (string, error) {
+	if _, err := w.Write(b); err != nil {
+		w.abort()
+		return "", err
+	}
+	return w.commit()
+}
+
+// createBackupFile creates dir if needed and creates a new file within it
+// for saving the original version of a message received at now.
+// ext is appended to the filename.
+func createBackupFile(dir string, now time.Time, ext string) (*os.File, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return ioutil.TempFile(dir, now.UTC().Format("20060102-150405.999")+"-*"+ext)
+}
+
+// fileBackup is a backupWriter that writes a message to a bare file.
+type fileBackup struct {
+	f    *os.File
+	sync bool // sync file and directory in commit
+}
+
+func (fb *fileBackup) Write(p []byte) (int, error) { return fb.f.Write(p) }
+func (fb *fileBackup) path() string                { return fb.f.Name() }
+
+func (fb *fileBackup) commit() (string, error) {
+	if fb.sync {
+		if err := fb.f.Sync(); err != nil {
+			fb.abort()
+			return "", err
+		}
+	}
+	if err := fb.f.Close(); err != nil {
+		return "", err
+	}
+	if fb.sync {
+		return fb.f.Name(), syncDir(filepath.Dir(fb.f.Name()))
+	}
+	return fb.f.Name(), nil
+}
+
+func (fb *fileBackup) abort() {
+	fb.f.Close()
+	os.Remove(fb.f.Name())
+}
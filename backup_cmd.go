@@ -0,0 +1,379 @@
+// Copyright 2022 Daniel Erat.
+// All rights reserved.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/derat/rendmail/rewrite"
+	"golang.org/x/crypto/openpgp"
+)
+
+// backupMain implements the "backup" subcommand using the supplied command-line
+// arguments. The process's exit code is returned.
+func backupMain(args []string) int {
+	var bk backupOptions
+	fs := flag.NewFlagSet("backup", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s backup [flag]... list|show ID|restore ID|verify [ID]...\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Manages original messages saved by -backup-dir, -backup-maildir, or -backup-mbox.\n")
+		fmt.Fprintf(os.Stderr, "IDs are printed by \"list\". \"restore\" writes a backup to stdout.\n\n")
+		fs.PrintDefaults()
+	}
+	fs.StringVar(&bk.dir, "backup-dir", "", "Directory (or URL for show and restore) containing backups")
+	fs.StringVar(&bk.maildir, "backup-maildir", "", "Maildir containing backups")
+	fs.StringVar(&bk.mbox, "backup-mbox", "", "mbox file containing backups")
+	pgpKey := fs.String("pgp-decrypt-key", "", "File containing OpenPGP secret key for decrypting backups")
+	pgpPassFile := fs.String("pgp-passphrase-file", "", "File containing passphrase for -pgp-decrypt-key")
+	fs.Parse(args)
+
+	if fs.NArg() == 0 || !bk.enabled() {
+		fs.Usage()
+		return 2
+	}
+	if err := bk.check(); err != nil {
+		fmt.Fprintln(os.Stderr, "Invalid flags:", err)
+		return 2
+	}
+	var keys openpgp.EntityList
+	if *pgpKey != "" {
+		var pass []byte
+		if *pgpPassFile != "" {
+			b, err := ioutil.ReadFile(*pgpPassFile)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, "Bad -pgp-passphrase-file:", err)
+				return 2
+			}
+			pass = bytes.TrimRight(b, "\r\n")
+		}
+		var err error
+		if keys, err = rewrite.LoadPGPKeys(*pgpKey, pass); err != nil {
+			fmt.Fprintln(os.Stderr, "Bad -pgp-decrypt-key:", err)
+			return 2
+		}
+	}
+
+	cmd, cargs := fs.Arg(0), fs.Args()[1:]
+	var err error
+	switch {
+	case cmd == "list" && len(cargs) == 0:
+		err = listBackups(os.Stdout, &bk, keys)
+	case cmd == "show" && len(cargs) == 1:
+		err = showBackup(os.Stdout, &bk, keys, cargs[0])
+	case cmd == "restore" && len(cargs) == 1:
+		var sb *storedBackup
+		if sb, err = findStoredBackup(&bk, cargs[0]); err == nil {
+			var b []byte
+			if b, err = sb.load(keys); err == nil {
+				if readPartsBackup(b) != nil {
+					fmt.Fprintln(os.Stderr, "Backup only contains deleted parts; use -restore with the rewritten message")
+				}
+				_, err = os.Stdout.Write(b)
+			}
+		}
+	case cmd == "verify":
+		var bad int
+		if bad, err = verifyBackups(os.Stdout, &bk, keys, cargs); err == nil && bad > 0 {
+			return 1
+		}
+	default:
+		fs.Usage()
+		return 2
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed running %q: %v\n", cmd, err)
+		return 1
+	}
+	return 0
+}
+
+// storedBackup describes a backup found by listStoredBackups.
+type storedBackup struct {
+	id   string // identifier used by the "backup" subcommand
+	dir  string // directory (or URL) containing the backup, empty for mbox messages
+	name string // backup's filename within dir
+	data []byte // message read from an mbox file
+}
+
+// load returns the backup's contents, decrypting them using keys if needed.
+func (sb *storedBackup) load(keys openpgp.EntityList) ([]byte, error) {
+	if sb.data != nil {
+		return sb.data, nil
+	}
+	return readBackupFile(sb.dir, sb.name, keys)
+}
+
+// listStoredBackups returns all of the backups described by bk.
+// Backups in mbox files are identified by 1-based indexes, and backups in
+// directories are identified by their paths relative to the directory (or Maildir).
+func listStoredBackups(bk *backupOptions) ([]storedBackup, error) {
+	if bk.store != nil {
+		return nil, errors.New("remote backups can't be listed")
+	}
+	var backups []storedBackup
+	if bk.mbox != "" {
+		f, err := os.Open(bk.mbox)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		mr := newMboxReader(f)
+		for {
+			_, msg, err := mr.read()
+			if err == io.EOF {
+				return backups, nil
+			} else if err != nil {
+				return nil, err
+			}
+			backups = append(backups, storedBackup{id: strconv.Itoa(len(backups) + 1), data: msg})
+		}
+	}
+
+	root := bk.dir
+	if bk.maildir != "" {
+		root = bk.maildir
+	}
+	for _, dir := range bk.dirs() {
+		fis, err := ioutil.ReadDir(dir)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		for _, fi := range fis {
+			if !fi.Mode().IsRegular() || fi.Name() == backupIndexName {
+				continue
+			}
+			id, err := filepath.Rel(root, filepath.Join(dir, fi.Name()))
+			if err != nil {
+				return nil, err
+			}
+			backups = append(backups, storedBackup{id: id, dir: dir, name: fi.Name()})
+		}
+	}
+	return backups, nil
+}
+
+// findStoredBackup returns the backup in bk with the supplied ID.
+func findStoredBackup(bk *backupOptions, id string) (*storedBackup, error) {
+	if bk.store != nil {
+		return &storedBackup{id: id, dir: bk.dir, name: id}, nil
+	}
+	backups, err := listStoredBackups(bk)
+	if err != nil {
+		return nil, err
+	}
+	for i := range backups {
+		if backups[i].id == id {
+			return &backups[i], nil
+		}
+	}
+	return nil, fmt.Errorf("no backup with ID %q", id)
+}
+
+// readBackupIndex reads bk's backup index and returns its entries keyed by path.
+// An empty map is returned if the index doesn't exist or if bk uses an mbox file
+// (since all of its entries have the same path).
+func readBackupIndex(bk *backupOptions) (map[string]*backupIndexEntry, error) {
+	entries := make(map[string]*backupIndexEntry)
+	if bk.store != nil || bk.mbox != "" {
+		return entries, nil
+	}
+	f, err := os.Open(bk.indexPath())
+	if os.IsNotExist(err) {
+		return entries, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	sc.Buffer(nil, 1024*1024)
+	for ln := 1; sc.Scan(); ln++ {
+		var e backupIndexEntry
+		if err := json.Unmarshal(sc.Bytes(), &e); err != nil {
+			return nil, fmt.Errorf("%v:%d: %v", bk.indexPath(), ln, err)
+		}
+		entries[e.Path] = &e
+	}
+	return entries, sc.Err()
+}
+
+// backupHeader returns the decoded value of the named header field in msg.
+func backupHeader(msg *mail.Message, name string) string {
+	if msg == nil {
+		return ""
+	}
+	v := msg.Header.Get(name)
+	if dec, err := rewrite.DecodeHeader(v); err == nil {
+		v = dec
+	}
+	return v
+}
+
+// listBackups writes a line describing each of bk's backups to w.
+// Each line contains tab-separated ID, date, size, sender, and subject.
+func listBackups(w io.Writer, bk *backupOptions, keys openpgp.EntityList) error {
+	backups, err := listStoredBackups(bk)
+	if err != nil {
+		return err
+	}
+	for _, sb := range backups {
+		b, err := sb.load(keys)
+		if err != nil {
+			fmt.Fprintf(w, "%v\t(%v)\n", sb.id, err)
+			continue
+		}
+		msg, _ := mail.ReadMessage(bytes.NewReader(b))
+		date := backupHeader(msg, "Date")
+		if t, err := mail.ParseDate(date); err == nil {
+			date = t.Format(time.RFC3339)
+		}
+		fmt.Fprintf(w, "%v\t%v\t%d\t%v\t%v\n", sb.id, date, len(b),
+			backupHeader(msg, "From"), backupHeader(msg, "Subject"))
+	}
+	return nil
+}
+
+// showBackup writes a description of the backup with the supplied ID to w.
+func showBackup(w io.Writer, bk *backupOptions, keys openpgp.EntityList, id string) error {
+	sb, err := findStoredBackup(bk, id)
+	if err != nil {
+		return err
+	}
+	b, err := sb.load(keys)
+	if err != nil {
+		return err
+	}
+	sum := sha256.Sum256(b)
+	fmt.Fprintf(w, "ID: %v\n", sb.id)
+	if sb.dir != "" {
+		fmt.Fprintf(w, "Path: %v\n", filepath.Join(sb.dir, sb.name))
+	}
+	fmt.Fprintf(w, "Size: %d\n", len(b))
+	fmt.Fprintf(w, "SHA-256: %v\n", hex.EncodeToString(sum[:]))
+	msg, _ := mail.ReadMessage(bytes.NewReader(b))
+	for _, k := range []string{"Date", "From", "To", "Subject", "Message-Id"} {
+		if v := backupHeader(msg, k); v != "" {
+			fmt.Fprintf(w, "%v: %v\n", k, v)
+		}
+	}
+	if parts := readPartsBackup(b); parts != nil {
+		var paths []string
+		for p := range parts {
+			paths = append(paths, p)
+		}
+		sort.Strings(paths)
+		fmt.Fprintf(w, "Saved parts: %v\n", strings.Join(paths, ", "))
+	}
+
+	entries, err := readBackupIndex(bk)
+	if err != nil {
+		return err
+	}
+	if e := entries[sb.id]; e != nil {
+		fmt.Fprintf(w, "Backed up: %v\n", e.Time.Format(time.RFC3339))
+		fmt.Fprintf(w, "Rewritten size: %d\n", e.NewSize)
+		for _, d := range e.Deleted {
+			fmt.Fprintf(w, "Deleted: %v %q (%d bytes)\n", d.Type, d.Filename, d.Size)
+		}
+		if e.Duplicate {
+			fmt.Fprintln(w, "Duplicate: true")
+		}
+		if e.Profile != "" {
+			fmt.Fprintf(w, "Profile: %v\n", e.Profile)
+		}
+		if len(e.Rules) > 0 {
+			fmt.Fprintf(w, "Rules: %v\n", strings.Join(e.Rules, ", "))
+		}
+		if len(e.Options) > 0 {
+			b, err := json.Marshal(e.Options)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(w, "Options: %s\n", b)
+		}
+	}
+	return nil
+}
+
+// verifyBackups checks the backups in bk with the supplied IDs (or all backups if ids is
+// empty) and writes a line to w for each problem. Backups must be readable messages and
+// must match the hashes recorded in the index. Index entries for missing backups are also
+// reported if ids is empty. The number of problems is returned.
+func verifyBackups(w io.Writer, bk *backupOptions, keys openpgp.EntityList, ids []string) (int, error) {
+	entries, err := readBackupIndex(bk)
+	if err != nil {
+		return 0, err
+	}
+	var backups []storedBackup
+	if len(ids) == 0 {
+		if backups, err = listStoredBackups(bk); err != nil {
+			return 0, err
+		}
+	} else {
+		for _, id := range ids {
+			sb, err := findStoredBackup(bk, id)
+			if err != nil {
+				return 0, err
+			}
+			backups = append(backups, *sb)
+		}
+	}
+
+	var bad int
+	report := func(id string, err error) {
+		fmt.Fprintf(w, "%v: %v\n", id, err)
+		bad++
+	}
+	seen := make(map[string]bool)
+	for _, sb := range backups {
+		seen[sb.id] = true
+		b, err := sb.load(keys)
+		if err != nil {
+			report(sb.id, err)
+			continue
+		}
+		if _, err := mail.ReadMessage(bytes.NewReader(b)); err != nil {
+			report(sb.id, fmt.Errorf("bad message: %v", err))
+			continue
+		}
+		if e := entries[sb.id]; e != nil && e.SHA256 != "" {
+			if sum := sha256.Sum256(b); hex.EncodeToString(sum[:]) != e.SHA256 {
+				report(sb.id, fmt.Errorf("sha256 %v doesn't match index", hex.EncodeToString(sum[:])))
+			}
+		}
+	}
+	// Messages in Maildirs can be moved from new/ to cur/, so only check for missing
+	// backups in plain directories.
+	if len(ids) == 0 && bk.dir != "" {
+		var paths []string
+		for p := range entries {
+			if !seen[p] {
+				paths = append(paths, p)
+			}
+		}
+		sort.Strings(paths)
+		for _, p := range paths {
+			report(p, errors.New("listed in index but missing"))
+		}
+	}
+	fmt.Fprintf(w, "Checked %d backup(s), found %d problem(s)\n", len(backups), bad)
+	return bad, nil
+}
@@ -0,0 +1,138 @@
+// Copyright 2022 Daniel Erat.
+// All rights reserved.
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/derat/rendmail/rewrite"
+)
+
+func TestBackupCommands(t *testing.T) {
+	msgs := []string{
+		"Date: Sat, 16 Apr 2022 12:00:00 +0000\r\nFrom: me@example.org\r\nSubject: First\r\n\r\nBody\r\n",
+		"From: you@example.org\r\nSubject: =?UTF-8?Q?S=C3=A9cond?=\r\n\r\nBody\r\n",
+	}
+	now := time.Date(2022, 4, 16, 16, 33, 34, 0, time.UTC)
+
+	for _, tc := range []struct {
+		bk  backupOptions
+		ids []string // expected IDs, with "*" matching any suffix
+	}{
+		{backupOptions{dir: t.TempDir(), index: true}, []string{"20220416-163334-*", "20220416-163335-*"}},
+		{backupOptions{maildir: t.TempDir()}, []string{"new/*", "new/*"}},
+		{backupOptions{mbox: filepath.Join(t.TempDir(), "mbox")}, []string{"1", "2"}},
+	} {
+		bk := tc.bk
+		for i, msg := range msgs {
+			w, err := bk.create(now.Add(time.Duration(i) * time.Second))
+			if err != nil {
+				t.Fatal(err)
+			}
+			p, err := writeBackup(w, []byte(msg))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := bk.addToIndex(newBackupIndexEntry(p, w, []byte(msg), 0, &rewrite.Options{Now: now}, nil)); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		var list bytes.Buffer
+		if err := listBackups(&list, &bk, nil); err != nil {
+			t.Errorf("listBackups() with %+v failed: %v", bk, err)
+			continue
+		}
+		lines := strings.Split(strings.TrimSpace(list.String()), "\n")
+		if len(lines) != len(msgs) {
+			t.Errorf("listBackups() with %+v printed %q; want %d lines", bk, list.String(), len(msgs))
+			continue
+		}
+		var ids []string
+		for i, ln := range lines {
+			fields := strings.Split(ln, "\t")
+			want := strings.TrimSuffix(tc.ids[i], "*")
+			if len(fields) != 5 || !strings.HasPrefix(fields[0], want) {
+				t.Errorf("listBackups() with %+v printed line %q; want ID %q", bk, ln, tc.ids[i])
+				continue
+			}
+			ids = append(ids, fields[0])
+		}
+		if len(ids) != len(msgs) {
+			continue
+		}
+		if !strings.Contains(list.String(), "\t2022-04-16T12:00:00Z\t") ||
+			!strings.Contains(list.String(), "\tSécond\n") {
+			t.Errorf("listBackups() with %+v printed %q", bk, list.String())
+		}
+
+		for i, id := range ids {
+			sb, err := findStoredBackup(&bk, id)
+			if err != nil {
+				t.Errorf("findStoredBackup(%q) with %+v failed: %v", id, bk, err)
+			} else if b, err := sb.load(nil); err != nil {
+				t.Errorf("load() for %q with %+v failed: %v", id, bk, err)
+			} else if string(b) != msgs[i] {
+				t.Errorf("load() for %q with %+v = %q; want %q", id, bk, b, msgs[i])
+			}
+			var show bytes.Buffer
+			if err := showBackup(&show, &bk, nil, id); err != nil {
+				t.Errorf("showBackup(%q) with %+v failed: %v", id, bk, err)
+			} else if !strings.HasPrefix(show.String(), "ID: "+id+"\n") {
+				t.Errorf("showBackup(%q) with %+v printed %q", id, bk, show.String())
+			}
+		}
+
+		var out bytes.Buffer
+		if bad, err := verifyBackups(&out, &bk, nil, nil); err != nil {
+			t.Errorf("verifyBackups() with %+v failed: %v", bk, err)
+		} else if bad != 0 {
+			t.Errorf("verifyBackups() with %+v reported %d problem(s):\n%s", bk, bad, out.String())
+		}
+	}
+}
+
+func TestVerifyBackups_problems(t *testing.T) {
+	bk := backupOptions{dir: t.TempDir(), index: true}
+	now := time.Date(2022, 4, 16, 16, 33, 34, 0, time.UTC)
+	var paths []string
+	for _, msg := range []string{"Subject: 1\n\nBody\n", "Subject: 2\n\nBody\n", "Subject: 3\n\nBody\n"} {
+		w, err := bk.create(now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p, err := writeBackup(w, []byte(msg))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := bk.addToIndex(newBackupIndexEntry(p, w, []byte(msg), 0, &rewrite.Options{Now: now}, nil)); err != nil {
+			t.Fatal(err)
+		}
+		paths = append(paths, p)
+	}
+	if err := ioutil.WriteFile(paths[0], []byte("Subject: 1\n\nModified\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(paths[1]); err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	if bad, err := verifyBackups(&out, &bk, nil, nil); err != nil {
+		t.Fatal("verifyBackups() failed:", err)
+	} else if bad != 2 {
+		t.Errorf("verifyBackups() reported %d problem(s); want 2:\n%s", bad, out.String())
+	}
+	for _, p := range paths[:2] {
+		if !strings.Contains(out.String(), filepath.Base(p)+": ") {
+			t.Errorf("verifyBackups() didn't report %v:\n%s", filepath.Base(p), out.String())
+		}
+	}
+}
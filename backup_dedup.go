@@ -0,0 +1,142 @@
+// Copyright 2022 Daniel Erat.
+// All rights reserved.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// backupHashDir is the name of the directory within the backup directory (or Maildir)
+// that holds hard links to backups named by the hex-encoded SHA-256 hashes of their
+// contents for -backup-dedup. When using -backup-mbox, the directory is named after
+// the mbox file plus backupHashExt.
+const (
+	backupHashDir = "rendmail-sha256"
+	backupHashExt = ".sha256"
+)
+
+// hashDir returns the directory used to find duplicate backups.
+func (bk *backupOptions) hashDir() string {
+	switch {
+	case bk.maildir != "":
+		return filepath.Join(bk.maildir, backupHashDir)
+	case bk.mbox != "":
+		return bk.mbox + backupHashExt
+	default:
+		return filepath.Join(bk.dir, backupHashDir)
+	}
+}
+
+// dedupBackup is a backupWriter that hashes the data written to it and avoids
+// storing multiple copies of identical backups. If dir is empty, the data is only hashed.
+//
+// If link is true, a hard link to each new backup is created in dir, and later
+// backups with the same contents are replaced by hard links to the earlier copy.
+// Otherwise (i.e. for mbox files, where individual messages can't be linked),
+// empty files are created in dir and duplicate backups are skipped.
+type dedupBackup struct {
+	dst  backupWriter
+	dir  string
+	link bool
+	h    hash.Hash
+
+	sum string // hex-encoded hash, set by commit
+	dup bool   // set by commit if the backup was a duplicate
+}
+
+func newDedupBackup(dst backupWriter, dir string, link bool) *dedupBackup {
+	return &dedupBackup{dst: dst, dir: dir, link: link, h: sha256.New()}
+}
+
+func (db *dedupBackup) Write(p []byte) (int, error) {
+	db.h.Write(p)
+	return db.dst.Write(p)
+}
+
+func (db *dedupBackup) path() string { return db.dst.path() }
+func (db *dedupBackup) abort()       { db.dst.abort() }
+
+func (db *dedupBackup) commit() (string, error) {
+	db.sum = hex.EncodeToString(db.h.Sum(nil))
+	if db.dir == "" {
+		return db.dst.commit()
+	}
+	if err := os.MkdirAll(db.dir, 0700); err != nil {
+		db.dst.abort()
+		return "", err
+	}
+	hp := filepath.Join(db.dir, db.sum)
+	fi, err := os.Stat(hp)
+	if err != nil && !os.IsNotExist(err) {
+		db.dst.abort()
+		return "", err
+	}
+	exists := err == nil
+
+	if !db.link {
+		if exists {
+			db.dst.abort()
+			db.dup = true
+			return db.dst.path(), nil
+		}
+		p, err := db.dst.commit()
+		if err != nil {
+			return "", err
+		}
+		return p, ioutil.WriteFile(hp, nil, 0600)
+	}
+
+	p, err := db.dst.commit()
+	if err != nil {
+		return "", err
+	}
+	if exists && linkCount(fi) <= 1 {
+		// All other links to the earlier backup were removed (e.g. by pruning old
+		// backups), so start over with the new one instead of resurrecting it.
+		if err := os.Remove(hp); err != nil {
+			return "", err
+		}
+		exists = false
+	}
+	if !exists {
+		if err := os.Link(p, hp); err != nil && !os.IsExist(err) {
+			return "", err
+		}
+		return p, nil
+	}
+	// Atomically replace the new backup with a link to the existing one.
+	tmp := hp + ".tmp-" + filepath.Base(p)
+	if err := os.Link(hp, tmp); err != nil {
+		return "", err
+	}
+	if err := os.Rename(tmp, p); err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+	db.dup = true
+	return p, nil
+}
+
+// linkCount returns the number of hard links to the file described by fi.
+func linkCount(fi os.FileInfo) uint64 {
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		return uint64(st.Nlink)
+	}
+	return 1
+}
+
+// backupDedupInfo returns the hex-encoded hash of the backup committed to w and
+// whether it was a duplicate. An empty string is returned if w isn't a dedupBackup.
+func backupDedupInfo(w backupWriter) (sum string, dup bool) {
+	if db, ok := w.(*dedupBackup); ok {
+		return db.sum, db.dup
+	}
+	return "", false
+}
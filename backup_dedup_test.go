@@ -0,0 +1,87 @@
+// Copyright 2022 Daniel Erat.
+// All rights reserved.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDedupBackup(t *testing.T) {
+	td := t.TempDir()
+	const (
+		msg1 = "Subject: One\r\n\r\nBody\r\n"
+		msg2 = "Subject: Two\r\n\r\nBody\r\n"
+	)
+	sum1 := sha256.Sum256([]byte(msg1))
+	hash1 := hex.EncodeToString(sum1[:])
+	now := time.Date(2022, 4, 16, 16, 33, 34, 0, time.UTC)
+
+	for _, bk := range []backupOptions{
+		{dir: filepath.Join(td, "dir"), dedup: true},
+		{maildir: filepath.Join(td, "maildir"), dedup: true},
+		{mbox: filepath.Join(td, "mbox"), dedup: true},
+	} {
+		// save writes msg and returns the backup's path and whether it was a duplicate.
+		save := func(msg string) (string, bool) {
+			w, err := bk.create(now)
+			if err != nil {
+				t.Fatalf("create() with %+v failed: %v", bk, err)
+			}
+			p, err := writeBackup(w, []byte(msg))
+			if err != nil {
+				t.Fatalf("writeBackup() with %+v failed: %v", bk, err)
+			}
+			sum, dup := backupDedupInfo(w)
+			if hs := sha256.Sum256([]byte(msg)); sum != hex.EncodeToString(hs[:]) {
+				t.Errorf("backupDedupInfo() with %+v returned hash %q for %q", bk, sum, msg)
+			}
+			return p, dup
+		}
+
+		p1, dup1 := save(msg1)
+		p2, dup2 := save(msg2)
+		p3, dup3 := save(msg1)
+		if dup1 || dup2 || !dup3 {
+			t.Errorf("Duplicates with %+v were %v, %v, %v; want false, false, true", bk, dup1, dup2, dup3)
+		}
+		if _, err := os.Stat(filepath.Join(bk.hashDir(), hash1)); err != nil {
+			t.Errorf("Hash file with %+v not created: %v", bk, err)
+		}
+
+		if bk.mbox != "" {
+			if b, err := ioutil.ReadFile(bk.mbox); err != nil {
+				t.Error(err)
+			} else if n := strings.Count(string(b), "Subject: One"); n != 1 {
+				t.Errorf("mbox contains %d copies of first message; want 1", n)
+			}
+			continue
+		}
+		fi1, err1 := os.Stat(p1)
+		fi3, err3 := os.Stat(p3)
+		if err1 != nil || err3 != nil {
+			t.Errorf("Backups with %+v missing: %v, %v", bk, err1, err3)
+		} else if !os.SameFile(fi1, fi3) {
+			t.Errorf("Backups %v and %v with %+v aren't linked", p1, p3, bk)
+		} else if p1 == p3 {
+			t.Errorf("Backups with %+v have same path %v", bk, p1)
+		}
+		if _, err := os.Stat(p2); err != nil {
+			t.Error(err)
+		}
+
+		// After the earlier copies are removed, a new backup shouldn't be linked to them.
+		os.Remove(p1)
+		os.Remove(p3)
+		if _, dup := save(msg1); dup {
+			t.Errorf("Backup with %+v was a duplicate after removing earlier copies", bk)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+// Copyright 2022 Daniel Erat.
+// All rights reserved.
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os/exec"
+	"strings"
+
+	"golang.org/x/crypto/openpgp"
+)
+
+// backupEncrypter encrypts backups.
+type backupEncrypter interface {
+	// encrypt returns a WriteCloser that writes an encrypted version of the
+	// data written to it to w. Close must be called to finish writing.
+	encrypt(w io.Writer) (io.WriteCloser, error)
+	// ext returns the filename extension used for encrypted backups, e.g. ".gpg".
+	ext() string
+}
+
+// newBackupEncrypter returns a backupEncrypter for recipient, which is either an age
+// recipient (starting with "age1") or the path to a file containing an armored or binary
+// OpenPGP public key. age encryption is performed by running the age command.
+func newBackupEncrypter(recipient string) (backupEncrypter, error) {
+	if strings.HasPrefix(recipient, "age1") {
+		if _, err := exec.LookPath("age"); err != nil {
+			return nil, err
+		}
+		return &ageEncrypter{recipient}, nil
+	}
+	b, err := ioutil.ReadFile(expandHome(recipient))
+	if err != nil {
+		return nil, err
+	}
+	keys, err := openpgp.ReadArmoredKeyRing(bytes.NewReader(b))
+	if err != nil {
+		if keys, err = openpgp.ReadKeyRing(bytes.NewReader(b)); err != nil {
+			return nil, err
+		}
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("no keys")
+	}
+	return &pgpEncrypter{keys}, nil
+}
+
+// pgpEncrypter is a backupEncrypter that writes binary OpenPGP messages.
+type pgpEncrypter struct{ keys openpgp.EntityList }
+
+func (e *pgpEncrypter) encrypt(w io.Writer) (io.WriteCloser, error) {
+	return openpgp.Encrypt(w, e.keys, nil, nil, nil)
+}
+
+func (e *pgpEncrypter) ext() string { return ".gpg" }
+
+// ageEncrypter is a backupEncrypter that runs the age command.
+type ageEncrypter struct{ recipient string }
+
+func (e *ageEncrypter) encrypt(w io.Writer) (io.WriteCloser, error) {
+	var stderr bytes.Buffer
+	cmd := exec.Command("age", "-r", e.recipient)
+	cmd.Stdout = w
+	cmd.Stderr = &stderr
+	in, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	return &cmdWriter{in, cmd, &stderr}, nil
+}
+
+func (e *ageEncrypter) ext() string { return ".age" }
+
+// cmdWriter is an io.WriteCloser that writes to a running command's stdin.
+// Close waits for the command to exit.
+type cmdWriter struct {
+	in     io.WriteCloser
+	cmd    *exec.Cmd
+	stderr *bytes.Buffer
+}
+
+func (cw *cmdWriter) Write(p []byte) (int, error) { return cw.in.Write(p) }
+
+func (cw *cmdWriter) Close() error {
+	cerr := cw.in.Close()
+	if err := cw.cmd.Wait(); err != nil {
+		return fmt.Errorf("%v (%v)", err, strings.TrimSpace(cw.stderr.String()))
+	}
+	return cerr
+}
+
+// encryptedBackup is a backupWriter that encrypts data before writing it to another backupWriter.
+type encryptedBackup struct {
+	dst backupWriter
+	enc io.WriteCloser
+}
+
+func (eb *encryptedBackup) Write(p []byte) (int, error) { return eb.enc.Write(p) }
+func (eb *encryptedBackup) path() string                { return eb.dst.path() }
+
+func (eb *encryptedBackup) commit() (string, error) {
+	if err := eb.enc.Close(); err != nil {
+		eb.dst.abort()
+		return "", err
+	}
+	return eb.dst.commit()
+}
+
+func (eb *encryptedBackup) abort() {
+	eb.enc.Close()
+	eb.dst.abort()
+}
+
+// decryptPGPBackup decrypts b, a backup encrypted by pgpEncrypter, using keys.
+func decryptPGPBackup(b []byte, keys openpgp.EntityList) ([]byte, error) {
+	if len(keys) == 0 {
+		return nil, errors.New("no keys")
+	}
+	md, err := openpgp.ReadMessage(bytes.NewReader(b), keys, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(md.UnverifiedBody)
+}
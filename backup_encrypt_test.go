@@ -0,0 +1,65 @@
+// Copyright 2022 Daniel Erat.
+// All rights reserved.
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+)
+
+func TestBackupEncrypt(t *testing.T) {
+	td := t.TempDir()
+	ent, err := openpgp.NewEntity("Test", "", "test@example.org", nil)
+	if err != nil {
+		t.Fatal("Failed generating key:", err)
+	}
+	var pub bytes.Buffer
+	aw, err := armor.Encode(&pub, openpgp.PublicKeyType, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ent.Serialize(aw); err != nil {
+		t.Fatal("Failed serializing key:", err)
+	}
+	aw.Close()
+	keyPath := filepath.Join(td, "key.asc")
+	if err := ioutil.WriteFile(keyPath, pub.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	bk := backupOptions{dir: filepath.Join(td, "backup"), encryptRecipient: keyPath}
+	if err := bk.check(); err != nil {
+		t.Fatal("check() failed:", err)
+	}
+	const msg = "Subject: Secret\r\n\r\nBody\r\n"
+	p, err := bk.save(time.Date(2022, 4, 16, 16, 33, 34, 0, time.UTC), []byte(msg))
+	if err != nil {
+		t.Fatal("save() failed:", err)
+	}
+	if !strings.HasSuffix(p, ".gpg") {
+		t.Errorf("save() wrote %v; want .gpg extension", p)
+	}
+	if b, err := ioutil.ReadFile(p); err != nil {
+		t.Error(err)
+	} else if bytes.Contains(b, []byte("Secret")) {
+		t.Errorf("save() wrote plaintext to %v", p)
+	}
+
+	rec := backupRecord(p, []byte(msg))
+	if got, err := findBackup(bk.dirs(), rec, openpgp.EntityList{ent}); err != nil {
+		t.Error("findBackup() failed:", err)
+	} else if string(got) != msg {
+		t.Errorf("findBackup() = %q; want %q", got, msg)
+	}
+	if _, err := findBackup(bk.dirs(), rec, nil); err == nil {
+		t.Error("findBackup() unexpectedly succeeded without key")
+	}
+}
@@ -0,0 +1,164 @@
+// Copyright 2022 Daniel Erat.
+// All rights reserved.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/derat/rendmail/rewrite"
+)
+
+// backupIndexName is the name of the index file written to the backup directory (or Maildir).
+const backupIndexName = "index.jsonl"
+
+// backupIndexEntry describes a backed-up message. Entries are written as lines of JSON.
+type backupIndexEntry struct {
+	Time      time.Time         `json:"time"`                // time at which the message was rewritten
+	Path      string            `json:"path"`                // backup's path relative to the index
+	MessageID string            `json:"messageId,omitempty"` // Message-ID header field
+	From      string            `json:"from,omitempty"`      // decoded From header field
+	Subject   string            `json:"subject,omitempty"`   // decoded Subject header field
+	Size      int               `json:"size"`                // original message size in bytes
+	NewSize   int               `json:"newSize"`             // rewritten message size in bytes
+	Deleted   []backupIndexPart `json:"deleted,omitempty"`   // deleted parts
+	SHA256    string            `json:"sha256,omitempty"`    // hash of backup contents (before encryption)
+	Duplicate bool              `json:"duplicate,omitempty"` // backup was identical to an earlier one
+
+	Profile string                 `json:"profile,omitempty"` // -profile used to rewrite the message
+	Rules   []string               `json:"rules,omitempty"`   // names of matching rules from -config
+	Options map[string]interface{} `json:"options,omitempty"` // non-default rewrite.Options after applying rules
+}
+
+// backupIndexPart describes a deleted part in a backupIndexEntry.
+type backupIndexPart struct {
+	Type     string `json:"type"`               // media type, e.g. "image/png"
+	Filename string `json:"filename,omitempty"` // decoded filename
+	Size     int64  `json:"size"`               // encoded size in bytes
+}
+
+// newBackupIndexEntry returns an entry describing the backup at p (committed via w) of the
+// original message orig, which was rewritten to newSize bytes using opts. rep is the
+// report returned by rewrite.Rewrite, or nil if it wasn't called.
+func newBackupIndexEntry(p string, w backupWriter, orig []byte, newSize int,
+	opts *rewrite.Options, rep *rewrite.Report) *backupIndexEntry {
+	e := backupIndexEntry{Time: opts.Now, Path: p, Size: len(orig), NewSize: newSize, Profile: opts.Profile}
+	e.SHA256, e.Duplicate = backupDedupInfo(w)
+	if msg, err := mail.ReadMessage(bytes.NewReader(orig)); err == nil {
+		decode := func(k string) string {
+			v := msg.Header.Get(k)
+			if dec, err := rewrite.DecodeHeader(v); err == nil {
+				v = dec
+			}
+			return v
+		}
+		e.MessageID = strings.TrimSpace(msg.Header.Get("Message-Id"))
+		e.From = decode("From")
+		e.Subject = decode("Subject")
+	}
+	used := opts
+	if rep != nil {
+		for _, d := range rep.Deleted {
+			e.Deleted = append(e.Deleted, backupIndexPart{d.MediaType, d.Filename, d.Size})
+		}
+		e.Rules = rep.Rules
+		if rep.Options != nil {
+			used = rep.Options
+		}
+	}
+	e.Options = nonDefaultOptions(used)
+	return &e
+}
+
+// nonDefaultOptions returns the JSON representation of opts's exported fields,
+// omitting fields with zero values and fields that don't control how parts are rewritten.
+func nonDefaultOptions(opts *rewrite.Options) map[string]interface{} {
+	b, err := json.Marshal(opts)
+	if err != nil {
+		return nil
+	}
+	var m map[string]interface{}
+	if err := json.Unmarshal(b, &m); err != nil {
+		return nil
+	}
+	for k, v := range m {
+		switch k {
+		case "backupRecord", "now", "rules":
+			delete(m, k)
+			continue
+		}
+		switch tv := v.(type) {
+		case nil:
+			delete(m, k)
+		case bool:
+			if !tv {
+				delete(m, k)
+			}
+		case float64:
+			if tv == 0 {
+				delete(m, k)
+			}
+		case string:
+			if tv == "" {
+				delete(m, k)
+			}
+		case []interface{}:
+			if len(tv) == 0 {
+				delete(m, k)
+			}
+		}
+	}
+	if len(m) == 0 {
+		return nil
+	}
+	return m
+}
+
+// indexPath returns the path of the backup index file.
+func (bk *backupOptions) indexPath() string {
+	if bk.maildir != "" {
+		return filepath.Join(bk.maildir, backupIndexName)
+	}
+	if bk.mbox != "" {
+		return filepath.Join(filepath.Dir(bk.mbox), backupIndexName)
+	}
+	return filepath.Join(bk.dir, backupIndexName)
+}
+
+// addToIndex appends e to the index file if bk.index is true. e.Path is
+// rewritten to be relative to the index file's directory.
+//
+// The file is opened in append mode and each entry is written with a single
+// write() call so that concurrent rendmail processes don't interleave entries.
+func (bk *backupOptions) addToIndex(e *backupIndexEntry) error {
+	if !bk.index {
+		return nil
+	}
+	ip := bk.indexPath()
+	if rel, err := filepath.Rel(filepath.Dir(ip), e.Path); err == nil {
+		e.Path = rel
+	}
+	// Encode (which also adds a trailing newline) is used instead of json.Marshal
+	// to avoid escaping '<' and '>' in addresses.
+	var b bytes.Buffer
+	enc := json.NewEncoder(&b)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(e); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(ip, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(b.Bytes()); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
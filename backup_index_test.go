@@ -0,0 +1,90 @@
+// Copyright 2022 Daniel Erat.
+// All rights reserved.
+
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/derat/rendmail/rewrite"
+)
+
+func TestBackupIndex(t *testing.T) {
+	orig, err := ioutil.ReadFile("rewrite/testdata/audio.in.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2022, 4, 16, 16, 33, 34, 0, time.UTC)
+	opts := rewrite.Options{
+		Rules:   []*rewrite.Rule{{Name: "audio", Subject: "audio", DeleteTypes: []string{"audio/*"}}},
+		Now:     now,
+		Profile: "strip",
+	}
+	for _, tc := range []struct {
+		bk       backupOptions
+		wantPath string // expected entry path prefix
+	}{
+		{backupOptions{dir: t.TempDir(), index: true}, "20220416-163334-"},
+		{backupOptions{maildir: t.TempDir(), index: true}, "new/"},
+	} {
+		bo := batchOptions{backup: tc.bk}
+		b, _, err := rewriteData("audio.eml", orig, &bo, &opts)
+		if err != nil {
+			t.Fatalf("rewriteData with %+v failed: %v", tc.bk, err)
+		}
+		f, err := os.Open(tc.bk.indexPath())
+		if err != nil {
+			t.Fatal(err)
+		}
+		var entries []backupIndexEntry
+		sc := bufio.NewScanner(f)
+		for sc.Scan() {
+			var e backupIndexEntry
+			if err := json.Unmarshal(sc.Bytes(), &e); err != nil {
+				t.Errorf("Bad index line %q: %v", sc.Text(), err)
+			}
+			entries = append(entries, e)
+		}
+		f.Close()
+		if len(entries) != 1 {
+			t.Errorf("Got %d index entries with %+v; want 1", len(entries), tc.bk)
+			continue
+		}
+		e := entries[0]
+		if !strings.HasPrefix(e.Path, tc.wantPath) {
+			t.Errorf("Entry path with %+v is %q; want prefix %q", tc.bk, e.Path, tc.wantPath)
+		} else if _, err := os.Stat(filepath.Join(filepath.Dir(tc.bk.indexPath()), e.Path)); err != nil {
+			t.Errorf("Entry path with %+v is bad: %v", tc.bk, err)
+		}
+		want := backupIndexEntry{
+			Time:      now,
+			Path:      e.Path,
+			MessageID: "<xxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxx@mail.gmail.com>",
+			From:      "Redacted <user@example.org>",
+			Subject:   "Example message with small audio file",
+			Size:      len(orig),
+			NewSize:   len(b),
+			Deleted:   []backupIndexPart{{"audio/wav", "wav.wav", 62}},
+			Profile:   "strip",
+			Rules:     []string{"audio"},
+			Options:   map[string]interface{}{"deleteMediaTypes": []interface{}{"audio/*"}},
+		}
+		if bb, err := ioutil.ReadFile(filepath.Join(filepath.Dir(tc.bk.indexPath()), e.Path)); err == nil {
+			sum := sha256.Sum256(bb)
+			want.SHA256 = hex.EncodeToString(sum[:])
+		}
+		if !reflect.DeepEqual(e, want) {
+			t.Errorf("Entry with %+v is %+v; want %+v", tc.bk, e, want)
+		}
+	}
+}
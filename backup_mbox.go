@@ -0,0 +1,99 @@
+// Copyright 2022 Daniel Erat.
+// All rights reserved.
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+// mboxBackup is a backupWriter that buffers a message and appends it to an mbox file.
+type mboxBackup struct {
+	p    string      // mbox file
+	now  time.Time   // used for From_ line
+	perm os.FileMode // permissions for new file
+	sync bool        // sync file and directory after writing
+	buf  bytes.Buffer
+}
+
+func (mb *mboxBackup) Write(p []byte) (int, error) { return mb.buf.Write(p) }
+func (mb *mboxBackup) path() string                { return mb.p }
+func (mb *mboxBackup) abort()                      { mb.buf.Reset() }
+
+func (mb *mboxBackup) commit() (string, error) {
+	msg := mb.buf.Bytes()
+	return mb.p, appendToMbox(mb.p, mboxFromLine(msg, mb.now), msg, mb.perm, mb.sync)
+}
+
+// appendToMbox appends msg to the mbox file at p, creating it with perm if needed.
+// An exclusive flock() lock is held while writing so that concurrent
+// rendmail processes (and mail clients honoring the lock) don't interleave
+// or read partial messages. If sync is true, the file and its directory are
+// synced before returning.
+func appendToMbox(p, from string, msg []byte, perm os.FileMode, sync bool) error {
+	f, err := os.OpenFile(p, os.O_WRONLY|os.O_APPEND|os.O_CREATE, perm)
+	if err != nil {
+		return err
+	}
+	// Closing the file releases the lock.
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		f.Close()
+		return err
+	}
+	if fi, err := f.Stat(); err != nil {
+		f.Close()
+		return err
+	} else if fi.Size() == 0 {
+		// Apply perm exactly (i.e. ignoring the umask) to newly-created files.
+		if err := f.Chmod(perm); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err := writeMboxMessage(f, from, msg); err != nil {
+		f.Close()
+		return err
+	}
+	if sync {
+		if err := f.Sync(); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if sync {
+		return syncDir(filepath.Dir(p))
+	}
+	return nil
+}
+
+// findMboxBackup returns the first message in the mbox file at p with the
+// supplied hex-encoded SHA-256 hash.
+func findMboxBackup(p, want string) ([]byte, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	mr := newMboxReader(f)
+	for {
+		_, msg, err := mr.read()
+		if err == io.EOF {
+			return nil, nil
+		} else if err != nil {
+			return nil, err
+		}
+		if sum := sha256.Sum256(msg); hex.EncodeToString(sum[:]) == want {
+			return msg, nil
+		}
+	}
+}
@@ -0,0 +1,52 @@
+// Copyright 2022 Daniel Erat.
+// All rights reserved.
+
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestMboxBackup(t *testing.T) {
+	bk := backupOptions{mbox: filepath.Join(t.TempDir(), "backup.mbox")}
+	if err := bk.check(); err != nil {
+		t.Fatal("check() failed:", err)
+	}
+	msgs := []string{
+		"Return-Path: <me@example.org>\n\nFirst\n",
+		"Subject: Hi\n\nFrom here\n>From there\n",
+	}
+	now := time.Date(2022, 4, 16, 16, 33, 34, 0, time.UTC)
+	var recs []string
+	for _, msg := range msgs {
+		p, err := bk.save(now, []byte(msg))
+		if err != nil {
+			t.Fatal("save() failed:", err)
+		}
+		if p != bk.mbox {
+			t.Errorf("save() returned %q; want %q", p, bk.mbox)
+		}
+		recs = append(recs, backupRecord(p, []byte(msg)))
+	}
+
+	const want = "From me@example.org Sat Apr 16 16:33:34 2022\n" +
+		"Return-Path: <me@example.org>\n\nFirst\n\n" +
+		"From MAILER-DAEMON Sat Apr 16 16:33:34 2022\n" +
+		"Subject: Hi\n\n>From here\n>>From there\n\n"
+	if b, err := ioutil.ReadFile(bk.mbox); err != nil {
+		t.Error(err)
+	} else if string(b) != want {
+		t.Errorf("mbox contains:\n%s\nwant:\n%s", b, want)
+	}
+
+	for i, rec := range recs {
+		if got, err := findBackup(bk.dirs(), rec, nil); err != nil {
+			t.Errorf("findBackup(%q) failed: %v", rec, err)
+		} else if string(got) != msgs[i] {
+			t.Errorf("findBackup(%q) = %q; want %q", rec, got, msgs[i])
+		}
+	}
+}
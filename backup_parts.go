@@ -0,0 +1,113 @@
+// Copyright 2022 Daniel Erat.
+// All rights reserved.
+
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"mime"
+	"net/mail"
+	"sort"
+	"strings"
+
+	"github.com/derat/rendmail/rewrite"
+)
+
+// Media types used by backups written for -backup-parts-only. Each backup is a
+// multipart message containing one child per deleted part, with the part's path
+// in a "path" parameter and the original part (header and body) as its body.
+const (
+	partsBackupType = "multipart/x-rendmail-parts"
+	partBackupType  = "application/x-rendmail-part"
+)
+
+// partsBackupFields lists header fields copied from the original message to
+// parts backups so they're identifiable when viewed in a mail client.
+var partsBackupFields = []string{"Date", "From", "Subject"}
+
+// findDeletedStubs returns the paths of the stubs that rendmail left in msg
+// in place of deleted parts, along with the stubs' spans.
+func findDeletedStubs(msg []byte) ([]string, map[string]rewrite.PartSpan) {
+	parts := rewrite.FindParts(msg)
+	var paths []string
+	for path, p := range parts {
+		if p.MediaType == "message/external-body" && p.Params["access-type"] == "x-rendmail-deleted" {
+			paths = append(paths, path)
+		}
+	}
+	sort.Strings(paths)
+	return paths, parts
+}
+
+// makePartsBackup returns a parts backup containing the parts of orig that were
+// deleted in rewritten. nil is returned if no parts were deleted.
+func makePartsBackup(orig, rewritten []byte) ([]byte, error) {
+	paths, _ := findDeletedStubs(rewritten)
+	if len(paths) == 0 {
+		return nil, nil
+	}
+	oparts := rewrite.FindParts(orig)
+	saved := make([][]byte, len(paths))
+	for i, path := range paths {
+		op, ok := oparts[path]
+		if !ok {
+			return nil, fmt.Errorf("original message doesn't have part %q", path)
+		}
+		saved[i] = orig[op.Start:op.End]
+	}
+
+	term := "\n"
+	if i := bytes.IndexByte(orig, '\n'); i > 0 && orig[i-1] == '\r' {
+		term = "\r\n"
+	}
+	var bnd string
+	for bnd == "" || bytes.Contains(orig, []byte(bnd)) {
+		rb := make([]byte, 12)
+		if _, err := rand.Read(rb); err != nil {
+			return nil, err
+		}
+		bnd = "rendmail-parts-" + hex.EncodeToString(rb)
+	}
+
+	var b bytes.Buffer
+	if msg, err := mail.ReadMessage(bytes.NewReader(orig)); err == nil {
+		for _, k := range partsBackupFields {
+			if v := msg.Header.Get(k); v != "" {
+				b.WriteString(k + ": " + v + term)
+			}
+		}
+	}
+	b.WriteString("MIME-Version: 1.0" + term)
+	b.WriteString("Content-Type: " + mime.FormatMediaType(partsBackupType, map[string]string{"boundary": bnd}) + term)
+	b.WriteString(term)
+	for i, path := range paths {
+		b.WriteString("--" + bnd + term)
+		b.WriteString("Content-Type: " + mime.FormatMediaType(partBackupType, map[string]string{"path": path}) + term)
+		b.WriteString(term)
+		b.Write(saved[i])
+		// Add a line break to precede the delimiter in case the part didn't end with one.
+		// It isn't considered part of the body.
+		b.WriteString(term)
+	}
+	b.WriteString("--" + bnd + "--" + term)
+	return b.Bytes(), nil
+}
+
+// readPartsBackup returns the original parts saved in the parts backup b, keyed by path.
+// nil is returned if b isn't a parts backup.
+func readPartsBackup(b []byte) map[string][]byte {
+	parts := rewrite.FindParts(b)
+	if parts[""].MediaType != partsBackupType {
+		return nil
+	}
+	saved := make(map[string][]byte)
+	for path, p := range parts {
+		if p.MediaType == partBackupType && !strings.Contains(path, ".") {
+			saved[p.Params["path"]] = p.Body(b, false)
+		}
+	}
+	return saved
+}
@@ -0,0 +1,60 @@
+// Copyright 2022 Daniel Erat.
+// All rights reserved.
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/derat/rendmail/rewrite"
+)
+
+func TestPartsBackup(t *testing.T) {
+	for _, fn := range []string{
+		"rewrite/testdata/audio.in.txt",
+		"rewrite/testdata/add_placeholder.in.txt",
+		"rewrite/testdata/delete_parts.in.txt",
+	} {
+		orig, err := ioutil.ReadFile(fn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		const name = "20220415-151904-123"
+		opts := rewrite.Options{
+			BackupRecord:     backupRecord(name, nil),
+			DeleteMediaTypes: []string{"application/*", "audio/*", "image/*", "video/*"},
+			Now:              time.Date(2022, 4, 15, 15, 19, 4, 0, time.UTC),
+		}
+		var mod bytes.Buffer
+		if _, err := rewrite.Rewrite(bytes.NewReader(orig), &mod, &opts); err != nil {
+			t.Fatalf("rewrite.Rewrite(%v) failed: %v", fn, err)
+		}
+		parts, err := makePartsBackup(orig, mod.Bytes())
+		if err != nil {
+			t.Fatalf("makePartsBackup(%v) failed: %v", fn, err)
+		} else if parts == nil {
+			t.Fatalf("makePartsBackup(%v) didn't find deleted parts", fn)
+		}
+
+		dir := t.TempDir()
+		if err := ioutil.WriteFile(filepath.Join(dir, name), parts, 0600); err != nil {
+			t.Fatal(err)
+		}
+		var got bytes.Buffer
+		if err := restoreMessage(bytes.NewReader(mod.Bytes()), &got, []string{dir}, nil, nil); err != nil {
+			t.Errorf("restoreMessage(%v) failed: %v", fn, err)
+		} else if !bytes.Equal(got.Bytes(), orig) {
+			t.Errorf("restoreMessage(%v) produced:\n%s", fn, got.Bytes())
+		}
+	}
+
+	// Nothing should be saved if no parts were deleted.
+	msg := []byte("Subject: Hi\r\n\r\nBody\r\n")
+	if parts, err := makePartsBackup(msg, msg); err != nil || parts != nil {
+		t.Errorf("makePartsBackup for unchanged message returned %q, %v; want nil, nil", parts, err)
+	}
+}
@@ -0,0 +1,334 @@
+// Copyright 2022 Daniel Erat.
+// All rights reserved.
+
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// backupStore saves backups to a remote location.
+type backupStore interface {
+	// put saves b under name.
+	put(name string, b []byte) error
+	// get returns the data previously saved under name.
+	get(name string) ([]byte, error)
+	// url returns a URL identifying name.
+	url(name string) string
+}
+
+// backupStores maps from URL schemes accepted by -backup-dir to functions
+// that create backupStores for URLs.
+var backupStores = map[string]func(u *url.URL) (backupStore, error){
+	"s3":      newS3Store,
+	"gs":      newS3Store,
+	"webdav":  newWebDAVStore,
+	"webdavs": newWebDAVStore,
+}
+
+// remoteBackupTimeout is the maximum time spent on a single request to a backupStore.
+const remoteBackupTimeout = time.Minute
+
+// newBackupStore returns a backupStore for dir if it is a URL with a scheme
+// from backupStores. nil is returned if dir is a local path.
+func newBackupStore(dir string) (backupStore, error) {
+	if !strings.Contains(dir, "://") {
+		return nil, nil
+	}
+	u, err := url.Parse(dir)
+	if err != nil {
+		return nil, err
+	}
+	fn, ok := backupStores[u.Scheme]
+	if !ok {
+		return nil, fmt.Errorf("unsupported scheme %q", u.Scheme)
+	}
+	return fn(u)
+}
+
+// remoteBackupName returns a new unique name for a backup of a message received at now.
+func remoteBackupName(now time.Time, ext string) (string, error) {
+	rb := make([]byte, 6)
+	if _, err := rand.Read(rb); err != nil {
+		return "", err
+	}
+	return now.UTC().Format("20060102-150405.999") + "-" + hex.EncodeToString(rb) + ext, nil
+}
+
+// remoteBackup is a backupWriter that buffers a message and uploads it to a backupStore.
+type remoteBackup struct {
+	store backupStore
+	name  string
+	buf   bytes.Buffer
+}
+
+func (rb *remoteBackup) Write(p []byte) (int, error) { return rb.buf.Write(p) }
+func (rb *remoteBackup) path() string                { return rb.store.url(rb.name) }
+func (rb *remoteBackup) abort()                      { rb.buf.Reset() }
+
+func (rb *remoteBackup) commit() (string, error) {
+	if err := rb.store.put(rb.name, rb.buf.Bytes()); err != nil {
+		return "", err
+	}
+	return rb.path(), nil
+}
+
+// httpStatusError is returned for unsuccessful HTTP responses.
+type httpStatusError struct {
+	method, url string
+	code        int
+	body        string
+}
+
+func (e *httpStatusError) Error() string {
+	msg := fmt.Sprintf("%v %v: %v", e.method, e.url, http.StatusText(e.code))
+	if e.body != "" {
+		msg += " (" + e.body + ")"
+	}
+	return msg
+}
+
+// doHTTP sends req and returns the response body, or an error if the response was unsuccessful.
+func doHTTP(req *http.Request) ([]byte, error) {
+	client := http.Client{Timeout: remoteBackupTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		body := strings.TrimSpace(string(b))
+		if len(body) > 200 {
+			body = body[:200] + "..."
+		}
+		return nil, &httpStatusError{req.Method, req.URL.String(), resp.StatusCode, body}
+	}
+	return b, nil
+}
+
+// webDAVStore is a backupStore that uploads backups to a WebDAV collection.
+// webdav:// URLs use HTTP and webdavs:// URLs use HTTPS. Basic auth credentials
+// may be supplied in the URL.
+type webDAVStore struct{ base *url.URL }
+
+func newWebDAVStore(u *url.URL) (backupStore, error) {
+	base := *u
+	base.Scheme = "http"
+	if u.Scheme == "webdavs" {
+		base.Scheme = "https"
+	}
+	if !strings.HasSuffix(base.Path, "/") {
+		base.Path += "/"
+	}
+	return &webDAVStore{&base}, nil
+}
+
+// request returns a new request to name (or the collection itself if name is empty).
+func (s *webDAVStore) request(method, name string, body []byte) (*http.Request, error) {
+	u := *s.base
+	u.User = nil
+	u.Path += name
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if s.base.User != nil {
+		pass, _ := s.base.User.Password()
+		req.SetBasicAuth(s.base.User.Username(), pass)
+	}
+	return req, nil
+}
+
+func (s *webDAVStore) put(name string, b []byte) error {
+	req, err := s.request(http.MethodPut, name, b)
+	if err != nil {
+		return err
+	}
+	_, err = doHTTP(req)
+	if herr, ok := err.(*httpStatusError); !ok || herr.code != http.StatusConflict {
+		return err
+	}
+	// The collection doesn't exist yet, so create it and try again.
+	if req, err = s.request("MKCOL", "", nil); err != nil {
+		return err
+	}
+	if _, err := doHTTP(req); err != nil {
+		return err
+	}
+	if req, err = s.request(http.MethodPut, name, b); err != nil {
+		return err
+	}
+	_, err = doHTTP(req)
+	return err
+}
+
+func (s *webDAVStore) get(name string) ([]byte, error) {
+	req, err := s.request(http.MethodGet, name, nil)
+	if err != nil {
+		return nil, err
+	}
+	return doHTTP(req)
+}
+
+func (s *webDAVStore) url(name string) string {
+	u := *s.base
+	u.User = nil // omit credentials
+	u.Scheme = "webdav"
+	if s.base.Scheme == "https" {
+		u.Scheme = "webdavs"
+	}
+	u.Path += name
+	return u.String()
+}
+
+// s3Store is a backupStore that uploads backups to an S3 bucket using
+// path-style requests signed with AWS Signature Version 4.
+//
+// s3:// URLs read credentials from $AWS_ACCESS_KEY_ID, $AWS_SECRET_ACCESS_KEY,
+// and $AWS_SESSION_TOKEN, the region from $AWS_REGION, and an optional endpoint
+// from $AWS_ENDPOINT_URL (for S3-compatible services).
+//
+// gs:// URLs use Google Cloud Storage's XML API with HMAC keys from
+// $GS_ACCESS_KEY_ID and $GS_SECRET_ACCESS_KEY.
+type s3Store struct {
+	scheme   string // "s3" or "gs"
+	endpoint string // e.g. "https://s3.us-east-1.amazonaws.com"
+	region   string // e.g. "us-east-1"
+	bucket   string
+	prefix   string // key prefix ending in '/', or empty
+	keyID    string
+	secret   string
+	token    string // session token, or empty
+	now      func() time.Time
+}
+
+func newS3Store(u *url.URL) (backupStore, error) {
+	s := s3Store{
+		scheme: u.Scheme,
+		bucket: u.Host,
+		prefix: strings.TrimPrefix(u.Path, "/"),
+		now:    time.Now,
+	}
+	if s.bucket == "" {
+		return nil, errors.New("no bucket in URL")
+	}
+	if s.prefix != "" && !strings.HasSuffix(s.prefix, "/") {
+		s.prefix += "/"
+	}
+	if u.Scheme == "gs" {
+		s.endpoint = "https://storage.googleapis.com"
+		s.region = "auto"
+		s.keyID = os.Getenv("GS_ACCESS_KEY_ID")
+		s.secret = os.Getenv("GS_SECRET_ACCESS_KEY")
+	} else {
+		if s.region = os.Getenv("AWS_REGION"); s.region == "" {
+			s.region = "us-east-1"
+		}
+		if s.endpoint = os.Getenv("AWS_ENDPOINT_URL"); s.endpoint == "" {
+			s.endpoint = "https://s3." + s.region + ".amazonaws.com"
+		}
+		s.keyID = os.Getenv("AWS_ACCESS_KEY_ID")
+		s.secret = os.Getenv("AWS_SECRET_ACCESS_KEY")
+		s.token = os.Getenv("AWS_SESSION_TOKEN")
+	}
+	if s.keyID == "" || s.secret == "" {
+		return nil, fmt.Errorf("no credentials for %v", u.Scheme)
+	}
+	s.endpoint = strings.TrimSuffix(s.endpoint, "/")
+	return &s, nil
+}
+
+// request returns a new signed request for the object name.
+func (s *s3Store) request(method, name string, body []byte) (*http.Request, error) {
+	var escaped []string
+	for _, seg := range strings.Split(s.bucket+"/"+s.prefix+name, "/") {
+		escaped = append(escaped, url.PathEscape(seg))
+	}
+	req, err := http.NewRequest(method, s.endpoint+"/"+strings.Join(escaped, "/"), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	s.sign(req, body)
+	return req, nil
+}
+
+// sign adds AWS Signature Version 4 headers to req, which has the supplied body.
+func (s *s3Store) sign(req *http.Request, body []byte) {
+	now := s.now().UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	bodySum := sha256.Sum256(body)
+	bodyHash := hex.EncodeToString(bodySum[:])
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", bodyHash)
+	hdrs := []string{"host", "x-amz-content-sha256", "x-amz-date"}
+	vals := []string{req.URL.Host, bodyHash, amzDate}
+	if s.token != "" {
+		req.Header.Set("X-Amz-Security-Token", s.token)
+		hdrs = append(hdrs, "x-amz-security-token")
+		vals = append(vals, s.token)
+	}
+	var canonHdrs string
+	for i, h := range hdrs {
+		canonHdrs += h + ":" + vals[i] + "\n"
+	}
+	signed := strings.Join(hdrs, ";")
+	canonReq := strings.Join([]string{
+		req.Method, req.URL.EscapedPath(), req.URL.RawQuery, canonHdrs, signed, bodyHash,
+	}, "\n")
+	reqSum := sha256.Sum256([]byte(canonReq))
+
+	scope := date + "/" + s.region + "/s3/aws4_request"
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(reqSum[:])
+	key := []byte("AWS4" + s.secret)
+	for _, v := range []string{date, s.region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, v)
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%v/%v, SignedHeaders=%v, Signature=%v",
+		s.keyID, scope, signed, hex.EncodeToString(hmacSHA256(key, toSign))))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func (s *s3Store) put(name string, b []byte) error {
+	req, err := s.request(http.MethodPut, name, b)
+	if err != nil {
+		return err
+	}
+	_, err = doHTTP(req)
+	return err
+}
+
+func (s *s3Store) get(name string) ([]byte, error) {
+	req, err := s.request(http.MethodGet, name, nil)
+	if err != nil {
+		return nil, err
+	}
+	return doHTTP(req)
+}
+
+func (s *s3Store) url(name string) string {
+	return s.scheme + "://" + path.Join(s.bucket, s.prefix+name)
+}
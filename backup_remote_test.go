@@ -0,0 +1,133 @@
+// Copyright 2022 Daniel Erat.
+// All rights reserved.
+
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeObjectServer is an HTTP server that stores PUT bodies in memory.
+type fakeObjectServer struct {
+	mu      sync.Mutex
+	objects map[string][]byte // keyed by path
+	colls   map[string]bool   // collections created via MKCOL
+	auth    []string          // Authorization headers
+}
+
+func (fs *fakeObjectServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.auth = append(fs.auth, req.Header.Get("Authorization"))
+	switch req.Method {
+	case "MKCOL":
+		fs.colls[strings.TrimSuffix(req.URL.Path, "/")] = true
+		w.WriteHeader(http.StatusCreated)
+	case http.MethodPut:
+		if fs.colls != nil && !fs.colls[req.URL.Path[:strings.LastIndex(req.URL.Path, "/")]] {
+			http.Error(w, "no collection", http.StatusConflict)
+			return
+		}
+		b, _ := ioutil.ReadAll(req.Body)
+		fs.objects[req.URL.Path] = b
+		w.WriteHeader(http.StatusCreated)
+	case http.MethodGet:
+		if b, ok := fs.objects[req.URL.Path]; ok {
+			w.Write(b)
+		} else {
+			http.NotFound(w, req)
+		}
+	default:
+		http.Error(w, "bad method", http.StatusMethodNotAllowed)
+	}
+}
+
+func TestWebDAVStore(t *testing.T) {
+	fs := &fakeObjectServer{objects: make(map[string][]byte), colls: make(map[string]bool)}
+	srv := httptest.NewServer(fs)
+	defer srv.Close()
+
+	dir := "webdav://user:pass@" + strings.TrimPrefix(srv.URL, "http://") + "/backup"
+	bk := backupOptions{dir: dir}
+	if err := bk.check(); err != nil {
+		t.Fatal("check() failed:", err)
+	}
+	const msg = "Subject: Hi\r\n\r\nBody\r\n"
+	p, err := bk.save(time.Date(2022, 4, 16, 16, 33, 34, 0, time.UTC), []byte(msg))
+	if err != nil {
+		t.Fatal("save() failed:", err)
+	}
+	if want := strings.Replace(dir, "user:pass@", "", 1) + "/"; !strings.HasPrefix(p, want) {
+		t.Errorf("save() returned %q; want prefix %q", p, want)
+	}
+	if !fs.colls["/backup"] {
+		t.Error("Collection wasn't created")
+	}
+	if got, err := findBackup(bk.dirs(), backupRecord(p, []byte(msg)), nil); err != nil {
+		t.Error("findBackup() failed:", err)
+	} else if string(got) != msg {
+		t.Errorf("findBackup() = %q; want %q", got, msg)
+	}
+	for _, auth := range fs.auth {
+		if auth != "Basic dXNlcjpwYXNz" {
+			t.Errorf("Got Authorization %q; want basic auth", auth)
+		}
+	}
+}
+
+func TestS3Store(t *testing.T) {
+	fs := &fakeObjectServer{objects: make(map[string][]byte)}
+	srv := httptest.NewServer(fs)
+	defer srv.Close()
+
+	u, _ := url.Parse("s3://bucket/some/prefix")
+	for k, v := range map[string]string{
+		"AWS_ACCESS_KEY_ID":     "AKID",
+		"AWS_SECRET_ACCESS_KEY": "secret",
+		"AWS_SESSION_TOKEN":     "",
+		"AWS_REGION":            "eu-west-1",
+		"AWS_ENDPOINT_URL":      srv.URL,
+	} {
+		t.Setenv(k, v)
+	}
+	st, err := newS3Store(u)
+	if err != nil {
+		t.Fatal("newS3Store() failed:", err)
+	}
+	st.(*s3Store).now = func() time.Time { return time.Date(2022, 4, 16, 16, 33, 34, 0, time.UTC) }
+
+	const name = "20220416-163334-abc"
+	if err := st.put(name, []byte("data")); err != nil {
+		t.Fatal("put() failed:", err)
+	}
+	if got, want := st.url(name), "s3://bucket/some/prefix/"+name; got != want {
+		t.Errorf("url() = %q; want %q", got, want)
+	}
+	if got, ok := fs.objects["/bucket/some/prefix/"+name]; !ok {
+		t.Errorf("Object not uploaded; have %v", fs.objects)
+	} else if string(got) != "data" {
+		t.Errorf("Uploaded %q; want %q", got, "data")
+	}
+	if got, err := st.get(name); err != nil {
+		t.Error("get() failed:", err)
+	} else if string(got) != "data" {
+		t.Errorf("get() = %q; want %q", got, "data")
+	}
+	if _, err := st.get("missing"); err == nil {
+		t.Error("get() unexpectedly succeeded for missing object")
+	}
+	const wantAuth = "AWS4-HMAC-SHA256 Credential=AKID/20220416/eu-west-1/s3/aws4_request, " +
+		"SignedHeaders=host;x-amz-content-sha256;x-amz-date, Signature="
+	for _, auth := range fs.auth {
+		if !strings.HasPrefix(auth, wantAuth) {
+			t.Errorf("Got Authorization %q; want prefix %q", auth, wantAuth)
+		}
+	}
+}
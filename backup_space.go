@@ -0,0 +1,95 @@
+// Copyright 2022 Daniel Erat.
+// All rights reserved.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// backupSkippedWarning is the value of rewrite.BackupWarningField when -backup-low-space=skip
+// causes a backup to be skipped.
+const backupSkippedWarning = "not backed up due to low disk space"
+
+// lowSpaceError is returned by backupOptions.create if -backup-min-free isn't met.
+type lowSpaceError struct {
+	dir        string
+	avail, min int64
+}
+
+func (e *lowSpaceError) Error() string {
+	return fmt.Sprintf("%v has %d bytes free; need %d", e.dir, e.avail, e.min)
+}
+
+// isLowSpace returns true if err is a *lowSpaceError.
+func isLowSpace(err error) bool {
+	_, ok := err.(*lowSpaceError)
+	return ok
+}
+
+// skipBackup returns true if err (returned by create) indicates that there isn't
+// enough free space and the backup should be skipped rather than failing.
+func (bk *backupOptions) skipBackup(err error) bool {
+	return isLowSpace(err) && bk.lowSpace == "skip"
+}
+
+// checkFreeSpace returns a *lowSpaceError if the filesystem holding bk's backups
+// has less than bk.minFree bytes available.
+func (bk *backupOptions) checkFreeSpace() error {
+	dir := bk.dir
+	if bk.maildir != "" {
+		dir = bk.maildir
+	} else if bk.mbox != "" {
+		dir = filepath.Dir(bk.mbox)
+	}
+	// The directory may not have been created yet.
+	for {
+		if _, err := os.Stat(dir); err == nil || filepath.Dir(dir) == dir {
+			break
+		}
+		dir = filepath.Dir(dir)
+	}
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(dir, &st); err != nil {
+		return err
+	}
+	if avail := int64(uint64(st.Bavail) * uint64(st.Bsize)); avail < bk.minFree {
+		return &lowSpaceError{dir, avail, bk.minFree}
+	}
+	return nil
+}
+
+// parseByteSize parses a size like "1024", "100K", "500M", or "2G".
+// Suffixes are case-insensitive and use powers of 1024.
+func parseByteSize(s string) (int64, error) {
+	mult := int64(1)
+	if n := len(s); n > 0 {
+		switch strings.ToUpper(s[n-1:]) {
+		case "K":
+			mult = 1 << 10
+		case "M":
+			mult = 1 << 20
+		case "G":
+			mult = 1 << 30
+		case "T":
+			mult = 1 << 40
+		}
+		if mult != 1 {
+			s = s[:n-1]
+		}
+	}
+	v, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	if v < 0 {
+		return 0, errors.New("negative size")
+	}
+	return v * mult, nil
+}
@@ -0,0 +1,72 @@
+// Copyright 2022 Daniel Erat.
+// All rights reserved.
+
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/derat/rendmail/rewrite"
+)
+
+func TestParseByteSize(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		want int64 // -1 for error
+	}{
+		{"0", 0},
+		{"1024", 1024},
+		{"100K", 100 << 10},
+		{"5m", 5 << 20},
+		{"2G", 2 << 30},
+		{"1T", 1 << 40},
+		{"", -1},
+		{"M", -1},
+		{"-1K", -1},
+		{"1.5G", -1},
+		{"10X", -1},
+	} {
+		if got, err := parseByteSize(tc.in); err != nil && tc.want >= 0 {
+			t.Errorf("parseByteSize(%q) failed: %v", tc.in, err)
+		} else if err == nil && got != tc.want {
+			t.Errorf("parseByteSize(%q) = %d; want %d", tc.in, got, tc.want)
+		}
+	}
+}
+
+func TestBackupOptions_minFree(t *testing.T) {
+	td := t.TempDir()
+	now := time.Date(2022, 4, 16, 16, 33, 34, 0, time.UTC)
+
+	bk := backupOptions{dir: filepath.Join(td, "backup"), minFreeFlag: "1K"}
+	if err := bk.check(); err != nil {
+		t.Fatal("check() failed:", err)
+	}
+	if _, err := bk.save(now, []byte("Subject: Hi\n\nBody\n")); err != nil {
+		t.Error("save() failed with small -backup-min-free:", err)
+	}
+
+	bk.minFree = 1 << 62
+	if _, err := bk.create(now); !isLowSpace(err) {
+		t.Errorf("create() with huge -backup-min-free returned %v; want lowSpaceError", err)
+	} else if bk.skipBackup(err) {
+		t.Error("skipBackup() returned true for -backup-low-space=tempfail")
+	}
+
+	bk.lowSpace = "skip"
+	orig, err := ioutil.ReadFile("rewrite/testdata/audio.in.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bo := batchOptions{backup: bk}
+	opts := rewrite.Options{DeleteMediaTypes: []string{"audio/*"}, Now: now}
+	if b, changed, err := rewriteData("audio.eml", orig, &bo, &opts); err != nil {
+		t.Error("rewriteData() failed with -backup-low-space=skip:", err)
+	} else if want := rewrite.BackupWarningField + ": " + backupSkippedWarning + "\r\n"; !changed || !strings.HasPrefix(string(b), want) {
+		t.Errorf("rewriteData() with -backup-low-space=skip didn't write %q", want)
+	}
+}
@@ -0,0 +1,96 @@
+// Copyright 2022 Daniel Erat.
+// All rights reserved.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestBackupOptions_save(t *testing.T) {
+	td := t.TempDir()
+	const msg = "Subject: Hi\r\n\r\nBody\r\n"
+	now := time.Date(2022, 4, 16, 16, 33, 34, 0, time.UTC)
+	for _, tc := range []struct {
+		bk      backupOptions
+		wantDir string // expected directory containing backup
+	}{
+		{backupOptions{dir: filepath.Join(td, "dir")}, filepath.Join(td, "dir")},
+		{backupOptions{maildir: filepath.Join(td, "maildir")}, filepath.Join(td, "maildir/new")},
+	} {
+		p, err := tc.bk.save(now, []byte(msg))
+		if err != nil {
+			t.Errorf("save() with %+v failed: %v", tc.bk, err)
+			continue
+		}
+		if dir := filepath.Dir(p); dir != tc.wantDir {
+			t.Errorf("save() with %+v wrote to %v; want %v", tc.bk, dir, tc.wantDir)
+		}
+		if b, err := ioutil.ReadFile(p); err != nil {
+			t.Error(err)
+		} else if string(b) != msg {
+			t.Errorf("save() with %+v wrote %q; want %q", tc.bk, b, msg)
+		}
+		if got, err := findBackup(tc.bk.dirs(), backupRecord(p, []byte(msg)), nil); err != nil {
+			t.Errorf("findBackup() with %+v failed: %v", tc.bk, err)
+		} else if string(got) != msg {
+			t.Errorf("findBackup() with %+v = %q; want %q", tc.bk, got, msg)
+		}
+	}
+}
+
+func TestBackupOptions_check(t *testing.T) {
+	for _, tc := range []struct {
+		bk backupOptions
+		ok bool
+	}{
+		{backupOptions{}, true},
+		{backupOptions{dir: "a"}, true},
+		{backupOptions{maildir: "a", record: true}, true},
+		{backupOptions{dir: "a", maildir: "b"}, false},
+		{backupOptions{maildir: "a", mbox: "b"}, false},
+		{backupOptions{mbox: "a", index: true}, true},
+		{backupOptions{dir: "a", sync: true, modeFlag: "0640"}, true},
+		{backupOptions{sync: true}, false},
+		{backupOptions{dir: "a", modeFlag: "0999"}, false},
+		{backupOptions{dir: "a", modeFlag: "10000"}, false},
+		{backupOptions{record: true}, false},
+		{backupOptions{maildir: "a", encryptRecipient: "key.asc"}, false},
+		{backupOptions{dir: "a", encryptRecipient: "/nonexistent/key.asc"}, false},
+	} {
+		if err := tc.bk.check(); err == nil && !tc.ok {
+			t.Errorf("check() unexpectedly succeeded for %+v", tc.bk)
+		} else if err != nil && tc.ok {
+			t.Errorf("check() failed for %+v: %v", tc.bk, err)
+		}
+	}
+}
+
+func TestBackupOptions_mode(t *testing.T) {
+	td := t.TempDir()
+	now := time.Date(2022, 4, 16, 16, 33, 34, 0, time.UTC)
+	for _, bk := range []backupOptions{
+		{dir: filepath.Join(td, "dir"), modeFlag: "0640", sync: true},
+		{maildir: filepath.Join(td, "maildir"), modeFlag: "0604", sync: true},
+		{mbox: filepath.Join(td, "mbox"), modeFlag: "0644", sync: true},
+	} {
+		if err := bk.check(); err != nil {
+			t.Errorf("check() failed for %+v: %v", bk, err)
+			continue
+		}
+		p, err := bk.save(now, []byte("Subject: Hi\r\n\r\nBody\r\n"))
+		if err != nil {
+			t.Errorf("save() with %+v failed: %v", bk, err)
+			continue
+		}
+		if fi, err := os.Stat(p); err != nil {
+			t.Error(err)
+		} else if got := fi.Mode().Perm(); got != bk.perm {
+			t.Errorf("save() with %+v created %v with mode %04o; want %04o", bk, p, got, bk.perm)
+		}
+	}
+}
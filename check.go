@@ -0,0 +1,48 @@
+// Copyright 2022 Daniel Erat.
+// All rights reserved.
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/derat/rendmail/rewrite"
+)
+
+// checkMain implements the "check" subcommand using the supplied command-line
+// arguments. The process's exit code is returned.
+func checkMain(args []string) int {
+	fs := flag.NewFlagSet("check", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s check [file]\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Validates a message (read from stdin by default) and writes problems as JSON to stdout.\n")
+		fmt.Fprintf(os.Stderr, "Exits with status 1 if any problems were found.\n\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() > 1 {
+		fs.Usage()
+		return 2
+	}
+	b, err := readMessageArg(fs.Args())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Failed reading message:", err)
+		return 2
+	}
+	findings := rewrite.Check(b)
+	enc := json.NewEncoder(os.Stdout)
+	for _, f := range findings {
+		if err := enc.Encode(f); err != nil {
+			fmt.Fprintln(os.Stderr, "Failed writing findings:", err)
+			return 2
+		}
+	}
+	if len(findings) > 0 {
+		return 1
+	}
+	return 0
+}
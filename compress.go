@@ -0,0 +1,166 @@
+// Copyright 2022 Daniel Erat.
+// All rights reserved.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os/exec"
+	"strings"
+)
+
+// Magic numbers at the start of compressed data.
+var (
+	gzipMagic  = []byte{0x1f, 0x8b}
+	bzip2Magic = []byte("BZh")
+	xzMagic    = []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}
+)
+
+// detectCompression returns "gzip", "bzip2", or "xz" if b starts with
+// the corresponding magic number, or an empty string otherwise.
+func detectCompression(b []byte) string {
+	switch {
+	case bytes.HasPrefix(b, gzipMagic):
+		return "gzip"
+	case bytes.HasPrefix(b, bzip2Magic):
+		return "bzip2"
+	case bytes.HasPrefix(b, xzMagic):
+		return "xz"
+	default:
+		return ""
+	}
+}
+
+// isDecompressMode returns true if mode is a valid value for the -decompress flag.
+func isDecompressMode(mode string) bool {
+	switch mode {
+	case "auto", "none", "gzip", "bzip2", "xz":
+		return true
+	default:
+		return false
+	}
+}
+
+// newDecompressReader returns a reader that decompresses data from r.
+// mode is "auto" to detect the format, "none" to return r unchanged,
+// or "gzip", "bzip2", or "xz" to require that format.
+func newDecompressReader(r io.Reader, mode string) (io.Reader, error) {
+	format := mode
+	switch mode {
+	case "none":
+		return r, nil
+	case "auto":
+		br := bufio.NewReader(r)
+		// Peek returns an error if fewer bytes are available, but that's fine here.
+		magic, _ := br.Peek(len(xzMagic))
+		if format = detectCompression(magic); format == "" {
+			return br, nil
+		}
+		r = br
+	}
+
+	switch format {
+	case "gzip":
+		return gzip.NewReader(r)
+	case "bzip2":
+		return bzip2.NewReader(r), nil
+	case "xz":
+		// The standard library doesn't include an xz implementation.
+		cmd := exec.Command("xz", "--decompress", "--stdout")
+		cmd.Stdin = r
+		cr := &cmdReader{cmd: cmd}
+		cmd.Stderr = &cr.stderr
+		var err error
+		if cr.out, err = cmd.StdoutPipe(); err != nil {
+			return nil, err
+		}
+		if err := cmd.Start(); err != nil {
+			return nil, err
+		}
+		return cr, nil
+	default:
+		return nil, fmt.Errorf("unsupported compression %q", format)
+	}
+}
+
+// cmdReader reads a command's output and reports its failure at EOF.
+type cmdReader struct {
+	cmd    *exec.Cmd
+	out    io.Reader
+	stderr bytes.Buffer
+}
+
+func (cr *cmdReader) Read(p []byte) (int, error) {
+	n, err := cr.out.Read(p)
+	if err == io.EOF {
+		if werr := cr.cmd.Wait(); werr != nil {
+			return n, fmt.Errorf("%v: %v (%v)", cr.cmd.Path, werr, strings.TrimSpace(cr.stderr.String()))
+		}
+	}
+	return n, err
+}
+
+// decompressData decompresses b as described by newDecompressReader.
+// An empty mode is treated as "none". The format of b is also returned
+// (empty if b wasn't decompressed).
+func decompressData(b []byte, mode string) (data []byte, format string, err error) {
+	switch mode {
+	case "", "none":
+		return b, "", nil
+	case "auto":
+		if format = detectCompression(b); format == "" {
+			return b, "", nil
+		}
+	default:
+		format = mode
+	}
+	r, err := newDecompressReader(bytes.NewReader(b), format)
+	if err != nil {
+		return nil, "", err
+	}
+	if data, err = ioutil.ReadAll(r); err != nil {
+		return nil, "", fmt.Errorf("%v: %v", format, err)
+	}
+	return data, format, nil
+}
+
+// newCompressWriter returns a writer that compresses data using format
+// and writes it to w. Only "gzip" is supported. If format is empty, a
+// writer that passes data through to w unchanged is returned.
+func newCompressWriter(w io.Writer, format string) (io.WriteCloser, error) {
+	switch format {
+	case "":
+		return nopWriteCloser{w}, nil
+	case "gzip":
+		return gzip.NewWriter(w), nil
+	default:
+		return nil, fmt.Errorf("unsupported compression %q", format)
+	}
+}
+
+// nopWriteCloser wraps an io.Writer with a no-op Close method.
+type nopWriteCloser struct{ io.Writer }
+
+func (nopWriteCloser) Close() error { return nil }
+
+// compressData compresses b as described by newCompressWriter.
+func compressData(b []byte, format string) ([]byte, error) {
+	var buf bytes.Buffer
+	w, err := newCompressWriter(&buf, format)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(b); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
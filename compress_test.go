@@ -0,0 +1,76 @@
+// Copyright 2022 Daniel Erat.
+// All rights reserved.
+
+package main
+
+import (
+	"io/ioutil"
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+func TestDecompressData(t *testing.T) {
+	const msg = "Subject: hi\n\nBody\n"
+	gz, err := compressData([]byte(msg), "gzip")
+	if err != nil {
+		t.Fatal("compressData failed:", err)
+	}
+	// Produced by "bzip2 -c".
+	bz := []byte{
+		0x42, 0x5a, 0x68, 0x39, 0x31, 0x41, 0x59, 0x26, 0x53, 0x59, 0x62, 0xd1,
+		0x7a, 0x23, 0x00, 0x00, 0x03, 0x5f, 0x80, 0x00, 0x10, 0x40, 0x00, 0x00,
+		0x10, 0x10, 0x00, 0x08, 0x00, 0x1e, 0x70, 0x86, 0x20, 0x20, 0x00, 0x22,
+		0x9a, 0x32, 0x03, 0x4f, 0x6a, 0x85, 0x30, 0x00, 0x4d, 0x38, 0xc3, 0xab,
+		0xd0, 0x90, 0xd9, 0xe9, 0x48, 0xf8, 0xbb, 0x92, 0x29, 0xc2, 0x84, 0x83,
+		0x16, 0x8b, 0xd1, 0x18,
+	}
+
+	for _, tc := range []struct {
+		in     []byte
+		mode   string
+		want   string
+		format string
+		ok     bool
+	}{
+		{[]byte(msg), "auto", msg, "", true},
+		{gz, "auto", msg, "gzip", true},
+		{gz, "gzip", msg, "gzip", true},
+		{gz, "none", string(gz), "", true},
+		{gz, "", string(gz), "", true},
+		{bz, "auto", msg, "bzip2", true},
+		{[]byte(msg), "gzip", "", "", false},
+		{gz[:len(gz)-4], "auto", "", "", false},
+	} {
+		got, format, err := decompressData(tc.in, tc.mode)
+		if err != nil {
+			if tc.ok {
+				t.Errorf("decompressData(%q, %q) failed: %v", tc.in, tc.mode, err)
+			}
+		} else if !tc.ok {
+			t.Errorf("decompressData(%q, %q) unexpectedly succeeded", tc.in, tc.mode)
+		} else if string(got) != tc.want || format != tc.format {
+			t.Errorf("decompressData(%q, %q) = %q, %q; want %q, %q",
+				tc.in, tc.mode, got, format, tc.want, tc.format)
+		}
+	}
+}
+
+func TestNewDecompressReaderXZ(t *testing.T) {
+	const msg = "Subject: hi\n\nBody\n"
+	cmd := exec.Command("xz", "--compress", "--stdout")
+	cmd.Stdin = strings.NewReader(msg)
+	xz, err := cmd.Output()
+	if err != nil {
+		t.Skip("xz unavailable:", err)
+	}
+	r, err := newDecompressReader(strings.NewReader(string(xz)), "auto")
+	if err != nil {
+		t.Fatal("newDecompressReader failed:", err)
+	}
+	if got, err := ioutil.ReadAll(r); err != nil {
+		t.Error("Reading failed:", err)
+	} else if string(got) != msg {
+		t.Errorf("Read %q; want %q", got, msg)
+	}
+}
@@ -0,0 +1,317 @@
+// Copyright 2022 Daniel Erat.
+// All rights reserved.
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/derat/rendmail/rewrite"
+)
+
+// defaultConfigPath returns the default path of the configuration file read for -profile.
+func defaultConfigPath() string {
+	if dir := os.Getenv("XDG_CONFIG_HOME"); dir != "" {
+		return filepath.Join(dir, "rendmail/config.toml")
+	}
+	return "~/.config/rendmail/config.toml"
+}
+
+// expandHome replaces a leading "~/" in p with the user's home directory.
+func expandHome(p string) string {
+	if strings.HasPrefix(p, "~/") {
+		if home := os.Getenv("HOME"); home != "" {
+			return filepath.Join(home, p[2:])
+		}
+	}
+	return p
+}
+
+// configSetting is a flag value set by a profile in a configuration file.
+type configSetting struct {
+	name  string // flag name, e.g. "delete-types"
+	value string // flag value, e.g. "image/*,video/*"
+	line  int    // 1-based line number in file
+}
+
+// configFile contains the contents of a configuration file.
+type configFile struct {
+	profiles map[string][]configSetting // keyed by profile name
+	rules    []*rewrite.Rule            // in the order in which they appeared
+}
+
+// readConfig reads the configuration file at p.
+func readConfig(p string) (*configFile, error) {
+	f, err := os.Open(expandHome(p))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return parseConfig(f)
+}
+
+// Regular expressions used by parseConfig.
+var (
+	configTableRegexp = regexp.MustCompile(`^\[\s*(profile|rule)\.([-_A-Za-z0-9]+)\s*\]$`)
+	configKeyRegexp   = regexp.MustCompile(`^([-_A-Za-z0-9]+)\s*=\s*(.*)$`)
+)
+
+// parseConfig parses a configuration file from r. The file uses a small subset of TOML:
+//
+//	# Comment
+//	[profile.attachments]
+//	delete-types = ["image/*", "video/*"]
+//	keep-types = "image/svg+xml"
+//	strip-receipts = true
+//	max-text-size = 65536
+//	backup-dir = "/home/me/mail/backup"
+//
+//	[rule.lists]
+//	list-id = "\\.lists\\.example\\.org"
+//	strip-headers = ["Received"]
+//	tag-subject = "[list]"
+//
+// Each profile's keys are names of command-line flags. Arrays of strings
+// are joined with commas to produce values for list flags. Rules' keys
+// are described by newMessageRule.
+func parseConfig(r io.Reader) (*configFile, error) {
+	cfg := configFile{profiles: make(map[string][]configSetting)}
+	tables := make(map[string][]configSetting) // keyed by e.g. "profile.foo"
+	var ruleNames []string
+	var table string
+	var lineNum int
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		lineNum++
+		ln := strings.TrimSpace(stripConfigComment(sc.Text()))
+		if ln == "" {
+			continue
+		}
+		if strings.HasPrefix(ln, "[") {
+			m := configTableRegexp.FindStringSubmatch(ln)
+			if m == nil {
+				return nil, fmt.Errorf("line %d: bad table %q", lineNum, ln)
+			}
+			table = m[1] + "." + m[2]
+			if _, ok := tables[table]; ok {
+				return nil, fmt.Errorf("line %d: duplicate %v %q", lineNum, m[1], m[2])
+			}
+			tables[table] = nil
+			if m[1] == "rule" {
+				ruleNames = append(ruleNames, m[2])
+			} else {
+				cfg.profiles[m[2]] = nil
+			}
+			continue
+		}
+		m := configKeyRegexp.FindStringSubmatch(ln)
+		if m == nil {
+			return nil, fmt.Errorf("line %d: expected key = value", lineNum)
+		}
+		if table == "" {
+			return nil, fmt.Errorf("line %d: key %q not in table", lineNum, m[1])
+		}
+		for _, s := range tables[table] {
+			if s.name == m[1] {
+				return nil, fmt.Errorf("line %d: duplicate key %q", lineNum, m[1])
+			}
+		}
+		val, err := parseConfigValue(m[2])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", lineNum, err)
+		}
+		tables[table] = append(tables[table], configSetting{m[1], val, lineNum})
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+
+	for name := range cfg.profiles {
+		cfg.profiles[name] = tables["profile."+name]
+	}
+	for _, name := range ruleNames {
+		r, err := newMessageRule(name, tables["rule."+name])
+		if err != nil {
+			return nil, fmt.Errorf("rule %q: %v", name, err)
+		}
+		cfg.rules = append(cfg.rules, r)
+	}
+	return &cfg, nil
+}
+
+// stripConfigComment removes a trailing "#" comment from ln.
+// "#" characters within quoted strings are preserved.
+func stripConfigComment(ln string) string {
+	var quote rune
+	var escaped bool
+	for i, ch := range ln {
+		switch {
+		case escaped:
+			escaped = false
+		case quote == '"' && ch == '\\':
+			escaped = true
+		case quote != 0:
+			if ch == quote {
+				quote = 0
+			}
+		case ch == '"' || ch == '\'':
+			quote = ch
+		case ch == '#':
+			return ln[:i]
+		}
+	}
+	return ln
+}
+
+// parseConfigValue parses a TOML string, boolean, integer, or array of strings.
+func parseConfigValue(s string) (string, error) {
+	s = strings.TrimSpace(s)
+	switch {
+	case s == "true" || s == "false":
+		return s, nil
+	case strings.HasPrefix(s, "["):
+		if !strings.HasSuffix(s, "]") {
+			return "", errors.New("unterminated array")
+		}
+		var vals []string
+		rest := strings.TrimSpace(s[1 : len(s)-1])
+		for rest != "" {
+			v, n, err := parseConfigString(rest)
+			if err != nil {
+				return "", err
+			}
+			vals = append(vals, v)
+			rest = strings.TrimSpace(rest[n:])
+			if rest != "" {
+				if rest[0] != ',' {
+					return "", errors.New("expected comma in array")
+				}
+				rest = strings.TrimSpace(rest[1:])
+			}
+		}
+		return strings.Join(vals, ","), nil
+	case strings.HasPrefix(s, `"`) || strings.HasPrefix(s, "'"):
+		v, n, err := parseConfigString(s)
+		if err != nil {
+			return "", err
+		}
+		if n != len(s) {
+			return "", errors.New("trailing data after string")
+		}
+		return v, nil
+	default:
+		if _, err := strconv.ParseInt(strings.Replace(s, "_", "", -1), 10, 64); err != nil {
+			return "", fmt.Errorf("bad value %q", s)
+		}
+		return strings.Replace(s, "_", "", -1), nil
+	}
+}
+
+// parseConfigString parses the basic ("...") or literal ('...') TOML string
+// at the beginning of s. The string's value and length in s are returned.
+func parseConfigString(s string) (val string, n int, err error) {
+	if strings.HasPrefix(s, "'") {
+		end := strings.IndexByte(s[1:], '\'')
+		if end < 0 {
+			return "", 0, errors.New("unterminated string")
+		}
+		return s[1 : end+1], end + 2, nil
+	}
+	if !strings.HasPrefix(s, `"`) {
+		return "", 0, fmt.Errorf("expected string at %q", s)
+	}
+	for i := 1; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case '"':
+			v, err := strconv.Unquote(s[:i+1])
+			if err != nil {
+				return "", 0, fmt.Errorf("bad string %s", s[:i+1])
+			}
+			return v, i + 1, nil
+		}
+	}
+	return "", 0, errors.New("unterminated string")
+}
+
+// applyProfile sets flags in fs from the settings in profile.
+// Flags that were already set on the command line are left unchanged.
+// If all is true, settings for flags not defined in fs produce an error;
+// otherwise they're ignored (since subcommands only define some flags).
+func applyProfile(fs *flag.FlagSet, profile []configSetting, all bool) error {
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	for _, s := range profile {
+		switch s.name {
+		case "config", "profile":
+			return fmt.Errorf("line %d: %q can't be set in profile", s.line, s.name)
+		}
+		if fs.Lookup(s.name) == nil {
+			if all {
+				return fmt.Errorf("line %d: unknown flag %q", s.line, s.name)
+			}
+			continue
+		}
+		if set[s.name] {
+			continue
+		}
+		if err := fs.Set(s.name, s.value); err != nil {
+			return fmt.Errorf("line %d: bad %q value: %v", s.line, s.name, err)
+		}
+	}
+	return nil
+}
+
+// newMessageRule returns a rule named name using settings from a "[rule.NAME]" table
+// in a configuration file. Keys are the hyphenated names of rewrite.Rule's fields.
+func newMessageRule(name string, settings []configSetting) (*rewrite.Rule, error) {
+	r := &rewrite.Rule{Name: name}
+	for _, s := range settings {
+		var err error
+		switch s.name {
+		case "from":
+			r.From = s.value
+		case "to":
+			r.To = s.value
+		case "list-id":
+			r.ListID = s.value
+		case "subject":
+			r.Subject = s.value
+		case "min-size":
+			r.MinSize, err = strconv.Atoi(s.value)
+		case "max-size":
+			r.MaxSize, err = strconv.Atoi(s.value)
+		case "auth":
+			r.Auth = s.value
+		case "sieve":
+			r.Sieve = s.value
+		case "delete-types":
+			r.DeleteTypes = splitList(s.value)
+		case "keep-types":
+			r.KeepTypes = splitList(s.value)
+		case "strip-headers":
+			r.StripHeaders = splitList(s.value)
+		case "tag-subject":
+			r.TagSubject = s.value
+		default:
+			err = fmt.Errorf("unknown key %q", s.name)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", s.line, err)
+		}
+	}
+	if err := r.Check(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
@@ -0,0 +1,118 @@
+// Copyright 2022 Daniel Erat.
+// All rights reserved.
+
+package main
+
+import (
+	"flag"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/derat/rendmail/rewrite"
+)
+
+func TestParseConfig(t *testing.T) {
+	const cfg = `# Comment
+[profile.a]
+delete-types = ["image/*", 'video/*'] # trailing comment
+keep-types = "image/#svg"
+strip-receipts = true
+max-text-size = 65_536
+
+[ profile.b-2 ]
+url-template = "https://example.org/?u={{urlquery .URL}}\t"
+
+[rule.lists]
+list-id = '\.example\.org'
+strip-headers = ["Received", "DKIM-Signature"]
+tag-subject = "[list]"
+
+[rule.big]
+min-size = 1_000_000
+delete-types = ["image/*"]
+`
+	got, err := parseConfig(strings.NewReader(cfg))
+	if err != nil {
+		t.Fatal("parseConfig failed:", err)
+	}
+	want := map[string][]configSetting{
+		"a": {
+			{"delete-types", "image/*,video/*", 3},
+			{"keep-types", "image/#svg", 4},
+			{"strip-receipts", "true", 5},
+			{"max-text-size", "65536", 6},
+		},
+		"b-2": {
+			{"url-template", "https://example.org/?u={{urlquery .URL}}\t", 9},
+		},
+	}
+	if !reflect.DeepEqual(got.profiles, want) {
+		t.Errorf("parseConfig returned profiles %+v; want %+v", got.profiles, want)
+	}
+	wantRules := []*rewrite.Rule{
+		{
+			Name:         "lists",
+			ListID:       `\.example\.org`,
+			StripHeaders: []string{"Received", "DKIM-Signature"},
+			TagSubject:   "[list]",
+		},
+		{Name: "big", MinSize: 1000000, DeleteTypes: []string{"image/*"}},
+	}
+	if !reflect.DeepEqual(got.rules, wantRules) {
+		t.Errorf("parseConfig returned rules %+v; want %+v", got.rules, wantRules)
+	}
+
+	for _, bad := range []string{
+		"a = 1\n",                             // not in profile
+		"[other.a]\n",                         // bad table
+		"[profile.a]\n[profile.a]\n",          // duplicate profile
+		"[profile.a]\nb = 1\nb = 2\n",         // duplicate key
+		"[profile.a]\nb\n",                    // missing value
+		"[profile.a]\nb = \"abc\n",            // unterminated string
+		"[profile.a]\nb = [\"a\" \"b\"]\n",    // missing comma
+		"[profile.a]\nb = [\"a\"\n",           // unterminated array
+		"[profile.a]\nb = yes\n",              // bad value
+		"[profile.a]\nb = \"a\" \"b\"\n",      // trailing data
+		"[profile.a]\nb = \"\\q\"\n",          // bad escape
+		"[profile.a]\nb = 'abc\n",             // unterminated literal string
+		"[profile.a]\nb = [\"a\", 1]\n",       // non-string in array
+		"[profile.a]\nb = 1.5\n",              // float
+		"[profile.a]\nb.c = true\n",           // dotted key
+		"[profile.a]\nb = \"a\" # c\nb = 1\n", // duplicate after comment
+		"[rule.a]\nbogus = 1\n",               // unknown rule key
+		"[rule.a]\nfrom = \"(\"\n",            // bad regexp
+		"[rule.a]\nauth = \"maybe\"\n",        // bad auth verdict
+		"[rule.a]\nmax-size = \"big\"\n",      // bad size
+		"[rule.a]\n[rule.a]\n",                // duplicate rule
+	} {
+		if _, err := parseConfig(strings.NewReader(bad)); err == nil {
+			t.Errorf("parseConfig(%q) unexpectedly succeeded", bad)
+		}
+	}
+}
+
+func TestApplyProfile(t *testing.T) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	a := fs.String("a", "", "")
+	b := fs.Bool("b", false, "")
+	c := fs.Int("c", 0, "")
+	if err := fs.Parse([]string{"-a=cmdline"}); err != nil {
+		t.Fatal(err)
+	}
+	profile := []configSetting{{"a", "profile", 1}, {"b", "true", 2}, {"c", "5", 3}, {"d", "x", 4}}
+	if err := applyProfile(fs, profile, true); err == nil {
+		t.Error("applyProfile with unknown flag unexpectedly succeeded with all=true")
+	}
+	if err := applyProfile(fs, profile, false); err != nil {
+		t.Error("applyProfile failed:", err)
+	}
+	if *a != "cmdline" || !*b || *c != 5 {
+		t.Errorf("applyProfile set a=%q, b=%v, c=%v; want \"cmdline\", true, 5", *a, *b, *c)
+	}
+	fs2 := flag.NewFlagSet("test2", flag.ContinueOnError)
+	fs2.Int("c", 0, "")
+	if err := applyProfile(fs2, []configSetting{{"c", "x", 1}}, false); err == nil {
+		t.Error("applyProfile with bad value unexpectedly succeeded")
+	}
+}
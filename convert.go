@@ -0,0 +1,276 @@
+// Copyright 2022 Daniel Erat.
+// All rights reserved.
+
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/derat/rendmail/rewrite"
+)
+
+// convertMain implements the "convert" subcommand using the supplied command-line
+// arguments. The process's exit code is returned.
+func convertMain(args []string) int {
+	opts := rewrite.Options{Now: time.Now()}
+	fs := flag.NewFlagSet("convert", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s convert -from=FORMAT -to=FORMAT [flag]... SRC... DST\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Copies messages between mbox files, Maildirs, and directories of .eml files,\n")
+		fmt.Fprintf(os.Stderr, "rewriting them along the way. Formats are \"mbox\", \"maildir\", and \"eml\".\n")
+		fmt.Fprintf(os.Stderr, "With -from=eml, SRC may be either a message file or a directory of .eml files.\n\n")
+		fs.PrintDefaults()
+	}
+	from := fs.String("from", "", `Format of SRC ("mbox", "maildir", or "eml")`)
+	jobs := fs.Int("jobs", 1, "Number of messages to rewrite concurrently")
+	progress := fs.Bool("progress", false, "Write progress and a summary to stderr")
+	to := fs.String("to", "", `Format of DST ("mbox", "maildir", or "eml")`)
+	rf := addRewriteFlags(fs, &opts)
+	pf := addProfileFlags(fs)
+	fs.Parse(args)
+
+	if err := rf.finish(&opts); err != nil {
+		fmt.Fprintln(os.Stderr, "Invalid flags:", err)
+		return 2
+	}
+	if !isConvertFormat(*from) || !isConvertFormat(*to) || fs.NArg() < 2 {
+		fs.Usage()
+		return 2
+	}
+
+	if *jobs < 1 {
+		fmt.Fprintln(os.Stderr, "-jobs must be positive")
+		return 2
+	}
+
+	stopProfile, err := pf.start()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Failed starting profiling:", err)
+		return 2
+	}
+	defer func() {
+		if err := stopProfile(); err != nil {
+			opts.Logger().Errorf("Failed writing profile: %v", err)
+		}
+	}()
+
+	bo := batchOptions{jobs: *jobs}
+	if *progress {
+		bo.progress = os.Stderr
+	}
+	srcs, dst := fs.Args()[:fs.NArg()-1], fs.Arg(fs.NArg()-1)
+	n, err := convertMessages(*from, srcs, *to, dst, &bo, &opts)
+	opts.Logger().Infof("Converted %d message(s)", n)
+	if err != nil {
+		opts.Logger().Errorf("Failed converting messages: %v", err)
+		return 1
+	}
+	return 0
+}
+
+// isConvertFormat returns true if format is supported by convertMessages.
+func isConvertFormat(format string) bool {
+	return format == "mbox" || format == "maildir" || format == "eml"
+}
+
+// convertMessages rewrites the messages in srcs (in format from) and writes them to dst
+// (in format to). Messages are appended to an existing mbox file, delivered to new/ in a
+// Maildir, or written to new numbered files in an .eml directory. The number of converted
+// messages is returned. Failures for individual messages are logged and processing continues.
+// Messages are rewritten concurrently per bo.jobs, and progress is written to bo.progress.
+func convertMessages(from string, srcs []string, to, dst string,
+	bo *batchOptions, opts *rewrite.Options) (n int, err error) {
+	var put func(msg []byte, envFrom string, mtime time.Time) error
+	switch to {
+	case "mbox":
+		f, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+		if err != nil {
+			return 0, err
+		}
+		defer func() {
+			if serr := f.Sync(); serr != nil && err == nil {
+				err = serr
+			}
+			if cerr := f.Close(); cerr != nil && err == nil {
+				err = cerr
+			}
+		}()
+		put = func(msg []byte, envFrom string, mtime time.Time) error {
+			if envFrom == "" {
+				envFrom = mboxFromLine(msg, mtime)
+			}
+			return writeMboxMessage(f, envFrom, msg)
+		}
+	case "maildir":
+		put = func(msg []byte, envFrom string, mtime time.Time) error {
+			// Name the message using its original time so that it sorts correctly.
+			d, err := newMaildirDelivery(dst, mtime)
+			if err != nil {
+				return err
+			}
+			if _, err := d.Write(msg); err != nil {
+				d.abort()
+				return err
+			}
+			p, err := d.commit()
+			if err != nil {
+				return err
+			}
+			return os.Chtimes(p, mtime, mtime)
+		}
+	case "eml":
+		if err := os.MkdirAll(dst, 0755); err != nil {
+			return 0, err
+		}
+		put = func(msg []byte, envFrom string, mtime time.Time) error {
+			p, err := writeNewFile(dst, fmt.Sprintf("%06d.eml", n+1), msg)
+			if err != nil {
+				return err
+			}
+			return os.Chtimes(p, mtime, mtime)
+		}
+	default:
+		return 0, fmt.Errorf("bad output format %q", to)
+	}
+
+	type result struct {
+		desc    string
+		msg     []byte
+		envFrom string
+		mtime   time.Time
+		mod     bool
+		err     error
+	}
+	prog := newBatchProgress(bo.progress, 0)
+	pool := newOrderedPool(bo.jobs, func(res interface{}) error {
+		r := res.(result)
+		if r.err != nil {
+			opts.Logger().Errorf("Failed rewriting %v: %v", r.desc, r.err)
+		} else if err := put(r.msg, r.envFrom, r.mtime); err != nil {
+			return err // output errors are fatal
+		} else {
+			n++
+		}
+		prog.update(r.mod, r.err)
+		return nil
+	})
+	convert := func(desc string, orig []byte, envFrom string, mtime time.Time) error {
+		return pool.add(func() interface{} {
+			var b bytes.Buffer
+			_, err := rewrite.Rewrite(bytes.NewReader(orig), &b, withLogField(opts, "message", desc))
+			return result{desc, b.Bytes(), envFrom, mtime, !bytes.Equal(b.Bytes(), orig), err}
+		})
+	}
+
+	err = readMessages(from, srcs, convert)
+	if perr := pool.wait(); err == nil {
+		err = perr
+	}
+	prog.finish()
+	if err == nil {
+		err = prog.failure("failed rewriting %d message(s)", prog.failed)
+	}
+	return n, err
+}
+
+// readMessages reads each message in srcs (in format from) and passes it to fn.
+func readMessages(from string, srcs []string,
+	fn func(desc string, msg []byte, envFrom string, mtime time.Time) error) error {
+	for _, src := range srcs {
+		switch from {
+		case "mbox":
+			if err := convertMbox(src, fn); err != nil {
+				return err
+			}
+		case "maildir", "eml":
+			var paths []string
+			var err error
+			if from == "maildir" {
+				paths, err = maildirMessages(src)
+			} else {
+				paths, err = emlMessages(src)
+			}
+			if err != nil {
+				return err
+			}
+			for _, p := range paths {
+				fi, err := os.Stat(p)
+				if err != nil {
+					return err
+				}
+				b, err := ioutil.ReadFile(p)
+				if err != nil {
+					return err
+				}
+				if err := fn(p, b, "", fi.ModTime()); err != nil {
+					return err
+				}
+			}
+		default:
+			return fmt.Errorf("bad input format %q", from)
+		}
+	}
+	return nil
+}
+
+// convertMbox reads each message from the mbox file at p and passes it to fn.
+func convertMbox(p string, fn func(desc string, msg []byte, envFrom string, mtime time.Time) error) error {
+	f, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	mr := newMboxReader(f)
+	for i := 1; ; i++ {
+		envFrom, msg, err := mr.read()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("%v: %v", p, err)
+		}
+		// The From_ line ends with an asctime()-style date.
+		mtime := time.Now()
+		if fields := strings.Fields(envFrom); len(fields) >= 7 {
+			if t, err := time.Parse(time.ANSIC, strings.Join(fields[len(fields)-5:], " ")); err == nil {
+				mtime = t
+			}
+		}
+		if err := fn(fmt.Sprintf("%v message %d", p, i), msg, envFrom, mtime); err != nil {
+			return err
+		}
+	}
+}
+
+// emlMessages returns p if it's a file or the sorted paths of
+// files with ".eml" extensions if it's a directory.
+func emlMessages(p string) ([]string, error) {
+	fi, err := os.Stat(p)
+	if err != nil {
+		return nil, err
+	}
+	if !fi.IsDir() {
+		return []string{p}, nil
+	}
+	fis, err := ioutil.ReadDir(p)
+	if err != nil {
+		return nil, err
+	}
+	var paths []string
+	for _, fi := range fis {
+		if fi.Mode().IsRegular() && strings.EqualFold(filepath.Ext(fi.Name()), ".eml") {
+			paths = append(paths, filepath.Join(p, fi.Name()))
+		}
+	}
+	sort.Strings(paths)
+	return paths, nil
+}
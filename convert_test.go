@@ -0,0 +1,71 @@
+// Copyright 2022 Daniel Erat.
+// All rights reserved.
+
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/derat/rendmail/rewrite"
+)
+
+func TestConvertMessages(t *testing.T) {
+	const (
+		from1 = "From a@example.org Sat Apr 16 16:33:34 2022"
+		msg1  = "Subject: 1\n\n>From here\n"
+		from2 = "From b@example.org Sat Apr 16 16:33:35 2022"
+		msg2  = "Subject: 2\nContent-Type: audio/wav\n\nRIFF\n"
+		mbox  = from1 + "\n" + msg1 + "\n" + from2 + "\n" + msg2 + "\n"
+	)
+	opts := rewrite.Options{Now: time.Date(2022, 4, 16, 16, 33, 34, 0, time.UTC)}
+
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src.mbox")
+	if err := ioutil.WriteFile(src, []byte(mbox), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Go from mbox to Maildir to .eml files and back to mbox.
+	md := filepath.Join(dir, "maildir")
+	if n, err := convertMessages("mbox", []string{src}, "maildir", md, &batchOptions{jobs: 2}, &opts); err != nil {
+		t.Fatal("mbox to Maildir failed:", err)
+	} else if n != 2 {
+		t.Errorf("mbox to Maildir converted %d message(s); want 2", n)
+	}
+	emlDir := filepath.Join(dir, "eml")
+	if _, err := convertMessages("maildir", []string{md}, "eml", emlDir, &batchOptions{}, &opts); err != nil {
+		t.Fatal("Maildir to .eml failed:", err)
+	}
+	dst := filepath.Join(dir, "dst.mbox")
+	if _, err := convertMessages("eml", []string{emlDir}, "mbox", dst, &batchOptions{jobs: 2}, &opts); err != nil {
+		t.Fatal(".eml to mbox failed:", err)
+	}
+	if b, err := ioutil.ReadFile(dst); err != nil {
+		t.Fatal(err)
+	} else if want := "From MAILER-DAEMON Sat Apr 16 16:33:34 2022\n" + msg1 + "\n" +
+		"From MAILER-DAEMON Sat Apr 16 16:33:35 2022\n" + msg2 + "\n"; string(b) != want {
+		// Envelope senders are lost in the Maildir, but times are preserved.
+		t.Errorf("Round-tripped mbox is %q; want %q", b, want)
+	}
+
+	// Rewrite options should be applied.
+	opts.DeleteMediaTypes = []string{"audio/*"}
+	rewritten := filepath.Join(dir, "rewritten")
+	if _, err := convertMessages("mbox", []string{src}, "eml", rewritten, &batchOptions{jobs: 4}, &opts); err != nil {
+		t.Fatal("Rewriting mbox to .eml failed:", err)
+	}
+	const want2 = "Subject: 2\n" +
+		"Content-Type: message/external-body; access-type=x-rendmail-deleted;\n" +
+		"\texpiration=\"Sat, 16 Apr 2022 16:33:34 +0000\"\n" +
+		"\n" +
+		"Content-Type: audio/wav\n" +
+		"\n"
+	if b, err := ioutil.ReadFile(filepath.Join(rewritten, "000002.eml")); err != nil {
+		t.Fatal(err)
+	} else if string(b) != want2 {
+		t.Errorf("Rewritten message is %q; want %q", b, want2)
+	}
+}
@@ -0,0 +1,216 @@
+// Copyright 2022 Daniel Erat.
+// All rights reserved.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// diffContext is the number of unchanged lines included around changes by writeUnifiedDiff.
+const diffContext = 3
+
+// diffOp describes a single line in a diff.
+type diffOp struct {
+	kind byte   // ' ' for unchanged, '-' for deleted, or '+' for inserted
+	line []byte // includes line terminator (unless at EOF)
+}
+
+// writeUnifiedDiff writes a unified diff from a to b to w, using name in the
+// "---" and "+++" lines. Nothing is written if a and b are identical.
+func writeUnifiedDiff(w io.Writer, name string, a, b []byte) error {
+	if bytes.Equal(a, b) {
+		return nil
+	}
+	ops := diffLines(splitLines(a), splitLines(b))
+
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "--- %s\n+++ %s (rewritten)\n", name, name)
+	for start := 0; start < len(ops); {
+		// Find the next change.
+		for start < len(ops) && ops[start].kind == ' ' {
+			start++
+		}
+		if start == len(ops) {
+			break
+		}
+		// Extend the hunk until there's a long-enough run of unchanged lines.
+		end := start
+		for end < len(ops) {
+			if ops[end].kind != ' ' {
+				end++
+				continue
+			}
+			run := end
+			for run < len(ops) && ops[run].kind == ' ' {
+				run++
+			}
+			if run == len(ops) || run-end > 2*diffContext {
+				break
+			}
+			end = run
+		}
+		hs := start - diffContext
+		if hs < 0 {
+			hs = 0
+		}
+		he := end + diffContext
+		if he > len(ops) {
+			he = len(ops)
+		}
+
+		// Line numbers are 1-based and count lines preceding the hunk.
+		var aStart, bStart, aLen, bLen int
+		for _, op := range ops[:hs] {
+			if op.kind != '+' {
+				aStart++
+			}
+			if op.kind != '-' {
+				bStart++
+			}
+		}
+		for _, op := range ops[hs:he] {
+			if op.kind != '+' {
+				aLen++
+			}
+			if op.kind != '-' {
+				bLen++
+			}
+		}
+		fmt.Fprintf(bw, "@@ -%s +%s @@\n", hunkRange(aStart, aLen), hunkRange(bStart, bLen))
+		for _, op := range ops[hs:he] {
+			bw.WriteByte(op.kind)
+			bw.Write(op.line)
+			if !bytes.HasSuffix(op.line, []byte("\n")) {
+				bw.WriteString("\n\\ No newline at end of file\n")
+			}
+		}
+		start = he
+	}
+	return bw.Flush()
+}
+
+// hunkRange formats a range for a unified diff hunk header.
+// start is the number of lines preceding the range.
+func hunkRange(start, n int) string {
+	switch n {
+	case 0:
+		return fmt.Sprintf("%d,0", start)
+	case 1:
+		return fmt.Sprint(start + 1)
+	default:
+		return fmt.Sprintf("%d,%d", start+1, n)
+	}
+}
+
+// splitLines splits b into lines, each including its terminator.
+func splitLines(b []byte) [][]byte {
+	var lines [][]byte
+	for len(b) > 0 {
+		n := len(b)
+		if i := bytes.IndexByte(b, '\n'); i >= 0 {
+			n = i + 1
+		}
+		lines = append(lines, b[:n])
+		b = b[n:]
+	}
+	return lines
+}
+
+// diffLines returns the operations needed to transform a into b.
+// It uses the patience algorithm, which produces readable diffs quickly for
+// the large blocks of deleted lines that are typical of rewritten messages.
+func diffLines(a, b [][]byte) []diffOp {
+	var ops []diffOp
+	// Strip the common prefix and suffix.
+	pre := 0
+	for pre < len(a) && pre < len(b) && bytes.Equal(a[pre], b[pre]) {
+		ops = append(ops, diffOp{' ', a[pre]})
+		pre++
+	}
+	suf := 0
+	for suf < len(a)-pre && suf < len(b)-pre && bytes.Equal(a[len(a)-1-suf], b[len(b)-1-suf]) {
+		suf++
+	}
+	am, bm := a[pre:len(a)-suf], b[pre:len(b)-suf]
+
+	if anchors := uniqueCommonLines(am, bm); len(anchors) > 0 {
+		ai, bi := 0, 0
+		for _, an := range anchors {
+			ops = append(ops, diffLines(am[ai:an[0]], bm[bi:an[1]])...)
+			ops = append(ops, diffOp{' ', am[an[0]]})
+			ai, bi = an[0]+1, an[1]+1
+		}
+		ops = append(ops, diffLines(am[ai:], bm[bi:])...)
+	} else {
+		for _, ln := range am {
+			ops = append(ops, diffOp{'-', ln})
+		}
+		for _, ln := range bm {
+			ops = append(ops, diffOp{'+', ln})
+		}
+	}
+
+	for _, ln := range a[len(a)-suf:] {
+		ops = append(ops, diffOp{' ', ln})
+	}
+	return ops
+}
+
+// uniqueCommonLines returns pairs of indexes into a and b of lines that appear exactly
+// once in each. The pairs form the longest sequence that is increasing in both a and b.
+func uniqueCommonLines(a, b [][]byte) [][2]int {
+	type counts struct{ na, nb, ia, ib int }
+	m := make(map[string]*counts)
+	for i, ln := range a {
+		c := m[string(ln)]
+		if c == nil {
+			c = &counts{}
+			m[string(ln)] = c
+		}
+		c.na++
+		c.ia = i
+	}
+	for i, ln := range b {
+		if c := m[string(ln)]; c != nil {
+			c.nb++
+			c.ib = i
+		}
+	}
+	var pairs [][2]int
+	for _, c := range m {
+		if c.na == 1 && c.nb == 1 {
+			pairs = append(pairs, [2]int{c.ia, c.ib})
+		}
+	}
+	sort.Slice(pairs, func(i, j int) bool { return pairs[i][1] < pairs[j][1] })
+
+	// Find the longest increasing subsequence of a-indexes using patience sorting.
+	var tails []int                 // indexes into pairs of the last element of each pile
+	prev := make([]int, len(pairs)) // previous element in the subsequence ending at each pair
+	for i, p := range pairs {
+		n := sort.Search(len(tails), func(j int) bool { return pairs[tails[j]][0] > p[0] })
+		if n > 0 {
+			prev[i] = tails[n-1]
+		} else {
+			prev[i] = -1
+		}
+		if n == len(tails) {
+			tails = append(tails, i)
+		} else {
+			tails[n] = i
+		}
+	}
+	if len(tails) == 0 {
+		return nil
+	}
+	seq := make([][2]int, len(tails))
+	for i, j := len(seq)-1, tails[len(tails)-1]; i >= 0; i, j = i-1, prev[j] {
+		seq[i] = pairs[j]
+	}
+	return seq
+}
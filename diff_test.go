@@ -0,0 +1,50 @@
+// Copyright 2022 Daniel Erat.
+// All rights reserved.
+
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestWriteUnifiedDiff(t *testing.T) {
+	// lines returns n lines containing consecutive letters, starting with 'a'+start.
+	lines := func(start, n int) string {
+		var s string
+		for i := start; i < start+n; i++ {
+			s += string(rune('a'+i)) + "\n"
+		}
+		return s
+	}
+
+	for _, tc := range []struct{ a, b, want string }{
+		{"same\n", "same\n", ""},
+		{"a\nb\nc\n", "a\nB\nc\n", "--- msg\n+++ msg (rewritten)\n@@ -1,3 +1,3 @@\n a\n-b\n+B\n c\n"},
+		{"", "new\n", "--- msg\n+++ msg (rewritten)\n@@ -0,0 +1 @@\n+new\n"},
+		{"a\nb", "a\nc", "--- msg\n+++ msg (rewritten)\n@@ -1,2 +1,2 @@\n a\n-b\n\\ No newline at end of file\n+c\n\\ No newline at end of file\n"},
+		{
+			// Changes separated by more than twice the context are in separate hunks.
+			lines(0, 20),
+			lines(0, 2) + "X\n" + lines(3, 12) + "Y\n" + lines(16, 4),
+			"--- msg\n+++ msg (rewritten)\n" +
+				"@@ -1,6 +1,6 @@\n a\n b\n-c\n+X\n d\n e\n f\n" +
+				"@@ -13,7 +13,7 @@\n m\n n\n o\n-p\n+Y\n q\n r\n s\n",
+		},
+		{
+			// Unique lines anchor the diff even when other lines move around.
+			"x\n1\n2\n3\ny\n",
+			"y\n1\n2\n3\nx\n",
+			"--- msg\n+++ msg (rewritten)\n@@ -1,5 +1,5 @@\n-x\n+y\n 1\n 2\n 3\n-y\n+x\n",
+		},
+	} {
+		var b bytes.Buffer
+		if err := writeUnifiedDiff(&b, "msg", []byte(tc.a), []byte(tc.b)); err != nil {
+			t.Errorf("writeUnifiedDiff(..., %q, %q) failed: %v", tc.a, tc.b, err)
+		} else if got := b.String(); got != tc.want {
+			t.Errorf("writeUnifiedDiff(..., %q, %q) wrote:\n%s\nwant:\n%s",
+				tc.a, tc.b, got, strings.TrimSuffix(tc.want, "\n"))
+		}
+	}
+}
@@ -0,0 +1,172 @@
+// Copyright 2022 Daniel Erat.
+// All rights reserved.
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"mime"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/derat/rendmail/rewrite"
+)
+
+// extractMain implements the "extract" subcommand using the supplied command-line
+// arguments. The process's exit code is returned.
+func extractMain(args []string) int {
+	fs := flag.NewFlagSet("extract", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s extract [flag]... [file]\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Decodes a message's parts (read from stdin by default) and writes them to files.\n")
+		fmt.Fprintf(os.Stderr, "All attachments are extracted if -part is unset.\n\n")
+		fs.PrintDefaults()
+	}
+	outDir := fs.String("o", ".", "Directory to which parts are written")
+	partList := fs.String("part", "", `Comma-separated paths of parts to extract (e.g. "1.2"), as printed by -list`)
+	verbose := fs.Bool("verbose", false, "Print the name of each written file")
+	fs.Parse(args)
+
+	if fs.NArg() > 1 {
+		fs.Usage()
+		return 2
+	}
+	b, err := readMessageArg(fs.Args())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Failed reading message:", err)
+		return 1
+	}
+	written, err := extractParts(b, splitList(*partList), *outDir)
+	if *verbose {
+		for _, p := range written {
+			fmt.Fprintln(os.Stderr, "Wrote", p)
+		}
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Failed extracting parts:", err)
+		return 1
+	}
+	return 0
+}
+
+// extractParts decodes the parts of msg with the supplied paths (using "0" for the
+// top-level part) and writes them to new files in dir. If paths is empty, all attachments
+// are extracted. The paths of the written files are returned.
+func extractParts(msg []byte, paths []string, dir string) ([]string, error) {
+	spans := rewrite.FindParts(msg)
+
+	if len(paths) == 0 {
+		for path, span := range spans {
+			if isAttachment(&span) {
+				paths = append(paths, path)
+			}
+		}
+		sort.Slice(paths, func(i, j int) bool { return rewrite.LessPartPath(paths[i], paths[j]) })
+		if len(paths) == 0 {
+			return nil, errors.New("no attachments found")
+		}
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	var written []string
+	for _, path := range paths {
+		if path == "0" {
+			path = ""
+		}
+		span, ok := spans[path]
+		if !ok {
+			return written, fmt.Errorf("no part %q", path)
+		}
+		if strings.HasPrefix(span.MediaType, "multipart/") {
+			return written, fmt.Errorf("part %q is %v", path, span.MediaType)
+		}
+		data, err := rewrite.DecodeBody(span.Body(msg, path == ""), span.Encoding)
+		if err != nil {
+			return written, fmt.Errorf("part %q: %v", path, err)
+		}
+		p, err := writeNewFile(dir, extractName(path, &span), data)
+		if err != nil {
+			return written, err
+		}
+		written = append(written, p)
+	}
+	return written, nil
+}
+
+// isAttachment returns true if p describes a non-multipart part that
+// has an attachment disposition or a filename.
+func isAttachment(p *rewrite.PartSpan) bool {
+	if strings.HasPrefix(p.MediaType, "multipart/") {
+		return false
+	}
+	return p.Disposition == "attachment" || partFilename(p) != ""
+}
+
+// extractName returns a safe filename for writing the part at path.
+// If the part doesn't specify a usable filename, one is generated
+// from its path and media type.
+func extractName(path string, p *rewrite.PartSpan) string {
+	name := strings.Map(func(r rune) rune {
+		if r == '/' || r == '\\' || unicode.IsControl(r) {
+			return '_'
+		}
+		return r
+	}, partFilename(p))
+	name = strings.TrimLeft(strings.TrimSpace(name), ".")
+	if name != "" {
+		return name
+	}
+
+	if path == "" {
+		path = "0"
+	}
+	name = "part-" + path
+	if ext, ok := extractExts[p.MediaType]; ok {
+		return name + ext
+	}
+	if exts, err := mime.ExtensionsByType(p.MediaType); err == nil && len(exts) > 0 {
+		sort.Strings(exts) // the returned order is arbitrary
+		name += exts[0]
+	}
+	return name
+}
+
+// extractExts contains preferred extensions for media types
+// that mime.ExtensionsByType maps to multiple extensions.
+var extractExts = map[string]string{
+	"message/rfc822": ".eml",
+	"text/html":      ".html",
+	"text/plain":     ".txt",
+}
+
+// writeNewFile writes data to a new file in dir with the supplied name. If the name is
+// already taken, a numeric suffix is inserted before the extension, e.g. "a-1.txt".
+// The path of the created file is returned.
+func writeNewFile(dir, name string, data []byte) (string, error) {
+	ext := filepath.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	for i := 0; ; i++ {
+		p := filepath.Join(dir, name)
+		if i > 0 {
+			p = filepath.Join(dir, fmt.Sprintf("%s-%d%s", base, i, ext))
+		}
+		f, err := os.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if os.IsExist(err) {
+			continue
+		} else if err != nil {
+			return "", err
+		}
+		if _, err := f.Write(data); err != nil {
+			f.Close()
+			return "", err
+		}
+		return p, f.Close()
+	}
+}
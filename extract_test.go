@@ -0,0 +1,118 @@
+// Copyright 2022 Daniel Erat.
+// All rights reserved.
+
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/derat/rendmail/rewrite"
+)
+
+func TestExtractParts(t *testing.T) {
+	const msg = "Content-Type: multipart/mixed; boundary=abc\n" +
+		"\n" +
+		"--abc\n" +
+		"Content-Type: text/plain\n" +
+		"\n" +
+		"Hello\n" +
+		"--abc\n" +
+		"Content-Type: application/octet-stream\n" +
+		"Content-Disposition: attachment; filename*=UTF-8''caf%C3%A9.txt\n" +
+		"Content-Transfer-Encoding: base64\n" +
+		"\n" +
+		"Zmlyc3Q=\n" +
+		"--abc\n" +
+		"Content-Type: text/plain; name=\"=?utf-8?q?caf=C3=A9.txt?=\"\n" +
+		"Content-Disposition: attachment\n" +
+		"Content-Transfer-Encoding: quoted-printable\n" +
+		"\n" +
+		"sec=\n" +
+		"ond\n" +
+		"--abc\n" +
+		"Content-Type: application/pdf\n" +
+		"Content-Disposition: attachment\n" +
+		"\n" +
+		"%PDF\n" +
+		"--abc--\n"
+
+	for _, tc := range []struct {
+		paths []string
+		want  map[string]string // filenames to contents
+		ok    bool
+	}{
+		{nil, map[string]string{
+			"café.txt":   "first",
+			"café-1.txt": "second",
+			"part-4.pdf": "%PDF",
+		}, true},
+		{[]string{"1", "2", "2"}, map[string]string{
+			"part-1.txt": "Hello",
+			"café.txt":   "first",
+			"café-1.txt": "first",
+		}, true},
+		{[]string{"0"}, nil, false},   // multipart
+		{[]string{"1.1"}, nil, false}, // nonexistent
+	} {
+		dir := t.TempDir()
+		written, err := extractParts([]byte(msg), tc.paths, dir)
+		if err != nil {
+			if tc.ok {
+				t.Errorf("extractParts(..., %q, ...) failed: %v", tc.paths, err)
+			}
+			continue
+		} else if !tc.ok {
+			t.Errorf("extractParts(..., %q, ...) unexpectedly succeeded", tc.paths)
+			continue
+		}
+
+		got := make(map[string]string)
+		var wantWritten []string
+		fis, err := ioutil.ReadDir(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, fi := range fis {
+			p := filepath.Join(dir, fi.Name())
+			b, err := ioutil.ReadFile(p)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got[fi.Name()] = string(b)
+			wantWritten = append(wantWritten, p)
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("extractParts(..., %q, ...) wrote %q; want %q", tc.paths, got, tc.want)
+		}
+		sort.Strings(written)
+		if !reflect.DeepEqual(written, wantWritten) {
+			t.Errorf("extractParts(..., %q, ...) returned %q; want %q", tc.paths, written, wantWritten)
+		}
+	}
+}
+
+func TestExtractName(t *testing.T) {
+	for _, tc := range []struct {
+		path      string
+		mediaType string
+		filename  string
+		want      string
+	}{
+		{"1", "image/png", "a.png", "a.png"},
+		{"1", "image/png", "../../etc/passwd", "_.._etc_passwd"},
+		{"1", "image/png", "a\x00b", "a_b"},
+		{"1", "image/png", "..", "part-1.png"},
+		{"2.1", "text/plain", "", "part-2.1.txt"},
+		{"", "message/rfc822", "", "part-0.eml"},
+		{"3", "application/x-unknown-type", "", "part-3"},
+	} {
+		p := rewrite.PartSpan{MediaType: tc.mediaType, DispParams: map[string]string{"filename": tc.filename}}
+		if got := extractName(tc.path, &p); got != tc.want {
+			t.Errorf("extractName(%q, %q) = %q; want %q", tc.path, tc.filename, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,310 @@
+// Copyright 2022 Daniel Erat.
+// All rights reserved.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/derat/rendmail/rewrite"
+)
+
+// batchOptions configures how rewriteFiles, rewriteMaildir, and rewriteMbox handle multiple messages.
+type batchOptions struct {
+	backup     backupOptions // how original messages are saved
+	outDir     string        // directory for rewritten files (rewriteFiles only)
+	inPlace    bool          // replace original files (rewriteFiles only)
+	keepMtime  bool          // preserve original files' modification times
+	dryRun     bool          // report modified messages without writing anything
+	decompress string        // -decompress mode for input ("" for none)
+	compress   string        // compression for output ("" for none)
+	diff       io.Writer     // if non-nil, unified diffs of modified messages are written here
+	jobs       int           // number of messages to rewrite concurrently (rewriteMaildir and rewriteMbox only)
+	progress   io.Writer     // if non-nil, progress and a summary are written here (rewriteMaildir and rewriteMbox only)
+	report     io.Writer     // if non-nil, JSON reports describing rewritten messages are written here
+
+	diffMu   sync.Mutex // serializes writes to diff
+	reportMu sync.Mutex // serializes writes to report
+}
+
+// fileMtime returns the modification time that should be used for a
+// rewritten version of the file described by fi, or the zero time if the
+// current time should be used.
+func (bo *batchOptions) fileMtime(fi os.FileInfo) time.Time {
+	if !bo.keepMtime {
+		return time.Time{}
+	}
+	return fi.ModTime()
+}
+
+// checkReplace returns an error if orig, the original data of a file that will be
+// replaced, would be decompressed but the rewritten version wouldn't be compressed.
+func (bo *batchOptions) checkReplace(orig []byte) error {
+	if bo.decompress == "" || bo.decompress == "none" || bo.compress != "" {
+		return nil
+	}
+	if format := detectCompression(orig); format != "" {
+		return fmt.Errorf("not replacing %v-compressed file with uncompressed data", format)
+	}
+	return nil
+}
+
+// rewriteFiles rewrites the message files at paths. Rewritten messages are written to
+// bo.outDir, written over the originals if bo.inPlace is true, or written to w otherwise.
+// The paths of modified messages are returned. Failures for individual files are logged
+// and processing continues.
+func rewriteFiles(paths []string, w io.Writer, bo *batchOptions, opts *rewrite.Options) (changed []string, err error) {
+	if bo.outDir != "" {
+		seen := make(map[string]string, len(paths))
+		for _, p := range paths {
+			base := filepath.Base(p)
+			if prev, ok := seen[base]; ok {
+				return nil, fmt.Errorf("%v and %v would both be written to %v", prev, p, base)
+			}
+			seen[base] = p
+		}
+		if !bo.dryRun {
+			if err := os.MkdirAll(bo.outDir, 0755); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	prog := newBatchProgress(nil, len(paths))
+	for _, p := range paths {
+		mod, err := rewriteFile(p, w, bo, opts)
+		if err != nil {
+			opts.Logger().Errorf("Failed rewriting %v: %v", p, err)
+		} else if mod {
+			changed = append(changed, p)
+		}
+		prog.update(mod, err)
+	}
+	return changed, prog.failure("failed rewriting %d of %d file(s)", prog.failed, len(paths))
+}
+
+// rewriteFile rewrites the message file at p as described by rewriteFiles.
+func rewriteFile(p string, w io.Writer, bo *batchOptions, opts *rewrite.Options) (changed bool, err error) {
+	opts = withLogField(opts, "message", p)
+	fi, err := os.Stat(p)
+	if err != nil {
+		return false, err
+	}
+	orig, err := ioutil.ReadFile(p)
+	if err != nil {
+		return false, err
+	}
+	if bo.inPlace {
+		if err := bo.checkReplace(orig); err != nil {
+			return false, err
+		}
+	}
+	b, changed, err := rewriteData(p, orig, bo, opts)
+	if err != nil {
+		return false, err
+	}
+	if changed {
+		opts.Logger().Infof("Rewrote %v", p)
+	}
+	if bo.dryRun {
+		return changed, nil
+	}
+	switch {
+	case bo.outDir != "":
+		dst := filepath.Join(bo.outDir, filepath.Base(p))
+		err = replaceFile(dst, bo.outDir, b, fi.Mode().Perm(), bo.fileMtime(fi))
+	case bo.inPlace:
+		if changed {
+			err = replaceFile(p, filepath.Dir(p), b, fi.Mode().Perm(), bo.fileMtime(fi))
+		}
+	default:
+		_, err = w.Write(b)
+	}
+	return changed, err
+}
+
+// rewriteData rewrites the message in orig (read from the file at p) and returns the new
+// version. The original is backed up first if requested by bo (or afterward if the
+// backup is deferred). orig is decompressed
+// and the new version is compressed as requested by bo. If the message was
+// unchanged (ignoring any X-Rendmail-Backup field) and its compression
+// doesn't need to change, orig is returned.
+func rewriteData(p string, orig []byte, bo *batchOptions, opts *rewrite.Options) (b []byte, changed bool, err error) {
+	var bw backupWriter   // uncommitted backup, aborted before returning
+	var cw backupWriter   // bw, retained after it's committed
+	var backupPath string // path of committed backup
+	if bo.backup.enabled() && !bo.dryRun {
+		if bw, err = bo.backup.create(opts.Now); bo.backup.skipBackup(err) {
+			opts.Logger().Warningf("Skipping backup: %v", err)
+			o := *opts
+			o.BackupWarning = backupSkippedWarning
+			opts = &o
+		} else if err != nil {
+			return nil, false, fmt.Errorf("backup: %v", err)
+		}
+	}
+	if bw != nil {
+		cw = bw
+		defer func() {
+			if bw != nil {
+				bw.abort()
+			}
+		}()
+		if bo.backup.record {
+			o := *opts
+			o.BackupRecord = bo.backup.recordValue(bw.path(), orig)
+			opts = &o
+		}
+		if !bo.backup.deferred() {
+			backupPath, err = writeBackup(bw, orig)
+			bw = nil // committed or aborted
+			if err != nil {
+				return nil, false, fmt.Errorf("backup: %v", err)
+			}
+		}
+	}
+	data, format, err := decompressData(orig, bo.decompress)
+	if err != nil {
+		return nil, false, err
+	}
+	var buf bytes.Buffer
+	rep, err := rewrite.Rewrite(bytes.NewReader(data), &buf, opts)
+	if err != nil {
+		return nil, false, err
+	}
+	if bo.report != nil {
+		bo.reportMu.Lock()
+		err := writeReport(bo.report, p, rep)
+		bo.reportMu.Unlock()
+		if err != nil {
+			return nil, false, fmt.Errorf("report: %v", err)
+		}
+	}
+	b = buf.Bytes()
+	if changed, err = rewriteChanged(data, b, opts); err != nil {
+		return nil, false, err
+	}
+	if bw != nil {
+		backupPath, err = bo.backup.finish(bw, orig, data, b, changed)
+		bw = nil // committed or aborted
+		if err != nil {
+			return nil, false, fmt.Errorf("backup: %v", err)
+		}
+	}
+	if backupPath != "" {
+		e := newBackupIndexEntry(backupPath, cw, data, len(b), opts, rep)
+		if err := bo.backup.addToIndex(e); err != nil {
+			return nil, false, fmt.Errorf("backup index: %v", err)
+		}
+	}
+	if !changed {
+		if format == bo.compress {
+			return orig, false, nil
+		}
+		b = data
+	} else {
+		if bo.diff != nil {
+			bo.diffMu.Lock()
+			err := writeUnifiedDiff(bo.diff, p, data, b)
+			bo.diffMu.Unlock()
+			if err != nil {
+				return nil, false, err
+			}
+		}
+	}
+	if b, err = compressData(b, bo.compress); err != nil {
+		return nil, false, err
+	}
+	return b, changed, nil
+}
+
+// rewriteChanged returns true if rewritten (produced by rewrite.Rewrite from orig using opts)
+// differs from orig. Any X-Rendmail-Backup or X-Rendmail-Backup-Warning fields added due to
+// opts.BackupRecord or opts.BackupWarning are ignored.
+func rewriteChanged(orig, rewritten []byte, opts *rewrite.Options) (bool, error) {
+	if opts.BackupRecord != "" {
+		var err error
+		if rewritten, _, err = rewrite.RemoveHeaderField(rewritten, rewrite.BackupField); err != nil {
+			return false, err
+		}
+	}
+	if opts.BackupWarning != "" {
+		var err error
+		if rewritten, _, err = rewrite.RemoveHeaderField(rewritten, rewrite.BackupWarningField); err != nil {
+			return false, err
+		}
+	}
+	return !bytes.Equal(orig, rewritten), nil
+}
+
+// replaceFile atomically replaces the file at p with data by writing it to a temporary
+// file in tmpDir (which must be on the same filesystem as p) and renaming it to p.
+// The new file is created with the supplied permissions. If mtime is non-zero, it is
+// used as the new file's modification time. The data and the rename are both synced
+// to disk before returning.
+func replaceFile(p, tmpDir string, data []byte, mode os.FileMode, mtime time.Time) error {
+	tmp, err := writeTempFile(tmpDir, data, mode, mtime)
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, p); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return syncDir(filepath.Dir(p))
+}
+
+// writeTempFile writes data to a new file in dir for replaceFile and returns its path.
+// mode and mtime are as described for replaceFile. The data is synced to disk.
+func writeTempFile(dir string, data []byte, mode os.FileMode, mtime time.Time) (string, error) {
+	f, err := ioutil.TempFile(dir, ".rendmail-*")
+	if err != nil {
+		return "", err
+	}
+	ok := false
+	defer func() {
+		if !ok {
+			f.Close()
+			os.Remove(f.Name())
+		}
+	}()
+	if _, err := f.Write(data); err != nil {
+		return "", err
+	}
+	if err := f.Chmod(mode); err != nil {
+		return "", err
+	}
+	if err := f.Sync(); err != nil {
+		return "", err
+	}
+	if err := f.Close(); err != nil {
+		return "", err
+	}
+	if !mtime.IsZero() {
+		if err := os.Chtimes(f.Name(), time.Now(), mtime); err != nil {
+			return "", err
+		}
+	}
+	ok = true
+	return f.Name(), nil
+}
+
+// syncDir fsyncs the directory at p so that renames within it are durable.
+func syncDir(p string) error {
+	d, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	if err := d.Sync(); err != nil {
+		d.Close()
+		return err
+	}
+	return d.Close()
+}
@@ -0,0 +1,207 @@
+// Copyright 2022 Daniel Erat.
+// All rights reserved.
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/derat/rendmail/rewrite"
+)
+
+func TestRewriteFiles(t *testing.T) {
+	orig, err := ioutil.ReadFile("rewrite/testdata/audio.in.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := ioutil.ReadFile("rewrite/testdata/audio.out.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	const plain = "From: me@example.org\nSubject: Hi\n\nNothing to see here.\n"
+
+	opts := rewrite.Options{
+		DeleteMediaTypes: []string{"audio/*", "video/*"},
+		Now:              time.Date(2022, 4, 15, 15, 19, 4, 0, time.UTC),
+	}
+
+	// writeFiles writes the audio and plain messages to a new dir and returns their paths.
+	writeFiles := func() (audio, plainPath string) {
+		dir := t.TempDir()
+		audio = filepath.Join(dir, "audio.eml")
+		plainPath = filepath.Join(dir, "plain.eml")
+		if err := ioutil.WriteFile(audio, orig, 0640); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(plainPath, []byte(plain), 0600); err != nil {
+			t.Fatal(err)
+		}
+		return audio, plainPath
+	}
+	// checkFile checks that the file at p contains data.
+	checkFile := func(desc, p, data string) {
+		t.Helper()
+		if got, err := ioutil.ReadFile(p); err != nil {
+			t.Errorf("%v: %v", desc, err)
+		} else if string(got) != data {
+			t.Errorf("%v: %v has unexpected contents:\n%s", desc, p, got)
+		}
+	}
+	// checkChanged checks that rewriteFiles returned only the audio message as modified.
+	checkChanged := func(desc string, got []string, err error, audio string) {
+		t.Helper()
+		if err != nil {
+			t.Errorf("%v: rewriteFiles failed: %v", desc, err)
+		} else if want := []string{audio}; !reflect.DeepEqual(got, want) {
+			t.Errorf("%v: rewriteFiles returned %q; want %q", desc, got, want)
+		}
+	}
+
+	{
+		audio, plainPath := writeFiles()
+		var b bytes.Buffer
+		changed, err := rewriteFiles([]string{audio, plainPath}, &b, &batchOptions{}, &opts)
+		checkChanged("stdout", changed, err, audio)
+		if got := b.String(); got != string(want)+plain {
+			t.Errorf("stdout: rewriteFiles wrote:\n%s", got)
+		}
+		checkFile("stdout", audio, string(orig))
+	}
+
+	{
+		audio, plainPath := writeFiles()
+		outDir := filepath.Join(t.TempDir(), "out")
+		changed, err := rewriteFiles([]string{audio, plainPath}, nil, &batchOptions{outDir: outDir}, &opts)
+		checkChanged("outDir", changed, err, audio)
+		checkFile("outDir", audio, string(orig))
+		checkFile("outDir", filepath.Join(outDir, "audio.eml"), string(want))
+		checkFile("outDir", filepath.Join(outDir, "plain.eml"), plain)
+		if fi, err := os.Stat(filepath.Join(outDir, "audio.eml")); err != nil {
+			t.Error("outDir:", err)
+		} else if fi.Mode().Perm() != 0640 {
+			t.Errorf("outDir: audio.eml has mode %v; want %v", fi.Mode().Perm(), os.FileMode(0640))
+		}
+	}
+
+	{
+		audio, plainPath := writeFiles()
+		changed, err := rewriteFiles([]string{audio, plainPath}, nil, &batchOptions{inPlace: true}, &opts)
+		checkChanged("inPlace", changed, err, audio)
+		checkFile("inPlace", audio, string(want))
+		checkFile("inPlace", plainPath, plain)
+		if fis, err := ioutil.ReadDir(filepath.Dir(audio)); err != nil {
+			t.Error("inPlace:", err)
+		} else if len(fis) != 2 {
+			t.Errorf("inPlace: dir contains %v file(s); want 2", len(fis))
+		}
+	}
+
+	{
+		audio, plainPath := writeFiles()
+		mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+		if err := os.Chtimes(audio, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+		changed, err := rewriteFiles([]string{audio, plainPath}, nil, &batchOptions{inPlace: true, keepMtime: true}, &opts)
+		checkChanged("keepMtime", changed, err, audio)
+		checkFile("keepMtime", audio, string(want))
+		if fi, err := os.Stat(audio); err != nil {
+			t.Error("keepMtime:", err)
+		} else if !fi.ModTime().Equal(mtime) {
+			t.Errorf("keepMtime: audio.eml has mtime %v; want %v", fi.ModTime(), mtime)
+		} else if fi.Mode().Perm() != 0640 {
+			t.Errorf("keepMtime: audio.eml has mode %v; want %v", fi.Mode().Perm(), os.FileMode(0640))
+		}
+	}
+
+	{
+		audio, plainPath := writeFiles()
+		changed, err := rewriteFiles([]string{audio, plainPath}, nil, &batchOptions{inPlace: true, dryRun: true}, &opts)
+		checkChanged("dryRun", changed, err, audio)
+		checkFile("dryRun", audio, string(orig))
+	}
+
+	{
+		audio, plainPath := writeFiles()
+		backupDir := t.TempDir()
+		bo := batchOptions{inPlace: true, backup: backupOptions{dir: backupDir, record: true}}
+		changed, err := rewriteFiles([]string{audio, plainPath}, nil, &bo, &opts)
+		checkChanged("backup", changed, err, audio)
+		// The unmodified message shouldn't get an X-Rendmail-Backup field.
+		checkFile("backup", plainPath, plain)
+		var restored bytes.Buffer
+		if f, err := os.Open(audio); err != nil {
+			t.Error("backup:", err)
+		} else {
+			if err := restoreMessage(f, &restored, []string{backupDir}, nil, nil); err != nil {
+				t.Error("backup: restoreMessage failed:", err)
+			} else if !bytes.Equal(restored.Bytes(), orig) {
+				t.Errorf("backup: restoreMessage produced:\n%s", restored.Bytes())
+			}
+			f.Close()
+		}
+	}
+
+	{
+		audio, plainPath := writeFiles()
+		backupDir := t.TempDir()
+		bo := batchOptions{inPlace: true, backup: backupOptions{dir: backupDir, record: true, onlyModified: true}}
+		changed, err := rewriteFiles([]string{audio, plainPath}, nil, &bo, &opts)
+		checkChanged("backupOnlyModified", changed, err, audio)
+		checkFile("backupOnlyModified", plainPath, plain)
+		// Only the modified message should be backed up.
+		if fis, err := ioutil.ReadDir(backupDir); err != nil {
+			t.Error("backupOnlyModified:", err)
+		} else if len(fis) != 1 {
+			t.Errorf("backupOnlyModified: got %d backup(s); want 1", len(fis))
+		} else if b, err := ioutil.ReadFile(filepath.Join(backupDir, fis[0].Name())); err != nil {
+			t.Error("backupOnlyModified:", err)
+		} else if !bytes.Equal(b, orig) {
+			t.Errorf("backupOnlyModified: backup contains:\n%s", b)
+		}
+	}
+
+	{
+		audio, plainPath := writeFiles()
+		gz, err := compressData(orig, "gzip")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(audio, gz, 0644); err != nil {
+			t.Fatal(err)
+		}
+		bo := batchOptions{inPlace: true, decompress: "auto"}
+		if _, err := rewriteFiles([]string{audio}, nil, &bo, &opts); err == nil {
+			t.Error("compress: rewriteFiles unexpectedly replaced gzip file with uncompressed data")
+		}
+		bo.compress = "gzip"
+		changed, err := rewriteFiles([]string{audio, plainPath}, nil, &bo, &opts)
+		checkChanged("compress", changed, err, audio)
+		checkFile("compress", plainPath, plain)
+		if b, err := ioutil.ReadFile(audio); err != nil {
+			t.Error("compress:", err)
+		} else if b, _, err := decompressData(b, "gzip"); err != nil {
+			t.Error("compress:", err)
+		} else if !bytes.Equal(b, want) {
+			t.Errorf("compress: %v decompressed to:\n%s", audio, b)
+		}
+	}
+
+	{
+		audio, _ := writeFiles()
+		other := filepath.Join(t.TempDir(), "audio.eml")
+		if _, err := rewriteFiles([]string{audio, other}, nil,
+			&batchOptions{outDir: t.TempDir()}, &opts); err == nil {
+			t.Error("rewriteFiles unexpectedly succeeded for duplicate filenames")
+		}
+		if _, err := rewriteFiles([]string{other}, nil, &batchOptions{inPlace: true}, &opts); err == nil {
+			t.Error("rewriteFiles unexpectedly succeeded for missing file")
+		}
+	}
+}
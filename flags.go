@@ -0,0 +1,317 @@
+// Copyright 2022 Daniel Erat.
+// All rights reserved.
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/mail"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/derat/rendmail/rewrite"
+)
+
+// rewriteFlags holds the values of flags registered by addRewriteFlags
+// that need to be processed before they can be stored in rewrite.Options.
+type rewriteFlags struct {
+	fs *flag.FlagSet
+
+	addDeliveredTo *string
+	appendFooter   *string
+	charsets       *string
+	config         *string
+	deleteBinary   *bool
+	deleteParts    *string
+	deleteTypes    *string
+	fakeNow        *string
+	keepTypes      *string
+	logFile        *string
+	logFormat      *string
+	logLevel       *string
+	pgpKey         *string
+	pgpPassFile    *string
+	plugin         *string
+	profile        *string
+	redactKeyFile  *string
+	stripHeaders   *string
+	verbose        *bool
+}
+
+// addRewriteFlags registers flags in fs for setting fields in opts.
+// rewriteFlags.finish must be called after fs is parsed.
+func addRewriteFlags(fs *flag.FlagSet, opts *rewrite.Options) *rewriteFlags {
+	rf := rewriteFlags{fs: fs}
+	rf.addDeliveredTo = fs.String("add-delivered-to", "", "Address to add to top of header in Delivered-To field")
+	fs.BoolVar(&opts.AddPlaceholder, "add-placeholder", false, "Add text part describing deleted parts if no displayable parts remain")
+	fs.BoolVar(&opts.AddTextAlt, "add-text-alternative", false, "Add plain-text alternatives to HTML-only messages")
+	rf.appendFooter = fs.String("append-footer", "", "File containing text to append to main text and HTML parts")
+	rf.charsets = fs.String("charsets", "html", `Supported charsets for decoding text ("html" for WHATWG encodings or "iana" for all known)`)
+	rf.config = fs.String("config", defaultConfigPath(), "Configuration file containing -profile definitions and rules")
+	fs.BoolVar(&opts.CheckHeaders, "check-headers", false, "Report RFC 5322 problems in header as JSON to stderr")
+	fs.IntVar(&opts.DataURIMinSize, "data-uri-min-size", 0, "Minimum encoded size in bytes of data: URIs removed by -strip-data-uris")
+	fs.BoolVar(&opts.DecodeSubject, "decode-subject", false, "Write X-Rendmail-Subject for RFC-2047-encoded Subject")
+	fs.BoolVar(&opts.DedupContentType, "dedup-content-type", false, "Remove Content-Type fields after the first one in each part")
+	fs.BoolVar(&opts.DefangURLs, "defang-urls", false, `Defang URLs in text and HTML parts (e.g. "hxxp://")`)
+	rf.deleteBinary = fs.Bool("delete-binary", false, "Delete common binary attachments from message")
+	rf.deleteParts = fs.String("delete-parts", "", `Comma-separated paths of parts to delete as printed by -list (e.g. "1.3,2.1.2")`)
+	fs.BoolVar(&opts.DeleteEncrypted, "delete-encrypted", false, "Delete multipart/encrypted (e.g. PGP/MIME) parts")
+	rf.deleteTypes = fs.String("delete-types", "", "Comma-separated globs of attachment media types to delete")
+	fs.BoolVar(&opts.DropEpilogue, "drop-epilogue", false, "Remove data following multipart parts' closing boundaries")
+	fs.BoolVar(&opts.Encode8BitHeader, "encode-8bit-header", false, "RFC-2047-encode header fields containing raw 8-bit data")
+	fs.BoolVar(&opts.EnforceLineLimit, "enforce-line-limit", false, "Re-encode parts with lines over 998 characters (quoted-printable for text, base64 otherwise)")
+	fs.BoolVar(&opts.ExtractList, "extract-list", false, "Write decoded X-Rendmail-List-* for List-Unsubscribe and List-Id")
+	rf.fakeNow = fs.String("fake-now", "", "Hardcoded RFC 3339 time (only used for testing)")
+	fs.BoolVar(&opts.FixBoundaries, "fix-boundaries", false, "Regenerate multipart boundaries that collide with enclosing parts' boundaries")
+	fs.BoolVar(&opts.FlattenMultipart, "flatten-multipart", false, "Replace multipart parts left with one part after deletion by that part")
+	fs.StringVar(&opts.FormatFlowed, "format-flowed", "", `Convert text parts to "fixed" or "flowed" (RFC 3676) formatting`)
+	rf.keepTypes = fs.String("keep-types", "", "Comma-separated glob overrides for -delete-types")
+	rf.logFile = fs.String("log-file", "", "File to which log messages are appended instead of stderr")
+	rf.logFormat = fs.String("log-format", "text", `Format for log messages ("text" or "json")`)
+	rf.logLevel = fs.String("log-level", "warning", `Minimum level of logged messages ("debug", "info", "warning", or "error")`)
+	fs.StringVar(&opts.LineEndings, "line-endings", "keep", `Line endings to use in output ("crlf", "lf", or "keep"; binary parts are base64-encoded)`)
+	fs.BoolVar(&opts.MarkEncrypted, "mark-encrypted", false, "Add X-Rendmail-Encrypted field to encrypted messages")
+	fs.IntVar(&opts.MaxDepth, "max-depth", 0, "Fail for parts nested more deeply than this (0 for no limit)")
+	fs.IntVar(&opts.MaxHeaderSize, "max-header-size", 0, "Fail for part headers larger than this many bytes (0 for no limit)")
+	fs.IntVar(&opts.MaxLineLength, "max-line-length", 0, "Fail for lines longer than this many bytes (0 for no limit)")
+	fs.IntVar(&opts.MaxParts, "max-parts", 0, "Fail for messages with more parts than this (0 for no limit)")
+	fs.IntVar(&opts.MaxTextSize, "max-text-size", 0, "Truncate text parts larger than this many bytes (0 for no limit; tiny limits leave just a notice)")
+	fs.IntVar(&opts.MaxUnfoldedLength, "max-unfolded-length", 0, "Fail for unfolded header fields longer than this many bytes (0 for no limit)")
+	fs.StringVar(&opts.NormalizeCTE, "normalize-cte", "", `Re-encode text parts ("quoted-printable", "base64", or "8bit")`)
+	fs.StringVar(&opts.OnBadContentType, "on-bad-content-type", "ignore", `Handling of unparsable Content-Type fields ("ignore", "warn", or "fail")`)
+	fs.StringVar(&opts.OnBadHeader, "on-bad-header", "warn", `Handling of malformed header fields and -check-headers problems ("ignore", "warn", or "fail")`)
+	fs.StringVar(&opts.OnMissingBoundary, "on-missing-boundary", "warn", `Handling of multipart parts without boundaries ("ignore", "warn", or "fail")`)
+	fs.StringVar(&opts.OnMultipartCTE, "on-multipart-cte", "warn", `Handling of base64 or quoted-printable multipart parts ("ignore", "warn", "fail", or "repair")`)
+	rf.pgpKey = fs.String("pgp-decrypt-key", "", "File containing OpenPGP secret key for decrypting PGP/MIME parts")
+	fs.StringVar(&opts.PGPOutput, "pgp-output", "decrypted", `Output for PGP/MIME parts decrypted by -pgp-decrypt-key ("decrypted" or "encrypted"; changed parts are re-encrypted only to the key, without signatures)`)
+	rf.pgpPassFile = fs.String("pgp-passphrase-file", "", "File containing passphrase for -pgp-decrypt-key")
+	rf.plugin = fs.String("plugin", "", "Command (with space-separated args) run to decide whether to keep, delete, or replace parts via JSON")
+	rf.profile = fs.String("profile", "", "Named profile in -config file supplying defaults for other flags")
+	rf.redactKeyFile = fs.String("redact-key-file", "", `File containing secret key used to hash addresses for -redact-recipients=hash`)
+	fs.StringVar(&opts.RedactRecipients, "redact-recipients", "", `Replace To/Cc/Bcc addresses ("hash" or "placeholder"; use -redact-key-file so hashes can't be checked against guesses)`)
+	fs.BoolVar(&opts.RewrapBase64, "rewrap-base64", false, "Re-wrap base64-encoded bodies to 76-character lines")
+	fs.BoolVar(&opts.RewriteBoundaries, "rewrite-boundaries", false, "Replace all multipart boundaries with newly generated ones")
+	fs.BoolVar(&opts.SanitizeHTML, "sanitize-html", false, "Remove tracking pixels, external scripts, and prefetch links from HTML")
+	fs.BoolVar(&opts.ScanEmbedded, "scan-embedded", false, "Also delete matching BinHex and yEnc data embedded in text parts")
+	fs.BoolVar(&opts.SortHeaders, "sort-headers", false, "Sort top-level header fields into a canonical order")
+	fs.BoolVar(&opts.Strict, "strict", false, "Exit with status 1 for malformed message (same as \"fail\" for -on-bad-header and -on-missing-boundary)")
+	fs.BoolVar(&opts.StripAppleDouble, "strip-appledouble", false, "Delete Mac resource forks and unwrap multipart/appledouble parts")
+	fs.BoolVar(&opts.StripDataURIs, "strip-data-uris", false, "Replace base64 data: URIs (e.g. embedded images) in HTML with placeholders")
+	rf.stripHeaders = fs.String("strip-headers", "", "Comma-separated names of top-level header fields to remove")
+	fs.BoolVar(&opts.StripImageMeta, "strip-image-metadata", false, "Remove EXIF, GPS, and XMP metadata from JPEG and PNG attachments")
+	fs.BoolVar(&opts.StripLeadingJunk, "strip-leading-junk", false, "Remove UTF-8 BOM and blank or garbage lines preceding header")
+	fs.BoolVar(&opts.StripMboxFrom, "strip-mbox-from", false, "Remove mbox From_ line (e.g. from formail) preceding header")
+	fs.BoolVar(&opts.StripReceipts, "strip-receipts", false, "Remove header fields requesting read receipts")
+	fs.BoolVar(&opts.StripSignature, "strip-signature", false, `Remove "-- " signature blocks and HTML signature elements from text parts`)
+	fs.StringVar(&opts.SubjectTag, "tag-subject", "", `Text to prepend to Subject if not already present (e.g. "[list]")`)
+	fs.BoolVar(&opts.TranscodeUTF8, "transcode-utf8", false, "Convert text parts to UTF-8")
+	fs.StringVar(&opts.URLTemplate, "url-template", "", `Template for rewriting URLs in text and HTML parts (e.g. "https://example.org/?u={{urlquery .URL}}")`)
+	fs.StringVar(&opts.ValidateOutput, "validate-output", "", `Re-parse output before writing it and treat broken output as a temporary failure ("internal" or "full")`)
+	rf.verbose = fs.Bool("verbose", false, "Log informative messages (same as -log-level=info)")
+	fs.BoolVar(&opts.VerifyIdempotent, "verify-idempotent", false, "Fail without writing output if rewriting it again would change it")
+	fs.StringVar(&opts.WhenAuth, "when-auth", "any", `Only delete attachments (by any flag or rule) for Authentication-Results verdict ("pass", "fail", or "any")`)
+	return &rf
+}
+
+// finish validates the parsed flags and finishes filling opts.
+// If -profile was supplied, its settings are first applied to all
+// flags in the FlagSet that weren't set on the command line.
+// Rules from -config are copied to opts.
+func (rf *rewriteFlags) finish(opts *rewrite.Options) error {
+	// The config file is only read if it was requested.
+	var readCfg bool
+	rf.fs.Visit(func(f *flag.Flag) { readCfg = readCfg || f.Name == "config" })
+	if readCfg || *rf.profile != "" {
+		cfg, err := readConfig(*rf.config)
+		if err != nil {
+			return fmt.Errorf("bad -config file: %v", err)
+		}
+		if *rf.profile != "" {
+			profile, ok := cfg.profiles[*rf.profile]
+			if !ok {
+				return fmt.Errorf("no -profile %q in %v", *rf.profile, *rf.config)
+			}
+			// Subcommands don't define the top-level command's flags.
+			if err := applyProfile(rf.fs, profile, rf.fs == flag.CommandLine); err != nil {
+				return fmt.Errorf("bad -profile %q: %v", *rf.profile, err)
+			}
+		}
+		opts.Rules = cfg.rules
+	}
+	opts.Profile = *rf.profile
+
+	level, ok := rewrite.ParseLogLevel(*rf.logLevel)
+	if !ok {
+		return fmt.Errorf("bad -log-level value %q", *rf.logLevel)
+	}
+	if *rf.verbose && level > rewrite.LogInfo {
+		level = rewrite.LogInfo
+	}
+	if *rf.logFormat != "text" && *rf.logFormat != "json" {
+		return fmt.Errorf("bad -log-format value %q", *rf.logFormat)
+	}
+	logW := io.Writer(os.Stderr)
+	if *rf.logFile != "" {
+		f, err := os.OpenFile(*rf.logFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+		if err != nil {
+			return fmt.Errorf("bad -log-file: %v", err)
+		}
+		logW = f // left open until the process exits
+	}
+	opts.Log = rewrite.NewLogger(logW, level, *rf.logFormat == "json")
+	opts.Findings = os.Stderr
+
+	if *rf.fakeNow != "" {
+		var err error
+		if opts.Now, err = time.Parse(time.RFC3339, *rf.fakeNow); err != nil {
+			return fmt.Errorf("bad -fake-now time: %v", err)
+		}
+	}
+
+	if *rf.addDeliveredTo != "" {
+		addr, err := mail.ParseAddress(*rf.addDeliveredTo)
+		if err != nil {
+			return fmt.Errorf("bad -add-delivered-to address: %v", err)
+		}
+		opts.AddDeliveredTo = addr.Address
+	}
+
+	if *rf.appendFooter != "" {
+		b, err := ioutil.ReadFile(*rf.appendFooter)
+		if err != nil {
+			return fmt.Errorf("bad -append-footer file: %v", err)
+		}
+		opts.Footer = string(b)
+	}
+
+	switch opts.RedactRecipients {
+	case "", "hash", "placeholder":
+	default:
+		return fmt.Errorf("bad -redact-recipients mode %q", opts.RedactRecipients)
+	}
+	if *rf.redactKeyFile != "" {
+		b, err := ioutil.ReadFile(*rf.redactKeyFile)
+		if err != nil {
+			return fmt.Errorf("bad -redact-key-file: %v", err)
+		}
+		if opts.RedactKey = string(bytes.TrimRight(b, "\r\n")); opts.RedactKey == "" {
+			return errors.New("bad -redact-key-file: empty key")
+		}
+	}
+
+	switch opts.LineEndings {
+	case "crlf", "lf", "keep":
+	default:
+		return fmt.Errorf("bad -line-endings value %q", opts.LineEndings)
+	}
+
+	switch *rf.charsets {
+	case "html":
+		opts.Charsets = nil // default
+	case "iana":
+		opts.Charsets = rewrite.IANACharsets
+	default:
+		return fmt.Errorf("bad -charsets value %q", *rf.charsets)
+	}
+
+	if err := rewrite.CheckURLTemplate(opts.URLTemplate); err != nil {
+		return fmt.Errorf("bad -url-template: %v", err)
+	}
+
+	switch opts.NormalizeCTE {
+	case "", "quoted-printable", "base64", "8bit":
+	default:
+		return fmt.Errorf("bad -normalize-cte encoding %q", opts.NormalizeCTE)
+	}
+
+	switch opts.FormatFlowed {
+	case "", "fixed", "flowed":
+	default:
+		return fmt.Errorf("bad -format-flowed value %q", opts.FormatFlowed)
+	}
+
+	switch opts.ValidateOutput {
+	case "", "internal", "full":
+	default:
+		return fmt.Errorf("bad -validate-output value %q", opts.ValidateOutput)
+	}
+
+	switch opts.PGPOutput {
+	case "decrypted", "encrypted":
+	default:
+		return fmt.Errorf("bad -pgp-output value %q", opts.PGPOutput)
+	}
+	if *rf.pgpKey != "" {
+		var pass []byte
+		if *rf.pgpPassFile != "" {
+			b, err := ioutil.ReadFile(*rf.pgpPassFile)
+			if err != nil {
+				return fmt.Errorf("bad -pgp-passphrase-file: %v", err)
+			}
+			pass = bytes.TrimRight(b, "\r\n")
+		}
+		var err error
+		if opts.PGPKeys, err = rewrite.LoadPGPKeys(*rf.pgpKey, pass); err != nil {
+			return fmt.Errorf("bad -pgp-decrypt-key: %v", err)
+		}
+	}
+
+	switch opts.WhenAuth {
+	case "any", "pass", "fail":
+	default:
+		return fmt.Errorf("bad -when-auth verdict %q", opts.WhenAuth)
+	}
+
+	if *rf.deleteBinary {
+		if *rf.deleteTypes != "" || *rf.keepTypes != "" {
+			return errors.New("-delete-binary is incompatible with -delete-types and -keep-types")
+		}
+		opts.DeleteMediaTypes = binaryDeleteTypes
+		opts.KeepMediaTypes = binaryKeepTypes
+	} else {
+		opts.DeleteMediaTypes = splitList(*rf.deleteTypes)
+		opts.KeepMediaTypes = splitList(*rf.keepTypes)
+	}
+
+	opts.StripHeaders = splitList(*rf.stripHeaders)
+
+	opts.DeleteParts = splitList(*rf.deleteParts)
+	for _, p := range opts.DeleteParts {
+		if !partPathRegexp.MatchString(p) {
+			return fmt.Errorf("bad -delete-parts path %q", p)
+		}
+	}
+
+	if args := strings.Fields(*rf.plugin); len(args) > 0 {
+		pl, err := startPlugin(args[0], args[1:], opts.Log)
+		if err != nil {
+			return fmt.Errorf("bad -plugin: %v", err)
+		}
+		opts.Visit = pl.visit // left running until the process exits
+	}
+
+	// Parse globs, templates, and rules once rather than for each message.
+	c, err := opts.Compile()
+	if err != nil {
+		return err
+	}
+	*opts = *c
+	return nil
+}
+
+// partPathRegexp matches part paths like "0" (for the top-level part), "1", and "1.2".
+var partPathRegexp = regexp.MustCompile(`^(0|[1-9][0-9]*(\.[1-9][0-9]*)*)$`)
+
+// withLogField returns a copy of opts whose logger includes the supplied field in messages.
+func withLogField(opts *rewrite.Options, key, val string) *rewrite.Options {
+	o := *opts
+	o.Log = rewrite.LoggerWith(opts.Log, key, val)
+	return &o
+}
@@ -2,4 +2,7 @@ module github.com/derat/rendmail
 
 go 1.12
 
-require golang.org/x/text v0.3.7
+require (
+	golang.org/x/crypto v0.0.0-20200622213623-75b288015ac9
+	golang.org/x/text v0.3.7
+)
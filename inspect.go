@@ -0,0 +1,194 @@
+// Copyright 2022 Daniel Erat.
+// All rights reserved.
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/derat/rendmail/rewrite"
+)
+
+// inspectMain implements the "inspect" subcommand using the supplied command-line
+// arguments. The process's exit code is returned.
+func inspectMain(args []string) int {
+	opts := rewrite.Options{Now: time.Now()}
+	fs := flag.NewFlagSet("inspect", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s inspect [flag]... [file]\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Prints a JSON description of a message's parts (read from stdin by default).\n")
+		fmt.Fprintf(os.Stderr, "Rewriting flags are used to report which parts would be deleted.\n\n")
+		fs.PrintDefaults()
+	}
+	rf := addRewriteFlags(fs, &opts)
+	fs.Parse(args)
+
+	if err := rf.finish(&opts); err != nil {
+		fmt.Fprintln(os.Stderr, "Invalid flags:", err)
+		return 2
+	}
+	if fs.NArg() > 1 {
+		fs.Usage()
+		return 2
+	}
+
+	b, err := readMessageArg(fs.Args())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Failed reading message:", err)
+		return 1
+	}
+
+	part, err := inspectMessage(b, &opts)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Failed inspecting message:", err)
+		return 1
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(part); err != nil {
+		fmt.Fprintln(os.Stderr, "Failed writing JSON:", err)
+		return 1
+	}
+	return 0
+}
+
+// readMessageArg reads the message from the file named by args[0],
+// or from stdin if args is empty. Compressed messages are decompressed.
+func readMessageArg(args []string) ([]byte, error) {
+	var b []byte
+	var err error
+	if len(args) > 0 {
+		b, err = ioutil.ReadFile(args[0])
+	} else {
+		b, err = ioutil.ReadAll(os.Stdin)
+	}
+	if err != nil {
+		return nil, err
+	}
+	b, _, err = decompressData(b, "auto")
+	return b, err
+}
+
+// inspectPart describes a message part for the "inspect" subcommand.
+type inspectPart struct {
+	Path         string            `json:"path"` // empty for top-level part, else e.g. "1" or "1.2"
+	MediaType    string            `json:"mediaType"`
+	Params       map[string]string `json:"params,omitempty"`
+	Disposition  string            `json:"disposition,omitempty"`
+	Filename     string            `json:"filename,omitempty"`
+	Encoding     string            `json:"encoding,omitempty"`
+	HeaderOffset int               `json:"headerOffset"`          // byte offset of header
+	BodyOffset   int               `json:"bodyOffset"`            // byte offset of body
+	EncodedSize  int               `json:"encodedSize"`           // body size in bytes
+	DecodedSize  *int              `json:"decodedSize,omitempty"` // nil if body couldn't be decoded
+	Delete       bool              `json:"delete"`                // true if opts would delete the part
+	Parts        []*inspectPart    `json:"parts,omitempty"`
+}
+
+// inspectMessage describes the structure of the message in b.
+// opts is used to determine which parts would be deleted.
+func inspectMessage(b []byte, opts *rewrite.Options) (*inspectPart, error) {
+	spans := rewrite.FindParts(b)
+	var inspect func(path string, parentDel bool) (*inspectPart, error)
+	inspect = func(path string, parentDel bool) (*inspectPart, error) {
+		span := spans[path]
+		body := span.Body(b, path == "")
+		part := &inspectPart{
+			Path:         path,
+			MediaType:    span.MediaType,
+			Params:       span.Params,
+			Disposition:  span.Disposition,
+			Filename:     partFilename(&span),
+			Encoding:     span.Encoding,
+			HeaderOffset: span.Start,
+			BodyOffset:   span.BodyStart,
+			EncodedSize:  len(body),
+		}
+		if dec, err := rewrite.DecodeBody(body, span.Encoding); err == nil {
+			n := len(dec)
+			part.DecodedSize = &n
+		}
+
+		del, err := opts.MatchesDeleteRules(spans, path)
+		if err != nil {
+			return nil, err
+		}
+		part.Delete = parentDel || del
+
+		for i := 1; ; i++ {
+			cpath := strconv.Itoa(i)
+			if path != "" {
+				cpath = path + "." + cpath
+			}
+			if _, ok := spans[cpath]; !ok {
+				break
+			}
+			child, err := inspect(cpath, part.Delete)
+			if err != nil {
+				return nil, err
+			}
+			part.Parts = append(part.Parts, child)
+		}
+		return part, nil
+	}
+	return inspect("", false)
+}
+
+// partFilename returns the decoded filename from p's Content-Disposition
+// or Content-Type parameters, or an empty string if no name was supplied.
+func partFilename(p *rewrite.PartSpan) string {
+	name := p.DispParams["filename"]
+	if name == "" {
+		name = p.Params["name"]
+	}
+	// mime.ParseMediaType handles RFC 2231 parameters, but some senders use RFC 2047 instead.
+	if dec, err := rewrite.DecodeHeader(name); err == nil {
+		name = dec
+	}
+	return name
+}
+
+// writePartList writes a line to w for part and each of its descendants containing
+// tab-separated fields with the part's path ("0" for the top-level part), media type,
+// filename, decoded size (or encoded size if the body couldn't be decoded), and
+// Content-Transfer-Encoding. Missing filenames and encodings are written as "-".
+func writePartList(w io.Writer, part *inspectPart) error {
+	path := part.Path
+	if path == "" {
+		path = "0"
+	}
+	size := part.EncodedSize
+	if part.DecodedSize != nil {
+		size = *part.DecodedSize
+	}
+	field := func(s string) string {
+		if s == "" {
+			return "-"
+		}
+		return strings.Map(func(r rune) rune {
+			if unicode.IsSpace(r) && r != ' ' {
+				return ' '
+			}
+			return r
+		}, s)
+	}
+	if _, err := fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%s\n", path, part.MediaType,
+		field(part.Filename), size, field(part.Encoding)); err != nil {
+		return err
+	}
+	for _, child := range part.Parts {
+		if err := writePartList(w, child); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+// Copyright 2022 Daniel Erat.
+// All rights reserved.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"github.com/derat/rendmail/rewrite"
+)
+
+func TestInspectMessage(t *testing.T) {
+	const msg = "Authentication-Results: mx.example.org; dkim=pass\n" +
+		"Content-Type: multipart/mixed; boundary=abc\n" +
+		"\n" +
+		"--abc\n" +
+		"Content-Type: text/plain\n" +
+		"\n" +
+		"Hello\n" +
+		"--abc\n" +
+		"Content-Type: application/octet-stream\n" +
+		"Content-Disposition: attachment; filename*=UTF-8''caf%C3%A9.bin\n" +
+		"Content-Transfer-Encoding: base64\n" +
+		"\n" +
+		"AAECAw==\n" +
+		"--abc\n" +
+		"Content-Type: image/png; name=\"=?utf-8?q?x=5Fy.png?=\"\n" +
+		"Content-Transfer-Encoding: base64\n" +
+		"\n" +
+		"!!!\n" +
+		"--abc--\n"
+
+	for _, tc := range []struct {
+		when string
+		want string
+	}{
+		{"any", `{"path":"","mediaType":"multipart/mixed","params":{"boundary":"abc"},` +
+			`"headerOffset":0,"bodyOffset":95,"encodedSize":298,"decodedSize":298,"delete":false,"parts":[` +
+			`{"path":"1","mediaType":"text/plain","headerOffset":101,"bodyOffset":127,"encodedSize":5,"decodedSize":5,"delete":false},` +
+			`{"path":"2","mediaType":"application/octet-stream","disposition":"attachment","filename":"café.bin",` +
+			`"encoding":"base64","headerOffset":139,"bodyOffset":277,"encodedSize":8,"decodedSize":4,"delete":true},` +
+			`{"path":"3","mediaType":"image/png","params":{"name":"=?utf-8?q?x=5Fy.png?="},"filename":"x_y.png",` +
+			`"encoding":"base64","headerOffset":292,"bodyOffset":381,"encodedSize":3,"delete":false}]}`},
+		{"fail", `{"path":"","mediaType":"multipart/mixed","params":{"boundary":"abc"},` +
+			`"headerOffset":0,"bodyOffset":95,"encodedSize":298,"decodedSize":298,"delete":false,"parts":[` +
+			`{"path":"1","mediaType":"text/plain","headerOffset":101,"bodyOffset":127,"encodedSize":5,"decodedSize":5,"delete":false},` +
+			`{"path":"2","mediaType":"application/octet-stream","disposition":"attachment","filename":"café.bin",` +
+			`"encoding":"base64","headerOffset":139,"bodyOffset":277,"encodedSize":8,"decodedSize":4,"delete":false},` +
+			`{"path":"3","mediaType":"image/png","params":{"name":"=?utf-8?q?x=5Fy.png?="},"filename":"x_y.png",` +
+			`"encoding":"base64","headerOffset":292,"bodyOffset":381,"encodedSize":3,"delete":false}]}`},
+	} {
+		opts := rewrite.Options{
+			DeleteMediaTypes: []string{"application/*"},
+			WhenAuth:         tc.when,
+		}
+		part, err := inspectMessage([]byte(msg), &opts)
+		if err != nil {
+			t.Errorf("inspectMessage (when %q) failed: %v", tc.when, err)
+			continue
+		}
+		b, err := json.Marshal(part)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := string(b); got != tc.want {
+			t.Errorf("inspectMessage (when %q) = %s; want %s", tc.when, got, tc.want)
+		}
+	}
+}
+
+func TestWritePartList(t *testing.T) {
+	n := 4
+	part := &inspectPart{
+		MediaType:   "multipart/mixed",
+		EncodedSize: 120,
+		Parts: []*inspectPart{
+			{Path: "1", MediaType: "text/plain", EncodedSize: 6},
+			{Path: "2", MediaType: "application/octet-stream", Filename: "a\tb.bin",
+				Encoding: "base64", EncodedSize: 8, DecodedSize: &n},
+		},
+	}
+	var b bytes.Buffer
+	if err := writePartList(&b, part); err != nil {
+		t.Fatal("writePartList failed:", err)
+	}
+	const want = "0\tmultipart/mixed\t-\t120\t-\n" +
+		"1\ttext/plain\t-\t6\t-\n" +
+		"2\tapplication/octet-stream\ta b.bin\t4\tbase64\n"
+	if got := b.String(); got != want {
+		t.Errorf("writePartList wrote %q; want %q", got, want)
+	}
+}
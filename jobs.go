@@ -0,0 +1,139 @@
+// Copyright 2022 Daniel Erat.
+// All rights reserved.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"time"
+)
+
+// orderedPool runs functions concurrently and passes their results to a callback
+// in the order in which the functions were added. The number of pending results
+// is bounded so memory usage stays limited when processing large batches.
+type orderedPool struct {
+	sem     chan struct{}               // limits the number of running functions
+	pending []chan interface{}          // results in the order in which they were added
+	done    func(res interface{}) error // called by add and wait for each result
+	err     error                       // first error returned by done
+}
+
+// newOrderedPool returns a pool that runs up to jobs functions at once and passes
+// their results to done, which is always called from the goroutine calling add or wait.
+func newOrderedPool(jobs int, done func(res interface{}) error) *orderedPool {
+	if jobs < 1 {
+		jobs = 1
+	}
+	return &orderedPool{sem: make(chan struct{}, jobs), done: done}
+}
+
+// add runs fn in a new goroutine. If too many results are pending, add first waits for
+// the oldest one. The first error returned by done is returned, after which no more
+// functions are run.
+func (p *orderedPool) add(fn func() interface{}) error {
+	for p.err == nil && len(p.pending) >= 2*cap(p.sem) {
+		p.finishOldest()
+	}
+	if p.err != nil {
+		return p.err
+	}
+	ch := make(chan interface{}, 1)
+	p.pending = append(p.pending, ch)
+	go func() {
+		p.sem <- struct{}{}
+		ch <- fn()
+		<-p.sem
+	}()
+	return nil
+}
+
+// wait waits for all pending results and returns the first error returned by done.
+func (p *orderedPool) wait() error {
+	for len(p.pending) > 0 {
+		p.finishOldest()
+	}
+	return p.err
+}
+
+// finishOldest waits for the oldest pending result and passes it to p.done.
+func (p *orderedPool) finishOldest() {
+	res := <-p.pending[0]
+	p.pending = p.pending[1:]
+	if p.err == nil {
+		p.err = p.done(res)
+	}
+}
+
+// progressInterval is the minimum interval between lines written by batchProgress.
+const progressInterval = 2 * time.Second
+
+// batchProgress writes periodic progress updates and a final summary while a batch
+// of messages is processed. All methods are no-ops if w is nil.
+type batchProgress struct {
+	w     io.Writer // destination for updates, or nil
+	total int       // total number of messages, or 0 if unknown
+
+	start, last            time.Time
+	done, modified, failed int
+	tempFailed             int // failures for which tempRewriteError returned true
+}
+
+// newBatchProgress returns a batchProgress that writes to w (which may be nil)
+// for a batch of total messages (0 if unknown).
+func newBatchProgress(w io.Writer, total int) *batchProgress {
+	now := time.Now()
+	return &batchProgress{w: w, total: total, start: now, last: now}
+}
+
+// update records that a message was processed (unsuccessfully if err is non-nil) and
+// writes a progress line if enough time has passed since the last one.
+func (p *batchProgress) update(modified bool, err error) {
+	p.done++
+	if modified {
+		p.modified++
+	}
+	if err != nil {
+		p.failed++
+		if tempRewriteError(err) {
+			p.tempFailed++
+		}
+	}
+	if p.w == nil {
+		return
+	}
+	if now := time.Now(); now.Sub(p.last) >= progressInterval {
+		p.last = now
+		if p.total > 0 {
+			fmt.Fprintf(p.w, "Processed %d of %d message(s) (%d%%)\n", p.done, p.total, 100*p.done/p.total)
+		} else {
+			fmt.Fprintf(p.w, "Processed %d message(s)\n", p.done)
+		}
+	}
+}
+
+// failure returns a *batchError with the supplied message if any messages failed,
+// or nil otherwise.
+func (p *batchProgress) failure(format string, args ...interface{}) error {
+	if p.failed == 0 {
+		return nil
+	}
+	return &batchError{fmt.Sprintf(format, args...), p.tempFailed == p.failed}
+}
+
+// batchError is returned when one or more messages in a batch couldn't be rewritten.
+type batchError struct {
+	msg  string
+	temp bool // all failures were temporary (see tempRewriteError)
+}
+
+func (e *batchError) Error() string { return e.msg }
+
+// finish writes a summary line.
+func (p *batchProgress) finish() {
+	if p.w == nil {
+		return
+	}
+	fmt.Fprintf(p.w, "Processed %d message(s) in %v: %d modified, %d failed\n",
+		p.done, time.Since(p.start).Round(time.Millisecond), p.modified, p.failed)
+}
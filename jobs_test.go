@@ -0,0 +1,75 @@
+// Copyright 2022 Daniel Erat.
+// All rights reserved.
+
+package main
+
+import (
+	"errors"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestOrderedPool(t *testing.T) {
+	const (
+		jobs  = 3
+		items = 20
+	)
+	var running, maxRunning int32
+	var got []int
+	pool := newOrderedPool(jobs, func(res interface{}) error {
+		got = append(got, res.(int))
+		return nil
+	})
+	var want []int
+	for i := 0; i < items; i++ {
+		i := i
+		want = append(want, i)
+		if err := pool.add(func() interface{} {
+			n := atomic.AddInt32(&running, 1)
+			for {
+				max := atomic.LoadInt32(&maxRunning)
+				if n <= max || atomic.CompareAndSwapInt32(&maxRunning, max, n) {
+					break
+				}
+			}
+			// Make earlier functions finish later.
+			time.Sleep(time.Duration(items-i) * time.Millisecond)
+			atomic.AddInt32(&running, -1)
+			return i
+		}); err != nil {
+			t.Fatal("add failed:", err)
+		}
+	}
+	if err := pool.wait(); err != nil {
+		t.Fatal("wait failed:", err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Got results %v; want %v", got, want)
+	}
+	if maxRunning > jobs {
+		t.Errorf("%d functions ran concurrently; want at most %d", maxRunning, jobs)
+	}
+
+	// The first error returned by the callback should be returned and stop the pool.
+	errDone := errors.New("done failed")
+	var calls int
+	pool = newOrderedPool(2, func(res interface{}) error {
+		calls++
+		return errDone
+	})
+	var err error
+	for i := 0; i < items && err == nil; i++ {
+		err = pool.add(func() interface{} { return nil })
+	}
+	if werr := pool.wait(); werr != errDone {
+		t.Errorf("wait returned %v; want %v", werr, errDone)
+	}
+	if err != errDone {
+		t.Errorf("add returned %v; want %v", err, errDone)
+	}
+	if calls != 1 {
+		t.Errorf("Callback was called %d times; want 1", calls)
+	}
+}
@@ -0,0 +1,174 @@
+// Copyright 2022 Daniel Erat.
+// All rights reserved.
+
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"time"
+
+	"github.com/derat/rendmail/rewrite"
+)
+
+// ldaMain implements the "lda" subcommand using the supplied command-line
+// arguments. The process's exit code is returned.
+//
+// The subcommand is intended to be used in place of dovecot-lda, e.g. as Postfix's
+// mailbox_command or as a Dovecot Sieve filter program. Since it's responsible for
+// final delivery, it follows dovecot-lda's exit semantics: if rendmail fails to rewrite
+// the message, the original message is delivered instead, and failures that could
+// result in a lost message produce EX_TEMPFAIL so the MTA will retry later.
+func ldaMain(args []string) int {
+	opts := rewrite.Options{Now: time.Now()}
+	fs := flag.NewFlagSet("lda", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s lda [-lda=PATH] [-d USER] [flag]... [-- LDA-ARG...]\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Rewrites a message from stdin and passes it to dovecot-lda (or stdout).\n")
+		fmt.Fprintf(os.Stderr, "Additional arguments are passed to dovecot-lda.\n\n")
+		fs.PrintDefaults()
+	}
+	ldaPath := fs.String("lda", "", "dovecot-lda executable to run with the rewritten message (e.g. /usr/lib/dovecot/dovecot-lda);\n"+
+		"if empty, the message is written to stdout")
+	user := fs.String("d", "", "Destination user (passed to -lda)")
+	from := fs.String("f", "", "Envelope sender address (passed to -lda)")
+	rcpt := fs.String("a", "", "Original envelope recipient address (passed to -lda)")
+	mailbox := fs.String("m", "", "Destination mailbox (passed to -lda)")
+	var bk backupOptions
+	addBackupFlags(fs, &bk)
+	rf := addRewriteFlags(fs, &opts)
+	fs.Parse(args)
+
+	// Flag errors are treated as temporary since they're presumably caused by a
+	// misconfiguration that will be fixed.
+	if err := rf.finish(&opts); err != nil {
+		fmt.Fprintln(os.Stderr, "Invalid flags:", err)
+		return exitTempFail
+	}
+	if *ldaPath == "" && fs.NArg() > 0 {
+		fmt.Fprintln(os.Stderr, "Arguments can only be passed with -lda")
+		return exitTempFail
+	}
+	if err := bk.check(); err != nil {
+		fmt.Fprintln(os.Stderr, "Invalid flags:", err)
+		return exitTempFail
+	}
+	if *user != "" {
+		opts.Log = rewrite.LoggerWith(opts.Log, "user", *user)
+	}
+
+	orig, err := ioutil.ReadAll(os.Stdin)
+	if err != nil {
+		opts.Logger().Errorf("Failed reading message: %v", err)
+		return exitTempFail
+	}
+	var bw backupWriter   // uncommitted backup
+	var cw backupWriter   // bw, retained after it's committed
+	var backupPath string // committed backup
+	if bk.enabled() {
+		if bw, err = bk.create(opts.Now); bk.skipBackup(err) {
+			opts.Logger().Warningf("Skipping backup: %v", err)
+			opts.BackupWarning = backupSkippedWarning
+		} else if err != nil {
+			opts.Logger().Errorf("Failed creating backup: %v", err)
+			return exitTempFail
+		}
+	}
+	if bw != nil {
+		cw = bw
+		if bk.record {
+			opts.BackupRecord = bk.recordValue(bw.path(), orig)
+		}
+		if !bk.deferred() {
+			backupPath, err = writeBackup(bw, orig)
+			bw = nil // committed or aborted
+			if err != nil {
+				opts.Logger().Errorf("Failed saving backup: %v", err)
+				return exitTempFail
+			}
+		}
+	}
+
+	msg := orig
+	var rewritten []byte // nil if rewriting failed
+	var changed bool
+	var b bytes.Buffer
+	rep, err := rewrite.Rewrite(bytes.NewReader(orig), &b, &opts)
+	if err != nil {
+		opts.Logger().Warningf("Failed rewriting message; delivering original: %v", err)
+	} else if changed, err = rewriteChanged(orig, b.Bytes(), &opts); err != nil {
+		opts.Logger().Warningf("Failed comparing message; delivering original: %v", err)
+	} else {
+		msg, rewritten = b.Bytes(), b.Bytes()
+	}
+	if bw != nil {
+		if backupPath, err = bk.finish(bw, orig, orig, rewritten, changed); err != nil {
+			opts.Logger().Errorf("Failed saving backup: %v", err)
+			return exitTempFail
+		}
+	}
+	if backupPath != "" {
+		if err := bk.addToIndex(newBackupIndexEntry(backupPath, cw, orig, len(msg), &opts, rep)); err != nil {
+			opts.Logger().Errorf("Failed updating backup index: %v", err)
+			return exitTempFail
+		}
+	}
+
+	if *ldaPath == "" {
+		if _, err := os.Stdout.Write(msg); err != nil {
+			opts.Logger().Errorf("Failed writing message: %v", err)
+			return exitTempFail
+		}
+		return 0
+	}
+
+	code, err := runLDA(*ldaPath, ldaArgs(*user, *from, *rcpt, *mailbox, fs.Args()), msg)
+	if err != nil {
+		opts.Logger().Errorf("Failed running %v: %v", *ldaPath, err)
+		return exitTempFail
+	}
+	if code != 0 {
+		opts.Logger().Warningf("%v exited with %d", *ldaPath, code)
+	} else {
+		opts.Logger().Infof("Delivered message via %v", *ldaPath)
+	}
+	return code
+}
+
+// ldaArgs returns arguments for dovecot-lda. Empty values are omitted
+// and extra is appended.
+func ldaArgs(user, from, rcpt, mailbox string, extra []string) []string {
+	var args []string
+	for _, a := range []struct{ flag, val string }{
+		{"-d", user},
+		{"-f", from},
+		{"-a", rcpt},
+		{"-m", mailbox},
+	} {
+		if a.val != "" {
+			args = append(args, a.flag, a.val)
+		}
+	}
+	return append(args, extra...)
+}
+
+// runLDA runs the executable at path with args and writes msg to its stdin.
+// The process's exit code is returned. An error is only returned if the
+// process couldn't be started or was killed by a signal.
+func runLDA(path string, args []string, msg []byte) (int, error) {
+	cmd := exec.Command(path, args...)
+	cmd.Stdin = bytes.NewReader(msg)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		if ee, ok := err.(*exec.ExitError); ok && ee.ExitCode() >= 0 {
+			return ee.ExitCode(), nil
+		}
+		return 0, err
+	}
+	return 0, nil
+}
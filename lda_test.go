@@ -0,0 +1,56 @@
+// Copyright 2022 Daniel Erat.
+// All rights reserved.
+
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+func TestLDAArgs(t *testing.T) {
+	for _, tc := range []struct {
+		user, from, rcpt, mailbox string
+		extra                     []string
+		want                      []string
+	}{
+		{"", "", "", "", nil, nil},
+		{"me", "", "", "", nil, []string{"-d", "me"}},
+		{"me", "a@example.org", "b@example.org", "Lists", []string{"-c", "cfg"},
+			[]string{"-d", "me", "-f", "a@example.org", "-a", "b@example.org", "-m", "Lists", "-c", "cfg"}},
+	} {
+		if got := ldaArgs(tc.user, tc.from, tc.rcpt, tc.mailbox, tc.extra); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("ldaArgs(%q, %q, %q, %q, %q) = %q; want %q",
+				tc.user, tc.from, tc.rcpt, tc.mailbox, tc.extra, got, tc.want)
+		}
+	}
+}
+
+func TestRunLDA(t *testing.T) {
+	td := t.TempDir()
+	p := filepath.Join(td, "msg")
+	const msg = "Subject: Hi\r\n\r\nBody\r\n"
+	for _, code := range []int{0, 67, 75} {
+		script := "cat >" + p + "; exit " + strconv.Itoa(code)
+		got, err := runLDA("sh", []string{"-c", script}, []byte(msg))
+		if err != nil {
+			t.Errorf("runLDA with exit %d failed: %v", code, err)
+			continue
+		}
+		if got != code {
+			t.Errorf("runLDA returned %d; want %d", got, code)
+		}
+		if b, err := ioutil.ReadFile(p); err != nil {
+			t.Error(err)
+		} else if string(b) != msg {
+			t.Errorf("runLDA wrote %q; want %q", b, msg)
+		}
+	}
+
+	if _, err := runLDA(filepath.Join(td, "missing"), nil, []byte(msg)); err == nil {
+		t.Error("runLDA with missing executable unexpectedly succeeded")
+	}
+}
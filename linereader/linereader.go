@@ -0,0 +1,419 @@
+// Copyright 2022 Daniel Erat.
+// All rights reserved.
+
+// Package linereader reads email messages line-by-line with optional limits
+// on line lengths.
+//
+// Lines may be terminated by "\r\n" or "\n", and the two may be mixed within
+// a message. Input that doesn't contain any "\n" characters (e.g. messages
+// from classic Mac OS) is instead split at bare "\r" terminators. Bare CRs
+// in other input are treated as ordinary characters so that a stray CR
+// (e.g. within a header field) doesn't split a line. Terminators are always
+// returned unchanged.
+package linereader
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+)
+
+var (
+	// ErrLineTooLong is returned by Reader when a line exceeds MaxLineLength.
+	ErrLineTooLong = errors.New("linereader: line too long")
+	// ErrUnfoldedTooLong is returned by ReadFoldedLine when an unfolded line
+	// exceeds MaxUnfoldedLength.
+	ErrUnfoldedTooLong = errors.New("linereader: unfolded line too long")
+)
+
+// Reader reads an email message line-by-line.
+//
+// Its functionality is similar to the ReadLine and ReadContinuedLine
+// functions from Reader in the net/textproto, except it additionally returns
+// the original data to callers.
+type Reader struct {
+	// MaxLineLength is the maximum length of a line in bytes, excluding its
+	// terminating "\r\n", "\n", or "\r". If zero, lines may be arbitrarily long.
+	//
+	// RFC 5322 2.1.1 "Line Length Limits":
+	//  There are two limits that this specification places on the number of
+	//  characters in a line.  Each line of characters MUST be no more than
+	//  998 characters, and SHOULD be no more than 78 characters, excluding
+	//  the CRLF.
+	MaxLineLength int
+	// MaxUnfoldedLength is the maximum length in bytes of an unfolded line
+	// returned by ReadFoldedLine. If zero, unfolded lines may be arbitrarily long.
+	//
+	// RFC 5322 2.2.3 doesn't impose any limit:
+	//  An unfolded header field has no length restriction and therefore
+	//  may be indeterminately long.
+	MaxUnfoldedLength int
+
+	r         *bufio.Reader
+	buf       []byte // reused for lines that don't fit in r's buffer
+	line      int    // number of lines read
+	lineStart int64  // byte offset of the start of the last line read
+	off       int64  // number of bytes read
+	crMode    int8   // 1 if bare CRs terminate lines, -1 if not, 0 if undecided
+}
+
+// bufferSize is the size of the buffer used to read data.
+const bufferSize = 64 * 1024
+
+// New returns a Reader that reads from r.
+func New(r io.Reader) *Reader {
+	return &Reader{r: bufio.NewReaderSize(r, bufferSize)}
+}
+
+// maxRetainedSize is the largest line buffer retained by Reset.
+const maxRetainedSize = 1024 * 1024
+
+// Reset discards r's state (including its limits) and makes it read from rd.
+// Buffers are retained so that Readers can be reused without new allocations.
+func (r *Reader) Reset(rd io.Reader) {
+	r.r.Reset(rd)
+	buf := r.buf
+	if cap(buf) > maxRetainedSize {
+		buf = nil
+	}
+	*r = Reader{r: r.r, buf: buf[:0]}
+}
+
+// BareCR returns true if bare CRs are treated as line terminators, i.e. if
+// the start of the input (up to the buffer size) contains CRs but no LFs.
+// The decision is made when this method or a method that reads lines is first
+// called and is retained until Reset is called.
+func (r *Reader) BareCR() bool {
+	if r.crMode == 0 {
+		buf, _ := r.r.Peek(r.r.Size())
+		if bytes.IndexByte(buf, '\n') < 0 && bytes.IndexByte(buf, '\r') >= 0 {
+			r.crMode = 1
+		} else {
+			r.crMode = -1
+		}
+	}
+	return r.crMode > 0
+}
+
+// Line returns the number of lines that have been read.
+func (r *Reader) Line() int { return r.line }
+
+// LineStart returns the byte offset of the start of the last line that was read.
+func (r *Reader) LineStart() int64 { return r.lineStart }
+
+// Offset returns the number of bytes that have been read.
+func (r *Reader) Offset() int64 { return r.off }
+
+// Peek returns up to the next n bytes without consuming them. Fewer bytes are
+// returned if EOF is reached or if n exceeds the buffer size. The returned slice
+// is only valid until the next call to a Reader method.
+func (r *Reader) Peek(n int) []byte {
+	if n > r.r.Size() {
+		n = r.r.Size()
+	}
+	b, _ := r.r.Peek(n)
+	return b
+}
+
+// Read reads unprocessed data, e.g. to copy the remainder of a message.
+// Lines read via Read aren't counted by Line.
+func (r *Reader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.off += int64(n)
+	return n, err
+}
+
+// ReadLine reads and returns a single line terminated by "\n" (or by a bare "\r"
+// if BareCR returns true).
+//
+// The terminator is included in the returned string.
+//
+// If one or more bytes are read but EOF is encountered before
+// a terminator, then the data and nil are returned. If EOF is
+// encountered before reading any bytes, than io.EOF is returned.
+//
+// If the line exceeds MaxLineLength, ErrLineTooLong is returned and
+// the line's remaining data is left unread.
+func (r *Reader) ReadLine() (string, error) {
+	ln, err := r.ReadLineBytes()
+	return string(ln), err
+}
+
+// ReadLineBytes is like ReadLine but returns a byte slice to avoid allocating
+// a string for each line. The slice is only valid until the next call to a
+// Reader method.
+func (r *Reader) ReadLineBytes() ([]byte, error) {
+	start := r.off
+	ln, err := r.readSlice()
+	r.off += int64(len(ln))
+	if err == bufio.ErrBufferFull {
+		// The line didn't fit in r.r's buffer, so accumulate it in r.buf instead.
+		r.buf = append(r.buf[:0], ln...)
+		for err == bufio.ErrBufferFull {
+			// Allow room for a CRLF split across reads.
+			if r.MaxLineLength > 0 && len(r.buf) > r.MaxLineLength+2 {
+				r.line++
+				r.lineStart = start
+				return nil, ErrLineTooLong
+			}
+			var frag []byte
+			frag, err = r.readSlice()
+			r.off += int64(len(frag))
+			r.buf = append(r.buf, frag...)
+		}
+		ln = r.buf
+	}
+	if len(ln) > 0 {
+		r.line++
+		r.lineStart = start
+		if r.MaxLineLength > 0 && len(trimCRLF(ln)) > r.MaxLineLength {
+			return nil, ErrLineTooLong
+		}
+		if err == io.EOF {
+			err = nil
+		}
+	}
+	return ln, err
+}
+
+// readSlice is like bufio.Reader.ReadSlice('\n'), but it also stops after a bare CR
+// if BareCR returns true. In that case, if the buffer fills with a trailing CR, the
+// CR is left unread so that it can be examined along with the following byte.
+func (r *Reader) readSlice() ([]byte, error) {
+	if !r.BareCR() {
+		return r.r.ReadSlice('\n')
+	}
+	for searched := 0; ; {
+		buf, _ := r.r.Peek(r.r.Buffered())
+		if i := indexTerminator(buf, searched); i >= 0 {
+			r.r.Discard(i + 1)
+			return buf[:i+1], nil
+		}
+		if len(buf) == r.r.Size() {
+			n := len(buf)
+			if buf[n-1] == '\r' {
+				n--
+			}
+			r.r.Discard(n)
+			return buf[:n], bufio.ErrBufferFull
+		}
+		// Read more data, keeping a trailing CR in the region that's searched next.
+		if searched = len(buf) - 1; searched < 0 {
+			searched = 0
+		}
+		if _, err := r.r.Peek(len(buf) + 1); err != nil {
+			buf, _ = r.r.Peek(r.r.Buffered())
+			r.r.Discard(len(buf))
+			return buf, err
+		}
+	}
+}
+
+// indexTerminator returns the index of the first "\n" or bare "\r" in buf at or after start,
+// or -1 if there isn't one. A CR at the end of buf isn't reported, since it may be
+// followed by a LF that hasn't been read yet.
+func indexTerminator(buf []byte, start int) int {
+	nl := bytes.IndexByte(buf[start:], '\n')
+	end := len(buf)
+	if nl >= 0 {
+		nl += start
+		end = nl
+	}
+	for i := start; i < end; {
+		j := bytes.IndexByte(buf[i:end], '\r')
+		if j < 0 {
+			break
+		}
+		if i += j; i+1 < len(buf) && buf[i+1] != '\n' {
+			return i
+		}
+		i++
+	}
+	return nl
+}
+
+// lastLineStart returns the index of the start of the last line in chunk,
+// which must end with a terminator. Bare CRs are only terminators if cr is true.
+func lastLineStart(chunk []byte, cr bool) int {
+	for i := len(chunk) - 2; i >= 0; i-- {
+		if chunk[i] == '\n' || cr && chunk[i] == '\r' && chunk[i+1] != '\n' {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+// countLines returns the number of terminators in chunk, which must end with a terminator.
+// Bare CRs are only counted if cr is true.
+func countLines(chunk []byte, cr bool) int {
+	n := bytes.Count(chunk, []byte{'\n'})
+	for i := 0; cr && i < len(chunk); {
+		j := bytes.IndexByte(chunk[i:], '\r')
+		if j < 0 {
+			break
+		}
+		if i += j; i == len(chunk)-1 || chunk[i+1] != '\n' {
+			n++
+		}
+		i++
+	}
+	return n
+}
+
+// CopyUntilPrefix copies lines to w until it reads a line starting with prefix,
+// which is returned without being written. The returned slice is only valid until
+// the next call to a Reader method. If EOF is encountered first (or if prefix is empty),
+// all remaining data is copied and io.EOF is returned.
+//
+// This is equivalent to calling ReadLineBytes repeatedly but is much faster, since
+// buffered data is searched for prefix and copied in chunks rather than line-by-line.
+func (r *Reader) CopyUntilPrefix(w io.Writer, prefix []byte) ([]byte, error) {
+	for {
+		// Line lengths can only be checked by reading individual lines.
+		if r.MaxLineLength > 0 {
+			if ln, err := r.copyLine(w, prefix); ln != nil || err != nil {
+				return ln, err
+			}
+			continue
+		}
+
+		// We're always at the start of a line here.
+		if _, err := r.r.Peek(1); err != nil {
+			return nil, err
+		}
+		cr := r.BareCR()
+		buf, _ := r.r.Peek(r.r.Buffered())
+		var chunk []byte
+		if len(prefix) == 0 || (len(buf) > len(prefix) && !bytes.HasPrefix(buf, prefix)) {
+			if i := indexLinePrefix(buf, prefix, cr); i > 0 {
+				chunk = buf[:i] // copy up to the matching line
+			} else if j := lastTerminator(buf, cr); j >= 0 {
+				chunk = buf[:j+1] // no match, so copy all complete lines
+			}
+		}
+		if chunk == nil {
+			// The buffered data either starts with a potential match or doesn't
+			// contain a complete line, so fall back to reading a single line.
+			if ln, err := r.copyLine(w, prefix); ln != nil || err != nil {
+				return ln, err
+			}
+			continue
+		}
+
+		if _, err := w.Write(chunk); err != nil {
+			return nil, err
+		}
+		r.line += countLines(chunk, cr)
+		r.lineStart = r.off + int64(lastLineStart(chunk, cr))
+		r.off += int64(len(chunk))
+		r.r.Discard(len(chunk))
+	}
+}
+
+// indexLinePrefix returns the index of the first line after the start of buf that
+// begins with prefix, or -1 if no such line is present (or prefix is empty).
+// Lines may also start after bare CRs if cr is true.
+//
+// Searching for prefix rather than for newlines is much faster when prefix is
+// a boundary delimiter, since delimiters start with "--" and typically only
+// appear at the starts of lines.
+func indexLinePrefix(buf, prefix []byte, cr bool) int {
+	if len(prefix) == 0 {
+		return -1
+	}
+	for start := 1; start < len(buf); {
+		i := bytes.Index(buf[start:], prefix)
+		if i < 0 {
+			return -1
+		}
+		// The prefix doesn't start with '\n', so a preceding CR must be a bare terminator.
+		if i += start; buf[i-1] == '\n' || cr && buf[i-1] == '\r' {
+			return i
+		}
+		start = i + 1
+	}
+	return -1
+}
+
+// lastTerminator returns the index of the last "\n" (or bare "\r" if cr is true) in buf,
+// or -1 if there isn't one. As in indexTerminator, a CR at the end of buf isn't reported.
+func lastTerminator(buf []byte, cr bool) int {
+	for i := len(buf) - 1; i >= 0; i-- {
+		if buf[i] == '\n' || cr && buf[i] == '\r' && i+1 < len(buf) && buf[i+1] != '\n' {
+			return i
+		}
+	}
+	return -1
+}
+
+// copyLine reads a single line. If it starts with a non-empty prefix, it's returned.
+// Otherwise, it's written to w and nil is returned.
+func (r *Reader) copyLine(w io.Writer, prefix []byte) ([]byte, error) {
+	ln, err := r.ReadLineBytes()
+	if err != nil {
+		return nil, err
+	}
+	if len(prefix) > 0 && bytes.HasPrefix(ln, prefix) {
+		return ln, nil
+	}
+	_, err = w.Write(ln)
+	return nil, err
+}
+
+// ReadFoldedLine reads and returns a possibly-folded line.
+//
+// See RFC 5322 2.2.3, "Long Header Fields", for more details about folding.
+// This function is similar to ReadContinuedLine from Reader in net/textproto.
+//
+// The folded return value contains all of the original lines, including
+// terminating "\r\n", "\n", or bare "\r" suffixes if present.
+//
+// The unfolded return value contains the unfolded line, i.e. with all
+// terminating suffixes removed.
+//
+// If the unfolded line exceeds MaxUnfoldedLength, ErrUnfoldedTooLong is returned.
+func (r *Reader) ReadFoldedLine() (folded []string, unfolded string, err error) {
+	first, err := r.ReadLine()
+	if err != nil {
+		return nil, "", err
+	}
+	folded = append(folded, first)
+	unfolded = string(trimCRLF([]byte(first)))
+	if len(unfolded) == 0 {
+		return folded, unfolded, nil
+	}
+
+	for {
+		if r.MaxUnfoldedLength > 0 && len(unfolded) > r.MaxUnfoldedLength {
+			return nil, "", ErrUnfoldedTooLong
+		}
+		if next, err := r.r.Peek(1); err == io.EOF {
+			return folded, unfolded, nil // input ends after newline
+		} else if err != nil {
+			return nil, "", err
+		} else if next[0] != ' ' && next[0] != '\t' {
+			return folded, unfolded, nil // next line isn't a continuation
+		}
+
+		ln, err := r.ReadLine()
+		if err != nil {
+			return nil, "", err
+		}
+		folded = append(folded, ln)
+		unfolded += string(trimCRLF([]byte(ln)))
+	}
+}
+
+// trimCRLF trims a trailing "\r\n" (or just "\n" or "\r") from ln.
+func trimCRLF(ln []byte) []byte {
+	if len(ln) > 0 && ln[len(ln)-1] == '\n' {
+		ln = ln[:len(ln)-1]
+		if len(ln) > 0 && ln[len(ln)-1] == '\r' {
+			ln = ln[:len(ln)-1]
+		}
+	} else if len(ln) > 0 && ln[len(ln)-1] == '\r' {
+		ln = ln[:len(ln)-1]
+	}
+	return ln
+}
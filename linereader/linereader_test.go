@@ -0,0 +1,253 @@
+// Copyright 2022 Daniel Erat.
+// All rights reserved.
+
+package linereader
+
+import (
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestReader_ReadLine(t *testing.T) {
+	const eof = "EOF"
+	const tooLong = "TOO LONG"
+	for _, tc := range []struct {
+		in   string
+		max  int
+		want []string // or eof for empty line and io.EOF, or tooLong for ErrLineTooLong
+	}{
+		{"", 0, []string{eof}},
+		{"abc\r\ndef\r\n", 0, []string{"abc\r\n", "def\r\n", eof}},
+		{"abc\ndef", 0, []string{"abc\n", "def", eof}},
+		{"abc\r\ndef\n", 3, []string{"abc\r\n", "def\n", eof}},
+		{"abc\nabcd\n", 3, []string{"abc\n", tooLong}},
+		{"abcd", 3, []string{tooLong}},
+		{strings.Repeat("a", 10000) + "\n", 9999, []string{tooLong}},
+		{strings.Repeat("a", 10000) + "\r\n", 10000, []string{strings.Repeat("a", 10000) + "\r\n", eof}},
+		// Bare CRs are only terminators if the input doesn't contain any LFs.
+		{"abc\rdef\r", 0, []string{"abc\r", "def\r", eof}},
+		{"abc\r\rdef", 0, []string{"abc\r", "\r", "def", eof}},
+		{"abc\rdef\r", 3, []string{"abc\r", "def\r", eof}},
+		{"abcd\r", 3, []string{tooLong}},
+		{"abc\rdef\r\nghi\n\r\r\n", 0, []string{"abc\rdef\r\n", "ghi\n", "\r\r\n", eof}},
+		{"abc\rdef\n", 3, []string{tooLong}},
+		// Check terminators at the end of the buffer.
+		{strings.Repeat("a", bufferSize-1) + "\rb\r", 0, []string{strings.Repeat("a", bufferSize-1) + "\r", "b\r", eof}},
+		{strings.Repeat("a", bufferSize-1) + "\r\nb", 0, []string{strings.Repeat("a", bufferSize-1) + "\r\n", "b", eof}},
+		{strings.Repeat("a", bufferSize+1) + "\rb\n", 0, []string{strings.Repeat("a", bufferSize+1) + "\rb\n", eof}},
+	} {
+		r := New(strings.NewReader(tc.in))
+		r.MaxLineLength = tc.max
+		var got []string
+		for {
+			ln, err := r.ReadLine()
+			if err == nil {
+				got = append(got, ln)
+				continue
+			}
+			if err == io.EOF {
+				got = append(got, eof)
+			} else if err == ErrLineTooLong {
+				got = append(got, tooLong)
+			} else {
+				t.Fatalf("ReadLine() failed for %q: %v", tc.in, err)
+			}
+			break
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("ReadLine() with max %d produced %q for %q; want %q", tc.max, got, tc.in, tc.want)
+		}
+	}
+}
+
+func TestReader_ReadFoldedLine(t *testing.T) {
+	const in = "Subject: a\n b\n\tc\n" +
+		"To: d\n" +
+		"\n"
+	r := New(strings.NewReader(in))
+	folded, unfolded, err := r.ReadFoldedLine()
+	if err != nil {
+		t.Fatal("ReadFoldedLine() failed:", err)
+	}
+	if want := []string{"Subject: a\n", " b\n", "\tc\n"}; !reflect.DeepEqual(folded, want) {
+		t.Errorf("ReadFoldedLine() returned folded %q; want %q", folded, want)
+	}
+	if want := "Subject: a b\tc"; unfolded != want {
+		t.Errorf("ReadFoldedLine() returned unfolded %q; want %q", unfolded, want)
+	}
+	if r.Line() != 3 || r.LineStart() != 14 || r.Offset() != 17 {
+		t.Errorf("Line(), LineStart(), Offset() = %d, %d, %d; want 3, 14, 17",
+			r.Line(), r.LineStart(), r.Offset())
+	}
+
+	r = New(strings.NewReader(in))
+	r.MaxUnfoldedLength = 12
+	if _, _, err := r.ReadFoldedLine(); err != ErrUnfoldedTooLong {
+		t.Errorf("ReadFoldedLine() with max 12 returned %v; want %v", err, ErrUnfoldedTooLong)
+	}
+	r = New(strings.NewReader(in))
+	r.MaxUnfoldedLength = 14
+	if _, unfolded, err := r.ReadFoldedLine(); err != nil {
+		t.Errorf("ReadFoldedLine() with max 14 failed: %v", err)
+	} else if _, unfolded, err = r.ReadFoldedLine(); err != nil || unfolded != "To: d" {
+		t.Errorf("Second ReadFoldedLine() with max 14 returned %q, %v; want %q, nil", unfolded, err, "To: d")
+	}
+
+	// Lines with mixed terminators should also be handled.
+	r = New(strings.NewReader("Subject: a\r\n b\n\tc\r\nTo: d\n\n"))
+	if folded, unfolded, err := r.ReadFoldedLine(); err != nil {
+		t.Error("ReadFoldedLine() with mixed terminators failed:", err)
+	} else if want := []string{"Subject: a\r\n", " b\n", "\tc\r\n"}; !reflect.DeepEqual(folded, want) {
+		t.Errorf("ReadFoldedLine() with mixed terminators returned folded %q; want %q", folded, want)
+	} else if want := "Subject: a b\tc"; unfolded != want {
+		t.Errorf("ReadFoldedLine() with mixed terminators returned unfolded %q; want %q", unfolded, want)
+	}
+
+	// Bare CRs are terminators in CR-only input but are otherwise preserved.
+	for _, tc := range []struct {
+		in       string
+		folded   []string
+		unfolded string
+	}{
+		{"Subject: a\r b\r\tc\rTo: d\r\r", []string{"Subject: a\r", " b\r", "\tc\r"}, "Subject: a b\tc"},
+		{"Subject: a\rb\n c\nTo: d\n\n", []string{"Subject: a\rb\n", " c\n"}, "Subject: a\rb c"},
+	} {
+		r = New(strings.NewReader(tc.in))
+		if folded, unfolded, err := r.ReadFoldedLine(); err != nil {
+			t.Errorf("ReadFoldedLine() failed for %q: %v", tc.in, err)
+		} else if !reflect.DeepEqual(folded, tc.folded) || unfolded != tc.unfolded {
+			t.Errorf("ReadFoldedLine() returned %q, %q for %q; want %q, %q",
+				folded, unfolded, tc.in, tc.folded, tc.unfolded)
+		}
+	}
+}
+
+func TestReader_ReadLineBytes(t *testing.T) {
+	// Use lines longer than bufio's default buffer so r.buf is reused.
+	lines := []string{
+		strings.Repeat("a", 5000) + "\n",
+		"short\n",
+		strings.Repeat("b", 4500) + "\r\n",
+		strings.Repeat("c", 6000),
+	}
+	r := New(strings.NewReader(strings.Join(lines, "")))
+	for i, want := range lines {
+		ln, err := r.ReadLineBytes()
+		if err != nil {
+			t.Fatalf("ReadLineBytes() failed for line %d: %v", i, err)
+		}
+		if string(ln) != want {
+			t.Errorf("ReadLineBytes() returned %d-byte line %d; want %d bytes", len(ln), i, len(want))
+		}
+	}
+	if ln, err := r.ReadLineBytes(); err != io.EOF {
+		t.Errorf("ReadLineBytes() at end returned %q, %v; want EOF", ln, err)
+	}
+}
+
+func TestReader_CopyUntilPrefix(t *testing.T) {
+	for _, crOnly := range []bool{false, true} {
+		testCopyUntilPrefix(t, crOnly)
+	}
+}
+
+func testCopyUntilPrefix(t *testing.T, crOnly bool) {
+	// Build input that's larger than the buffer so matches span buffer boundaries.
+	// Lines are mostly terminated by CRLF but sometimes by LF, and some contain
+	// stray bare CRs. If crOnly is true, all lines are terminated by bare CRs instead.
+	var lines []string
+	for i := 0; len(strings.Join(lines, "")) < 3*bufferSize; i++ {
+		term := "\r\n"
+		switch {
+		case crOnly || i%11 == 4:
+			term = "\r"
+		case i%11 == 3:
+			term = "\n"
+		}
+		switch {
+		case i%997 == 0:
+			lines = append(lines, "--bound"+term)
+		case i%7 == 0:
+			lines = append(lines, "x--bound"+term) // not at start of line
+		case i%5 == 0:
+			lines = append(lines, "--boun"+term) // partial match
+		default:
+			lines = append(lines, strings.Repeat("a", i%150)+term)
+		}
+	}
+	lines = append(lines, "final line without newline")
+	in := strings.Join(lines, "")
+
+	for _, tc := range []struct {
+		prefix  string
+		maxLine int
+	}{
+		{"--bound", 0},
+		{"--bound", 1000},
+		{"--boun", 0}, // first match follows a bare CR if crOnly is false
+		{"--missing", 0},
+		{"", 0},
+	} {
+		// Compare against reading individual lines.
+		want := New(strings.NewReader(in))
+		var wantOut strings.Builder
+		var wantLn string
+		for {
+			ln, err := want.ReadLine()
+			if err != nil {
+				break
+			}
+			if tc.prefix != "" && strings.HasPrefix(ln, tc.prefix) {
+				wantLn = ln
+				break
+			}
+			wantOut.WriteString(ln)
+		}
+
+		got := New(strings.NewReader(in))
+		got.MaxLineLength = tc.maxLine
+		var gotOut strings.Builder
+		ln, err := got.CopyUntilPrefix(&gotOut, []byte(tc.prefix))
+		if wantLn == "" && err != io.EOF {
+			t.Errorf("CopyUntilPrefix(%q) with crOnly %v returned %q, %v; want EOF",
+				tc.prefix, crOnly, ln, err)
+		} else if wantLn != "" && (err != nil || string(ln) != wantLn) {
+			t.Errorf("CopyUntilPrefix(%q) with crOnly %v returned %q, %v; want %q",
+				tc.prefix, crOnly, ln, err, wantLn)
+		}
+		if gotOut.String() != wantOut.String() {
+			t.Errorf("CopyUntilPrefix(%q) with crOnly %v copied %d bytes; want %d",
+				tc.prefix, crOnly, gotOut.Len(), wantOut.Len())
+		}
+		if got.Line() != want.Line() || got.LineStart() != want.LineStart() || got.Offset() != want.Offset() {
+			t.Errorf("CopyUntilPrefix(%q) with crOnly %v left position at %d, %d, %d; want %d, %d, %d",
+				tc.prefix, crOnly, got.Line(), got.LineStart(), got.Offset(), want.Line(), want.LineStart(), want.Offset())
+		}
+	}
+}
+
+func TestReader_Reset(t *testing.T) {
+	r := New(strings.NewReader(strings.Repeat("a", 5000) + "\nabc\n"))
+	r.MaxLineLength = 10
+	if _, err := r.ReadLine(); err != ErrLineTooLong {
+		t.Fatalf("ReadLine() returned %v; want %v", err, ErrLineTooLong)
+	}
+	r.Reset(strings.NewReader(strings.Repeat("b", 5000) + "\ndef\n"))
+	if ln, err := r.ReadLine(); err != nil || ln != strings.Repeat("b", 5000)+"\n" {
+		t.Errorf("ReadLine() after Reset returned %d-byte line, %v", len(ln), err)
+	}
+	if ln, err := r.ReadLine(); err != nil || ln != "def\n" {
+		t.Errorf("ReadLine() after Reset returned %q, %v; want %q, nil", ln, err, "def\n")
+	}
+	if r.Line() != 2 || r.Offset() != 5005 {
+		t.Errorf("Line(), Offset() = %d, %d; want 2, 5005", r.Line(), r.Offset())
+	}
+
+	// Whether bare CRs are terminators should be decided again for the new input.
+	r.Reset(strings.NewReader("ghi\rjkl\r"))
+	if ln, err := r.ReadLine(); err != nil || ln != "ghi\r" {
+		t.Errorf("ReadLine() after second Reset returned %q, %v; want %q, nil", ln, err, "ghi\r")
+	}
+}
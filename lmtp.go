@@ -0,0 +1,458 @@
+// Copyright 2022 Daniel Erat.
+// All rights reserved.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/textproto"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/derat/rendmail/rewrite"
+)
+
+// serveMain implements the "serve" subcommand using the supplied command-line
+// arguments. The process's exit code is returned.
+func serveMain(args []string) int {
+	opts := rewrite.Options{Now: time.Now()}
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s serve -lmtp=ADDR [-relay-lmtp=ADDR|-relay-maildir=DIR] [flag]...\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Accepts messages via LMTP, rewrites them, and relays them.\n\n")
+		fs.PrintDefaults()
+	}
+	listenAddr := fs.String("lmtp", "", `Unix socket path or "host:port" on which to accept LMTP connections`)
+	relayLMTP := fs.String("relay-lmtp", "", `Unix socket path or "host:port" of LMTP server to relay rewritten messages to`)
+	relayMaildir := fs.String("relay-maildir", "", "Maildir to deliver rewritten messages to")
+	pprofAddr := fs.String("pprof", "", `"host:port" on which to serve net/http/pprof profiles`)
+	maxSize := fs.Int64("max-size", 64<<20, "Reject messages larger than this many bytes (0 for no limit)")
+	timeout := fs.Duration("timeout", 0, "Maximum time to spend rewriting each message (0 for no limit)")
+	rf := addRewriteFlags(fs, &opts)
+	fs.Parse(args)
+
+	if err := rf.finish(&opts); err != nil {
+		fmt.Fprintln(os.Stderr, "Invalid flags:", err)
+		return 2
+	}
+	if *listenAddr == "" {
+		fmt.Fprintln(os.Stderr, "-lmtp is required")
+		return 2
+	}
+	if (*relayLMTP == "") == (*relayMaildir == "") {
+		fmt.Fprintln(os.Stderr, "Exactly one of -relay-lmtp and -relay-maildir is required")
+		return 2
+	}
+	if *pprofAddr != "" {
+		if err := servePprof(*pprofAddr, opts.Logger()); err != nil {
+			opts.Logger().Errorf("Failed serving pprof: %v", err)
+			return 1
+		}
+	}
+
+	srv := lmtpServer{
+		opts:         &opts,
+		fakeNow:      *rf.fakeNow != "",
+		maxSize:      *maxSize,
+		relayMaildir: *relayMaildir,
+		timeout:      *timeout,
+	}
+	if *relayLMTP != "" {
+		srv.relayNet, srv.relayAddr = lmtpNetwork(*relayLMTP), *relayLMTP
+	}
+
+	network := lmtpNetwork(*listenAddr)
+	if network == "unix" {
+		// Remove a stale socket left behind by a previous instance.
+		if fi, err := os.Stat(*listenAddr); err == nil && fi.Mode()&os.ModeSocket != 0 {
+			os.Remove(*listenAddr)
+		}
+	}
+	ln, err := net.Listen(network, *listenAddr)
+	if err != nil {
+		opts.Logger().Errorf("Failed listening for LMTP connections: %v", err)
+		return 1
+	}
+	sc := make(chan os.Signal, 1)
+	signal.Notify(sc, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-sc
+		ln.Close() // also removes Unix sockets
+	}()
+
+	if err := srv.serve(ln); err != nil {
+		opts.Logger().Errorf("Failed serving LMTP: %v", err)
+		return 1
+	}
+	return 0
+}
+
+// lmtpNetwork returns the network ("unix" or "tcp") to use for addr.
+func lmtpNetwork(addr string) string {
+	if strings.Contains(addr, "/") {
+		return "unix"
+	}
+	return "tcp"
+}
+
+// lmtpServer accepts messages via LMTP (RFC 2033), rewrites them, and relays them
+// to either another LMTP server or a Maildir.
+type lmtpServer struct {
+	opts    *rewrite.Options
+	fakeNow bool          // true if opts.Now shouldn't be updated for each message
+	maxSize int64         // maximum size of received messages in bytes (0 for no limit)
+	timeout time.Duration // maximum time to spend rewriting each message (0 for no limit)
+
+	relayNet, relayAddr string // downstream LMTP server
+	relayMaildir        string // Maildir used if relayAddr is empty
+}
+
+// serve accepts and handles connections from ln until it is closed.
+func (s *lmtpServer) serve(ln net.Listener) error {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				time.Sleep(100 * time.Millisecond)
+				continue
+			}
+			if isClosedError(err) {
+				return nil
+			}
+			return err
+		}
+		go s.handle(conn)
+	}
+}
+
+// isClosedError returns true if err was returned because a listener was closed.
+func isClosedError(err error) bool {
+	// net.ErrClosed was only added in Go 1.16.
+	return strings.Contains(err.Error(), "use of closed network connection")
+}
+
+// handle runs an LMTP session on conn.
+func (s *lmtpServer) handle(conn net.Conn) {
+	tc := textproto.NewConn(conn)
+	defer tc.Close()
+
+	host, _ := os.Hostname()
+	tc.PrintfLine("220 %s LMTP rendmail ready", host)
+
+	var greeted bool
+	var from string
+	var rcpts []string
+	var inTx bool // true after MAIL
+	for {
+		ln, err := readLMTPLine(tc)
+		if err == errLMTPLineTooLong {
+			tc.PrintfLine("500 5.5.2 Line too long")
+			continue
+		} else if err != nil {
+			return
+		}
+		verb, arg := ln, ""
+		if i := strings.IndexByte(ln, ' '); i >= 0 {
+			verb, arg = ln[:i], strings.TrimSpace(ln[i+1:])
+		}
+		switch strings.ToUpper(verb) {
+		case "LHLO":
+			greeted = true
+			inTx, from, rcpts = false, "", nil
+			tc.PrintfLine("250-%s", host)
+			tc.PrintfLine("250-8BITMIME")
+			tc.PrintfLine("250-ENHANCEDSTATUSCODES")
+			tc.PrintfLine("250 PIPELINING")
+		case "HELO", "EHLO":
+			tc.PrintfLine("500 5.5.1 Use LHLO")
+		case "MAIL":
+			addr, ok := parseLMTPPath(arg, "FROM:")
+			switch {
+			case !greeted:
+				tc.PrintfLine("503 5.5.1 Send LHLO first")
+			case inTx:
+				tc.PrintfLine("503 5.5.1 Nested MAIL command")
+			case !ok:
+				tc.PrintfLine("501 5.5.4 Bad MAIL syntax")
+			default:
+				inTx, from, rcpts = true, addr, nil
+				tc.PrintfLine("250 2.1.0 OK")
+			}
+		case "RCPT":
+			addr, ok := parseLMTPPath(arg, "TO:")
+			switch {
+			case !inTx:
+				tc.PrintfLine("503 5.5.1 Send MAIL first")
+			case !ok || addr == "":
+				tc.PrintfLine("501 5.5.4 Bad RCPT syntax")
+			default:
+				rcpts = append(rcpts, addr)
+				tc.PrintfLine("250 2.1.5 OK")
+			}
+		case "DATA":
+			if len(rcpts) == 0 {
+				tc.PrintfLine("503 5.5.1 No valid recipients")
+				continue
+			}
+			tc.PrintfLine("354 Start mail input; end with <CRLF>.<CRLF>")
+			msg := getLMTPBuffer()
+			dr := tc.DotReader()
+			var r io.Reader = dr
+			if s.maxSize > 0 {
+				r = io.LimitReader(dr, s.maxSize+1)
+			}
+			if _, err := msg.ReadFrom(r); err != nil {
+				return
+			}
+			var replies []string
+			if s.maxSize > 0 && int64(msg.Len()) > s.maxSize {
+				// Discard the rest of the message without buffering it.
+				if _, err := io.Copy(ioutil.Discard, dr); err != nil {
+					return
+				}
+				s.opts.Logger().Errorf("Rejecting message larger than %d bytes", s.maxSize)
+				replies = make([]string, len(rcpts))
+				for i := range replies {
+					replies[i] = "552 5.3.4 Message too big"
+				}
+			} else {
+				replies = s.deliver(from, rcpts, msg.Bytes())
+			}
+			// RFC 2033 4.2: one reply is sent for each successful RCPT command.
+			for _, reply := range replies {
+				tc.PrintfLine("%s", reply)
+			}
+			putLMTPBuffer(msg)
+			inTx, from, rcpts = false, "", nil
+		case "RSET":
+			inTx, from, rcpts = false, "", nil
+			tc.PrintfLine("250 2.0.0 OK")
+		case "NOOP":
+			tc.PrintfLine("250 2.0.0 OK")
+		case "VRFY":
+			tc.PrintfLine("252 2.5.0 Cannot verify user")
+		case "QUIT":
+			tc.PrintfLine("221 2.0.0 Bye")
+			return
+		default:
+			tc.PrintfLine("500 5.5.2 Unknown command")
+		}
+	}
+}
+
+// errLMTPLineTooLong is returned by readLMTPLine for overlong command lines.
+var errLMTPLineTooLong = errors.New("line too long")
+
+// readLMTPLine reads a command line from tc without its terminator. Unlike
+// textproto.Reader.ReadLine, it doesn't buffer arbitrarily long lines: lines that don't
+// fit in tc's buffer (4096 bytes, well over RFC 5321 4.5.3.1.4's 512-byte limit for
+// command lines) are discarded and errLMTPLineTooLong is returned.
+func readLMTPLine(tc *textproto.Conn) (string, error) {
+	b, err := tc.R.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		for err == bufio.ErrBufferFull {
+			_, err = tc.R.ReadSlice('\n')
+		}
+		if err != nil {
+			return "", err
+		}
+		return "", errLMTPLineTooLong
+	} else if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(b), "\r\n"), nil
+}
+
+// lmtpBufferPool holds buffers for messages received and rewritten by lmtpServer
+// so that they don't need to be reallocated for each message.
+var lmtpBufferPool = sync.Pool{New: func() interface{} { return &bytes.Buffer{} }}
+
+// maxPooledLMTPBufferSize is the capacity of the largest buffer returned to lmtpBufferPool.
+const maxPooledLMTPBufferSize = 16 * 1024 * 1024
+
+// getLMTPBuffer returns an empty buffer from lmtpBufferPool.
+func getLMTPBuffer() *bytes.Buffer {
+	b := lmtpBufferPool.Get().(*bytes.Buffer)
+	b.Reset()
+	return b
+}
+
+// putLMTPBuffer returns b to lmtpBufferPool unless it's too large.
+func putLMTPBuffer(b *bytes.Buffer) {
+	if b.Cap() <= maxPooledLMTPBufferSize {
+		lmtpBufferPool.Put(b)
+	}
+}
+
+// parseLMTPPath parses arg, the argument to a MAIL or RCPT command, and
+// returns the address from within its angle brackets. Trailing parameters
+// (e.g. "BODY=8BITMIME") are ignored.
+func parseLMTPPath(arg, prefix string) (string, bool) {
+	if len(arg) < len(prefix) || !strings.EqualFold(arg[:len(prefix)], prefix) {
+		return "", false
+	}
+	arg = strings.TrimSpace(arg[len(prefix):])
+	if !strings.HasPrefix(arg, "<") {
+		return "", false
+	}
+	end := strings.IndexByte(arg, '>')
+	if end < 0 {
+		return "", false
+	}
+	return arg[1:end], true
+}
+
+// deliver rewrites msg and relays it. A reply line is returned for each recipient.
+func (s *lmtpServer) deliver(from string, rcpts []string, msg []byte) []string {
+	replies := func(reply string) []string {
+		r := make([]string, len(rcpts))
+		for i := range r {
+			r[i] = reply
+		}
+		return r
+	}
+
+	opts := *s.opts
+	if !s.fakeNow {
+		opts.Now = time.Now()
+	}
+	ctx := context.Background()
+	if s.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.timeout)
+		defer cancel()
+	}
+	b := getLMTPBuffer()
+	defer putLMTPBuffer(b)
+	if _, err := rewrite.RewriteContext(ctx, bytes.NewReader(msg), b, &opts); err != nil {
+		opts.Logger().Errorf("Failed rewriting message: %v", err)
+		if tempRewriteError(err) {
+			return replies("451 4.3.0 Failed rewriting message")
+		}
+		return replies("554 5.6.0 Failed rewriting message")
+	}
+
+	if s.relayAddr != "" {
+		r, err := relayLMTP(s.relayNet, s.relayAddr, from, rcpts, b.Bytes())
+		if err != nil {
+			opts.Logger().Errorf("Failed relaying message: %v", err)
+			return replies("451 4.4.0 Failed relaying message")
+		}
+		return r
+	}
+
+	d, err := newMaildirDelivery(s.relayMaildir, opts.Now)
+	if err == nil {
+		if _, err = d.Write(b.Bytes()); err != nil {
+			d.abort()
+		} else {
+			var p string
+			if p, err = d.commit(); err == nil {
+				opts.Logger().Infof("Delivered message to %v", p)
+			}
+		}
+	}
+	if err != nil {
+		opts.Logger().Errorf("Failed delivering message to Maildir: %v", err)
+		return replies("451 4.3.0 Failed delivering message")
+	}
+	return replies("250 2.0.0 Delivered")
+}
+
+// relayLMTP sends msg (using LF line endings) from the supplied sender to rcpts via the
+// LMTP server at addr. The server's reply for each recipient is returned.
+func relayLMTP(network, addr, from string, rcpts []string, msg []byte) ([]string, error) {
+	conn, err := net.DialTimeout(network, addr, 30*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	tc := textproto.NewConn(conn)
+	defer tc.Close()
+
+	if _, _, err := tc.ReadResponse(220); err != nil {
+		return nil, err
+	}
+	host, _ := os.Hostname()
+	if err := cmdLMTP(tc, 250, "LHLO %s", host); err != nil {
+		return nil, err
+	}
+	if err := cmdLMTP(tc, 250, "MAIL FROM:<%s>", from); err != nil {
+		return nil, err
+	}
+
+	replies := make([]string, len(rcpts))
+	var accepted []int // indexes into rcpts
+	for i, rcpt := range rcpts {
+		id, err := tc.Cmd("RCPT TO:<%s>", rcpt)
+		if err != nil {
+			return nil, err
+		}
+		tc.StartResponse(id)
+		code, text, err := tc.ReadResponse(250)
+		tc.EndResponse(id)
+		if err == nil {
+			accepted = append(accepted, i)
+		} else if _, ok := err.(*textproto.Error); !ok {
+			return nil, err
+		}
+		replies[i] = fmt.Sprintf("%d %s", code, firstLine(text))
+	}
+	if len(accepted) == 0 {
+		cmdLMTP(tc, 221, "QUIT")
+		return replies, nil
+	}
+
+	if err := cmdLMTP(tc, 354, "DATA"); err != nil {
+		return nil, err
+	}
+	dw := tc.DotWriter()
+	if _, err := dw.Write(msg); err != nil {
+		return nil, err
+	}
+	if err := dw.Close(); err != nil {
+		return nil, err
+	}
+	for _, i := range accepted {
+		code, text, err := tc.ReadResponse(250)
+		if _, ok := err.(*textproto.Error); err != nil && !ok {
+			return nil, err
+		}
+		replies[i] = fmt.Sprintf("%d %s", code, firstLine(text))
+	}
+	cmdLMTP(tc, 221, "QUIT")
+	return replies, nil
+}
+
+// cmdLMTP sends a command to tc and reads a response, which must have the supplied code.
+func cmdLMTP(tc *textproto.Conn, code int, format string, args ...interface{}) error {
+	id, err := tc.Cmd(format, args...)
+	if err != nil {
+		return err
+	}
+	tc.StartResponse(id)
+	defer tc.EndResponse(id)
+	if _, _, err := tc.ReadResponse(code); err != nil {
+		return fmt.Errorf("%v: %v", strings.Fields(format)[0], err)
+	}
+	return nil
+}
+
+// firstLine returns the first line of s.
+func firstLine(s string) string {
+	if i := strings.IndexByte(s, '\n'); i >= 0 {
+		return s[:i]
+	}
+	return s
+}
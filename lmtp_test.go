@@ -0,0 +1,246 @@
+// Copyright 2022 Daniel Erat.
+// All rights reserved.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/derat/rendmail/rewrite"
+)
+
+// startLMTPServer starts s on a new local TCP listener and returns its address.
+func startLMTPServer(t *testing.T, s *lmtpServer) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go s.serve(ln)
+	return ln.Addr().String()
+}
+
+// sendLMTP sends cmds to the LMTP server at addr and returns the first lines of its replies.
+// After a successful DATA command, msg is sent and nrcpts replies are read.
+func sendLMTP(t *testing.T, addr string, cmds []string, msg string, nrcpts int) []string {
+	tc, err := textproto.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tc.Close()
+
+	var replies []string
+	read := func() string {
+		code, text, _ := tc.ReadResponse(0)
+		reply := fmt.Sprintf("%d %s", code, firstLine(text))
+		replies = append(replies, reply)
+		return reply
+	}
+	read() // greeting
+	for _, cmd := range cmds {
+		if err := tc.PrintfLine("%s", cmd); err != nil {
+			t.Fatal(err)
+		}
+		if reply := read(); cmd == "DATA" && strings.HasPrefix(reply, "354 ") {
+			dw := tc.DotWriter()
+			if _, err := dw.Write([]byte(msg)); err != nil {
+				t.Fatal(err)
+			}
+			if err := dw.Close(); err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < nrcpts; i++ {
+				read()
+			}
+		}
+	}
+	return replies[1:]
+}
+
+// readMaildirNew returns the contents of the messages in dir's new/ subdirectory.
+func readMaildirNew(t *testing.T, dir string) []string {
+	fis, err := ioutil.ReadDir(filepath.Join(dir, "new"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var msgs []string
+	for _, fi := range fis {
+		b, err := ioutil.ReadFile(filepath.Join(dir, "new", fi.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		msgs = append(msgs, string(b))
+	}
+	return msgs
+}
+
+func TestLMTPServer(t *testing.T) {
+	orig, err := ioutil.ReadFile("rewrite/testdata/audio.in.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := ioutil.ReadFile("rewrite/testdata/audio.out.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// LMTP uses CRLF, but the DotReader used by the server converts line endings to LF.
+	orig = []byte(strings.ReplaceAll(string(orig), "\r\n", "\n"))
+	wantMsg := strings.ReplaceAll(string(want), "\r\n", "\n")
+
+	opts := rewrite.Options{
+		DeleteMediaTypes: []string{"audio/*", "video/*"},
+		Now:              time.Date(2022, 4, 15, 15, 19, 4, 0, time.UTC),
+	}
+
+	// Chain two servers together: the first one rewrites messages and relays them to the
+	// second one, which delivers them unchanged to a Maildir.
+	dir := t.TempDir()
+	back := startLMTPServer(t, &lmtpServer{opts: &rewrite.Options{}, fakeNow: true, relayMaildir: dir})
+	front := startLMTPServer(t, &lmtpServer{opts: &opts, fakeNow: true, relayNet: "tcp", relayAddr: back})
+
+	host, _ := os.Hostname()
+	got := sendLMTP(t, front, []string{
+		"MAIL FROM:<sender@example.org>",
+		"LHLO client.example.org",
+		"RCPT TO:<me@example.org>",
+		"MAIL FROM:<sender@example.org> BODY=8BITMIME",
+		"RCPT TO:<me@example.org>",
+		"RCPT TO:<you@example.org>",
+		"DATA",
+		"NOOP",
+		"QUIT",
+	}, string(orig), 2)
+	if want := []string{
+		"503 5.5.1 Send LHLO first",
+		"250 " + host,
+		"503 5.5.1 Send MAIL first",
+		"250 2.1.0 OK",
+		"250 2.1.5 OK",
+		"250 2.1.5 OK",
+		"354 Start mail input; end with <CRLF>.<CRLF>",
+		"250 2.0.0 Delivered",
+		"250 2.0.0 Delivered",
+		"250 2.0.0 OK",
+		"221 2.0.0 Bye",
+	}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Got replies %q; want %q", got, want)
+	}
+
+	if msgs := readMaildirNew(t, dir); len(msgs) != 1 {
+		t.Errorf("Maildir has %d message(s); want 1", len(msgs))
+	} else if msgs[0] != wantMsg {
+		t.Errorf("Delivered message:\n%s", msgs[0])
+	}
+}
+
+func TestLMTPServer_rewriteFailure(t *testing.T) {
+	const msg = "From: sender@example.org\n" +
+		"Content-Type: multipart/mixed; boundary=abc\n" +
+		"\n" +
+		"--abc\n" +
+		"Content-Type: image/png\n" +
+		"\n" +
+		"data\n" +
+		"--abc--\n"
+	// Replace deleted parts with multipart parts that lack boundaries so validation fails.
+	broken := func(p *rewrite.PartInfo, w io.Writer) error {
+		_, err := io.WriteString(w, "Content-Type: multipart/mixed\n\n")
+		return err
+	}
+	for _, tc := range []struct {
+		opts  rewrite.Options
+		reply string
+	}{
+		{rewrite.Options{OnBadHeader: "fail"}, "554 5.6.0 Failed rewriting message"},
+		{rewrite.Options{
+			DeleteMediaTypes: []string{"image/*"},
+			ReplaceDeleted:   broken,
+			ValidateOutput:   "internal",
+		}, "451 4.3.0 Failed rewriting message"},
+	} {
+		dir := t.TempDir()
+		if err := os.Mkdir(filepath.Join(dir, "new"), 0700); err != nil {
+			t.Fatal(err)
+		}
+		s := lmtpServer{opts: &tc.opts, fakeNow: true, relayMaildir: dir}
+		in := msg
+		if tc.opts.OnBadHeader != "" {
+			in = strings.Replace(msg, "\n", "\nBogus header\n", 1)
+		}
+		rcpts := []string{"me@example.org", "you@example.org"}
+		if got, want := s.deliver("sender@example.org", rcpts, []byte(in)),
+			[]string{tc.reply, tc.reply}; !reflect.DeepEqual(got, want) {
+			t.Errorf("deliver() returned %q; want %q", got, want)
+		}
+		if msgs := readMaildirNew(t, dir); len(msgs) != 0 {
+			t.Errorf("Maildir has %d message(s) after failure; want 0", len(msgs))
+		}
+	}
+}
+
+func TestLMTPServer_limits(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(dir, "new"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	addr := startLMTPServer(t, &lmtpServer{opts: &rewrite.Options{}, fakeNow: true, maxSize: 100, relayMaildir: dir})
+	host, _ := os.Hostname()
+	msg := "Subject: Too big\n\n" + strings.Repeat("This line is repeated.\n", 20)
+	got := sendLMTP(t, addr, []string{
+		"LHLO client.example.org",
+		"MAIL FROM:<sender@example.org>",
+		"RCPT TO:<me@example.org>",
+		"RCPT TO:<you@example.org>",
+		"DATA",
+		"NOOP " + strings.Repeat("a", 10000),
+		"NOOP",
+		"QUIT",
+	}, msg, 2)
+	if want := []string{
+		"250 " + host,
+		"250 2.1.0 OK",
+		"250 2.1.5 OK",
+		"250 2.1.5 OK",
+		"354 Start mail input; end with <CRLF>.<CRLF>",
+		"552 5.3.4 Message too big",
+		"552 5.3.4 Message too big",
+		"500 5.5.2 Line too long",
+		"250 2.0.0 OK",
+		"221 2.0.0 Bye",
+	}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Got replies %q; want %q", got, want)
+	}
+	if msgs := readMaildirNew(t, dir); len(msgs) != 0 {
+		t.Errorf("Maildir has %d message(s) after oversized message; want 0", len(msgs))
+	}
+}
+
+func TestParseLMTPPath(t *testing.T) {
+	for _, tc := range []struct {
+		arg, prefix string
+		addr        string
+		ok          bool
+	}{
+		{"FROM:<a@example.org>", "FROM:", "a@example.org", true},
+		{"from: <a@example.org> BODY=8BITMIME", "FROM:", "a@example.org", true},
+		{"FROM:<>", "FROM:", "", true},
+		{"TO:<b@example.org>", "TO:", "b@example.org", true},
+		{"TO:b@example.org", "TO:", "", false},
+		{"FROM:<a@example.org", "FROM:", "", false},
+		{"TO:<b@example.org>", "FROM:", "", false},
+	} {
+		if addr, ok := parseLMTPPath(tc.arg, tc.prefix); addr != tc.addr || ok != tc.ok {
+			t.Errorf("parseLMTPPath(%q, %q) = %q, %v; want %q, %v", tc.arg, tc.prefix, addr, ok, tc.addr, tc.ok)
+		}
+	}
+}
@@ -0,0 +1,249 @@
+// Copyright 2022 Daniel Erat.
+// All rights reserved.
+
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/derat/rendmail/rewrite"
+)
+
+// rewriteMaildir rewrites each message in the cur/ and new/ subdirectories of the Maildir
+// at dir. Modified messages are written to dir's tmp/ subdirectory and then renamed over the
+// originals, so their filenames (including flags) are preserved aside from size fields (see
+// maildirSizeName). If bo.dryRun is true, messages are rewritten in memory but not saved.
+// The paths of modified messages are returned.
+// Failures for individual messages are logged and processing continues.
+func rewriteMaildir(dir string, bo *batchOptions, opts *rewrite.Options) (changed []string, err error) {
+	paths, err := maildirMessages(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	tmpDir := filepath.Join(dir, "tmp")
+	if !bo.dryRun {
+		if err := os.MkdirAll(tmpDir, 0700); err != nil {
+			return nil, err
+		}
+	}
+
+	// Results are handled in order so changed stays sorted.
+	type result struct {
+		p   string
+		dst string // new path if modified
+		err error
+	}
+	prog := newBatchProgress(bo.progress, len(paths))
+	pool := newOrderedPool(bo.jobs, func(res interface{}) error {
+		r := res.(result)
+		if r.err != nil {
+			opts.Logger().Errorf("Failed rewriting %v: %v", r.p, r.err)
+		} else if r.dst != "" {
+			changed = append(changed, r.dst)
+		}
+		prog.update(r.dst != "", r.err)
+		return nil
+	})
+	for _, p := range paths {
+		p := p
+		pool.add(func() interface{} {
+			dst, err := rewriteMaildirMessage(p, tmpDir, bo, opts)
+			return result{p, dst, err}
+		})
+	}
+	pool.wait()
+	prog.finish()
+
+	return changed, prog.failure("failed rewriting %d of %d message(s)", prog.failed, len(paths))
+}
+
+// maildirMessages returns the sorted paths of messages in the
+// cur/ and new/ subdirectories of the Maildir at dir.
+func maildirMessages(dir string) ([]string, error) {
+	var paths []string
+	for _, sub := range []string{"cur", "new"} {
+		fis, err := ioutil.ReadDir(filepath.Join(dir, sub))
+		if err != nil {
+			return nil, err
+		}
+		for _, fi := range fis {
+			// Maildir readers ignore dotfiles.
+			if fi.Mode().IsRegular() && fi.Name()[0] != '.' {
+				paths = append(paths, filepath.Join(dir, sub, fi.Name()))
+			}
+		}
+	}
+	sort.Strings(paths)
+	return paths, nil
+}
+
+// rewriteMaildirMessage rewrites the message at p. If the message is modified and bo.dryRun
+// is false, the new version is written to a file in tmpDir and then renamed to p (with its
+// size fields updated by maildirSizeName). The message's new path is returned if it was
+// modified, or an empty string otherwise.
+func rewriteMaildirMessage(p, tmpDir string, bo *batchOptions, opts *rewrite.Options) (dst string, err error) {
+	opts = withLogField(opts, "message", p)
+	fi, err := os.Stat(p)
+	if err != nil {
+		return "", err
+	}
+	orig, err := ioutil.ReadFile(p)
+	if err != nil {
+		return "", err
+	}
+	if err := bo.checkReplace(orig); err != nil {
+		return "", err
+	}
+	b, changed, err := rewriteData(p, orig, bo, opts)
+	if err != nil || !changed {
+		return "", err
+	}
+	opts.Logger().Infof("Rewrote %v", p)
+	if bo.dryRun {
+		return p, nil
+	}
+
+	tmp, err := writeTempFile(tmpDir, b, fi.Mode().Perm(), bo.fileMtime(fi))
+	if err != nil {
+		return "", err
+	}
+	// The message may have been moved (e.g. from new/ to cur/), deleted, or replaced by a
+	// mail client while we were rewriting it. Don't resurrect or clobber it in that case.
+	// Checking immediately before renaming keeps the window for this small.
+	if cur, err := os.Stat(p); err != nil || !os.SameFile(fi, cur) {
+		os.Remove(tmp)
+		if err == nil {
+			err = errors.New("message was replaced while being rewritten")
+		}
+		return "", err
+	}
+	dst = filepath.Join(filepath.Dir(p), maildirSizeName(filepath.Base(p), b))
+	if err := os.Rename(tmp, dst); err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+	if dst != p {
+		if err := os.Remove(p); err != nil {
+			return "", err
+		}
+	}
+	return dst, syncDir(filepath.Dir(p))
+}
+
+// maildirSizeName returns name, a Maildir filename, with Dovecot-style size fields in its
+// base (e.g. "1650036000.M1P2.host,S=1234,W=1260:2,S") updated for the message data.
+// S= holds the file size and W= holds the size with CRLF line endings. Dovecot reports
+// index errors for messages whose sizes don't match these fields.
+func maildirSizeName(name string, data []byte) string {
+	base, info := name, ""
+	if i := strings.IndexByte(name, ':'); i >= 0 {
+		base, info = name[:i], name[i:]
+	}
+	fields := strings.Split(base, ",")
+	for i := 1; i < len(fields); i++ {
+		switch {
+		case strings.HasPrefix(fields[i], "S="):
+			fields[i] = "S=" + strconv.Itoa(len(data))
+		case strings.HasPrefix(fields[i], "W="):
+			lf := bytes.Count(data, []byte("\n")) - bytes.Count(data, []byte("\r\n"))
+			fields[i] = "W=" + strconv.Itoa(len(data)+lf)
+		}
+	}
+	return strings.Join(fields, ",") + info
+}
+
+// maildirDelivery is an io.Writer that delivers a new message to a Maildir.
+// The message is written to a file in tmp/ and moved to new/ by commit.
+type maildirDelivery struct {
+	dir  string   // Maildir containing cur/, new/, and tmp/
+	name string   // unique filename
+	f    *os.File // file in tmp/
+}
+
+// newMaildirDelivery creates the Maildir at dir if needed and creates a new
+// file in its tmp/ subdirectory for a message received at now.
+func newMaildirDelivery(dir string, now time.Time) (*maildirDelivery, error) {
+	for _, sub := range []string{"cur", "new", "tmp"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0700); err != nil {
+			return nil, err
+		}
+	}
+	name, err := maildirName(now)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(filepath.Join(dir, "tmp", name), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &maildirDelivery{dir: dir, name: name, f: f}, nil
+}
+
+func (d *maildirDelivery) Write(p []byte) (int, error) {
+	return d.f.Write(p)
+}
+
+// path returns the path at which commit will deliver the message.
+func (d *maildirDelivery) path() string {
+	return filepath.Join(d.dir, "new", d.name)
+}
+
+// commit syncs the message to disk and moves it to new/.
+// The path of the delivered message is returned.
+func (d *maildirDelivery) commit() (string, error) {
+	if err := d.f.Sync(); err != nil {
+		d.abort()
+		return "", err
+	}
+	if err := d.f.Close(); err != nil {
+		d.abort()
+		return "", err
+	}
+	tmp := filepath.Join(d.dir, "tmp", d.name)
+	dst := d.path()
+	// Per the Maildir spec, use link() rather than rename() so an existing
+	// message with the same name is never overwritten.
+	if err := os.Link(tmp, dst); err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+	if err := os.Remove(tmp); err != nil {
+		return "", err
+	}
+	return dst, syncDir(filepath.Join(d.dir, "new"))
+}
+
+// abort closes and removes the partially-written message.
+func (d *maildirDelivery) abort() {
+	d.f.Close()
+	os.Remove(filepath.Join(d.dir, "tmp", d.name))
+}
+
+// maildirName returns a unique filename for a message delivered at now,
+// as described at https://cr.yp.to/proto/maildir.html.
+func maildirName(now time.Time) (string, error) {
+	host, err := os.Hostname()
+	if err != nil {
+		return "", err
+	}
+	// The spec says to replace "/" and ":" in invalid hostnames with octal escapes.
+	host = strings.NewReplacer("/", `\057`, ":", `\072`).Replace(host)
+	rnd := make([]byte, 8)
+	if _, err := rand.Read(rnd); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%d.M%dP%dR%v.%v", now.Unix(), now.Nanosecond()/1000,
+		os.Getpid(), hex.EncodeToString(rnd), host), nil
+}
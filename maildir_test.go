@@ -0,0 +1,276 @@
+// Copyright 2022 Daniel Erat.
+// All rights reserved.
+
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/derat/rendmail/rewrite"
+)
+
+func TestRewriteMaildir(t *testing.T) {
+	orig, err := ioutil.ReadFile("rewrite/testdata/audio.in.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := ioutil.ReadFile("rewrite/testdata/audio.out.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	const plain = "From: me@example.org\nSubject: Hi\n\nNothing to see here.\n"
+
+	for _, dryRun := range []bool{false, true} {
+		dir := t.TempDir()
+		for _, sub := range []string{"cur", "new", "tmp"} {
+			if err := os.Mkdir(filepath.Join(dir, sub), 0700); err != nil {
+				t.Fatal(err)
+			}
+		}
+		files := map[string]string{
+			"new/1650036000.M1P2.host":      string(orig),
+			"cur/1650036001.M3P4.host:2,RS": string(orig),
+			"cur/1650036002.M5P6.host:2,S":  plain,
+			"cur/.hidden":                   string(orig),
+		}
+		for fn, data := range files {
+			if err := ioutil.WriteFile(filepath.Join(dir, fn), []byte(data), 0600); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		opts := rewrite.Options{
+			DeleteMediaTypes: []string{"audio/*", "video/*"},
+			Now:              time.Date(2022, 4, 15, 15, 19, 4, 0, time.UTC),
+		}
+		changed, err := rewriteMaildir(dir, &batchOptions{dryRun: dryRun, jobs: 3}, &opts)
+		if err != nil {
+			t.Fatalf("rewriteMaildir(%v, dryRun=%v) failed: %v", dir, dryRun, err)
+		}
+		wantChanged := []string{
+			filepath.Join(dir, "cur/1650036001.M3P4.host:2,RS"),
+			filepath.Join(dir, "new/1650036000.M1P2.host"),
+		}
+		if !reflect.DeepEqual(changed, wantChanged) {
+			t.Errorf("rewriteMaildir(%v, dryRun=%v) = %q; want %q", dir, dryRun, changed, wantChanged)
+		}
+
+		for fn, data := range files {
+			if !dryRun && data == string(orig) && fn != "cur/.hidden" {
+				data = string(want)
+			}
+			if got, err := ioutil.ReadFile(filepath.Join(dir, fn)); err != nil {
+				t.Error(err)
+			} else if string(got) != data {
+				t.Errorf("%v (dryRun=%v) has unexpected contents:\n%s", fn, dryRun, got)
+			}
+		}
+		if fis, err := ioutil.ReadDir(filepath.Join(dir, "tmp")); err != nil {
+			t.Error(err)
+		} else if len(fis) != 0 {
+			t.Errorf("tmp/ (dryRun=%v) contains %v file(s)", dryRun, len(fis))
+		}
+	}
+
+	if _, err := rewriteMaildir(filepath.Join(t.TempDir(), "bogus"), &batchOptions{}, &rewrite.Options{}); err == nil {
+		t.Error("rewriteMaildir unexpectedly succeeded for missing dir")
+	}
+}
+
+func TestRewriteMaildir_sizeFields(t *testing.T) {
+	orig, err := ioutil.ReadFile("rewrite/testdata/audio.in.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := ioutil.ReadFile("rewrite/testdata/audio.out.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	for _, sub := range []string{"cur", "new", "tmp"} {
+		if err := os.Mkdir(filepath.Join(dir, sub), 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+	p := filepath.Join(dir, "cur", maildirSizeName("1650036000.M1P2.host,S=0,W=0:2,S", orig))
+	if err := ioutil.WriteFile(p, orig, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	opts := rewrite.Options{
+		DeleteMediaTypes: []string{"audio/*"},
+		Now:              time.Date(2022, 4, 15, 15, 19, 4, 0, time.UTC),
+	}
+	changed, err := rewriteMaildir(dir, &batchOptions{jobs: 1}, &opts)
+	if err != nil {
+		t.Fatal("rewriteMaildir failed:", err)
+	}
+	dst := filepath.Join(dir, "cur", maildirSizeName("1650036000.M1P2.host,S=0,W=0:2,S", want))
+	if !reflect.DeepEqual(changed, []string{dst}) {
+		t.Errorf("rewriteMaildir returned %q; want %q", changed, []string{dst})
+	}
+	if got, err := ioutil.ReadFile(dst); err != nil {
+		t.Error(err)
+	} else if string(got) != string(want) {
+		t.Errorf("%v has unexpected contents:\n%s", dst, got)
+	}
+	if _, err := os.Stat(p); !os.IsNotExist(err) {
+		t.Errorf("%v still exists (err: %v)", p, err)
+	}
+}
+
+func TestRewriteMaildir_replacedDuringRewrite(t *testing.T) {
+	orig, err := ioutil.ReadFile("rewrite/testdata/audio.in.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	for _, sub := range []string{"cur", "new", "tmp"} {
+		if err := os.Mkdir(filepath.Join(dir, sub), 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+	p := filepath.Join(dir, "new/1650036000.M1P2.host")
+	if err := ioutil.WriteFile(p, orig, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// Simulate a mail client replacing the message while it's being rewritten.
+	const other = "From: me@example.org\nSubject: Other\n\nReplacement\n"
+	var replaced bool
+	opts := rewrite.Options{
+		DeleteMediaTypes: []string{"audio/*"},
+		Visit: func(part *rewrite.PartInfo, body io.Reader) rewrite.Action {
+			if !replaced {
+				replaced = true
+				tmp := filepath.Join(dir, "tmp", "other")
+				if err := ioutil.WriteFile(tmp, []byte(other), 0600); err != nil {
+					t.Error(err)
+				} else if err := os.Rename(tmp, p); err != nil {
+					t.Error(err)
+				}
+			}
+			return rewrite.Keep
+		},
+	}
+	if _, err := rewriteMaildir(dir, &batchOptions{jobs: 1}, &opts); err == nil {
+		t.Error("rewriteMaildir unexpectedly succeeded")
+	}
+	if got, err := ioutil.ReadFile(p); err != nil {
+		t.Error(err)
+	} else if string(got) != other {
+		t.Errorf("%v was clobbered:\n%s", p, got)
+	}
+	if fis, err := ioutil.ReadDir(filepath.Join(dir, "tmp")); err != nil {
+		t.Error(err)
+	} else if len(fis) != 0 {
+		t.Errorf("tmp/ contains %v file(s)", len(fis))
+	}
+}
+
+func TestMaildirSizeName(t *testing.T) {
+	const data = "a\nb\r\nc\n" // 7 bytes, 9 with CRLF
+	for _, tc := range []struct {
+		name, want string
+	}{
+		{"1650036000.M1P2.host", "1650036000.M1P2.host"},
+		{"1650036000.M1P2.host:2,S", "1650036000.M1P2.host:2,S"},
+		{"1650036000.M1P2.host,S=1234:2,S", "1650036000.M1P2.host,S=7:2,S"},
+		{"1650036000.M1P2.host,S=1234,W=1260:2,RS", "1650036000.M1P2.host,S=7,W=9:2,RS"},
+		{"1650036000.M1P2.host,W=1260,X=5", "1650036000.M1P2.host,W=9,X=5"},
+	} {
+		if got := maildirSizeName(tc.name, []byte(data)); got != tc.want {
+			t.Errorf("maildirSizeName(%q, %q) = %q; want %q", tc.name, data, got, tc.want)
+		}
+	}
+}
+
+func TestRewriteMaildir_validationFailure(t *testing.T) {
+	orig, err := ioutil.ReadFile("rewrite/testdata/audio.in.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	for _, sub := range []string{"cur", "new", "tmp"} {
+		if err := os.Mkdir(filepath.Join(dir, sub), 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+	p := filepath.Join(dir, "new/1650036000.M1P2.host")
+	if err := ioutil.WriteFile(p, orig, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// Replace deleted parts with multipart parts that lack boundaries so validation fails.
+	opts := rewrite.Options{
+		DeleteMediaTypes: []string{"audio/*"},
+		ReplaceDeleted: func(p *rewrite.PartInfo, w io.Writer) error {
+			_, err := io.WriteString(w, "Content-Type: multipart/mixed\n\n")
+			return err
+		},
+		ValidateOutput: "internal",
+	}
+	_, err = rewriteMaildir(dir, &batchOptions{jobs: 1}, &opts)
+	if err == nil {
+		t.Fatal("rewriteMaildir unexpectedly succeeded")
+	} else if code := rewriteFailedCode(err); code != exitTempFail {
+		t.Errorf("rewriteMaildir returned %q with exit code %v; want %v", err, code, exitTempFail)
+	}
+	if got, err := ioutil.ReadFile(p); err != nil {
+		t.Error(err)
+	} else if string(got) != string(orig) {
+		t.Errorf("%v was modified after validation failure:\n%s", p, got)
+	}
+}
+
+func TestMaildirDelivery(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "Maildir")
+	now := time.Date(2022, 4, 15, 15, 19, 4, 123456789, time.UTC)
+	msgs := []string{"Subject: first\n\nHello\n", "Subject: second\n\nHello again\n"}
+	var paths []string
+	for _, msg := range msgs {
+		d, err := newMaildirDelivery(dir, now)
+		if err != nil {
+			t.Fatal("newMaildirDelivery failed:", err)
+		}
+		if _, err := io.WriteString(d, msg); err != nil {
+			t.Fatal("Write failed:", err)
+		}
+		p, err := d.commit()
+		if err != nil {
+			t.Fatal("commit failed:", err)
+		}
+		if !strings.HasPrefix(filepath.Base(p), "1650035944.M123456P") {
+			t.Errorf("commit returned unexpected path %v", p)
+		}
+		paths = append(paths, p)
+	}
+	for i, p := range paths {
+		if got, err := ioutil.ReadFile(p); err != nil {
+			t.Error(err)
+		} else if string(got) != msgs[i] {
+			t.Errorf("%v contains %q; want %q", p, got, msgs[i])
+		}
+	}
+
+	// Aborted deliveries shouldn't leave anything behind.
+	d, err := newMaildirDelivery(dir, now)
+	if err != nil {
+		t.Fatal("newMaildirDelivery failed:", err)
+	}
+	d.abort()
+	for sub, want := range map[string]int{"cur": 0, "new": 2, "tmp": 0} {
+		if fis, err := ioutil.ReadDir(filepath.Join(dir, sub)); err != nil {
+			t.Error(err)
+		} else if len(fis) != want {
+			t.Errorf("%v/ contains %v file(s); want %v", sub, len(fis), want)
+		}
+	}
+}
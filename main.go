@@ -4,6 +4,7 @@
 package main
 
 import (
+	"bytes"
 	"flag"
 	"fmt"
 	"io"
@@ -11,83 +12,506 @@ import (
 	"os"
 	"strings"
 	"time"
+
+	"github.com/derat/rendmail/rewrite"
 )
 
 func main() {
-	opts := rewriteOptions{Now: time.Now()}
+	if len(os.Args) > 1 {
+		if fn, ok := subcommands[os.Args[1]]; ok {
+			os.Exit(fn(os.Args[2:]))
+		}
+	}
+
+	opts := rewrite.Options{Now: time.Now()}
 
 	flag.Usage = func() {
-		fmt.Fprintf(os.Stderr, "Usage: %s [flag]...\n", os.Args[0])
-		fmt.Fprintf(os.Stderr, "Reads an email message from stdin and rewrites it to stdout.\n\n")
+		fmt.Fprintf(os.Stderr, "Usage: %s [flag]... [file]...\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s backup [flag]... list|show ID|restore ID|verify [ID]...\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s build DIR\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s check [file]\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s convert -from=FORMAT -to=FORMAT [flag]... SRC... DST\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s extract [flag]... [file]\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s inspect [flag]... [file]\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s lda [-lda=PATH] [-d USER] [flag]... [-- LDA-ARG...]\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s serve -lmtp=ADDR [flag]...\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s split -o DIR [file]\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s watch -maildir=DIR [flag]...\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Reads email messages from files (or stdin) and rewrites them to stdout.\n")
+		fmt.Fprintf(os.Stderr, "With -maildir or -mbox, rewrites all messages in a Maildir or mbox file in place.\n\n")
 		flag.PrintDefaults()
 	}
-	backupDir := flag.String("backup-dir", "", "Directory to which original, unmodified message will be saved")
-	flag.BoolVar(&opts.DecodeSubject, "decode-subject", false, "Write X-Rendmail-Subject for RFC-2047-encoded Subject")
-	deleteBinary := flag.Bool("delete-binary", false, "Delete common binary attachments from message")
-	deleteTypes := flag.String("delete-types", "", "Comma-separated globs of attachment media types to delete")
-	fakeNow := flag.String("fake-now", "", "Hardcoded RFC 3339 time (only used for testing)")
-	keepTypes := flag.String("keep-types", "", "Comma-separated glob overrides for -delete-types")
-	flag.BoolVar(&opts.Strict, "strict", false, "Exit with status 1 for malformed message")
-	flag.BoolVar(&opts.verbose, "verbose", false, "Write informative logging to stderr")
+	compress := flag.String("compress", "", `Compress rewritten messages ("gzip")`)
+	decompress := flag.String("decompress", "auto", `Decompress input ("auto" to detect gzip, bzip2, or xz; "none"; or a format)`)
+	deliverMaildir := flag.String("deliver-maildir", "", "Deliver rewritten message to new/ in this Maildir instead of writing it to stdout")
+	diff := flag.Bool("diff", false, "Write unified diffs of modified messages to stderr")
+	diffFile := flag.String("diff-file", "", "File to which -diff output is written instead of stderr")
+	dryRun := flag.Bool("dry-run", false, "With -maildir or file arguments, list messages that would be modified without writing anything")
+	exitOnModify := flag.Bool("exit-status-on-modify", false, fmt.Sprintf("Exit with status %d if any message was modified", exitModified))
+	inPlace := flag.Bool("in-place", false, "Atomically replace modified file arguments with rewritten versions")
+	jobs := flag.Int("jobs", 1, "Number of messages to rewrite concurrently with -maildir or -mbox")
+	list := flag.Bool("list", false, "Print one line per part (path, type, filename, size, encoding) instead of rewriting")
+	maildir := flag.String("maildir", "", "Maildir whose messages in cur/ and new/ should be rewritten in place")
+	mbox := flag.String("mbox", "", "mbox file whose messages should be rewritten in place")
+	outputDir := flag.String("output-dir", "", "Directory to which rewritten file arguments are written")
+	progress := flag.Bool("progress", false, "Write progress and a summary for -maildir or -mbox to stderr")
+	preserveMtime := flag.Bool("preserve-mtime", false, "Keep original modification times with -in-place, -output-dir, -maildir, and -mbox")
+	quarantineDir := flag.String("quarantine-dir", "", "Maildir to which original messages satisfying -quarantine-when are delivered instead of stdout")
+	quarantineWhen := flag.String("quarantine-when", quarantineExecutable+","+quarantineMalformed,
+		fmt.Sprintf("Comma-separated conditions for -quarantine-dir (%q, %q, %q)",
+			quarantineDeleted, quarantineExecutable, quarantineMalformed))
+	report := flag.String("report", "", "File to which a line of JSON describing each rewritten message is written")
+	restore := flag.Bool("restore", false, "Restore deleted parts to message from -backup-dir or -backup-maildir")
+	var bk backupOptions
+	addBackupFlags(flag.CommandLine, &bk)
+	rf := addRewriteFlags(flag.CommandLine, &opts)
+	pf := addProfileFlags(flag.CommandLine)
 
 	flag.Parse()
 
 	os.Exit(func() (code int) {
-		if *fakeNow != "" {
-			var err error
-			if opts.Now, err = time.Parse(time.RFC3339, *fakeNow); err != nil {
-				fmt.Fprintln(os.Stderr, "Bad -fake-now time:", err)
-				return 2
+		if err := rf.finish(&opts); err != nil {
+			fmt.Fprintln(os.Stderr, "Invalid flags:", err)
+			return 2
+		}
+		stopProfile, err := pf.start()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Failed starting profiling:", err)
+			return 2
+		}
+		defer func() {
+			if err := stopProfile(); err != nil {
+				opts.Logger().Errorf("Failed writing profile: %v", err)
+				code = 1
 			}
+		}()
+
+		if !isDecompressMode(*decompress) {
+			fmt.Fprintf(os.Stderr, "Invalid -decompress mode %q\n", *decompress)
+			return 2
+		}
+		if *jobs < 1 {
+			fmt.Fprintln(os.Stderr, "-jobs must be positive")
+			return 2
+		}
+		if err := bk.check(); err != nil {
+			fmt.Fprintln(os.Stderr, "Invalid flags:", err)
+			return 2
+		}
+		if *compress != "" && *compress != "gzip" {
+			fmt.Fprintf(os.Stderr, "Invalid -compress format %q\n", *compress)
+			return 2
+		}
+		quarantineConds := splitList(*quarantineWhen)
+		if err := checkQuarantineConds(quarantineConds); err != nil {
+			fmt.Fprintln(os.Stderr, "Invalid -quarantine-when:", err)
+			return 2
 		}
 
-		if *deleteBinary {
-			if *deleteTypes != "" || *keepTypes != "" {
-				fmt.Fprintln(os.Stderr, "-delete-binary is incompatible with -delete-types and -keep-types")
+		var diffW io.Writer
+		if *diffFile != "" {
+			f, err := os.Create(*diffFile)
+			if err != nil {
+				opts.Logger().Errorf("Failed creating diff file: %v", err)
+				return 1
+			}
+			defer func() {
+				if err := f.Close(); err != nil {
+					opts.Logger().Errorf("Failed closing diff file: %v", err)
+					code = 1
+				}
+			}()
+			diffW = f
+		} else if *diff {
+			diffW = os.Stderr
+		}
+
+		var reportW io.Writer
+		if *report != "" {
+			f, err := os.Create(*report)
+			if err != nil {
+				opts.Logger().Errorf("Failed creating report file: %v", err)
+				return 1
+			}
+			defer func() {
+				if err := f.Close(); err != nil {
+					opts.Logger().Errorf("Failed closing report file: %v", err)
+					code = 1
+				}
+			}()
+			reportW = f
+		}
+
+		if *list {
+			if flag.NArg() > 1 {
+				fmt.Fprintln(os.Stderr, "-list accepts at most one file argument")
 				return 2
 			}
-			opts.DeleteMediaTypes = binaryDeleteTypes
-			opts.KeepMediaTypes = binaryKeepTypes
-		} else {
-			opts.DeleteMediaTypes = splitList(*deleteTypes)
-			opts.KeepMediaTypes = splitList(*keepTypes)
+			b, err := readMessageArg(flag.Args())
+			if err != nil {
+				opts.Logger().Errorf("Failed reading message: %v", err)
+				return 1
+			}
+			part, err := inspectMessage(b, &opts)
+			if err == nil {
+				err = writePartList(os.Stdout, part)
+			}
+			if err != nil {
+				opts.Logger().Errorf("Failed listing parts: %v", err)
+				return 1
+			}
+			return 0
 		}
 
-		input := io.Reader(os.Stdin)
-		if *backupDir != "" {
-			if err := os.MkdirAll(*backupDir, 0700); err != nil {
-				fmt.Fprintln(os.Stderr, "Failed creating backup dir:", err)
+		if *restore {
+			if !bk.enabled() {
+				fmt.Fprintln(os.Stderr, "-restore requires -backup-dir or -backup-maildir")
+				return 2
+			}
+			if err := restoreMessage(os.Stdin, os.Stdout, bk.dirs(), opts.PGPKeys, opts.Logger()); err != nil {
+				opts.Logger().Errorf("Failed restoring message: %v", err)
 				return 1
 			}
-			f, err := ioutil.TempFile(*backupDir, opts.Now.UTC().Format("20060102-150405.999")+"-*")
+			return 0
+		}
+		bo := batchOptions{
+			backup:     bk,
+			outDir:     *outputDir,
+			inPlace:    *inPlace,
+			keepMtime:  *preserveMtime,
+			dryRun:     *dryRun,
+			decompress: *decompress,
+			compress:   *compress,
+			diff:       diffW,
+			report:     reportW,
+			jobs:       *jobs,
+		}
+		if *progress {
+			bo.progress = os.Stderr
+		}
+		paths := flag.Args()
+		switch {
+		case *mbox != "" && (*maildir != "" || len(paths) > 0):
+			fmt.Fprintln(os.Stderr, "-mbox is incompatible with -maildir and file arguments")
+			return 2
+		case *mbox != "" && (bo.outDir != "" || bo.inPlace || bo.compress != ""):
+			fmt.Fprintln(os.Stderr, "-output-dir, -in-place, and -compress are incompatible with -mbox")
+			return 2
+		case *maildir != "" && len(paths) > 0:
+			fmt.Fprintln(os.Stderr, "-maildir is incompatible with file arguments")
+			return 2
+		case *maildir != "" && (bo.outDir != "" || bo.inPlace):
+			fmt.Fprintln(os.Stderr, "-output-dir and -in-place are incompatible with -maildir")
+			return 2
+		case bo.outDir != "" && bo.inPlace:
+			fmt.Fprintln(os.Stderr, "-output-dir is incompatible with -in-place")
+			return 2
+		case len(paths) == 0 && (bo.outDir != "" || bo.inPlace):
+			fmt.Fprintln(os.Stderr, "-output-dir and -in-place require file arguments")
+			return 2
+		case *maildir == "" && *mbox == "" && len(paths) == 0 && bo.dryRun:
+			fmt.Fprintln(os.Stderr, "-dry-run requires -maildir, -mbox, or file arguments")
+			return 2
+		case *deliverMaildir != "" && (*maildir != "" || *mbox != "" || len(paths) > 0):
+			fmt.Fprintln(os.Stderr, "-deliver-maildir is incompatible with -maildir, -mbox, and file arguments")
+			return 2
+		case *quarantineDir != "" && (*maildir != "" || *mbox != "" || len(paths) > 0):
+			fmt.Fprintln(os.Stderr, "-quarantine-dir is incompatible with -maildir, -mbox, and file arguments")
+			return 2
+		}
+
+		if *maildir != "" || *mbox != "" || len(paths) > 0 {
+			var changed []string
+			var err error
+			if *maildir != "" {
+				changed, err = rewriteMaildir(*maildir, &bo, &opts)
+			} else if *mbox != "" {
+				changed, err = rewriteMbox(*mbox, &bo, &opts)
+			} else {
+				changed, err = rewriteFiles(paths, os.Stdout, &bo, &opts)
+			}
+			if bo.dryRun {
+				for _, p := range changed {
+					fmt.Println(p)
+				}
+			}
 			if err != nil {
-				fmt.Fprintln(os.Stderr, "Failed creating backup file:", err)
+				opts.Logger().Errorf("Failed rewriting messages: %v", err)
+				return rewriteFailedCode(err)
+			}
+			if *exitOnModify && len(changed) > 0 {
+				return exitModified
+			}
+			return 0
+		}
+
+		var modified bool       // set by writeMessage if the message was changed
+		var origData []byte     // set by writeMessage to the decompressed original message if buffered
+		var newData []byte      // set by writeMessage to the rewritten message if buffered
+		var rep *rewrite.Report // set by rewriteMsg
+		input := io.Reader(os.Stdin)
+		var saveBackup func() error // finishes saving the backup; only does work once
+		var bw backupWriter
+		if bk.enabled() {
+			var err error
+			if bw, err = bk.create(opts.Now); bk.skipBackup(err) {
+				opts.Logger().Warningf("Skipping backup: %v", err)
+				opts.BackupWarning = backupSkippedWarning
+			} else if isLowSpace(err) {
+				opts.Logger().Errorf("Failed creating backup: %v", err)
+				return exitTempFail
+			} else if err != nil {
+				opts.Logger().Errorf("Failed creating backup: %v", err)
 				return 1
 			}
-			input = io.TeeReader(input, f)
+		}
+		if bw != nil {
+			var err error
+			var orig []byte // set if the whole message is read up front
+			if bk.record || bk.deferred() || bk.index || bk.sync {
+				// The whole message needs to be read to record its hash in the header,
+				// and it needs to be held until we know whether it was modified.
+				if orig, err = ioutil.ReadAll(input); err != nil {
+					bw.abort()
+					opts.Logger().Errorf("Failed reading message: %v", err)
+					return 1
+				}
+				if bk.record {
+					opts.BackupRecord = bk.recordValue(bw.path(), orig)
+				}
+				input = bytes.NewReader(orig)
+			} else {
+				input = io.TeeReader(input, bw)
+			}
 
-			defer func() {
-				// Drain the reader to write the unread portion of the message to the file
-				// in case rewriteMessage encountered an error.
-				if _, err := io.Copy(ioutil.Discard, input); err != nil {
-					fmt.Fprintf(os.Stderr, "Failed writing message to %v: %v\n", f.Name(), err)
-					code = 1
+			var saved bool
+			saveBackup = func() error {
+				if saved {
+					return nil
 				}
-				if err := f.Close(); err != nil {
-					fmt.Fprintln(os.Stderr, "Failed closing file:", err)
+				saved = true
+				var p string
+				var err error
+				if orig != nil {
+					rewritten := newData
+					if code != 0 && !modified {
+						rewritten = nil // save the full message if something failed
+					}
+					p, err = bk.finish(bw, orig, origData, rewritten, modified)
+				} else {
+					// Drain the reader to write the unread portion of the message to the
+					// backup in case rewrite.Rewrite encountered an error.
+					if _, err := io.Copy(ioutil.Discard, input); err != nil {
+						bw.abort()
+						return fmt.Errorf("writing backup: %v", err)
+					}
+					p, err = bw.commit()
+				}
+				if err != nil {
+					return fmt.Errorf("saving backup: %v", err)
+				} else if p == "" {
+					return nil // not needed
+				}
+				if origData == nil {
+					origData = orig // rewriting failed
+				}
+				if err := bk.addToIndex(newBackupIndexEntry(p, bw, origData, len(newData), &opts, rep)); err != nil {
+					return fmt.Errorf("updating backup index: %v", err)
+				}
+				return nil
+			}
+			defer func() {
+				if err := saveBackup(); err != nil {
+					opts.Logger().Errorf("Failed %v", err)
 					code = 1
 				}
 			}()
 		}
 
-		if err := rewriteMessage(input, os.Stdout, &opts); err != nil {
-			fmt.Fprintln(os.Stderr, "Failed rewriting message:", err)
+		// Keep input (which may be writing to the backup file) separate so it can be drained.
+		msgInput, err := newDecompressReader(input, *decompress)
+		if err != nil {
+			opts.Logger().Errorf("Failed decompressing message: %v", err)
 			return 1
 		}
-		return 0
+
+		// rewriteMsg rewrites the message read from r to w and sets rep.
+		rewriteMsg := func(r io.Reader, w io.Writer) (err error) {
+			rep, err = rewrite.Rewrite(r, w, &opts)
+			if reportW != nil {
+				if rerr := writeReport(reportW, "", rep); rerr != nil && err == nil {
+					err = fmt.Errorf("writing report: %v", rerr)
+				}
+			}
+			return err
+		}
+		// rewriteTo rewrites the message read from r to w.
+		rewriteTo := rewriteMsg
+
+		if *quarantineDir != "" {
+			// Rewrite the message up front to check whether it should be quarantined.
+			orig, err := ioutil.ReadAll(msgInput)
+			if err != nil {
+				opts.Logger().Errorf("Failed reading message: %v", err)
+				return 1
+			}
+			var b bytes.Buffer
+			rerr := rewriteMsg(bytes.NewReader(orig), &b)
+			if reason := quarantineReason(quarantineConds, rep); reason != "" {
+				p, err := deliverQuarantine(*quarantineDir, orig, opts.Now)
+				if err != nil {
+					opts.Logger().Errorf("Failed quarantining message: %v", err)
+					return exitTempFail
+				}
+				opts.Logger().Warningf("Quarantined message (%v) to %v", reason, p)
+				return exitQuarantined
+			}
+			if rerr != nil {
+				opts.Logger().Errorf("Failed rewriting message: %v", rerr)
+				return rewriteFailedCode(rerr)
+			}
+			msgInput = bytes.NewReader(orig)
+			rewriteTo = func(r io.Reader, w io.Writer) error {
+				// Consume the original message so it can be diffed.
+				if _, err := io.Copy(ioutil.Discard, r); err != nil {
+					return err
+				}
+				_, err := w.Write(b.Bytes())
+				return err
+			}
+		}
+
+		// writeMessage rewrites the message to w, which is then closed.
+		// modified is set if the message was changed.
+		writeMessage := func(w io.WriteCloser) error {
+			if diffW == nil && !*exitOnModify && !bk.deferred() && !bk.index && !bk.sync {
+				if err := rewriteTo(msgInput, w); err != nil {
+					return err
+				}
+				return w.Close()
+			}
+			var ob, nb bytes.Buffer
+			out := io.MultiWriter(w, &nb)
+			if bk.sync && saveBackup != nil {
+				out = &nb // the backup needs to be on disk before the message is written
+			}
+			if err := rewriteTo(io.TeeReader(msgInput, &ob), out); err != nil {
+				return err
+			}
+			origData, newData = ob.Bytes(), nb.Bytes()
+			var err error
+			if modified, err = rewriteChanged(ob.Bytes(), nb.Bytes(), &opts); err != nil {
+				return err
+			}
+			if bk.sync && saveBackup != nil {
+				if err := saveBackup(); err != nil {
+					return err
+				}
+				if _, err := w.Write(nb.Bytes()); err != nil {
+					return err
+				}
+			}
+			if err := w.Close(); err != nil {
+				return err
+			}
+			if !modified || diffW == nil {
+				return nil
+			}
+			return writeUnifiedDiff(diffW, "stdin", ob.Bytes(), nb.Bytes())
+		}
+		// success returns the exit code to use after the message was rewritten.
+		success := func() int {
+			if *exitOnModify && modified {
+				return exitModified
+			}
+			return 0
+		}
+
+		if *deliverMaildir == "" {
+			cw, err := newCompressWriter(os.Stdout, *compress)
+			if err == nil {
+				err = writeMessage(cw)
+			}
+			if err != nil {
+				opts.Logger().Errorf("Failed rewriting message: %v", err)
+				return rewriteFailedCode(err)
+			}
+			return success()
+		}
+
+		d, err := newMaildirDelivery(*deliverMaildir, opts.Now)
+		if err != nil {
+			opts.Logger().Errorf("Failed creating message in Maildir: %v", err)
+			return exitTempFail
+		}
+		cw, err := newCompressWriter(d, *compress)
+		if err == nil {
+			err = writeMessage(cw)
+		}
+		if err != nil {
+			d.abort()
+			opts.Logger().Errorf("Failed rewriting message: %v", err)
+			return rewriteFailedCode(err)
+		}
+		p, err := d.commit()
+		if err != nil {
+			opts.Logger().Errorf("Failed delivering message to Maildir: %v", err)
+			return exitTempFail
+		}
+		opts.Logger().Infof("Delivered message to %v", p)
+		return success()
 	}())
 }
 
+// subcommands maps from subcommand names to functions implementing them.
+// Each function receives the arguments following the subcommand name and
+// returns the process's exit code.
+var subcommands = map[string]func(args []string) int{
+	"backup":  backupMain,
+	"build":   buildMain,
+	"check":   checkMain,
+	"convert": convertMain,
+	"extract": extractMain,
+	"inspect": inspectMain,
+	"lda":     ldaMain,
+	"serve":   serveMain,
+	"split":   splitMain,
+	"watch":   watchMain,
+}
+
+// exitModified is the exit code used for -exit-status-on-modify when a message was
+// modified. It's distinct from the codes used for errors (1) and bad flags (2).
+const exitModified = 3
+
+// exitTempFail is the exit code used for temporary delivery failures
+// (EX_TEMPFAIL from sysexits.h), telling the MTA to try again later.
+const exitTempFail = 75
+
+// rewriteFailedCode returns the exit code to use after failing to rewrite one or more
+// messages with err.
+func rewriteFailedCode(err error) int {
+	if tempRewriteError(err) {
+		return exitTempFail
+	}
+	return 1
+}
+
+// tempRewriteError returns true if err, returned while rewriting one or more messages,
+// should be treated as a temporary failure. A rewritten message rejected by -validate-output
+// is a bug in rendmail rather than a problem with the message, and a -plugin failure is a
+// problem with the helper, so delivery should be retried later instead of bouncing the message.
+func tempRewriteError(err error) bool {
+	switch e := err.(type) {
+	case *rewrite.ValidationError:
+		return true
+	case *batchError:
+		return e.temp
+	case *pluginError:
+		return true
+	}
+	return false
+}
+
 // Binary media type patterns used for -delete-binary.
 var binaryDeleteTypes = []string{
 	"application/*",
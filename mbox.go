@@ -0,0 +1,259 @@
+// Copyright 2022 Daniel Erat.
+// All rights reserved.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"regexp"
+	"time"
+
+	"github.com/derat/rendmail/rewrite"
+)
+
+// mboxReader reads messages from an mbox file. Both the mboxo and mboxrd variants
+// are accepted: lines beginning with one or more '>' characters followed by "From "
+// have a single '>' removed.
+type mboxReader struct {
+	r    *bufio.Reader
+	next string // From_ line of the next message, or empty at EOF
+	err  error  // error to return from the following read call
+}
+
+func newMboxReader(r io.Reader) *mboxReader {
+	return &mboxReader{r: bufio.NewReader(r)}
+}
+
+// read returns the next message and its From_ line (without a line break).
+// io.EOF is returned after the last message has been read.
+func (mr *mboxReader) read() (from string, msg []byte, err error) {
+	if mr.err != nil {
+		return "", nil, mr.err
+	}
+	if mr.next == "" {
+		// The first line must be a From_ line.
+		ln, err := mr.r.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return "", nil, err
+		} else if ln == "" {
+			return "", nil, io.EOF
+		} else if !isMboxFromLine(ln) {
+			return "", nil, errNotMbox
+		}
+		mr.next = trimLineBreakString(ln)
+	}
+
+	from = mr.next
+	mr.next = ""
+	var buf bytes.Buffer
+	var blank string // blank line that may separate this message from the next one
+	for {
+		ln, err := mr.r.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return "", nil, err
+		}
+		if ln == "" && err == io.EOF {
+			// A trailing blank line at EOF also separates messages, so drop it.
+			mr.err = io.EOF
+			break
+		}
+		if blank != "" && isMboxFromLine(ln) {
+			mr.next = trimLineBreakString(ln)
+			break
+		}
+		buf.WriteString(blank)
+		blank = ""
+		if ln == "\n" || ln == "\r\n" {
+			blank = ln
+		} else if mboxQuotedFromRegexp.MatchString(ln) {
+			buf.WriteString(ln[1:])
+		} else {
+			buf.WriteString(ln)
+		}
+		if err == io.EOF {
+			mr.err = io.EOF
+			break
+		}
+	}
+	return from, buf.Bytes(), nil
+}
+
+// errNotMbox is returned by mboxReader.read if the input doesn't start with a From_ line.
+var errNotMbox = errors.New("not an mbox file (missing From_ line)")
+
+// isMboxFromLine returns true if ln starts a new message in an mbox file.
+func isMboxFromLine(ln string) bool {
+	return len(ln) >= 5 && ln[:5] == "From "
+}
+
+// mboxQuotedFromRegexp matches lines that were escaped when written to an mbox file.
+var mboxQuotedFromRegexp = regexp.MustCompile(`^>+From `)
+
+// mboxEscapeRegexp matches lines that need to be escaped when written to an mbox file.
+var mboxEscapeRegexp = regexp.MustCompile(`(?m)^>*From `)
+
+// writeMboxMessage writes msg to w in mboxrd format, preceded by the supplied
+// From_ line (without a line break) and followed by a blank line.
+func writeMboxMessage(w io.Writer, from string, msg []byte) error {
+	term := []byte("\n")
+	if i := bytes.IndexByte(msg, '\n'); i > 0 && msg[i-1] == '\r' {
+		term = []byte("\r\n")
+	}
+	var buf bytes.Buffer
+	buf.WriteString(from)
+	buf.Write(term)
+	buf.Write(mboxEscapeRegexp.ReplaceAll(msg, []byte(">$0")))
+	if len(msg) > 0 && msg[len(msg)-1] != '\n' {
+		buf.Write(term)
+	}
+	buf.Write(term)
+	_, err := buf.WriteTo(w)
+	return err
+}
+
+// mboxFromLine returns a From_ line (without a line break) for msg, received at t.
+// The envelope sender is taken from the message's Return-Path header field.
+func mboxFromLine(msg []byte, t time.Time) string {
+	sender := "MAILER-DAEMON"
+	if m, err := mail.ReadMessage(bytes.NewReader(msg)); err == nil {
+		if addr, err := mail.ParseAddress(m.Header.Get("Return-Path")); err == nil && addr.Address != "" {
+			sender = addr.Address
+		}
+	}
+	return "From " + sender + " " + t.UTC().Format(time.ANSIC)
+}
+
+// trimLineBreakString removes a single trailing "\r\n" or "\n" from s.
+func trimLineBreakString(s string) string {
+	return string(trimLineBreak([]byte(s)))
+}
+
+// rewriteMbox rewrites each message in the mbox file at p. Messages are split at From_
+// lines and rewritten concurrently per bo.jobs, and the results are written in their
+// original order to a temporary file that is renamed over p if any messages were
+// modified. Only a bounded number of messages are held in memory at once. If bo.dryRun
+// is true, nothing is written. Descriptions of modified messages are returned.
+// Failures for individual messages are logged and the original messages are kept.
+//
+// Messages appended to p while it is being rewritten would be lost, so an error is
+// returned instead of replacing p if its size or modification time changed.
+func rewriteMbox(p string, bo *batchOptions, opts *rewrite.Options) (changed []string, err error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	var tmp *os.File
+	var bw *bufio.Writer
+	if !bo.dryRun {
+		if tmp, err = ioutil.TempFile(filepath.Dir(p), ".rendmail-*"); err != nil {
+			return nil, err
+		}
+		defer func() {
+			if tmp != nil {
+				tmp.Close()
+				os.Remove(tmp.Name())
+			}
+		}()
+		bw = bufio.NewWriter(tmp)
+	}
+
+	type result struct {
+		desc    string
+		envFrom string
+		orig    []byte
+		msg     []byte
+		mod     bool
+		err     error
+	}
+	prog := newBatchProgress(bo.progress, 0)
+	pool := newOrderedPool(bo.jobs, func(res interface{}) error {
+		r := res.(result)
+		msg := r.orig
+		if r.err != nil {
+			opts.Logger().Errorf("Failed rewriting %v: %v", r.desc, r.err)
+		} else if r.mod {
+			changed = append(changed, r.desc)
+			msg = r.msg
+		}
+		prog.update(r.mod, r.err)
+		if bw == nil {
+			return nil
+		}
+		return writeMboxMessage(bw, r.envFrom, msg) // output errors are fatal
+	})
+
+	mr := newMboxReader(f)
+	for i := 1; ; i++ {
+		envFrom, orig, err := mr.read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			pool.wait()
+			return nil, fmt.Errorf("%v: %v", p, err)
+		}
+		desc := fmt.Sprintf("%v message %d", p, i)
+		if err := pool.add(func() interface{} {
+			o := withLogField(opts, "message", desc)
+			msg, mod, err := rewriteData(desc, orig, bo, o)
+			if err == nil && mod {
+				o.Logger().Infof("Rewrote %v", desc)
+			}
+			return result{desc, envFrom, orig, msg, mod, err}
+		}); err != nil {
+			pool.wait()
+			return nil, err
+		}
+	}
+	if err := pool.wait(); err != nil {
+		return nil, err
+	}
+	prog.finish()
+
+	if tmp != nil && len(changed) > 0 {
+		if err := bw.Flush(); err != nil {
+			return nil, err
+		}
+		if err := tmp.Chmod(fi.Mode().Perm()); err != nil {
+			return nil, err
+		}
+		if err := tmp.Sync(); err != nil {
+			return nil, err
+		}
+		if err := tmp.Close(); err != nil {
+			return nil, err
+		}
+		if mtime := bo.fileMtime(fi); !mtime.IsZero() {
+			if err := os.Chtimes(tmp.Name(), time.Now(), mtime); err != nil {
+				return nil, err
+			}
+		}
+		if cur, err := os.Stat(p); err != nil {
+			return nil, err
+		} else if cur.Size() != fi.Size() || !cur.ModTime().Equal(fi.ModTime()) {
+			return nil, fmt.Errorf("%v changed while being rewritten", p)
+		}
+		if err := os.Rename(tmp.Name(), p); err != nil {
+			return nil, err
+		}
+		tmp = nil
+		if err := syncDir(filepath.Dir(p)); err != nil {
+			return changed, err
+		}
+	}
+
+	return changed, prog.failure("failed rewriting %d of %d message(s)", prog.failed, prog.done)
+}
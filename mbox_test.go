@@ -0,0 +1,166 @@
+// Copyright 2022 Daniel Erat.
+// All rights reserved.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/derat/rendmail/rewrite"
+)
+
+func TestMboxReader(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		want []string // alternating From_ lines and messages
+		err  error
+	}{
+		{"", nil, nil},
+		{"From a@example.org Sat Apr 16 16:33:34 2022\nSubject: 1\n\nBody\n\n" +
+			"From b@example.org Sat Apr 16 16:33:35 2022\nSubject: 2\n\n>From here\n>>From there\nFrom everywhere\n\n",
+			[]string{
+				"From a@example.org Sat Apr 16 16:33:34 2022", "Subject: 1\n\nBody\n",
+				"From b@example.org Sat Apr 16 16:33:35 2022", "Subject: 2\n\nFrom here\n>From there\nFrom everywhere\n",
+			}, nil},
+		{"From a@example.org Sat Apr 16 16:33:34 2022\r\nSubject: 1\r\n\r\nBody", []string{
+			"From a@example.org Sat Apr 16 16:33:34 2022", "Subject: 1\r\n\r\nBody",
+		}, nil},
+		{"Subject: 1\n\nBody\n", nil, errNotMbox},
+	} {
+		mr := newMboxReader(strings.NewReader(tc.in))
+		var got []string
+		var err error
+		for {
+			var from string
+			var msg []byte
+			if from, msg, err = mr.read(); err != nil {
+				break
+			}
+			got = append(got, from, string(msg))
+		}
+		if err == io.EOF {
+			err = nil
+		}
+		if !reflect.DeepEqual(got, tc.want) || err != tc.err {
+			t.Errorf("Reading %q returned %q, %v; want %q, %v", tc.in, got, err, tc.want, tc.err)
+		}
+	}
+}
+
+func TestWriteMboxMessage(t *testing.T) {
+	const from = "From a@example.org Sat Apr 16 16:33:34 2022"
+	for _, tc := range []struct{ msg, want string }{
+		{"Subject: 1\n\nBody\n", from + "\nSubject: 1\n\nBody\n\n"},
+		{"Subject: 1\n\nFrom here\n>From there\nNo newline",
+			from + "\nSubject: 1\n\n>From here\n>>From there\nNo newline\n\n"},
+		{"Subject: 1\r\n\r\nBody\r\n", from + "\r\nSubject: 1\r\n\r\nBody\r\n\r\n"},
+	} {
+		var b bytes.Buffer
+		if err := writeMboxMessage(&b, from, []byte(tc.msg)); err != nil {
+			t.Errorf("writeMboxMessage(..., %q) failed: %v", tc.msg, err)
+		} else if got := b.String(); got != tc.want {
+			t.Errorf("writeMboxMessage(..., %q) wrote %q; want %q", tc.msg, got, tc.want)
+		}
+	}
+}
+
+func TestMboxFromLine(t *testing.T) {
+	now := time.Date(2022, 4, 6, 16, 33, 34, 0, time.UTC)
+	for _, tc := range []struct{ msg, want string }{
+		{"Return-Path: <a@example.org>\nSubject: 1\n\nBody\n", "From a@example.org Wed Apr  6 16:33:34 2022"},
+		{"Return-Path: <>\nSubject: 1\n\nBody\n", "From MAILER-DAEMON Wed Apr  6 16:33:34 2022"},
+		{"Subject: 1\n\nBody\n", "From MAILER-DAEMON Wed Apr  6 16:33:34 2022"},
+	} {
+		if got := mboxFromLine([]byte(tc.msg), now); got != tc.want {
+			t.Errorf("mboxFromLine(%q, ...) = %q; want %q", tc.msg, got, tc.want)
+		}
+	}
+}
+
+func TestRewriteMbox(t *testing.T) {
+	orig, err := ioutil.ReadFile("rewrite/testdata/audio.in.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := ioutil.ReadFile("rewrite/testdata/audio.out.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	const plain = "From: me@example.org\nSubject: Hi\n\nNothing to see here.\n"
+
+	// Use enough messages that results are reordered by the pool.
+	var in, out bytes.Buffer
+	var wantChanged []string
+	const n = 20
+	for i := 0; i < n; i++ {
+		from := fmt.Sprintf("From user%d@example.org Fri Apr 15 15:19:%02d 2022", i, i)
+		if i%3 == 0 {
+			writeMboxMessage(&in, from, orig)
+			writeMboxMessage(&out, from, want)
+			wantChanged = append(wantChanged, fmt.Sprintf("message %d", i+1))
+		} else {
+			writeMboxMessage(&in, from, []byte(plain))
+			writeMboxMessage(&out, from, []byte(plain))
+		}
+	}
+
+	for _, dryRun := range []bool{false, true} {
+		dir := t.TempDir()
+		p := filepath.Join(dir, "mbox")
+		if err := ioutil.WriteFile(p, in.Bytes(), 0600); err != nil {
+			t.Fatal(err)
+		}
+		opts := rewrite.Options{
+			DeleteMediaTypes: []string{"audio/*", "video/*"},
+			Now:              time.Date(2022, 4, 15, 15, 19, 4, 0, time.UTC),
+		}
+		changed, err := rewriteMbox(p, &batchOptions{dryRun: dryRun, jobs: 4}, &opts)
+		if err != nil {
+			t.Fatalf("rewriteMbox(%v, dryRun=%v) failed: %v", p, dryRun, err)
+		}
+		var wc []string
+		for _, s := range wantChanged {
+			wc = append(wc, p+" "+s)
+		}
+		if !reflect.DeepEqual(changed, wc) {
+			t.Errorf("rewriteMbox(%v, dryRun=%v) = %q; want %q", p, dryRun, changed, wc)
+		}
+
+		wantData := out.Bytes()
+		if dryRun {
+			wantData = in.Bytes()
+		}
+		if got, err := ioutil.ReadFile(p); err != nil {
+			t.Error(err)
+		} else if !bytes.Equal(got, wantData) {
+			t.Errorf("%v (dryRun=%v) has unexpected contents:\n%s", p, dryRun, got)
+		}
+		if fis, err := ioutil.ReadDir(dir); err != nil {
+			t.Error(err)
+		} else if len(fis) != 1 {
+			t.Errorf("%v (dryRun=%v) contains %v file(s)", dir, dryRun, len(fis))
+		}
+	}
+
+	// Non-mbox input should be rejected without modifying the file.
+	p := filepath.Join(t.TempDir(), "mbox")
+	if err := ioutil.WriteFile(p, []byte(plain), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rewriteMbox(p, &batchOptions{jobs: 2}, &rewrite.Options{}); err == nil {
+		t.Errorf("rewriteMbox(%v) unexpectedly succeeded for non-mbox file", p)
+	}
+	if fis, err := ioutil.ReadDir(filepath.Dir(p)); err != nil {
+		t.Error(err)
+	} else if len(fis) != 1 {
+		t.Errorf("%v contains %v file(s) after failure", filepath.Dir(p), len(fis))
+	}
+}
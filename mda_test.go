@@ -13,7 +13,7 @@ import (
 )
 
 const (
-	mdaMsg  = "testdata/sa_easy_ham_2_00869.0fbb783356f6875063681dc49cfcb1eb-delete"
+	mdaMsg  = "rewrite/testdata/sa_easy_ham_2_00869.0fbb783356f6875063681dc49cfcb1eb-delete"
 	mdaDate = "2021-02-18T21:54:42.123Z" // matches .opts.json file
 )
 
@@ -133,3 +133,25 @@ match all
       continue
 match all action maildir "{{.Inbox}}"
 `
+
+func TestDovecotLDA(t *testing.T) {
+	// dovecot-lda typically isn't in $PATH.
+	lda, err := exec.LookPath("dovecot-lda")
+	if err != nil {
+		lda = "/usr/lib/dovecot/dovecot-lda"
+	}
+	runMDATest(t, dovecotConfTemplate, func(cfg string) *exec.Cmd {
+		// The user isn't passed via -d since dovecot-lda would need to look it up via
+		// the auth server; it delivers to the current user's mail_location by default.
+		return exec.Command("rendmail", "lda", "-delete-binary", "-fake-now="+mdaDate,
+			"-backup-dir="+filepath.Join(filepath.Dir(cfg), "backup"), "-verbose",
+			"-lda="+lda, "--", "-c", cfg)
+	})
+}
+
+const dovecotConfTemplate = `
+log_path = {{.LogFile}}
+mail_location = maildir:{{.Inbox}}
+postmaster_address = postmaster@example.org
+ssl = no
+`
@@ -0,0 +1,203 @@
+// Copyright 2022 Daniel Erat.
+// All rights reserved.
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/derat/rendmail/rewrite"
+)
+
+// plugin runs a helper process that decides what should be done with message parts.
+//
+// For each part, a pluginRequest is written to the process's stdin as a single line of JSON,
+// and a pluginResponse is read from its stdout as a single line of JSON. The process is
+// started once and reused for all messages; it should exit when its stdin is closed.
+// If an exchange fails or takes longer than timeout, the message fails with a *pluginError
+// and the process is killed and restarted for the next part.
+type plugin struct {
+	path    string
+	args    []string
+	timeout time.Duration
+	log     rewrite.Logger
+
+	mu     sync.Mutex // serializes exchanges when messages are rewritten concurrently
+	cmd    *exec.Cmd  // nil if the process needs to be (re)started
+	stdin  io.WriteCloser
+	stdout io.ReadCloser
+	enc    *json.Encoder
+	dec    *json.Decoder
+}
+
+// defaultPluginTimeout is the default maximum duration of a single exchange with a plugin.
+const defaultPluginTimeout = time.Minute
+
+// pluginError is returned by rewrite.Rewrite when a plugin fails.
+// It's treated as a temporary failure so the message can be retried later.
+type pluginError struct{ err error }
+
+func (e *pluginError) Error() string { return "plugin failed: " + e.err.Error() }
+
+// pluginRequest describes a message part to a plugin.
+type pluginRequest struct {
+	Path        string              `json:"path"`                  // e.g. "1.2" (empty for the top-level part)
+	Type        string              `json:"type"`                  // media type, e.g. "image/png"
+	Params      map[string]string   `json:"params,omitempty"`      // Content-Type parameters
+	Encoding    string              `json:"encoding,omitempty"`    // Content-Transfer-Encoding, e.g. "base64"
+	Disposition string              `json:"disposition,omitempty"` // e.g. "attachment"
+	Filename    string              `json:"filename,omitempty"`    // decoded filename
+	Header      map[string][]string `json:"header,omitempty"`      // part's header fields
+	Body        []byte              `json:"body,omitempty"`        // decoded body (base64 in JSON); omitted for multipart
+}
+
+// pluginResponse describes what a plugin wants done with a message part.
+type pluginResponse struct {
+	Action string `json:"action"`         // "keep", "delete", or "replace"
+	Body   []byte `json:"body,omitempty"` // new decoded body for "replace" (base64 in JSON)
+}
+
+// startPlugin starts the executable at path with args. Messages written by
+// the process to stderr are passed through.
+func startPlugin(path string, args []string, log rewrite.Logger) (*plugin, error) {
+	pl := &plugin{path: path, args: args, timeout: defaultPluginTimeout, log: log}
+	if err := pl.start(); err != nil {
+		return nil, err
+	}
+	return pl, nil
+}
+
+// start starts the process. pl.mu must be held (or pl must not yet be shared).
+func (pl *plugin) start() error {
+	cmd := exec.Command(pl.path, pl.args...)
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	// Encode is used instead of json.Marshal to avoid escaping '<' and '>' in addresses.
+	pl.enc = json.NewEncoder(stdin)
+	pl.enc.SetEscapeHTML(false)
+	pl.dec = json.NewDecoder(bufio.NewReader(stdout))
+	pl.cmd = cmd
+	pl.stdin = stdin
+	pl.stdout = stdout
+	return nil
+}
+
+// kill kills the process and waits for it to exit. pl.mu must be held.
+func (pl *plugin) kill() {
+	interruptPlugin(pl.cmd, pl.stdin, pl.stdout)
+	pl.cmd.Wait()
+	pl.cmd = nil
+}
+
+// interruptPlugin kills cmd and closes its pipes so that a blocked exchange returns
+// even if the process's children are still holding the pipes open.
+func interruptPlugin(cmd *exec.Cmd, stdin, stdout io.Closer) {
+	cmd.Process.Kill()
+	stdin.Close()
+	stdout.Close()
+}
+
+// visit implements rewrite.WalkFunc. If the process fails, times out, or returns a bad
+// response, it's killed (to be restarted for the next part) and the message fails.
+func (pl *plugin) visit(part *rewrite.PartInfo, body io.Reader) rewrite.Action {
+	pl.mu.Lock()
+	defer pl.mu.Unlock()
+
+	if pl.cmd == nil {
+		pl.log.Infof("Restarting plugin")
+		if err := pl.start(); err != nil {
+			return rewrite.Fail(&pluginError{err})
+		}
+	}
+
+	// Kill the process if it doesn't respond in time so the exchange is unblocked.
+	var timedOut int32
+	cmd, stdin, stdout := pl.cmd, pl.stdin, pl.stdout
+	timer := time.AfterFunc(pl.timeout, func() {
+		atomic.StoreInt32(&timedOut, 1)
+		interruptPlugin(cmd, stdin, stdout)
+	})
+	act, err := pl.exchange(part, body)
+	timer.Stop()
+	if atomic.LoadInt32(&timedOut) != 0 {
+		err = fmt.Errorf("no response within %v", pl.timeout)
+	}
+	if err != nil {
+		pl.log.Errorf("Plugin failed for part %q: %v", part.Path, err)
+		pl.kill()
+		return rewrite.Fail(&pluginError{err})
+	}
+	return act
+}
+
+// exchange sends a request describing part to the process and returns the action from its response.
+func (pl *plugin) exchange(part *rewrite.PartInfo, body io.Reader) (rewrite.Action, error) {
+	req := pluginRequest{
+		Path:        part.Path,
+		Type:        part.MediaType,
+		Params:      part.Params,
+		Encoding:    part.Encoding,
+		Disposition: part.Disposition,
+		Filename:    part.Filename,
+		Header:      part.Header,
+	}
+	if body != nil {
+		var err error
+		if req.Body, err = ioutil.ReadAll(body); err != nil {
+			return rewrite.Keep, err
+		}
+	}
+	if err := pl.enc.Encode(&req); err != nil {
+		return rewrite.Keep, err
+	}
+	var res pluginResponse
+	if err := pl.dec.Decode(&res); err != nil {
+		if err == io.EOF {
+			err = errors.New("process exited")
+		}
+		return rewrite.Keep, err
+	}
+	switch res.Action {
+	case "keep":
+		return rewrite.Keep, nil
+	case "delete":
+		return rewrite.Delete, nil
+	case "replace":
+		return rewrite.Replace(res.Body), nil
+	default:
+		return rewrite.Keep, fmt.Errorf("bad action %q", res.Action)
+	}
+}
+
+// close closes the process's stdin and waits for it to exit.
+func (pl *plugin) close() error {
+	pl.mu.Lock()
+	defer pl.mu.Unlock()
+	if pl.cmd == nil {
+		return nil
+	}
+	pl.stdin.Close()
+	err := pl.cmd.Wait()
+	pl.cmd = nil
+	return err
+}
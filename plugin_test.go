@@ -0,0 +1,124 @@
+// Copyright 2022 Daniel Erat.
+// All rights reserved.
+
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/derat/rendmail/rewrite"
+)
+
+func TestPlugin(t *testing.T) {
+	const msg = "From: a@example.org\n" +
+		"Content-Type: multipart/mixed; boundary=abc\n" +
+		"\n" +
+		"--abc\n" +
+		"Content-Type: text/plain\n" +
+		"\n" +
+		"Hello\n" +
+		"--abc\n" +
+		"Content-Type: image/png\n" +
+		"Content-Transfer-Encoding: base64\n" +
+		"\n" +
+		"YWJj\n" +
+		"--abc--\n"
+
+	// Replace the text part with "Goodbye\n" and delete the image.
+	const script = `while read -r req; do
+  case "$req" in
+    *'"type":"text/plain"'*'"body":"SGVsbG8K"'*) echo '{"action":"replace","body":"R29vZGJ5ZQo="}' ;;
+    *'"type":"image/png"'*) echo '{"action":"delete"}' ;;
+    *) echo '{"action":"keep"}' ;;
+  esac
+done`
+	pl, err := startPlugin("sh", []string{"-c", script}, rewrite.DefaultLogger())
+	if err != nil {
+		t.Fatal("startPlugin failed:", err)
+	}
+	var out bytes.Buffer
+	opts := rewrite.Options{Now: time.Now(), Visit: pl.visit}
+	rep, err := rewrite.Rewrite(strings.NewReader(msg), &out, &opts)
+	if err != nil {
+		t.Fatal("Rewrite failed:", err)
+	}
+	if err := pl.close(); err != nil {
+		t.Error("Plugin failed:", err)
+	}
+	if got := out.String(); !strings.Contains(got, "\nGoodbye\n--abc\n") {
+		t.Errorf("Plugin didn't replace text part:\n%s", got)
+	}
+	if len(rep.Deleted) != 1 || rep.Deleted[0].MediaType != "image/png" {
+		t.Errorf("Plugin deleted %+v; want image/png", rep.Deleted)
+	}
+}
+
+func TestPlugin_badResponse(t *testing.T) {
+	const msg = "Content-Type: image/png\n\nabc\n"
+	pl, err := startPlugin("sh", []string{"-c", `read -r req; echo '{"action":"explode"}'`}, rewrite.DefaultLogger())
+	if err != nil {
+		t.Fatal("startPlugin failed:", err)
+	}
+	defer pl.close()
+	opts := rewrite.Options{Now: time.Now(), Visit: pl.visit}
+	if _, err := rewrite.Rewrite(strings.NewReader(msg), ioutil.Discard, &opts); err == nil {
+		t.Error("Rewrite unexpectedly succeeded with bad plugin response")
+	} else if !tempRewriteError(err) {
+		t.Errorf("Rewrite with bad plugin response returned non-temporary error %q", err)
+	}
+}
+
+func TestPlugin_restart(t *testing.T) {
+	const msg = "Content-Type: multipart/mixed; boundary=abc\n" +
+		"\n" +
+		"--abc\n" +
+		"Content-Type: text/plain\n" +
+		"\n" +
+		"Hello\n" +
+		"--abc--\n"
+	// The process exits after responding to the first part, so the second part fails.
+	pl, err := startPlugin("sh", []string{"-c", `read -r req; echo '{"action":"keep"}'`}, rewrite.DefaultLogger())
+	if err != nil {
+		t.Fatal("startPlugin failed:", err)
+	}
+	defer pl.close()
+	opts := rewrite.Options{Now: time.Now(), Visit: pl.visit}
+	if _, err := rewrite.Rewrite(strings.NewReader(msg), ioutil.Discard, &opts); err == nil {
+		t.Error("Rewrite unexpectedly succeeded after plugin exited")
+	}
+	// The process should be restarted for the next message rather than being skipped.
+	var visited int
+	opts.Visit = func(part *rewrite.PartInfo, body io.Reader) rewrite.Action {
+		visited++
+		return pl.visit(part, body)
+	}
+	if _, err := rewrite.Rewrite(strings.NewReader("Content-Type: text/plain\n\nHi\n"), ioutil.Discard, &opts); err != nil {
+		t.Error("Rewrite failed after restarting plugin:", err)
+	} else if visited != 1 {
+		t.Errorf("Plugin visited %d part(s); want 1", visited)
+	}
+}
+
+func TestPlugin_timeout(t *testing.T) {
+	pl, err := startPlugin("sh", []string{"-c", "exec sleep 60"}, rewrite.DefaultLogger())
+	if err != nil {
+		t.Fatal("startPlugin failed:", err)
+	}
+	defer pl.close()
+	pl.timeout = 100 * time.Millisecond
+	opts := rewrite.Options{Now: time.Now(), Visit: pl.visit}
+	start := time.Now()
+	if _, err := rewrite.Rewrite(strings.NewReader("Content-Type: text/plain\n\nHi\n"), ioutil.Discard, &opts); err == nil {
+		t.Error("Rewrite unexpectedly succeeded with hung plugin")
+	} else if !tempRewriteError(err) {
+		t.Errorf("Rewrite with hung plugin returned non-temporary error %q", err)
+	}
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Errorf("Rewrite with hung plugin took %v", elapsed)
+	}
+}
@@ -0,0 +1,119 @@
+// Copyright 2022 Daniel Erat.
+// All rights reserved.
+
+package main
+
+import (
+	"flag"
+	"net"
+	"net/http"
+	httppprof "net/http/pprof"
+	"os"
+	"runtime"
+	"runtime/pprof"
+	"runtime/trace"
+
+	"github.com/derat/rendmail/rewrite"
+)
+
+// profileFlags holds the values of flags registered by addProfileFlags.
+type profileFlags struct {
+	cpu   *string
+	mem   *string
+	trace *string
+}
+
+// addProfileFlags registers flags in fs for profiling the process.
+// profileFlags.start must be called after fs is parsed.
+func addProfileFlags(fs *flag.FlagSet) *profileFlags {
+	return &profileFlags{
+		cpu:   fs.String("cpuprofile", "", "File to which a CPU profile is written"),
+		mem:   fs.String("memprofile", "", "File to which a heap profile is written before exiting"),
+		trace: fs.String("trace", "", "File to which an execution trace is written"),
+	}
+}
+
+// start starts CPU profiling and tracing as requested by pf. The returned function
+// stops them and writes the heap profile; it must be called before the process exits.
+func (pf *profileFlags) start() (stop func() error, err error) {
+	var stops []func() error
+	stop = func() error {
+		var first error
+		for i := len(stops) - 1; i >= 0; i-- {
+			if err := stops[i](); err != nil && first == nil {
+				first = err
+			}
+		}
+		return first
+	}
+	defer func() {
+		if err != nil {
+			stop()
+		}
+	}()
+
+	if *pf.cpu != "" {
+		f, err := os.Create(*pf.cpu)
+		if err != nil {
+			return nil, err
+		}
+		if err := pprof.StartCPUProfile(f); err != nil {
+			f.Close()
+			return nil, err
+		}
+		stops = append(stops, func() error {
+			pprof.StopCPUProfile()
+			return f.Close()
+		})
+	}
+	if *pf.trace != "" {
+		f, err := os.Create(*pf.trace)
+		if err != nil {
+			return nil, err
+		}
+		if err := trace.Start(f); err != nil {
+			f.Close()
+			return nil, err
+		}
+		stops = append(stops, func() error {
+			trace.Stop()
+			return f.Close()
+		})
+	}
+	if p := *pf.mem; p != "" {
+		stops = append(stops, func() error {
+			f, err := os.Create(p)
+			if err != nil {
+				return err
+			}
+			runtime.GC() // update allocation statistics
+			if err := pprof.WriteHeapProfile(f); err != nil {
+				f.Close()
+				return err
+			}
+			return f.Close()
+		})
+	}
+	return stop, nil
+}
+
+// servePprof serves net/http/pprof's handlers under /debug/pprof/ on the
+// TCP address addr (e.g. "localhost:6060") in the background.
+func servePprof(addr string, log rewrite.Logger) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", httppprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", httppprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", httppprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", httppprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", httppprof.Trace)
+	go func() {
+		if err := http.Serve(ln, mux); err != nil {
+			log.Errorf("Failed serving pprof: %v", err)
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,43 @@
+// Copyright 2022 Daniel Erat.
+// All rights reserved.
+
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestProfileFlags(t *testing.T) {
+	dir := t.TempDir()
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	pf := addProfileFlags(fs)
+	paths := []string{
+		filepath.Join(dir, "cpu"),
+		filepath.Join(dir, "mem"),
+		filepath.Join(dir, "trace"),
+	}
+	if err := fs.Parse([]string{
+		"-cpuprofile=" + paths[0],
+		"-memprofile=" + paths[1],
+		"-trace=" + paths[2],
+	}); err != nil {
+		t.Fatal(err)
+	}
+	stop, err := pf.start()
+	if err != nil {
+		t.Fatal("start failed:", err)
+	}
+	if err := stop(); err != nil {
+		t.Fatal("stop failed:", err)
+	}
+	for _, p := range paths {
+		if fi, err := os.Stat(p); err != nil {
+			t.Error(err)
+		} else if fi.Size() == 0 {
+			t.Errorf("%v is empty", p)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+// Copyright 2022 Daniel Erat.
+// All rights reserved.
+
+package main
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/derat/rendmail/rewrite"
+)
+
+// exitQuarantined is the exit code used when a message was delivered to -quarantine-dir
+// rather than being written to stdout. The MDA should stop processing the message.
+const exitQuarantined = 4
+
+// Conditions accepted by -quarantine-when.
+const (
+	quarantineDeleted    = "deleted"            // any part was deleted
+	quarantineExecutable = "deleted-executable" // an executable part was deleted
+	quarantineMalformed  = "malformed"          // the message was malformed
+)
+
+// checkQuarantineConds returns an error if conds contains unknown conditions.
+func checkQuarantineConds(conds []string) error {
+	for _, c := range conds {
+		switch c {
+		case quarantineDeleted, quarantineExecutable, quarantineMalformed:
+		default:
+			return fmt.Errorf("unknown quarantine condition %q", c)
+		}
+	}
+	return nil
+}
+
+// quarantineReason returns the first condition in conds that is satisfied
+// by rep, or an empty string if the message shouldn't be quarantined.
+func quarantineReason(conds []string, rep *rewrite.Report) string {
+	for _, c := range conds {
+		switch c {
+		case quarantineDeleted:
+			if len(rep.Deleted) > 0 {
+				return c
+			}
+		case quarantineExecutable:
+			for _, p := range rep.Deleted {
+				if isExecutable(p.MediaType, p.Filename) {
+					return c
+				}
+			}
+		case quarantineMalformed:
+			if rep.Malformed {
+				return c
+			}
+		}
+	}
+	return ""
+}
+
+// executableTypes contains lowercase media types used for executables.
+var executableTypes = map[string]struct{}{
+	"application/hta":                               {},
+	"application/java-archive":                      {},
+	"application/vnd.microsoft.portable-executable": {},
+	"application/x-dosexec":                         {},
+	"application/x-executable":                      {},
+	"application/x-msdos-program":                   {},
+	"application/x-msdownload":                      {},
+	"application/x-msi":                             {},
+	"application/x-ms-shortcut":                     {},
+}
+
+// executableExts contains lowercase extensions of filenames used for executables and scripts
+// that are commonly run by Windows when opened.
+var executableExts = map[string]struct{}{
+	".bat": {}, ".cmd": {}, ".com": {}, ".cpl": {}, ".dll": {}, ".exe": {}, ".hta": {},
+	".jar": {}, ".js": {}, ".jse": {}, ".lnk": {}, ".msi": {}, ".pif": {}, ".ps1": {},
+	".scr": {}, ".vbe": {}, ".vbs": {}, ".wsf": {},
+}
+
+// isExecutable returns true if a part with the supplied media type and filename
+// (either of which may be empty) appears to be executable.
+func isExecutable(mediaType, filename string) bool {
+	if _, ok := executableTypes[strings.ToLower(mediaType)]; ok {
+		return true
+	}
+	_, ok := executableExts[strings.ToLower(path.Ext(filename))]
+	return ok
+}
+
+// deliverQuarantine delivers msg to the Maildir at dir and returns the new file's path.
+func deliverQuarantine(dir string, msg []byte, now time.Time) (string, error) {
+	d, err := newMaildirDelivery(dir, now)
+	if err != nil {
+		return "", err
+	}
+	if _, err := d.Write(msg); err != nil {
+		d.abort()
+		return "", err
+	}
+	return d.commit()
+}
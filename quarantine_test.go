@@ -0,0 +1,78 @@
+// Copyright 2022 Daniel Erat.
+// All rights reserved.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/derat/rendmail/rewrite"
+)
+
+func TestQuarantineReason(t *testing.T) {
+	const (
+		msgFmt = "From: a@example.org\r\n" +
+			"MIME-Version: 1.0\r\n" +
+			"Content-Type: multipart/mixed; boundary=b\r\n" +
+			"\r\n" +
+			"--b\r\n" +
+			"Content-Type: text/plain\r\n" +
+			"\r\n" +
+			"Hi\r\n" +
+			"--b\r\n" +
+			"Content-Type: %s\r\n" +
+			"Content-Disposition: attachment; filename=\"%s\"\r\n" +
+			"\r\n" +
+			"data\r\n" +
+			"--b--\r\n"
+		all = quarantineDeleted + "," + quarantineExecutable + "," + quarantineMalformed
+	)
+	for _, tc := range []struct {
+		msg   string
+		del   string // opts.DeleteMediaTypes
+		conds string
+		want  string
+	}{
+		{fmt.Sprintf(msgFmt, "application/octet-stream", "run.EXE"),
+			"application/*", all, quarantineDeleted},
+		{fmt.Sprintf(msgFmt, "application/octet-stream", "run.EXE"),
+			"application/*", quarantineExecutable, quarantineExecutable},
+		{fmt.Sprintf(msgFmt, "application/x-msdownload", ""),
+			"application/*", quarantineExecutable, quarantineExecutable},
+		{fmt.Sprintf(msgFmt, "application/pdf", "doc.pdf"),
+			"application/*", quarantineExecutable + "," + quarantineMalformed, ""},
+		{fmt.Sprintf(msgFmt, "application/octet-stream", "run.exe"),
+			"image/*", all, ""},
+		{"From: a@example.org\r\nbad header\r\n\r\nBody\r\n", "", all, quarantineMalformed},
+		{"From: a@example.org\r\nbad header\r\n\r\nBody\r\n", "", quarantineDeleted, ""},
+	} {
+		opts := rewrite.Options{DeleteMediaTypes: splitList(tc.del)}
+		rep, err := rewrite.Rewrite(strings.NewReader(tc.msg), ioutil.Discard, &opts)
+		if err != nil {
+			t.Errorf("Rewriting %q failed: %v", tc.msg, err)
+			continue
+		}
+		if got := quarantineReason(splitList(tc.conds), rep); got != tc.want {
+			t.Errorf("quarantineReason(%q, ...) for %q = %q; want %q", tc.conds, tc.msg, got, tc.want)
+		}
+	}
+}
+
+func TestDeliverQuarantine(t *testing.T) {
+	dir := t.TempDir()
+	const msg = "Subject: Hi\r\n\r\nBody\r\n"
+	p, err := deliverQuarantine(dir, []byte(msg), time.Now())
+	if err != nil {
+		t.Fatal("deliverQuarantine failed:", err)
+	}
+	if b, err := ioutil.ReadFile(p); err != nil {
+		t.Error(err)
+	} else if !bytes.Equal(b, []byte(msg)) {
+		t.Errorf("%v contains %q; want %q", p, b, msg)
+	}
+}
@@ -0,0 +1,34 @@
+// Copyright 2022 Daniel Erat.
+// All rights reserved.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+
+	"github.com/derat/rendmail/rewrite"
+)
+
+// reportEntry is written as a line of JSON to -report for each rewritten message.
+type reportEntry struct {
+	Path string `json:"path,omitempty"` // message file, or empty for stdin
+	*rewrite.Report
+}
+
+// writeReport writes a line of JSON describing rep, which was produced
+// while rewriting the message at p (empty for stdin), to w.
+func writeReport(w io.Writer, p string, rep *rewrite.Report) error {
+	// Encode (which also adds a trailing newline) is used instead of json.Marshal
+	// to avoid escaping characters in filenames, and the entry is written with
+	// a single call so that concurrent writers don't interleave entries.
+	var b bytes.Buffer
+	enc := json.NewEncoder(&b)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(reportEntry{p, rep}); err != nil {
+		return err
+	}
+	_, err := w.Write(b.Bytes())
+	return err
+}
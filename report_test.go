@@ -0,0 +1,31 @@
+// Copyright 2022 Daniel Erat.
+// All rights reserved.
+
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/derat/rendmail/rewrite"
+)
+
+func TestWriteReport(t *testing.T) {
+	rep := rewrite.Report{
+		Parts:    2,
+		Deleted:  []rewrite.DeletedPart{{MediaType: "image/png", Size: 10, Filename: "<a>.png", Path: "2"}},
+		BytesIn:  100,
+		BytesOut: 50,
+		Options:  &rewrite.Options{},
+	}
+	var b bytes.Buffer
+	if err := writeReport(&b, "msg.eml", &rep); err != nil {
+		t.Fatal("writeReport failed:", err)
+	}
+	const want = `{"path":"msg.eml","parts":2,` +
+		`"deleted":[{"type":"image/png","size":10,"filename":"<a>.png","path":"2"}],` +
+		`"bytesIn":100,"bytesOut":50}` + "\n"
+	if got := b.String(); got != want {
+		t.Errorf("writeReport wrote %q; want %q", got, want)
+	}
+}
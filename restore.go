@@ -0,0 +1,166 @@
+// Copyright 2022 Daniel Erat.
+// All rights reserved.
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/derat/rendmail/rewrite"
+	"golang.org/x/crypto/openpgp"
+)
+
+// backupRecord returns the value of the rewrite.BackupField header field for
+// original message data written to the named backup file. If data is nil,
+// the value doesn't include a hash.
+//
+// The hash is unkeyed so that backups can be found and verified without any secrets
+// (e.g. in mbox files or by "backup verify"). Someone with the rewritten message could
+// use it to confirm a guess about a deleted part's exact contents, but the field is only
+// added by -record-backup, whose purpose is to let the message's recipient (who
+// controls the backups) restore those parts.
+func backupRecord(name string, data []byte) string {
+	if data == nil {
+		return filepath.Base(name)
+	}
+	sum := sha256.Sum256(data)
+	return filepath.Base(name) + "; sha256=" + hex.EncodeToString(sum[:])
+}
+
+// restoreMessage reads a message from r that was previously rewritten with its original
+// recorded in a rewrite.BackupField header field, finds the original in one of backupDirs, and
+// writes the message to w with the parts deleted by rendmail reinstated. keys are used to
+// decrypt OpenPGP-encrypted backups. Restored parts are logged to log, which may be nil.
+func restoreMessage(r io.Reader, w io.Writer, backupDirs []string, keys openpgp.EntityList, log rewrite.Logger) error {
+	msg, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	msg, rec, err := rewrite.RemoveHeaderField(msg, rewrite.BackupField)
+	if err != nil {
+		return err
+	} else if rec == "" {
+		return fmt.Errorf("message doesn't have %v header field", rewrite.BackupField)
+	}
+	orig, err := findBackup(backupDirs, rec, keys)
+	if err != nil {
+		return err
+	}
+
+	// Get the original versions of parts, either from a parts backup or the full message.
+	saved := readPartsBackup(orig)
+	if saved == nil {
+		oparts := rewrite.FindParts(orig)
+		saved = make(map[string][]byte, len(oparts))
+		for path, op := range oparts {
+			saved[path] = orig[op.Start:op.End]
+		}
+	}
+
+	// Find the stubs that were left in place of deleted parts.
+	paths, mparts := findDeletedStubs(msg)
+	// Replace later parts first so earlier offsets remain valid. Parts never overlap since
+	// stubs don't contain other parts.
+	sort.Slice(paths, func(i, j int) bool { return mparts[paths[i]].Start > mparts[paths[j]].Start })
+	for _, path := range paths {
+		mp := mparts[path]
+		op, ok := saved[path]
+		if !ok {
+			return fmt.Errorf("original message doesn't have part %q", path)
+		}
+		if log != nil {
+			log.Infof("Restoring part %q", path)
+		}
+		if path == "" {
+			msg = op // the whole message was deleted
+			break
+		}
+		var b bytes.Buffer
+		b.Write(msg[:mp.Start])
+		b.Write(op)
+		b.Write(msg[mp.End:])
+		msg = b.Bytes()
+	}
+	_, err = w.Write(msg)
+	return err
+}
+
+// findBackup returns the original message identified by rec (the value of a rewrite.BackupField
+// header field) in dirs. If the named file is missing or doesn't match the recorded hash,
+// all files in dirs are checked. Backups encrypted by pgpEncrypter are decrypted using keys.
+// dirs may also contain URLs accepted by newBackupStore, which can't be searched, and mbox
+// files, which are searched by hash.
+func findBackup(dirs []string, rec string, keys openpgp.EntityList) ([]byte, error) {
+	name, params, err := mime.ParseMediaType(rec)
+	if err != nil {
+		return nil, fmt.Errorf("bad %v %q: %v", rewrite.BackupField, rec, err)
+	}
+	want := strings.ToLower(params["sha256"])
+	matches := func(b []byte) bool {
+		sum := sha256.Sum256(b)
+		return want == "" || hex.EncodeToString(sum[:]) == want
+	}
+	var local []string
+	for _, dir := range dirs {
+		if b, err := readBackupFile(dir, path.Base(name), keys); err == nil && matches(b) {
+			return b, nil
+		}
+		if !strings.Contains(dir, "://") {
+			local = append(local, dir)
+		}
+	}
+	desc := strings.Join(dirs, ", ")
+	if want == "" {
+		return nil, fmt.Errorf("backup %v not found in %v", name, desc)
+	}
+	for _, dir := range local {
+		if fi, err := os.Stat(dir); err == nil && fi.Mode().IsRegular() {
+			if b, err := findMboxBackup(dir, want); err != nil {
+				return nil, err
+			} else if b != nil {
+				return b, nil
+			}
+			continue
+		}
+		fis, err := ioutil.ReadDir(dir)
+		if err != nil {
+			return nil, err
+		}
+		for _, fi := range fis {
+			if !fi.Mode().IsRegular() {
+				continue
+			}
+			if b, err := readBackupFile(dir, fi.Name(), keys); err == nil && matches(b) {
+				return b, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("no backup in %v has sha256 %v", desc, want)
+}
+
+// readBackupFile reads the backup named fn from dir, which may also be a URL accepted by
+// newBackupStore. Backups encrypted by pgpEncrypter are decrypted using keys.
+func readBackupFile(dir, fn string, keys openpgp.EntityList) ([]byte, error) {
+	var b []byte
+	st, err := newBackupStore(dir)
+	if err == nil && st != nil {
+		b, err = st.get(fn)
+	} else if err == nil {
+		b, err = ioutil.ReadFile(filepath.Join(dir, fn))
+	}
+	if err != nil || !strings.HasSuffix(fn, (&pgpEncrypter{}).ext()) {
+		return b, err
+	}
+	return decryptPGPBackup(b, keys)
+}
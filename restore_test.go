@@ -0,0 +1,69 @@
+// Copyright 2022 Daniel Erat.
+// All rights reserved.
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/derat/rendmail/rewrite"
+)
+
+func TestRestoreMessage(t *testing.T) {
+	for _, fn := range []string{
+		"rewrite/testdata/audio.in.txt",
+		"rewrite/testdata/add_placeholder.in.txt",
+		"rewrite/testdata/delimiter_after_header.in.txt",
+	} {
+		orig, err := ioutil.ReadFile(fn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		dir := t.TempDir()
+		const name = "20220415-151904-123"
+		if err := ioutil.WriteFile(filepath.Join(dir, name), orig, 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		opts := rewrite.Options{
+			BackupRecord:     backupRecord(name, orig),
+			DeleteMediaTypes: []string{"application/*", "audio/*", "image/*", "video/*"},
+			Now:              time.Date(2022, 4, 15, 15, 19, 4, 0, time.UTC),
+		}
+		var mod bytes.Buffer
+		if _, err := rewrite.Rewrite(bytes.NewReader(orig), &mod, &opts); err != nil {
+			t.Fatalf("rewrite.Rewrite(%v) failed: %v", fn, err)
+		}
+		if bytes.Equal(mod.Bytes(), orig) {
+			t.Fatalf("rewrite.Rewrite(%v) didn't change message", fn)
+		}
+
+		var got bytes.Buffer
+		if err := restoreMessage(bytes.NewReader(mod.Bytes()), &got, []string{dir}, nil, nil); err != nil {
+			t.Errorf("restoreMessage(%v) failed: %v", fn, err)
+		} else if !bytes.Equal(got.Bytes(), orig) {
+			t.Errorf("restoreMessage(%v) produced:\n%s", fn, got.Bytes())
+		}
+	}
+}
+
+func TestFindBackup(t *testing.T) {
+	dir := t.TempDir()
+	data := []byte("Subject: hi\n\nbody\n")
+	if err := ioutil.WriteFile(filepath.Join(dir, "renamed"), data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	// The file should be found by its hash even if it was renamed.
+	if got, err := findBackup([]string{dir}, backupRecord("original", data), nil); err != nil {
+		t.Errorf("findBackup() failed: %v", err)
+	} else if !bytes.Equal(got, data) {
+		t.Errorf("findBackup() = %q; want %q", got, data)
+	}
+	if _, err := findBackup([]string{dir}, backupRecord("original", []byte("other")), nil); err == nil {
+		t.Error("findBackup() unexpectedly succeeded for missing backup")
+	}
+}
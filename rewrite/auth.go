@@ -0,0 +1,99 @@
+// Copyright 2022 Daniel Erat.
+// All rights reserved.
+
+package rewrite
+
+import (
+	"bytes"
+	"net/mail"
+	"regexp"
+	"strings"
+)
+
+// authVerdict summarizes the results in an RFC 8601 Authentication-Results header field.
+type authVerdict string
+
+const (
+	authUnknown authVerdict = ""     // no relevant results
+	authPass    authVerdict = "pass" // at least one passing result and no failures
+	authFail    authVerdict = "fail" // at least one failing result
+)
+
+// matches returns true if v satisfies the -when-auth condition cond
+// ("pass", "fail", "any", or empty to match everything).
+func (v authVerdict) matches(cond string) bool {
+	switch cond {
+	case "", "any":
+		return true
+	default:
+		return string(v) == cond
+	}
+}
+
+// checksAuth returns true if opts.WhenAuth restricts deletion to a specific auth verdict.
+func (opts *Options) checksAuth() bool {
+	return opts.WhenAuth != "" && opts.WhenAuth != "any"
+}
+
+// topAuthVerdict returns the verdict from the topmost Authentication-Results field in
+// msg's top-level header. Only that field (presumably added by our own MTA) is trusted.
+func topAuthVerdict(msg []byte) authVerdict {
+	m, err := mail.ReadMessage(bytes.NewReader(trimLeadingJunk(msg)))
+	if err != nil {
+		return authUnknown // leave it to Rewrite to complain about malformed messages
+	}
+	return parseAuthResults(m.Header.Get("Authentication-Results"))
+}
+
+// authMethods lists the authentication methods that are considered by parseAuthResults.
+var authMethods = map[string]struct{}{"dkim": {}, "dmarc": {}, "spf": {}}
+
+// parseAuthResults examines the value of an Authentication-Results header field and returns
+// an overall verdict based on its DKIM, SPF, and DMARC results.
+func parseAuthResults(val string) authVerdict {
+	// Drop comments first, since they frequently contain semicolons and equals signs.
+	// Nested comments are removed from the inside out.
+	for {
+		s := authCommentRegexp.ReplaceAllString(val, "")
+		if s == val {
+			break
+		}
+		val = s
+	}
+
+	// RFC 8601 2.2:
+	//  authres-header-field = "Authentication-Results:" authres-payload
+	//  authres-payload = [CFWS] authserv-id
+	//           [ CFWS authres-version ]
+	//           ( no-result / 1*resinfo ) [CFWS] CRLF
+	//  resinfo = [CFWS] ";" methodspec [ CFWS reasonspec ]
+	//            [ CFWS 1*propspec ]
+	//  methodspec = [CFWS] method [CFWS] "=" [CFWS] result
+	verdict := authUnknown
+	parts := strings.Split(val, ";")
+	for _, p := range parts[1:] { // skip authserv-id
+		m := authResultRegexp.FindStringSubmatch(p)
+		if m == nil {
+			continue
+		}
+		if _, ok := authMethods[strings.ToLower(m[1])]; !ok {
+			continue
+		}
+		switch strings.ToLower(m[2]) {
+		case "pass":
+			if verdict == authUnknown {
+				verdict = authPass
+			}
+		case "fail", "softfail", "permerror":
+			return authFail
+		}
+	}
+	return verdict
+}
+
+// authCommentRegexp matches an innermost parenthesized comment.
+var authCommentRegexp = regexp.MustCompile(`\([^()]*\)`)
+
+// authResultRegexp matches a methodspec, capturing the method and result.
+// The method may have a version suffix, e.g. "dkim/1".
+var authResultRegexp = regexp.MustCompile(`^\s*([-A-Za-z0-9]+)(?:\s*/\s*\d+)?\s*=\s*([A-Za-z]+)`)
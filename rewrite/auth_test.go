@@ -0,0 +1,26 @@
+// Copyright 2022 Daniel Erat.
+// All rights reserved.
+
+package rewrite
+
+import "testing"
+
+func TestParseAuthResults(t *testing.T) {
+	for _, tc := range []struct {
+		val  string
+		want authVerdict
+	}{
+		{"mx.example.org; none", authUnknown},
+		{"mx.example.org; dkim=pass header.i=@example.com", authPass},
+		{"mx.example.org;\r\n dkim=pass header.i=@example.com;\r\n spf=fail smtp.mailfrom=a@example.com", authFail},
+		{"mx.example.org; spf=softfail (sender; dkim=pass) smtp.mailfrom=a@example.com", authFail},
+		{"mx.example.org; arc=fail; dkim=pass", authPass}, // arc isn't considered
+		{"mx.example.org 1; DKIM/1 = PASS", authPass},
+		{"mx.example.org; dmarc=permerror", authFail},
+		{"mx.example.org; (comment (nested; spf=fail)) dkim=neutral", authUnknown},
+	} {
+		if got := parseAuthResults(tc.val); got != tc.want {
+			t.Errorf("parseAuthResults(%q) = %q; want %q", tc.val, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,873 @@
+// Copyright 2022 Daniel Erat.
+// All rights reserved.
+
+package rewrite
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime/quotedprintable"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// leafPart holds a non-multipart message part's decoded body while it's being rewritten.
+type leafPart struct {
+	mediaType   string            // e.g. "text/plain"
+	params      map[string]string // Content-Type parameters
+	encoding    string            // original lowercase Content-Transfer-Encoding, e.g. "base64"
+	term        string            // line terminator used by the part's header
+	path        string            // position in MIME tree, e.g. "1.2"
+	parentType  string            // parent part's media type, or empty for the top-level part
+	disposition string            // e.g. "inline" or "attachment"
+	msg         *msgState         // state for the message containing the part
+	orig        []byte            // original encoded body
+	body        []byte            // body decoded per encoding
+
+	paramsChanged bool   // true if params was modified
+	altText       string // text/plain alternative to add for a text/html part
+
+	newEncoding string // Content-Transfer-Encoding to use when writing, or empty to keep encoding
+	changed     bool   // true if body was modified
+}
+
+// setParam sets a Content-Type parameter. params is copied first since
+// it may be shared with other parts.
+func (p *leafPart) setParam(name, val string) {
+	params := make(map[string]string, len(p.params)+1)
+	for k, v := range p.params {
+		params[k] = v
+	}
+	params[name] = val
+	p.params = params
+	p.paramsChanged = true
+}
+
+// deleteParams deletes the named Content-Type parameters.
+func (p *leafPart) deleteParams(names ...string) {
+	params := make(map[string]string, len(p.params))
+	for k, v := range p.params {
+		params[k] = v
+	}
+	for _, name := range names {
+		delete(params, name)
+	}
+	p.params = params
+	p.paramsChanged = true
+}
+
+// leafRewriter modifies p if needed.
+type leafRewriter func(p *leafPart, opts *Options)
+
+// leafRewriters lists functions that are run in order by copyLeafPart.
+var leafRewriters = []leafRewriter{
+	deleteEmbedded, // should precede transcodeUTF8 since yEnc data is raw 8-bit data
+	transcodeUTF8,  // should be early so later functions see UTF-8
+	truncateText,
+	sanitizeHTMLPart,
+	stripDataURIsPart,
+	convertFlowed,
+	stripSignature,
+	rewriteURLs,
+	appendFooter, // should be after rewriteURLs so the footer's URLs are kept
+	addTextAlt,
+	stripImageMetadataPart,
+	normalizeCTE,
+	rewrapBase64,
+	encodeBinary,
+	enforceLineLimit, // should be last so it sees the final body
+}
+
+// rewritesLeaves returns true if opts may require leaf parts' bodies to be rewritten.
+func (opts *Options) rewritesLeaves() bool {
+	return opts.EnforceLineLimit || opts.AddTextAlt || opts.SanitizeHTML || opts.TranscodeUTF8 || opts.NormalizeCTE != "" ||
+		opts.Footer != "" || opts.StripDataURIs || opts.RewrapBase64 ||
+		opts.FormatFlowed != "" || opts.StripSignature || opts.ScanEmbedded ||
+		opts.MaxTextSize > 0 || opts.StripImageMeta ||
+		opts.DefangURLs || opts.URLTemplate != ""
+}
+
+// convertsBinary returns true if opts.LineEndings would corrupt the body of a part with the
+// supplied media type and Content-Transfer-Encoding, i.e. the body contains binary data
+// in which CR and LF bytes aren't line terminators.
+func (opts *Options) convertsBinary(mediaType, encoding string) bool {
+	if !opts.convertsLineEndings() {
+		return false
+	}
+	return encoding == "binary" || encoding == "8bit" && !strings.HasPrefix(mediaType, "text/")
+}
+
+// convertsLineEndings returns true if opts.LineEndings requests conversion.
+func (opts *Options) convertsLineEndings() bool {
+	return opts.LineEndings == "crlf" || opts.LineEndings == "lf"
+}
+
+// canRewriteLeaf returns true if copyLeafPart can be used for a part with the supplied header.
+func canRewriteLeaf(hdata *headerData) bool {
+	// RFC 2046 5.2.1:
+	//  No encoding other than "7bit", "8bit", or "binary" is permitted for the body of a
+	//  "message/rfc822" entity.
+	return !hdata.deletePart &&
+		!strings.HasPrefix(hdata.mediaType, "multipart/") &&
+		!strings.HasPrefix(hdata.mediaType, "message/")
+}
+
+// copyLeafPart reads the body of a non-multipart part from lr, passes it to opts.TeePart and opts.Visit,
+// rewrites it using leafRewriters, and writes the part's header (hdr, updated if needed)
+// and body to w.
+// The return values and delim have the same meaning as in copyBody.
+func copyLeafPart(lr *lineReader, w io.Writer, hdr []byte, hdata *headerData, delim string,
+	parent *headerData, st *msgState, opts *Options) (end bool, err error) {
+	var body bytes.Buffer
+	delimLine, end, err := readBody(lr, &body, delim)
+	if err != nil {
+		// Write what we have so the rest of the message can still be copied in non-strict mode.
+		if _, werr := w.Write(hdr); werr != nil {
+			return false, werr
+		}
+		if _, werr := body.WriteTo(w); werr != nil {
+			return false, werr
+		}
+		return false, err
+	}
+
+	p := leafPart{
+		mediaType:   hdata.mediaType,
+		params:      hdata.contentParams,
+		encoding:    hdata.encoding,
+		term:        hdata.term,
+		path:        hdata.path,
+		disposition: hdata.disposition,
+		msg:         st,
+	}
+	if parent != nil {
+		p.parentType = parent.mediaType
+	}
+	orig := body.Bytes()
+	p.orig = orig
+	var decErr error
+	p.body, decErr = DecodeBody(orig, p.encoding)
+
+	if opts.teesBody(hdata) {
+		if err := teePart(hdata, orig, opts); err != nil {
+			return false, err
+		}
+	}
+	if opts.visitsBody(hdata) {
+		visited := p.body
+		if decErr != nil {
+			visited = orig
+		}
+		switch act := opts.Visit(newPartInfo(hdata, hdr), bytes.NewReader(visited)); act.op {
+		case deleteOp:
+			opts.Logger().Infof("Deleting %v", hdata.mediaType)
+			st.kept--
+			st.deleted = append(st.deleted, DeletedPart{hdata.mediaType, int64(len(orig)), hdata.decodedFilename(), hdata.path})
+			dhdr, err := deletedHeader(hdr, hdata, opts)
+			if err != nil {
+				return false, err
+			}
+			for _, b := range [][]byte{dhdr, []byte(delimLine)} {
+				if _, err := w.Write(b); err != nil {
+					return false, err
+				}
+			}
+			return end, nil
+		case replaceOp:
+			p.body, decErr = act.body, nil
+			p.changed = true
+		case failOp:
+			return false, act.err
+		}
+	}
+
+	if decErr != nil {
+		opts.Logger().Infof("Not rewriting %v part: %v", p.mediaType, decErr)
+	} else if (opts.rewritesLeaves() || opts.convertsBinary(hdata.mediaType, hdata.encoding)) &&
+		canRewriteLeaf(hdata) {
+		for _, fn := range leafRewriters {
+			if err := opts.checkContext(); err != nil {
+				return false, err
+			}
+			fn(&p, opts)
+		}
+	}
+
+	if p.changed || (p.newEncoding != "" && p.newEncoding != p.encoding) {
+		enc := p.newEncoding
+		if enc == "" {
+			enc = p.encoding
+		}
+		// 7-bit data can't hold 8-bit characters that may have been added.
+		if (enc == "" || enc == "7bit") && !isASCII(string(p.body)) {
+			enc = "quoted-printable"
+		}
+		if orig, err = EncodeBody(p.body, enc, p.term); err != nil {
+			return false, err
+		}
+		// The line break preceding the delimiter belongs to the delimiter (RFC 2046 5.1.1),
+		// but encoders don't necessarily end their output with one (e.g. quoted-printable
+		// drops a final LF following a bare CR).
+		if delimLine != "" && len(orig) > 0 && !bytes.HasSuffix(orig, []byte(p.term)) {
+			orig = append(orig, p.term...)
+		}
+		fields := make(map[string]string)
+		if enc != p.encoding {
+			fields["Content-Transfer-Encoding"] = enc
+		}
+		if p.paramsChanged {
+			fields["Content-Type"] = formatMediaType(p.mediaType, p.params)
+		}
+		if len(fields) > 0 {
+			hdr = []byte(replaceHeaderFields(string(hdr), p.term, fields))
+		}
+	}
+
+	if p.altText != "" {
+		if hdr, orig, err = makeAlternative(hdr, orig, &p); err != nil {
+			return false, err
+		}
+	}
+
+	for _, b := range [][]byte{hdr, orig, []byte(delimLine)} {
+		if _, err := w.Write(b); err != nil {
+			return false, err
+		}
+	}
+	return end, nil
+}
+
+// makeAlternative wraps a part with the supplied header and (encoded) body in a
+// multipart/alternative part that also includes p.altText as a text/plain part.
+// The new part's header and body are returned.
+func makeAlternative(hdr, body []byte, p *leafPart) (newHdr, newBody []byte, err error) {
+	text, err := EncodeBody([]byte(p.altText), "quoted-printable", p.term)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Generate a boundary from the content so that output is deterministic.
+	sum := sha256.Sum256(append(append([]byte{}, text...), body...))
+	bnd := generatedBoundaryPrefix + hex.EncodeToString(sum[:12])
+
+	// Content-* fields describe the original part, so they need to be moved into it.
+	outer, inner := splitContentFields(string(hdr))
+
+	var h, b bytes.Buffer
+	h.WriteString(outer)
+	h.WriteString("Content-Type: multipart/alternative;" + p.term + "\tboundary=\"" + bnd + "\"" + p.term)
+	h.WriteString(p.term)
+
+	b.WriteString("--" + bnd + p.term)
+	b.WriteString("Content-Type: text/plain; charset=utf-8" + p.term)
+	b.WriteString("Content-Transfer-Encoding: quoted-printable" + p.term)
+	b.WriteString(p.term)
+	b.Write(text)
+	b.WriteString("--" + bnd + p.term)
+	b.WriteString(inner)
+	b.WriteString(p.term)
+	b.Write(body)
+	if len(body) > 0 && body[len(body)-1] != '\n' {
+		b.WriteString(p.term)
+	}
+	b.WriteString("--" + bnd + "--" + p.term)
+	return h.Bytes(), b.Bytes(), nil
+}
+
+// splitContentFields splits hdr, a complete header including its trailing blank line, into
+// Content-* fields (inner) and all other fields (outer). The blank line is dropped.
+func splitContentFields(hdr string) (outer, inner string) {
+	var ob, ib strings.Builder
+	lr := newLineReader(strings.NewReader(hdr))
+	defer lr.release()
+	for {
+		folded, unfolded, err := lr.readFoldedLine()
+		if err != nil || unfolded == "" {
+			return ob.String(), ib.String()
+		}
+		if key, _, err := ParseHeaderField(unfolded); err == nil && strings.HasPrefix(key, "Content-") {
+			ib.WriteString(strings.Join(folded, ""))
+		} else {
+			ob.WriteString(strings.Join(folded, ""))
+		}
+	}
+}
+
+// readBody reads lines from lr and writes them to w until it finds delim at the beginning of
+// a line. Unlike copyBody, the delimiter line is returned rather than being written.
+// The end and err return values have the same meanings as in copyBody.
+func readBody(lr *lineReader, w io.Writer, delim string) (delimLine string, end bool, err error) {
+	ln, err := lr.copyUntilDelim(w, []byte(delim))
+	if err == io.EOF {
+		if delim != "" {
+			// This happens if a multipart message is truncated or the final delimiter is
+			// missing for some reason.
+			//
+			// For example, hard_ham/0142.0220f772ab37ba8d5899fc62f6878edf from the SpamAssassin
+			// corpus appears to be a multipart/alternative Oracle newsletter from 2002 that's
+			// missing an ending "--next_part_of_message--" delimiter.
+			return "", false, lr.errorf(UnexpectedEOF, "EOF while looking for delimiter %q", delim)
+		}
+		return "", true, nil
+	} else if err != nil {
+		return "", false, err
+	}
+	end = bytes.HasPrefix(ln[len(delim):], dashes)
+	if out := lr.outDelim(delim); out != delim {
+		return out + string(ln[len(delim):]), end, nil
+	}
+	return string(ln), end, nil
+}
+
+// IsIdentityEncoding returns true if the supplied Content-Transfer-Encoding
+// leaves data unchanged.
+func IsIdentityEncoding(enc string) bool {
+	switch enc {
+	case "", "7bit", "8bit", "binary":
+		return true
+	default:
+		return false
+	}
+}
+
+// DecodeBody decodes b per the supplied lowercase Content-Transfer-Encoding.
+func DecodeBody(b []byte, enc string) ([]byte, error) {
+	switch {
+	case IsIdentityEncoding(enc):
+		return b, nil
+	case enc == "quoted-printable":
+		return ioutil.ReadAll(quotedprintable.NewReader(bytes.NewReader(b)))
+	case enc == "base64":
+		return ioutil.ReadAll(base64.NewDecoder(base64.StdEncoding,
+			bytes.NewReader(bytes.Map(dropSpace, b))))
+	default:
+		return nil, fmt.Errorf("unsupported encoding %q", enc)
+	}
+}
+
+// dropSpace is a bytes.Map function that removes whitespace characters.
+func dropSpace(r rune) rune {
+	switch r {
+	case ' ', '\t', '\r', '\n':
+		return -1
+	default:
+		return r
+	}
+}
+
+// EncodeBody encodes b per the supplied lowercase Content-Transfer-Encoding.
+// Encoded lines are terminated by term.
+func EncodeBody(b []byte, enc, term string) ([]byte, error) {
+	var out bytes.Buffer
+	switch {
+	case IsIdentityEncoding(enc):
+		return b, nil
+	case enc == "quoted-printable":
+		qw := quotedprintable.NewWriter(&out)
+		if _, err := qw.Write(b); err != nil {
+			return nil, err
+		}
+		if err := qw.Close(); err != nil {
+			return nil, err
+		}
+		// quotedprintable.Writer always uses CRLF.
+		if term != "\r\n" {
+			return bytes.ReplaceAll(out.Bytes(), []byte("\r\n"), []byte(term)), nil
+		}
+		return out.Bytes(), nil
+	case enc == "base64":
+		// RFC 2045 6.8:
+		//  The encoded output stream must be represented in lines of no more than 76
+		//  characters each.
+		s := base64.StdEncoding.EncodeToString(b)
+		for len(s) > 0 {
+			n := 76
+			if n > len(s) {
+				n = len(s)
+			}
+			out.WriteString(s[:n] + term)
+			s = s[n:]
+		}
+		return out.Bytes(), nil
+	default:
+		return nil, fmt.Errorf("unsupported encoding %q", enc)
+	}
+}
+
+// replaceHeaderFields returns a copy of hdr, a complete header including its trailing blank
+// line, with fields replaced by the supplied values. fields is keyed by canonicalized names.
+// Only the first instance of each field is replaced; missing fields are added at the end.
+func replaceHeaderFields(hdr, term string, fields map[string]string) string {
+	var out strings.Builder
+	done := make(map[string]bool, len(fields))
+	lr := newLineReader(strings.NewReader(hdr))
+	defer lr.release()
+	for {
+		folded, unfolded, err := lr.readFoldedLine()
+		if err != nil || unfolded == "" {
+			for _, key := range sortedMapKeys(fields) {
+				if !done[key] {
+					out.WriteString(strings.Join(foldHeaderField(key+": "+fields[key], term), ""))
+				}
+			}
+			out.WriteString(strings.Join(folded, ""))
+			if err == nil {
+				// Copy anything after the header (e.g. a deleted part's original fields).
+				rest, _ := ioutil.ReadAll(lr.r)
+				out.Write(rest)
+			}
+			return out.String()
+		}
+		if key, _, err := ParseHeaderField(unfolded); err == nil {
+			if val, ok := fields[key]; ok && !done[key] {
+				out.WriteString(strings.Join(foldHeaderField(key+": "+val, term), ""))
+				done[key] = true
+				continue
+			}
+		}
+		out.WriteString(strings.Join(folded, ""))
+	}
+}
+
+// rewriteText decodes p's body from its charset and passes it to fn. If fn reports that it
+// changed the text, the new text is encoded using the original charset and saved to p.
+func rewriteText(p *leafPart, opts *Options, fn func(s string) (string, bool)) {
+	charset := p.params["charset"]
+	s, err := decodeText(p.body, charset, opts)
+	if err != nil {
+		opts.Logger().Infof("Not rewriting %v part: %v", p.mediaType, err)
+		return
+	}
+	s, changed := fn(s)
+	if !changed {
+		return
+	}
+	b, err := encodeText(s, charset, opts)
+	if err != nil {
+		opts.Logger().Infof("Not rewriting %v part: %v", p.mediaType, err)
+		return
+	}
+	p.body = b
+	p.changed = true
+}
+
+// deleteEmbedded deletes BinHex and yEnc data embedded in text/plain parts if
+// their media types are matched by opts.DeleteMediaTypes.
+func deleteEmbedded(p *leafPart, opts *Options) {
+	if !opts.ScanEmbedded || p.mediaType != "text/plain" {
+		return
+	}
+	s, deleted := deleteEmbeddedBinary(string(p.body), func(b *embeddedBlock) bool {
+		del, err := shouldDelete(b.mediaType, opts.DeleteMediaTypes, opts.KeepMediaTypes)
+		if err != nil || !del {
+			return false
+		}
+		if !p.msg.auth.matches(opts.WhenAuth) {
+			opts.Logger().Infof("Not deleting embedded %v due to %q auth verdict", b.mediaType, p.msg.auth)
+			return false
+		}
+		opts.Logger().Infof("Deleting embedded %v", b.mediaType)
+		return true
+	})
+	if len(deleted) == 0 {
+		return
+	}
+	for _, b := range deleted {
+		p.msg.deleted = append(p.msg.deleted, DeletedPart{b.mediaType, int64(b.size), b.name, p.path})
+	}
+	p.body = []byte(s)
+	p.changed = true
+}
+
+// transcodeUTF8 converts text/* parts to UTF-8.
+func transcodeUTF8(p *leafPart, opts *Options) {
+	if !opts.TranscodeUTF8 || !strings.HasPrefix(p.mediaType, "text/") {
+		return
+	}
+	switch charset := strings.ToLower(p.params["charset"]); charset {
+	case "", "us-ascii", "utf-8", "utf8":
+		return
+	default:
+		s, err := decodeText(p.body, charset, opts)
+		if err != nil {
+			opts.Logger().Infof("Not transcoding %v part: %v", p.mediaType, err)
+			return
+		}
+		opts.Logger().Infof("Transcoding %v part from %v to UTF-8", p.mediaType, charset)
+		p.body = []byte(s)
+		p.changed = true
+		p.setParam("charset", "utf-8")
+	}
+}
+
+// truncateText truncates the bodies of text/* parts that are larger than opts.MaxTextSize.
+// The truncated body, including the appended notice, fits within the limit unless the
+// limit is smaller than the notice (in which case the notice replaces the whole body),
+// so rewriting the output again doesn't change it.
+//
+// Parts are only cut where their charset permits: see textCutPoints. Parts in charsets
+// that don't encode line breaks as single LF bytes (e.g. UTF-16) are left alone.
+func truncateText(p *leafPart, opts *Options) {
+	if opts.MaxTextSize <= 0 || !strings.HasPrefix(p.mediaType, "text/") ||
+		len(p.body) <= opts.MaxTextSize || isTruncationNotice(p.body) {
+		return
+	}
+	charset := p.params["charset"]
+	lines, chars := textCutPoints(charset, opts)
+	if !lines {
+		opts.Logger().Infof("Not truncating %v part in charset %q", p.mediaType, charset)
+		return
+	}
+	// Leave room for the notice (whose count can't exceed the original size)
+	// and for terminators before and after it.
+	limit := opts.MaxTextSize - len(fmt.Sprintf(truncationNotice, len(p.body))) - 2*len(p.term)
+	if limit < 0 {
+		limit = 0
+	}
+	// Cut at the end of the last line that fits, or at the last character boundary
+	// if the first line is too long and the charset allows it.
+	n := bytes.LastIndexByte(p.body[:limit], '\n') + 1
+	if n == 0 && chars {
+		n = limit
+		for n > 0 && !utf8.RuneStart(p.body[n]) {
+			n--
+		}
+	}
+	removed := len(p.body) - n
+	opts.Logger().Infof("Truncating %v part by %d bytes", p.mediaType, removed)
+	body := append([]byte{}, p.body[:n]...)
+	if n > 0 && body[n-1] != '\n' {
+		body = append(body, p.term...)
+	}
+	body = append(body, fmt.Sprintf(truncationNotice, removed)...)
+	body = append(body, p.term...)
+	p.body = body
+	p.changed = true
+}
+
+// truncationNotice is a format string for the line appended by truncateText.
+const truncationNotice = "[Truncated %d bytes]"
+
+// isTruncationNotice returns true if body consists solely of a line added by
+// truncateText, as happens when MaxTextSize is smaller than the notice.
+func isTruncationNotice(body []byte) bool {
+	var n int
+	s := strings.TrimRight(string(body), "\r\n")
+	_, err := fmt.Sscanf(s, truncationNotice, &n)
+	return err == nil && s == fmt.Sprintf(truncationNotice, n)
+}
+
+// sanitizeHTMLPart removes tracking elements from text/html parts.
+func sanitizeHTMLPart(p *leafPart, opts *Options) {
+	if !opts.SanitizeHTML || p.mediaType != "text/html" {
+		return
+	}
+	rewriteText(p, opts, func(s string) (string, bool) {
+		s, n := sanitizeHTML(s)
+		if n > 0 {
+			opts.Logger().Infof("Removed %d tracking element(s) from HTML", n)
+		}
+		return s, n > 0
+	})
+}
+
+// stripDataURIsPart replaces large data: URIs in text/html parts.
+func stripDataURIsPart(p *leafPart, opts *Options) {
+	if !opts.StripDataURIs || p.mediaType != "text/html" {
+		return
+	}
+	rewriteText(p, opts, func(s string) (string, bool) {
+		s, n := stripDataURIs(s, opts.DataURIMinSize)
+		if n > 0 {
+			opts.Logger().Infof("Removed %d data: URI(s) from HTML", n)
+		}
+		return s, n > 0
+	})
+}
+
+// convertFlowed converts text/plain parts to or from format=flowed per opts.FormatFlowed.
+func convertFlowed(p *leafPart, opts *Options) {
+	if opts.FormatFlowed == "" || p.mediaType != "text/plain" || p.disposition == "attachment" {
+		return
+	}
+	flowed := strings.ToLower(p.params["format"]) == "flowed"
+	switch {
+	case opts.FormatFlowed == "fixed" && flowed:
+		delsp := strings.ToLower(p.params["delsp"]) == "yes"
+		rewriteText(p, opts, func(s string) (string, bool) { return unflowText(s, delsp), true })
+		if p.changed {
+			p.deleteParams("format", "delsp")
+		}
+	case opts.FormatFlowed == "flowed" && !flowed:
+		rewriteText(p, opts, func(s string) (string, bool) { return flowText(s), true })
+		if p.changed {
+			p.setParam("format", "flowed")
+		}
+	}
+}
+
+// stripSignature removes signature blocks from inline text/plain and text/html parts.
+func stripSignature(p *leafPart, opts *Options) {
+	if !opts.StripSignature || p.disposition == "attachment" {
+		return
+	}
+	var fn func(s string) (string, bool)
+	switch p.mediaType {
+	case "text/plain":
+		fn = stripTextSignature
+	case "text/html":
+		fn = func(s string) (string, bool) {
+			s, n := stripHTMLSignature(s)
+			return s, n > 0
+		}
+	default:
+		return
+	}
+	rewriteText(p, opts, func(s string) (string, bool) {
+		s, changed := fn(s)
+		if changed {
+			opts.Logger().Infof("Removed signature from %v part", p.mediaType)
+		}
+		return s, changed
+	})
+}
+
+// rewriteURLs defangs or rewrites URLs in text/plain and text/html parts.
+func rewriteURLs(p *leafPart, opts *Options) {
+	if (!opts.DefangURLs && opts.URLTemplate == "") ||
+		(p.mediaType != "text/plain" && p.mediaType != "text/html") {
+		return
+	}
+	var ur *urlRewriter
+	if opts.compiled != nil && opts.URLTemplate != "" {
+		ur = &urlRewriter{defang: opts.DefangURLs, tmpl: opts.compiled.urlTemplate}
+	} else {
+		var err error
+		if ur, err = newURLRewriter(opts.DefangURLs, opts.URLTemplate); err != nil {
+			opts.Logger().Infof("Not rewriting URLs: %v", err)
+			return
+		}
+	}
+	rewriteText(p, opts, func(s string) (string, bool) {
+		s, n, err := ur.rewrite(s, p.mediaType == "text/html")
+		if err != nil {
+			opts.Logger().Infof("Failed rewriting URL: %v", err)
+		}
+		return s, n > 0
+	})
+}
+
+// appendFooter appends opts.Footer to the first inline text/plain and text/html parts.
+func appendFooter(p *leafPart, opts *Options) {
+	if opts.Footer == "" || p.disposition == "attachment" {
+		return
+	}
+	var done *bool
+	switch p.mediaType {
+	case "text/plain":
+		done = &p.msg.textFooter
+	case "text/html":
+		done = &p.msg.htmlFooter
+	default:
+		return
+	}
+	if *done {
+		return
+	}
+
+	charset := p.params["charset"]
+	s, err := decodeText(p.body, charset, opts)
+	if err != nil {
+		opts.Logger().Infof("Not appending footer to %v part: %v", p.mediaType, err)
+		return
+	}
+	orig := s
+	if p.mediaType == "text/html" {
+		s = appendHTMLFooter(s, opts.Footer)
+	} else {
+		s = appendTextFooter(s, opts.Footer, p.term)
+	}
+	if s == orig {
+		*done = true // the footer was already present
+		return
+	}
+	// Switch to UTF-8 if the footer can't be represented in the part's charset.
+	b, err := encodeText(s, charset, opts)
+	if err != nil || (!isASCII(s) && isASCIICharset(charset)) {
+		b = []byte(s)
+		p.setParam("charset", "utf-8")
+	}
+	opts.Logger().Infof("Appending footer to %v part", p.mediaType)
+	p.body = b
+	p.changed = true
+	*done = true
+}
+
+// addTextAlt generates a plain-text version of a text/html part that is the message's
+// only displayable body (see findTextAltParts).
+func addTextAlt(p *leafPart, opts *Options) {
+	if !opts.AddTextAlt || p.mediaType != "text/html" || !p.msg.textAlt[p.path] {
+		return
+	}
+	s, err := decodeText(p.body, p.params["charset"], opts)
+	if err != nil {
+		opts.Logger().Infof("Not adding text alternative: %v", err)
+		return
+	}
+	p.altText = htmlToText(s)
+}
+
+// findTextAltParts returns the paths of text/html parts in the message in b that
+// should receive text/plain alternatives, i.e. the path of the message's only
+// displayable body if it's a text/html part.
+//
+// Inline text/plain and text/html parts and multipart/alternative parts are counted as
+// bodies, while attachments, the contents of multipart/alternative parts, and enclosed
+// messages aren't.
+func findTextAltParts(b []byte) map[string]bool {
+	parts := FindParts(b)
+	var bodies []string
+	for path, p := range parts {
+		if p.Disposition == "attachment" {
+			continue
+		}
+		switch p.MediaType {
+		case "text/plain", "text/html", "multipart/alternative":
+		default:
+			continue
+		}
+		nested := false
+		for anc := path; anc != "" && !nested; {
+			if i := strings.LastIndexByte(anc, '.'); i >= 0 {
+				anc = anc[:i]
+			} else {
+				anc = ""
+			}
+			switch parts[anc].MediaType {
+			case "multipart/alternative", "message/rfc822":
+				nested = true
+			}
+		}
+		if !nested {
+			bodies = append(bodies, path)
+		}
+	}
+	if len(bodies) != 1 || parts[bodies[0]].MediaType != "text/html" {
+		return nil
+	}
+	return map[string]bool{bodies[0]: true}
+}
+
+// sortedMapKeys returns m's keys in ascending order.
+func sortedMapKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// stripImageMetadataPart removes EXIF, GPS, and XMP metadata from JPEG and PNG parts.
+func stripImageMetadataPart(p *leafPart, opts *Options) {
+	if !opts.StripImageMeta || !strings.HasPrefix(p.mediaType, "image/") {
+		return
+	}
+	b, n, err := stripImageMetadata(p.body, p.mediaType)
+	if err != nil {
+		opts.Logger().Infof("Not stripping metadata from %v part: %v", p.mediaType, err)
+		return
+	}
+	if n == 0 {
+		return
+	}
+	opts.Logger().Infof("Removed %d metadata segment(s) from %v part", n, p.mediaType)
+	p.body = b
+	p.changed = true
+}
+
+// normalizeCTE switches text/* parts to the Content-Transfer-Encoding from opts.NormalizeCTE.
+func normalizeCTE(p *leafPart, opts *Options) {
+	if opts.NormalizeCTE == "" || !strings.HasPrefix(p.mediaType, "text/") {
+		return
+	}
+	enc := opts.NormalizeCTE
+	if enc == "8bit" && !is8BitSafe(p.body) {
+		enc = "quoted-printable"
+	}
+	if enc != p.encoding {
+		p.newEncoding = enc
+	}
+}
+
+// is8BitSafe returns true if b can be sent using the "8bit" Content-Transfer-Encoding.
+func is8BitSafe(b []byte) bool {
+	// RFC 2045 2.8:
+	//  "8bit data" refers to data that is all represented as relatively short lines with 998
+	//  octets or less between CRLF line separation sequences [RFC-821]), but octets with decimal
+	//  values greater than 127 may be used.  As with "7bit data" CR and LF octets only occur as
+	//  part of CRLF line separation sequences and no NULs are allowed.
+	for _, ln := range bytes.Split(b, []byte("\n")) {
+		ln = bytes.TrimSuffix(ln, []byte("\r"))
+		if len(ln) > maxLineLength || bytes.IndexByte(ln, 0) >= 0 || bytes.IndexByte(ln, '\r') >= 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// rewrapBase64 re-encodes base64 parts that aren't wrapped to 76-character lines.
+func rewrapBase64(p *leafPart, opts *Options) {
+	if !opts.RewrapBase64 || p.encoding != "base64" || p.changed ||
+		(p.newEncoding != "" && p.newEncoding != "base64") {
+		return
+	}
+	// RFC 2045 6.8:
+	//  The encoded output stream must be represented in lines of no more than 76
+	//  characters each.
+	for _, ln := range bytes.Split(p.orig, []byte("\n")) {
+		if len(bytes.TrimSuffix(ln, []byte("\r"))) > 76 {
+			opts.Logger().Infof("Rewrapping base64-encoded %v part", p.mediaType)
+			p.changed = true
+			return
+		}
+	}
+}
+
+// encodeBinary switches p to base64 encoding if opts.LineEndings would otherwise corrupt it.
+func encodeBinary(p *leafPart, opts *Options) {
+	enc := p.newEncoding
+	if enc == "" {
+		enc = p.encoding
+	}
+	if !opts.convertsBinary(p.mediaType, enc) {
+		return
+	}
+	opts.Logger().Infof("Encoding %v part with %v data as base64", p.mediaType, enc)
+	p.newEncoding = "base64"
+}
+
+// enforceLineLimit re-encodes p if it contains overlong lines. Text parts are switched to
+// quoted-printable encoding. Other parts are switched to base64 since quoted-printable
+// would turn CR and LF bytes in binary data into line breaks.
+func enforceLineLimit(p *leafPart, opts *Options) {
+	if !opts.EnforceLineLimit || !IsIdentityEncoding(p.encoding) || p.newEncoding != "" {
+		return
+	}
+	for _, ln := range bytes.Split(p.body, []byte("\n")) {
+		if len(bytes.TrimSuffix(ln, []byte("\r"))) > maxLineLength {
+			p.newEncoding = "base64"
+			if strings.HasPrefix(p.mediaType, "text/") {
+				p.newEncoding = "quoted-printable"
+			}
+			opts.Logger().Infof("Encoding %v part with overlong line as %v", p.mediaType, p.newEncoding)
+			return
+		}
+	}
+}
@@ -0,0 +1,202 @@
+// Copyright 2022 Daniel Erat.
+// All rights reserved.
+
+package rewrite
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestEncodeBody(t *testing.T) {
+	long := strings.Repeat("abc ", 30)
+	for _, tc := range []struct {
+		body, enc, term string
+	}{
+		{"plain text\n", "7bit", "\n"},
+		{"café\nline two\n", "quoted-printable", "\n"},
+		{"café\r\nline two\r\n", "quoted-printable", "\r\n"},
+		{long + "\n", "quoted-printable", "\n"},
+		{long + "\n", "base64", "\r\n"},
+		{"", "base64", "\n"},
+	} {
+		enc, err := EncodeBody([]byte(tc.body), tc.enc, tc.term)
+		if err != nil {
+			t.Errorf("EncodeBody(%q, %q, %q) failed: %v", tc.body, tc.enc, tc.term, err)
+			continue
+		}
+		for _, ln := range strings.SplitAfter(string(enc), "\n") {
+			if len(ln) > 76+len(tc.term) {
+				t.Errorf("EncodeBody(%q, %q, %q) produced long line %q", tc.body, tc.enc, tc.term, ln)
+			}
+		}
+		if dec, err := DecodeBody(enc, tc.enc); err != nil {
+			t.Errorf("DecodeBody(%q, %q) failed: %v", enc, tc.enc, err)
+		} else if string(dec) != tc.body {
+			t.Errorf("DecodeBody(%q, %q) = %q; want %q", enc, tc.enc, dec, tc.body)
+		}
+	}
+}
+
+func TestRewrite_enforceLineLimit(t *testing.T) {
+	const (
+		start = "Subject: Hi\n" +
+			"Content-Type: multipart/mixed; boundary=b\n" +
+			"\n" +
+			"--b\n"
+		end = "--b--\n"
+	)
+	long := strings.Repeat("x", 1000)
+	bin := long + "\r\n\x00\xff\r\xfe\n"
+	for _, tc := range []struct {
+		part, want string
+	}{
+		{
+			// Binary data would be corrupted by quoted-printable's handling of line breaks.
+			"Content-Type: application/octet-stream\n\n" + bin,
+			"Content-Type: application/octet-stream\nContent-Transfer-Encoding: base64\n\n" +
+				string(mustEncodeBody(t, []byte(bin), "base64", "\n")),
+		},
+		{
+			// Quoted-printable drops the final LF after a bare CR, but the delimiter still
+			// needs to start a new line.
+			"Content-Type: text/plain\n\n" + long + "\r\xff\n",
+			"Content-Type: text/plain\nContent-Transfer-Encoding: quoted-printable\n\n" +
+				string(mustEncodeBody(t, []byte(long+"\r\xff\n"), "quoted-printable", "\n")),
+		},
+	} {
+		in := start + tc.part + end
+		var b bytes.Buffer
+		if _, err := Rewrite(strings.NewReader(in), &b, &Options{EnforceLineLimit: true}); err != nil {
+			t.Errorf("Rewrite(%q) failed: %v", in, err)
+			continue
+		}
+		if got := b.String(); !strings.HasSuffix(got, "\n"+end) {
+			t.Errorf("Rewrite(%q) wrote %q without closing delimiter", in, got)
+		} else if got, want := strings.TrimSuffix(got, "\n"+end), start+strings.TrimSuffix(tc.want, "\n"); got != want {
+			t.Errorf("Rewrite(%q) wrote %q; want %q", in, got, want)
+		}
+	}
+}
+
+func mustEncodeBody(t *testing.T, b []byte, enc, term string) []byte {
+	out, err := EncodeBody(b, enc, term)
+	if err != nil {
+		t.Fatalf("EncodeBody(%q, %q) failed: %v", b, enc, err)
+	}
+	return out
+}
+
+func TestReplaceHeaderFields(t *testing.T) {
+	const hdr = "Content-Type: text/plain\n" +
+		"Content-Transfer-Encoding:\n 7bit\n" +
+		"Subject: hi\n" +
+		"\n"
+	for _, tc := range []struct {
+		fields map[string]string
+		want   string
+	}{
+		{nil, hdr},
+		{map[string]string{"Content-Transfer-Encoding": "base64"},
+			"Content-Type: text/plain\n" +
+				"Content-Transfer-Encoding: base64\n" +
+				"Subject: hi\n" +
+				"\n"},
+		{map[string]string{"Content-Type": "text/html", "X-New": "value"},
+			"Content-Type: text/html\n" +
+				"Content-Transfer-Encoding:\n 7bit\n" +
+				"Subject: hi\n" +
+				"X-New: value\n" +
+				"\n"},
+	} {
+		if got := replaceHeaderFields(hdr, "\n", tc.fields); got != tc.want {
+			t.Errorf("replaceHeaderFields(%q, %q) = %q; want %q", hdr, tc.fields, got, tc.want)
+		}
+	}
+}
+
+func TestIs8BitSafe(t *testing.T) {
+	for _, tc := range []struct {
+		body string
+		want bool
+	}{
+		{"", true},
+		{"café\nau lait\n", true},
+		{"café\r\nau lait\r\n", true},
+		{strings.Repeat("a", maxLineLength) + "\n", true},
+		{strings.Repeat("a", maxLineLength+1) + "\n", false},
+		{"nul\x00byte\n", false},
+		{"bare\rcr\n", false},
+	} {
+		if got := is8BitSafe([]byte(tc.body)); got != tc.want {
+			t.Errorf("is8BitSafe(%q) = %v; want %v", tc.body, got, tc.want)
+		}
+	}
+}
+
+func TestTruncateText(t *testing.T) {
+	for _, tc := range []struct {
+		charset string
+		body    string
+		max     int
+		want    string
+	}{
+		{"", "short\n", 10, "short\n"},
+		{"", "line one\nline two\nline three\nline four\nline five\n", 40, "line one\nline two\n[Truncated 31 bytes]\n"},
+		{"utf-8", "ééééééééééééééé\n", 27, "éé\n[Truncated 27 bytes]\n"},
+		{"iso-8859-1", strings.Repeat("\xe9", 30) + "\n", 26, "\xe9\xe9\xe9\xe9\n[Truncated 27 bytes]\n"},
+		// Multibyte charsets other than UTF-8 are only cut at line boundaries.
+		{"shift_jis", "\x93\xfa\x96\x7b\n" + strings.Repeat("\x93\xfa\x96\x7b", 8) + "\n", 28, "\x93\xfa\x96\x7b\n[Truncated 33 bytes]\n"},
+		{"shift_jis", strings.Repeat("\x93\xfa\x96\x7b", 8) + "\n", 24, "[Truncated 33 bytes]\n"},
+		{"iso-2022-jp", "\x1b$BF|K\\\x1b(B\n\x1b$B" + strings.Repeat("F|K\\", 4) + "\x1b(B\n", 33, "\x1b$BF|K\\\x1b(B\n[Truncated 23 bytes]\n"},
+		// Charsets that don't encode LF as a single byte aren't truncated.
+		{"utf-16le", "a\x00b\x00c\x00d\x00e\x00f\x00g\x00h\x00i\x00j\x00k\x00l\x00\n\x00", 20, "a\x00b\x00c\x00d\x00e\x00f\x00g\x00h\x00i\x00j\x00k\x00l\x00\n\x00"},
+		{"bogus", "abcdefghijklmnopqrstuvwxyz\n", 20, "abcdefghijklmnopqrstuvwxyz\n"},
+		// The notice is used by itself if the limit is too small to hold anything else.
+		{"", "abcdefghij\n", 5, "[Truncated 11 bytes]\n"},
+		{"", "[Truncated 11 bytes]\n", 5, "[Truncated 11 bytes]\n"},
+	} {
+		p := leafPart{mediaType: "text/plain", params: map[string]string{"charset": tc.charset},
+			term: "\n", body: []byte(tc.body)}
+		truncateText(&p, &Options{MaxTextSize: tc.max})
+		if got := string(p.body); got != tc.want {
+			t.Errorf("truncateText(%q, %q) with max %d = %q; want %q",
+				tc.charset, tc.body, tc.max, got, tc.want)
+		}
+	}
+}
+
+func TestFindTextAltParts(t *testing.T) {
+	const (
+		html  = "Content-Type: text/html\n\n<p>Hi</p>\n"
+		plain = "Content-Type: text/plain\n\nHi\n"
+		image = "Content-Type: image/png\nContent-Disposition: attachment\n\ndata\n"
+	)
+	multipart := func(mtype string, parts ...string) string {
+		s := "Content-Type: " + mtype + "; boundary=b\n\n"
+		for _, p := range parts {
+			s += "--b\n" + p
+		}
+		return s + "--b--\n"
+	}
+	for _, tc := range []struct {
+		desc, msg string
+		want      map[string]bool
+	}{
+		{"html", html, map[string]bool{"": true}},
+		{"plain", plain, nil},
+		{"html and attachment", multipart("multipart/mixed", html, image), map[string]bool{"1": true}},
+		{"plain and html", multipart("multipart/mixed", plain, html), nil},
+		{"html and html attachment", multipart("multipart/mixed", html,
+			"Content-Type: text/html\nContent-Disposition: attachment\n\n<p>Att</p>\n"), map[string]bool{"1": true}},
+		{"alternative", multipart("multipart/alternative", plain, html), nil},
+		{"html and forwarded message", multipart("multipart/mixed", html,
+			"Content-Type: message/rfc822\n\n"+plain), map[string]bool{"1": true}},
+	} {
+		if got := findTextAltParts([]byte(tc.msg)); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("findTextAltParts() for %v = %v; want %v", tc.desc, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,186 @@
+// Copyright 2022 Daniel Erat.
+// All rights reserved.
+
+package rewrite
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"strings"
+)
+
+// openDelim describes the boundary delimiter of a multipart part that's being read.
+type openDelim struct {
+	delim string // delimiter from the input, e.g. "--abc"
+	out   string // delimiter to write in place of delim
+	path  string // path of the multipart part
+}
+
+// pushBoundary should be called before reading the enclosed parts of the multipart part
+// described by hdata, whose delimiter is delim. A warning is logged if delim collides with
+// an enclosing part's delimiter. The delimiter that should be written is returned.
+func pushBoundary(lr *lineReader, delim string, hdata *headerData, st *msgState, opts *Options) string {
+	checkBoundary(lr, delim, hdata, st, opts)
+	out := delim
+	if hdata.boundary != "" {
+		out = "--" + hdata.boundary
+	}
+	lr.delims = append(lr.delims, openDelim{delim, out, hdata.path})
+	return out
+}
+
+// popBoundary undoes the most recent call to pushBoundary after the multipart part's closing
+// delimiter has been read. A warning is logged if an enclosing part's delimiter was seen.
+func popBoundary(lr *lineReader, st *msgState, opts *Options) {
+	lr.delims = lr.delims[:len(lr.delims)-1]
+	checkStrayDelim(lr, st, opts)
+}
+
+// outDelim returns the delimiter that should be written in place of delim.
+func (lr *lineReader) outDelim(delim string) string {
+	for i := len(lr.delims) - 1; i >= 0; i-- {
+		if lr.delims[i].delim == delim {
+			return lr.delims[i].out
+		}
+	}
+	return delim
+}
+
+// strayChecker is an io.Writer used by lineReader.copyUntilDelim to look for delimiter
+// lines belonging to enclosing multipart parts. Writes must start at the beginning of lines.
+type strayChecker struct {
+	w     io.Writer
+	lr    *lineReader
+	delim string // delimiter being searched for by copyUntilDelim
+}
+
+func (sc *strayChecker) Write(p []byte) (int, error) {
+	if sc.lr.stray == nil {
+		for _, od := range sc.lr.delims {
+			if od.delim != sc.delim && hasLinePrefix(p, od.delim) {
+				sc.lr.stray = &od
+				break
+			}
+		}
+	}
+	return sc.w.Write(p)
+}
+
+// hasLinePrefix returns true if any of the lines in p begin with prefix.
+func hasLinePrefix(p []byte, prefix string) bool {
+	pre := []byte(prefix)
+	if bytes.HasPrefix(p, pre) {
+		return true
+	}
+	for _, term := range []string{"\n", "\r"} {
+		if bytes.Contains(p, append([]byte(term), pre...)) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkBoundary checks whether the delimiter delim of the multipart part described by hdata
+// collides with the delimiters of enclosing parts.
+//
+// RFC 2046 5.1.2:
+//
+//	[...] it is essential that the composing agent choose a boundary that does not
+//	appear anywhere in the enclosed body parts [...] The boundary in an enclosed
+//	multipart entity must be different from the boundaries of all enclosing entities.
+func checkBoundary(lr *lineReader, delim string, hdata *headerData, st *msgState, opts *Options) {
+	for _, od := range lr.delims {
+		// Delimiter lines are matched by prefix, so a delimiter that's a prefix of
+		// another one is also ambiguous.
+		if strings.HasPrefix(delim, od.delim) || strings.HasPrefix(od.delim, delim) {
+			opts.warnf("Boundary %q collides with boundary %q of enclosing part", delim[2:], od.delim[2:])
+			st.collided(hdata.path)
+			return
+		}
+	}
+}
+
+// checkStrayDelim reports a delimiter line belonging to an enclosing part that was
+// found by strayChecker within a part that doesn't use it.
+func checkStrayDelim(lr *lineReader, st *msgState, opts *Options) {
+	if lr.stray == nil {
+		return
+	}
+	if lr.stray.path == "" {
+		opts.warnf("Found delimiter for top-level boundary %q within enclosed part", lr.stray.delim[2:])
+	} else {
+		opts.warnf("Found delimiter for part %v's boundary %q within enclosed part", lr.stray.path, lr.stray.delim[2:])
+	}
+	st.collided(lr.stray.path)
+	lr.stray = nil
+}
+
+// collided records that the boundary of the multipart part at path collides with another
+// delimiter and should be regenerated if Options.FixBoundaries is set.
+func (st *msgState) collided(path string) {
+	if st.collisions == nil {
+		st.collisions = make(map[string]bool)
+	}
+	st.collisions[path] = true
+}
+
+// regeneratesBoundary returns true if the boundary bnd of the multipart part at path
+// should be replaced, either because it collides with another delimiter (when
+// Options.FixBoundaries is set) or because Options.RewriteBoundaries is set.
+// Boundaries that were already generated by regenerateBoundary are left alone
+// by the latter so that rewriting a message again doesn't change it.
+func regeneratesBoundary(bnd, path string, st *msgState, opts *Options) bool {
+	if bnd == "" {
+		return false
+	}
+	return st.regen[path] || opts.RewriteBoundaries && !isGeneratedBoundary(bnd)
+}
+
+// regenerateContentType sets hdata.boundary to a regenerated boundary and returns
+// a folded Content-Type field using it.
+func regenerateContentType(hdata *headerData, term string, opts *Options) []string {
+	bnd := hdata.contentParams["boundary"]
+	hdata.boundary = regenerateBoundary(bnd, hdata.path)
+	opts.Logger().Infof("Replacing boundary %q with %q", bnd, hdata.boundary)
+	params := make(map[string]string, len(hdata.contentParams))
+	for k, v := range hdata.contentParams {
+		params[k] = v
+	}
+	params["boundary"] = hdata.boundary
+	return foldHeaderField("Content-Type: "+formatMediaType(hdata.mediaType, params), term)
+}
+
+// findBoundaryCollisions returns the paths of multipart parts in msg with colliding
+// boundaries as reported by checkBoundary and checkStrayDelim. Other problems are ignored.
+func findBoundaryCollisions(msg []byte) map[string]bool {
+	lr := newLineReader(bytes.NewReader(msg))
+	defer lr.release()
+	var st msgState
+	copyMessagePart(lr, ioutil.Discard, "", nil, &st, &Options{report: &Report{}})
+	return st.collisions
+}
+
+// regenerateBoundary returns a replacement for the boundary bnd of the multipart
+// part at path. The replacement is generated from the original so that output is
+// deterministic, and it uses the same "=_" prefix as makeAlternative, which can't
+// appear in quoted-printable or base64 data.
+func regenerateBoundary(bnd, path string) string {
+	sum := sha256.Sum256([]byte(path + "\x00" + bnd))
+	return generatedBoundaryPrefix + hex.EncodeToString(sum[:12])
+}
+
+// generatedBoundaryPrefix prefixes boundaries generated by rendmail.
+const generatedBoundaryPrefix = "=_rendmail_"
+
+// isGeneratedBoundary returns true if bnd looks like it was generated by
+// regenerateBoundary or makeAlternative.
+func isGeneratedBoundary(bnd string) bool {
+	if !strings.HasPrefix(bnd, generatedBoundaryPrefix) {
+		return false
+	}
+	b, err := hex.DecodeString(bnd[len(generatedBoundaryPrefix):])
+	return err == nil && len(b) == 12
+}
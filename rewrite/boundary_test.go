@@ -0,0 +1,111 @@
+// Copyright 2022 Daniel Erat.
+// All rights reserved.
+
+package rewrite
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestRewrite_boundaryCollision(t *testing.T) {
+	const text = "Content-Type: text/plain\n\nHello\n"
+	multi := func(bnd string, parts ...string) string {
+		s := "Content-Type: multipart/mixed; boundary=\"" + bnd + "\"\n\n"
+		for _, p := range parts {
+			s += "--" + bnd + "\n" + p
+		}
+		return s + "--" + bnd + "--\n"
+	}
+
+	// The inner part reuses the outer part's boundary.
+	reused := multi("abc", multi("abc", text), text)
+	// The inner part's boundary starts with the outer part's boundary.
+	prefixed := multi("abc", multi("abcd", text), text)
+	// An outer delimiter appears within a part that's enclosed by the inner part.
+	stray := multi("abc", multi("def", text+"--abc\n"), text)
+
+	for _, tc := range []struct {
+		in, want string
+		fix      bool
+	}{
+		{reused, reused, false},
+		{reused, strings.Replace(reused, multi("abc", text), multi(regenerateBoundary("abc", "1"), text), 1), true},
+		{prefixed, prefixed, false},
+		{prefixed, strings.Replace(prefixed, multi("abcd", text), multi(regenerateBoundary("abcd", "1"), text), 1), true},
+		{stray, stray, false},
+		{stray, multi(regenerateBoundary("abc", ""), multi("def", text+"--abc\n"), text), true},
+	} {
+		var b bytes.Buffer
+		opts := Options{DeleteMediaTypes: []string{"image/*"}, FixBoundaries: tc.fix}
+		rep, err := Rewrite(strings.NewReader(tc.in), &b, &opts)
+		if err != nil {
+			t.Errorf("Rewrite with fix=%v failed for %q: %v", tc.fix, tc.in, err)
+			continue
+		}
+		if got := b.String(); got != tc.want {
+			t.Errorf("Rewrite with fix=%v wrote %q for %q; want %q", tc.fix, got, tc.in, tc.want)
+		}
+		if len(rep.Warnings) == 0 {
+			t.Errorf("Rewrite with fix=%v didn't warn for %q", tc.fix, tc.in)
+		}
+		if tc.fix {
+			if got := findBoundaryCollisions(b.Bytes()); len(got) != 0 {
+				t.Errorf("Output for %q still has colliding boundaries at %v", tc.in, got)
+			}
+		}
+	}
+
+	// Distinct boundaries shouldn't be reported.
+	var b bytes.Buffer
+	in := multi("abc", multi("def", text), text)
+	if rep, err := Rewrite(strings.NewReader(in), &b, &Options{FixBoundaries: true}); err != nil {
+		t.Errorf("Rewrite failed for %q: %v", in, err)
+	} else if got := b.String(); got != in || len(rep.Warnings) != 0 {
+		t.Errorf("Rewrite wrote %q with warnings %q for %q; want unchanged", got, rep.Warnings, in)
+	}
+}
+
+func TestRewrite_rewriteBoundaries(t *testing.T) {
+	const text = "Content-Type: text/plain\n\nHello\n"
+	in := "Subject: Hi\n" +
+		"Content-Type: multipart/mixed; boundary=\"abc \"; charset=us-ascii\n" +
+		"\n" +
+		"Preamble\n" +
+		"--abc \n" +
+		"Content-Type: multipart/alternative; boundary=\"a<b>[c]\"\n" +
+		"\n" +
+		"--a<b>[c]\n" + text +
+		"--a<b>[c]--\n" +
+		"--abc \n" + text +
+		"--abc --\n"
+	outer := regenerateBoundary("abc ", "")
+	inner := regenerateBoundary("a<b>[c]", "1")
+	want := "Subject: Hi\n" +
+		"Content-Type: multipart/mixed; boundary=\"" + outer + "\";\n charset=us-ascii\n" +
+		"\n" +
+		"Preamble\n" +
+		"--" + outer + "\n" +
+		"Content-Type: multipart/alternative;\n boundary=\"" + inner + "\"\n" +
+		"\n" +
+		"--" + inner + "\n" + text +
+		"--" + inner + "--\n" +
+		"--" + outer + "\n" + text +
+		"--" + outer + "--\n"
+	if err := parseStdlib(strings.NewReader(want)); err != nil {
+		t.Fatal("Expected output is broken:", err)
+	}
+
+	for _, msg := range []string{in, want} {
+		var b bytes.Buffer
+		rep, err := Rewrite(strings.NewReader(msg), &b, &Options{RewriteBoundaries: true})
+		if err != nil {
+			t.Errorf("Rewrite failed for %q: %v", msg, err)
+		} else if got := b.String(); got != want {
+			t.Errorf("Rewrite wrote %q for %q; want %q", got, msg, want)
+		} else if msg == want && len(rep.Headers) != 0 {
+			t.Errorf("Rewrite reported changed header fields %q for own output", rep.Headers)
+		}
+	}
+}
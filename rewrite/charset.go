@@ -0,0 +1,160 @@
+// Copyright 2022 Daniel Erat.
+// All rights reserved.
+
+package rewrite
+
+import (
+	"fmt"
+	"io"
+	"mime"
+	"strings"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/charmap"
+	"golang.org/x/text/encoding/htmlindex"
+	"golang.org/x/text/encoding/ianaindex"
+)
+
+// CharsetRegistry looks up encodings for MIME charset names. Options.Charsets
+// can be set to control which charsets are supported.
+//
+// US-ASCII and UTF-8 are always supported, and RFC 2047 encoded-words in
+// header fields additionally always support ISO-8859-1.
+type CharsetRegistry interface {
+	// Lookup returns the encoding for name, e.g. "iso-8859-1", or an error
+	// if the charset isn't supported.
+	Lookup(name string) (encoding.Encoding, error)
+}
+
+var (
+	// HTMLCharsets supports the encodings from the WHATWG Encoding Standard
+	// via golang.org/x/text/encoding/htmlindex. It's used for message bodies
+	// if Options.Charsets is nil.
+	HTMLCharsets CharsetRegistry = htmlCharsets{}
+	// IANACharsets supports all of the encodings in golang.org/x/text/encoding
+	// via golang.org/x/text/encoding/ianaindex.
+	IANACharsets CharsetRegistry = ianaCharsets{}
+)
+
+type htmlCharsets struct{}
+
+func (htmlCharsets) Lookup(name string) (encoding.Encoding, error) { return htmlindex.Get(name) }
+
+type ianaCharsets struct{}
+
+func (ianaCharsets) Lookup(name string) (encoding.Encoding, error) {
+	enc, err := ianaindex.MIME.Encoding(name)
+	if err == nil && enc == nil {
+		err = fmt.Errorf("unsupported charset %q", name)
+	}
+	return enc, err
+}
+
+// CharsetMap is a CharsetRegistry supporting a fixed set of charsets.
+type CharsetMap struct {
+	Charsets map[string]encoding.Encoding // keyed by lowercase name
+	Fallback CharsetRegistry              // consulted for other names if non-nil
+}
+
+func (cm *CharsetMap) Lookup(name string) (encoding.Encoding, error) {
+	if enc, ok := cm.Charsets[strings.ToLower(strings.TrimSpace(name))]; ok {
+		return enc, nil
+	}
+	if cm.Fallback != nil {
+		return cm.Fallback.Lookup(name)
+	}
+	return nil, fmt.Errorf("unsupported charset %q", name)
+}
+
+// defaultHeaderCharsets is used for RFC 2047 encoded-words if Options.Charsets is nil.
+// mime.WordDecoder supports UTF-8, ISO-8859-1, and US-ASCII itself.
+var defaultHeaderCharsets = &CharsetMap{Charsets: map[string]encoding.Encoding{
+	"windows-1252": charmap.Windows1252,
+}}
+
+// newHeaderDecoder returns a decoder for RFC 2047 encoded-words that uses reg.
+func newHeaderDecoder(reg CharsetRegistry) *mime.WordDecoder {
+	return &mime.WordDecoder{
+		CharsetReader: func(charset string, input io.Reader) (io.Reader, error) {
+			enc, err := reg.Lookup(charset)
+			if err != nil {
+				return nil, fmt.Errorf("unhandled charset %q", charset)
+			}
+			return enc.NewDecoder().Reader(input), nil
+		},
+	}
+}
+
+// headerDecoder returns a decoder for RFC 2047 encoded-words in header fields.
+func (opts *Options) headerDecoder() *mime.WordDecoder {
+	if opts.Charsets == nil {
+		return headerDecoder
+	}
+	return newHeaderDecoder(opts.Charsets)
+}
+
+// lookupCharset returns the encoding for the supplied MIME charset name, e.g. "iso-8859-1".
+// An empty name is treated as "us-ascii", per RFC 2045 5.2. reg is used for other charsets,
+// or HTMLCharsets if reg is nil.
+func lookupCharset(name string, reg CharsetRegistry) (encoding.Encoding, error) {
+	switch strings.ToLower(strings.TrimSpace(name)) {
+	case "", "us-ascii", "utf-8", "utf8":
+		// htmlindex treats US-ASCII as Windows-1252, but I think that it's better to pass
+		// through 8-bit data in mislabeled messages (which is most likely UTF-8).
+		return encoding.Nop, nil
+	}
+	if reg == nil {
+		reg = HTMLCharsets
+	}
+	return reg.Lookup(name)
+}
+
+// isASCIICharset returns true if the supplied MIME charset name refers to US-ASCII.
+func isASCIICharset(name string) bool {
+	switch strings.ToLower(strings.TrimSpace(name)) {
+	case "", "us-ascii", "ascii":
+		return true
+	default:
+		return false
+	}
+}
+
+// textCutPoints reports where text in the supplied charset can be cut without breaking
+// any characters. lines is true if the charset encodes LF as a lone 0x0a byte, so the text
+// can be cut after any LF. chars is additionally true if the text can be cut before any
+// byte that could start a UTF-8 sequence, which holds for UTF-8 (and ASCII) and for
+// charsets that use a single byte per character. Multibyte and stateful charsets like
+// Shift_JIS and ISO-2022-JP only permit cuts at line boundaries.
+func textCutPoints(charset string, opts *Options) (lines, chars bool) {
+	enc, err := lookupCharset(charset, opts.Charsets)
+	if err != nil {
+		return false, false
+	}
+	if enc == encoding.Nop {
+		return true, true
+	}
+	if b, err := enc.NewEncoder().Bytes([]byte("\n")); err != nil || string(b) != "\n" {
+		return false, false
+	}
+	_, single := enc.(*charmap.Charmap)
+	return true, single
+}
+
+// decodeText converts b from the supplied charset to UTF-8 using opts.Charsets.
+func decodeText(b []byte, charset string, opts *Options) (string, error) {
+	enc, err := lookupCharset(charset, opts.Charsets)
+	if err != nil {
+		return "", err
+	}
+	dec, err := enc.NewDecoder().Bytes(b)
+	return string(dec), err
+}
+
+// encodeText converts s from UTF-8 to the supplied charset using opts.Charsets.
+func encodeText(s, charset string, opts *Options) ([]byte, error) {
+	enc, err := lookupCharset(charset, opts.Charsets)
+	if err != nil {
+		return nil, err
+	}
+	return enc.NewEncoder().Bytes([]byte(s))
+}
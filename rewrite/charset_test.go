@@ -0,0 +1,67 @@
+// Copyright 2022 Daniel Erat.
+// All rights reserved.
+
+package rewrite
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/charmap"
+)
+
+func TestCharsetRegistry(t *testing.T) {
+	restricted := &CharsetMap{Charsets: map[string]encoding.Encoding{"iso-8859-15": charmap.ISO8859_15}}
+	for _, tc := range []struct {
+		reg  CharsetRegistry
+		name string
+		ok   bool
+	}{
+		{nil, "utf-8", true},
+		{nil, "windows-1252", true},
+		{nil, "ibm437", false},
+		{IANACharsets, "IBM437", true},
+		{IANACharsets, "bogus", false},
+		{restricted, "ISO-8859-15", true},
+		{restricted, "us-ascii", true}, // always supported
+		{restricted, "windows-1252", false},
+		{&CharsetMap{Fallback: HTMLCharsets}, "windows-1252", true},
+	} {
+		if _, err := lookupCharset(tc.name, tc.reg); err != nil && tc.ok {
+			t.Errorf("lookupCharset(%q, %T) failed: %v", tc.name, tc.reg, err)
+		} else if err == nil && !tc.ok {
+			t.Errorf("lookupCharset(%q, %T) unexpectedly succeeded", tc.name, tc.reg)
+		}
+	}
+}
+
+func TestRewrite_charsets(t *testing.T) {
+	const msg = "Subject: =?ibm437?q?caf=82?=\n" +
+		"Content-Type: text/plain; charset=ibm437\n" +
+		"\n" +
+		"caf\x82\n"
+	for _, tc := range []struct {
+		reg  CharsetRegistry
+		body string // expected rewritten body
+		subj string // expected X-Rendmail-Subject, or empty if not added
+	}{
+		{nil, "caf\x82\n", ""},
+		{IANACharsets, "caf=C3=A9\n", "cafe"},
+	} {
+		var b bytes.Buffer
+		opts := Options{TranscodeUTF8: true, DecodeSubject: true, Charsets: tc.reg}
+		if _, err := Rewrite(strings.NewReader(msg), &b, &opts); err != nil {
+			t.Errorf("Rewrite with %T failed: %v", tc.reg, err)
+			continue
+		}
+		got := b.String()
+		if !strings.HasSuffix(got, "\n\n"+tc.body) {
+			t.Errorf("Rewrite with %T produced body not matching %q:\n%s", tc.reg, tc.body, got)
+		}
+		if hasSubj := strings.Contains(got, "X-Rendmail-Subject: "+tc.subj+"\n"); hasSubj != (tc.subj != "") {
+			t.Errorf("Rewrite with %T produced unexpected X-Rendmail-Subject:\n%s", tc.reg, got)
+		}
+	}
+}
@@ -0,0 +1,226 @@
+// Copyright 2022 Daniel Erat.
+// All rights reserved.
+
+package rewrite
+
+import (
+	"bytes"
+	"fmt"
+	"mime"
+	"net/mail"
+	"sort"
+	"strings"
+)
+
+// Finding describes a problem found while checking a message.
+type Finding struct {
+	Check  string `json:"check"`           // short machine-readable identifier, e.g. "bad-date"
+	Part   string `json:"part,omitempty"`  // part path (e.g. "1.2"), empty for top-level part
+	Field  string `json:"field,omitempty"` // canonicalized field name, if applicable
+	Detail string `json:"detail"`          // human-readable description
+}
+
+// headerChecker validates a top-level message header against RFC 5322.
+// Fields are supplied one at a time via addField and findings are returned by finish.
+type headerChecker struct {
+	counts   map[string]int // field counts keyed by canonicalized name
+	findings []Finding
+}
+
+// newHeaderChecker returns a headerChecker for checking a new header.
+func newHeaderChecker() *headerChecker {
+	return &headerChecker{counts: make(map[string]int)}
+}
+
+// maxLineLength is the maximum length of a line (excluding CRLF) from RFC 5322 2.1.1.
+const maxLineLength = 998
+
+// addField checks a single field. folded and unfolded are as returned by readFoldedLine.
+func (hc *headerChecker) addField(folded []string, unfolded string) {
+	idx := strings.IndexByte(unfolded, ':')
+	if idx < 0 {
+		hc.add("malformed-field", "", fmt.Sprintf("missing colon in %q", unfolded))
+		return
+	}
+	name := unfolded[:idx]
+	key, val, _ := ParseHeaderField(unfolded)
+
+	// RFC 5322 2.2:
+	//  A field name MUST be composed of printable US-ASCII characters (i.e., characters that
+	//  have values between 33 and 126, inclusive), except colon.
+	if name == "" {
+		hc.add("field-name", "", "empty field name")
+	}
+	for i := 0; i < len(name); i++ {
+		if c := name[i]; c < 33 || c > 126 {
+			hc.add("field-name", key, fmt.Sprintf("invalid character %q in field name", c))
+			break
+		}
+	}
+	for i, ln := range folded {
+		if n := len(trimCRLF(ln)); n > maxLineLength {
+			hc.add("line-length", key, fmt.Sprintf("line %d has %d characters", i+1, n))
+		}
+	}
+
+	switch key {
+	case "Date", "Resent-Date":
+		if _, err := mail.ParseDate(val); err != nil {
+			hc.add("bad-date", key, fmt.Sprintf("unparseable date %q", val))
+		}
+	}
+	hc.counts[key]++
+}
+
+// singleFields lists fields that may appear at most once (RFC 5322 3.6).
+var singleFields = []string{
+	"Bcc", "Cc", "Date", "From", "In-Reply-To", "Message-Id", "References",
+	"Reply-To", "Sender", "Subject", "To",
+}
+
+// finish performs whole-header checks and returns all findings.
+func (hc *headerChecker) finish() []Finding {
+	// RFC 5322 3.6:
+	//  The only required header fields are the origination date field and the originator
+	//  address field(s).
+	for _, key := range []string{"Date", "From"} {
+		if hc.counts[key] == 0 {
+			hc.add("missing-field", key, "required field is missing")
+		}
+	}
+	for _, key := range singleFields {
+		if n := hc.counts[key]; n > 1 {
+			hc.add("duplicate-field", key, fmt.Sprintf("field appears %d times", n))
+		}
+	}
+	return hc.findings
+}
+
+// add records a finding. field is empty if the finding doesn't apply to a specific field.
+func (hc *headerChecker) add(check, field, detail string) {
+	hc.findings = append(hc.findings, Finding{Check: check, Field: field, Detail: detail})
+}
+
+// Check validates the header syntax, multipart structure, and body encodings of
+// the message in msg and returns any problems that were found.
+func Check(msg []byte) []Finding {
+	spans := FindParts(msg)
+	paths := make([]string, 0, len(spans))
+	for p := range spans {
+		paths = append(paths, p)
+	}
+	sort.Slice(paths, func(i, j int) bool { return LessPartPath(paths[i], paths[j]) })
+
+	var findings []Finding
+	for _, path := range paths {
+		for _, f := range checkPart(msg, path, spans) {
+			f.Part = path
+			findings = append(findings, f)
+		}
+	}
+	return findings
+}
+
+// checkPart checks the part at path within msg. spans is as returned by FindParts.
+func checkPart(msg []byte, path string, spans map[string]PartSpan) []Finding {
+	span := spans[path]
+	top := path == ""
+
+	// Check the part's header. Only the top-level header needs to contain particular fields.
+	hc := newHeaderChecker()
+	lr := newLineReader(bytes.NewReader(msg[span.Start:span.BodyStart]))
+	defer lr.release()
+	var ended bool
+	for {
+		folded, unfolded, err := lr.readFoldedLine()
+		if err != nil {
+			break
+		}
+		if unfolded == "" {
+			ended = true
+			break
+		}
+		hc.addField(folded, unfolded)
+		switch key, val, _ := ParseHeaderField(unfolded); key {
+		case "Content-Type":
+			if _, _, err := mime.ParseMediaType(val); err != nil {
+				hc.add("bad-content-type", key, fmt.Sprintf("unparseable value %q: %v", val, err))
+			}
+		case "Content-Transfer-Encoding":
+			enc := strings.ToLower(strings.TrimSpace(val))
+			if !IsIdentityEncoding(enc) && enc != "quoted-printable" && enc != "base64" {
+				hc.add("bad-encoding", key, fmt.Sprintf("unknown encoding %q", val))
+			}
+		}
+	}
+	if top {
+		hc.finish()
+	}
+	if !ended {
+		hc.add("missing-body", "", "header isn't followed by blank line")
+	}
+
+	body := span.Body(msg, top)
+	if strings.HasPrefix(span.MediaType, "multipart/") {
+		checkMultipart(hc, &span, body)
+		return hc.findings
+	}
+
+	for i, ln := range bytes.SplitAfter(body, []byte("\n")) {
+		if n := len(trimCRLF(string(ln))); n > maxLineLength {
+			hc.add("line-length", "", fmt.Sprintf("body line %d has %d characters", i+1, n))
+		}
+	}
+
+	switch enc := span.Encoding; {
+	case enc == "" || enc == "7bit":
+		for i, c := range body {
+			if c >= 0x80 {
+				hc.add("8bit-data", "", fmt.Sprintf("8-bit byte at body offset %d with 7bit encoding", i))
+				break
+			}
+		}
+	case enc == "base64" || enc == "quoted-printable":
+		if _, err := DecodeBody(body, enc); err != nil {
+			hc.add("bad-"+enc, "", err.Error())
+		}
+	}
+	return hc.findings
+}
+
+// checkMultipart checks the boundary and delimiters of the multipart part
+// described by span, whose body is supplied. Findings are added to hc.
+func checkMultipart(hc *headerChecker, span *PartSpan, body []byte) {
+	if !IsIdentityEncoding(span.Encoding) {
+		// RFC 2045 6.4.
+		hc.add("multipart-encoding", "Content-Transfer-Encoding",
+			fmt.Sprintf("multipart part has %q encoding", span.Encoding))
+	}
+	bnd := span.Params["boundary"]
+	if bnd == "" {
+		hc.add("missing-boundary", "Content-Type", "multipart part has no boundary")
+		return
+	}
+	// RFC 2046 5.1.1 limits boundaries to 1-70 characters from a restricted set.
+	if len(bnd) > 70 {
+		hc.add("bad-boundary", "Content-Type", fmt.Sprintf("boundary has %d characters", len(bnd)))
+	}
+	if i := strings.IndexFunc(bnd, func(r rune) bool { return !strings.ContainsRune(boundaryChars, r) }); i >= 0 {
+		hc.add("bad-boundary", "Content-Type", fmt.Sprintf("boundary contains %q", bnd[i]))
+	} else if strings.HasSuffix(bnd, " ") {
+		hc.add("bad-boundary", "Content-Type", "boundary ends with space")
+	}
+
+	first, _, closing := FindDelimiters(body, "--"+bnd)
+	if first < 0 {
+		hc.add("missing-delimiter", "", "multipart body has no boundary delimiters")
+	} else if first == closing {
+		hc.add("no-parts", "", "multipart body has no parts")
+	}
+	if first >= 0 && closing < 0 {
+		hc.add("missing-closing-delimiter", "", "multipart body has no closing delimiter")
+	}
+}
+
+// boundaryChars contains the characters permitted in boundaries by RFC 2046 5.1.1.
+const boundaryChars = "0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ'()+_,-./:=? "
@@ -0,0 +1,77 @@
+// Copyright 2022 Daniel Erat.
+// All rights reserved.
+
+package rewrite
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestHeaderChecker(t *testing.T) {
+	for _, tc := range []struct {
+		fields []string
+		want   []string // "check field" pairs
+	}{
+		{[]string{"From: me@example.org", "Date: Sat, 16 Apr 2022 12:33:34 -0400"}, nil},
+		{[]string{"From: me@example.org"}, []string{"missing-field Date"}},
+		{[]string{"Date: yesterday", "From: me@example.org"}, []string{"bad-date Date"}},
+		{[]string{"Date: Sat, 16 Apr 2022 12:33:34 -0400", "From: a@example.org", "From: b@example.org"},
+			[]string{"duplicate-field From"}},
+		{[]string{"Date: Sat, 16 Apr 2022 12:33:34 -0400", "From: me@example.org", "Bad Name: x"},
+			[]string{"field-name Bad Name"}},
+		{[]string{"Date: Sat, 16 Apr 2022 12:33:34 -0400", "From: me@example.org",
+			"X-Long: " + strings.Repeat("a", 1000)}, []string{"line-length X-Long"}},
+	} {
+		hc := newHeaderChecker()
+		for _, f := range tc.fields {
+			hc.addField([]string{f + "\n"}, f)
+		}
+		var got []string
+		for _, f := range hc.finish() {
+			got = append(got, f.Check+" "+f.Field)
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("Checking %q produced %q; want %q", tc.fields, got, tc.want)
+		}
+	}
+}
+
+func TestCheckMessage(t *testing.T) {
+	const hdr = "From: me@example.org\nDate: Sat, 16 Apr 2022 12:33:34 -0400\n"
+	for _, tc := range []struct {
+		msg  string
+		want []string // "check part" pairs
+	}{
+		{hdr + "\nBody\n", nil},
+		{"From: me@example.org\n\nBody\n", []string{"missing-field "}},
+		{hdr + "Subject: caf\xc3\xa9\n", []string{"missing-body "}},
+		{hdr + "\nCaf\xc3\xa9\n", []string{"8bit-data "}},
+		{hdr + "\n" + strings.Repeat("a", 999) + "\n", []string{"line-length "}},
+		{hdr + "Content-Type: multipart/mixed; boundary=abc\n\n" +
+			"--abc\nContent-Transfer-Encoding: base64\n\n!!!\n" +
+			"--abc\nContent-Transfer-Encoding: quoted-printable\n\na=\x01b\n" +
+			"--abc\nContent-Transfer-Encoding: x-uuencode\n\nbegin\n" +
+			"--abc\nContent-Type: text/plain; bogus\n\nHi\n" +
+			"--abc--\n",
+			[]string{"bad-base64 1", "bad-quoted-printable 2", "bad-encoding 3", "bad-content-type 4"}},
+		{hdr + "Content-Type: multipart/mixed; boundary=abc\n\n--abc\n\nBody\n",
+			[]string{"missing-closing-delimiter "}},
+		{hdr + "Content-Type: multipart/mixed; boundary=abc\nContent-Transfer-Encoding: base64\n\n--abc\n\nBody\n--abc--\n",
+			[]string{"multipart-encoding "}},
+		{hdr + "Content-Type: multipart/mixed; boundary=\"a<b>\"\n\n--a<b>\n\nBody\n--a<b>--\n",
+			[]string{"bad-boundary "}},
+		{hdr + "Content-Type: multipart/mixed\n\nBody\n", []string{"missing-boundary "}},
+		{hdr + "Content-Type: multipart/mixed; boundary=abc\n\nBody\n", []string{"missing-delimiter "}},
+		{hdr + "Content-Type: multipart/mixed; boundary=abc\n\n--abc--\n", []string{"no-parts "}},
+	} {
+		var got []string
+		for _, f := range Check([]byte(tc.msg)) {
+			got = append(got, f.Check+" "+f.Part)
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("Check(%q) = %q; want %q", tc.msg, got, tc.want)
+		}
+	}
+}
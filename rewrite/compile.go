@@ -0,0 +1,125 @@
+// Copyright 2022 Daniel Erat.
+// All rights reserved.
+
+package rewrite
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"text/template"
+)
+
+// compiledOptions holds parsed forms of Options fields. It's read-only after
+// being created, so it can be shared by concurrent calls to Rewrite.
+type compiledOptions struct {
+	urlTemplate *template.Template      // parsed URLTemplate, or nil if empty
+	rules       map[*Rule]*compiledRule // parsed conditions for Rules
+}
+
+// compiledRule holds a Rule's parsed conditions.
+type compiledRule struct {
+	from, to, listID, subject *regexp.Regexp // nil if unset
+	sieve                     sieveTest      // nil if unset
+}
+
+// Compile validates opts's globs, templates, and rules and returns a copy of opts
+// holding their parsed forms, which Rewrite would otherwise need to create
+// for each message. The returned Options are safe for concurrent use by
+// multiple calls to Rewrite. The compiled fields (DeleteMediaTypes,
+// KeepMediaTypes, URLTemplate, and Rules) shouldn't be modified afterward.
+func (opts *Options) Compile() (*Options, error) {
+	c, err := compileOptions(opts)
+	if err != nil {
+		return nil, err
+	}
+	o := *opts
+	o.compiled = c
+	return &o, nil
+}
+
+// compileOptions returns parsed forms of opts's fields, or an error if any are invalid.
+func compileOptions(opts *Options) (*compiledOptions, error) {
+	if err := checkGlobs(opts.DeleteMediaTypes, opts.KeepMediaTypes); err != nil {
+		return nil, err
+	}
+	if err := checkErrorActions(opts); err != nil {
+		return nil, err
+	}
+	var c compiledOptions
+	if opts.URLTemplate != "" {
+		ur, err := newURLRewriter(false, opts.URLTemplate)
+		if err != nil {
+			return nil, fmt.Errorf("bad URL template: %v", err)
+		}
+		c.urlTemplate = ur.tmpl
+	}
+	if len(opts.Rules) > 0 {
+		c.rules = make(map[*Rule]*compiledRule, len(opts.Rules))
+		for _, r := range opts.Rules {
+			if err := r.Check(); err != nil {
+				return nil, fmt.Errorf("rule %q: %v", r.Name, err)
+			}
+			if err := checkGlobs(r.DeleteTypes, r.KeepTypes); err != nil {
+				return nil, fmt.Errorf("rule %q: %v", r.Name, err)
+			}
+			cr, err := compileRule(r)
+			if err != nil {
+				return nil, fmt.Errorf("rule %q: %v", r.Name, err)
+			}
+			c.rules[r] = cr
+		}
+	}
+	return &c, nil
+}
+
+// checkGlobs returns an error if any of the supplied media type globs are malformed.
+func checkGlobs(lists ...[]string) error {
+	for _, globs := range lists {
+		for _, g := range globs {
+			if _, err := filepath.Match(g, ""); err != nil {
+				return fmt.Errorf("bad glob %q: %v", g, err)
+			}
+		}
+	}
+	return nil
+}
+
+// compileRule parses r's regular expressions and Sieve test.
+func compileRule(r *Rule) (*compiledRule, error) {
+	var cr compiledRule
+	for _, f := range []struct {
+		expr string
+		dst  **regexp.Regexp
+	}{
+		{r.From, &cr.from},
+		{r.To, &cr.to},
+		{r.ListID, &cr.listID},
+		{r.Subject, &cr.subject},
+	} {
+		if f.expr == "" {
+			continue
+		}
+		var err error
+		if *f.dst, err = regexp.Compile(f.expr); err != nil {
+			return nil, err
+		}
+	}
+	if r.Sieve != "" {
+		var err error
+		if cr.sieve, err = parseSieveTest(r.Sieve); err != nil {
+			return nil, fmt.Errorf("bad sieve test: %v", err)
+		}
+	}
+	return &cr, nil
+}
+
+// compiledRule returns the parsed form of r, compiling it if needed.
+func (opts *Options) compiledRule(r *Rule) (*compiledRule, error) {
+	if opts.compiled != nil {
+		if cr, ok := opts.compiled.rules[r]; ok {
+			return cr, nil
+		}
+	}
+	return compileRule(r)
+}
@@ -0,0 +1,70 @@
+// Copyright 2022 Daniel Erat.
+// All rights reserved.
+
+package rewrite
+
+import (
+	"bytes"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestOptions_Compile(t *testing.T) {
+	for _, tc := range []struct {
+		opts Options
+		ok   bool
+	}{
+		{Options{}, true},
+		{Options{DeleteMediaTypes: []string{"image/*"}, URLTemplate: "https://example.org/?u={{.URL}}"}, true},
+		{Options{DeleteMediaTypes: []string{"image/["}}, false},
+		{Options{KeepMediaTypes: []string{"image/["}}, false},
+		{Options{URLTemplate: "{{.URL"}, false},
+		{Options{Rules: []*Rule{{Name: "a", From: "("}}}, false},
+		{Options{Rules: []*Rule{{Name: "a", DeleteTypes: []string{"["}}}}, false},
+		{Options{Rules: []*Rule{{Name: "a", Sieve: "bogus"}}}, false},
+	} {
+		if _, err := tc.opts.Compile(); err != nil && tc.ok {
+			t.Errorf("Compile() with %+v failed: %v", tc.opts, err)
+		} else if err == nil && !tc.ok {
+			t.Errorf("Compile() with %+v unexpectedly succeeded", tc.opts)
+		}
+	}
+}
+
+func TestOptions_Compile_concurrent(t *testing.T) {
+	opts, err := (&Options{
+		DeleteMediaTypes: []string{"image/*"},
+		URLTemplate:      "https://example.org/?u={{.URL}}",
+		Rules:            []*Rule{{Name: "tag", Subject: "^Hi$", TagSubject: "[tag]"}},
+	}).Compile()
+	if err != nil {
+		t.Fatal("Compile failed:", err)
+	}
+	const msg = "Subject: Hi\nContent-Type: text/plain\n\nSee https://example.com/\n"
+	const want = "Subject: [tag] Hi\nContent-Type: text/plain\n\nSee https://example.org/?u=https://example.com/\n"
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var b bytes.Buffer
+			if _, err := Rewrite(strings.NewReader(msg), &b, opts); err != nil {
+				t.Error("Rewrite failed:", err)
+			} else if got := b.String(); got != want {
+				t.Errorf("Rewrite produced %q; want %q", got, want)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestRewrite_badGlob(t *testing.T) {
+	var b bytes.Buffer
+	opts := Options{DeleteMediaTypes: []string{"image/["}}
+	if _, err := Rewrite(strings.NewReader("Subject: Hi\n\nBody\n"), &b, &opts); err == nil {
+		t.Error("Rewrite unexpectedly succeeded with bad glob")
+	} else if b.Len() > 0 {
+		t.Errorf("Rewrite wrote %q before reporting bad glob", b.String())
+	}
+}
@@ -0,0 +1,55 @@
+// Copyright 2022 Daniel Erat.
+// All rights reserved.
+
+package rewrite
+
+import (
+	"bytes"
+	"context"
+	"io"
+)
+
+// RewriteContext is like Rewrite, but it stops early and returns ctx.Err() if ctx
+// is cancelled or its deadline passes. The rewritten message is buffered in memory
+// and nothing is written to w in that case.
+//
+// ctx is checked between reads from r, between header fields, and between the steps
+// that rewrite each part's body, so a Read call that blocks (e.g. on a network
+// connection) or a single slow step (e.g. sanitizing a huge HTML part) isn't interrupted.
+func RewriteContext(ctx context.Context, r io.Reader, w io.Writer, opts *Options) (*Report, error) {
+	if err := ctx.Err(); err != nil {
+		return &Report{}, err
+	}
+	o := *opts
+	o.ctx = ctx
+	var b bytes.Buffer
+	rep, err := Rewrite(&ctxReader{ctx, r}, &b, &o)
+	if cerr := ctx.Err(); cerr != nil {
+		return rep, cerr
+	}
+	if _, werr := b.WriteTo(w); werr != nil && err == nil {
+		err = werr
+	}
+	return rep, err
+}
+
+// ctxReader wraps an io.Reader and returns ctx.Err() once ctx is done.
+type ctxReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (cr *ctxReader) Read(p []byte) (int, error) {
+	if err := cr.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return cr.r.Read(p)
+}
+
+// checkContext returns an error if opts.ctx (set by RewriteContext) is done.
+func (opts *Options) checkContext() error {
+	if opts.ctx == nil {
+		return nil
+	}
+	return opts.ctx.Err()
+}
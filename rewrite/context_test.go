@@ -0,0 +1,89 @@
+// Copyright 2022 Daniel Erat.
+// All rights reserved.
+
+package rewrite
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+// cancelReader cancels a context after the first call to Read.
+type cancelReader struct {
+	r      io.Reader
+	cancel context.CancelFunc
+}
+
+func (cr *cancelReader) Read(p []byte) (int, error) {
+	defer cr.cancel()
+	return cr.r.Read(p)
+}
+
+func TestRewriteContext(t *testing.T) {
+	msg := "Content-Type: text/plain\n\n" + strings.Repeat("Long line of text\n", 10000)
+
+	if _, err := RewriteContext(context.Background(), strings.NewReader(msg),
+		ioutil.Discard, &Options{}); err != nil {
+		t.Error("RewriteContext failed:", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	r := &cancelReader{strings.NewReader(msg), cancel}
+	if _, err := RewriteContext(ctx, r, ioutil.Discard, &Options{}); err != context.Canceled {
+		t.Errorf("RewriteContext with cancelled context returned %v; want %v", err, context.Canceled)
+	}
+	if _, err := RewriteContext(ctx, strings.NewReader(msg), ioutil.Discard, &Options{}); err != context.Canceled {
+		t.Errorf("RewriteContext with done context returned %v; want %v", err, context.Canceled)
+	}
+}
+
+// cancelLogger cancels a context when Infof is called and counts the calls.
+type cancelLogger struct {
+	nopLogger
+	cancel context.CancelFunc
+	calls  int
+}
+
+func (cl *cancelLogger) Infof(format string, args ...interface{}) {
+	cl.cancel()
+	cl.calls++
+}
+
+func TestRewriteContext_cancelDuringRewrite(t *testing.T) {
+	for _, tc := range []struct {
+		desc string
+		msg  string
+		opts Options
+	}{
+		{
+			// Logged while reading the header. FixBoundaries reads the whole message first.
+			"header",
+			"junk\nmore junk\nFrom: me@example.org\nSubject: Hi\n\nBody\n",
+			Options{StripLeadingJunk: true, FixBoundaries: true},
+		},
+		{
+			// Logged by a leaf rewriter.
+			"body",
+			"Content-Type: text/plain; charset=iso-8859-1\n\nCaf\xe9\n",
+			Options{TranscodeUTF8: true, SanitizeHTML: true},
+		},
+	} {
+		ctx, cancel := context.WithCancel(context.Background())
+		log := &cancelLogger{cancel: cancel}
+		tc.opts.Log = log
+		var b bytes.Buffer
+		if _, err := RewriteContext(ctx, strings.NewReader(tc.msg), &b, &tc.opts); err != context.Canceled {
+			t.Errorf("RewriteContext cancelled during %v returned %v; want %v", tc.desc, err, context.Canceled)
+		}
+		if b.Len() > 0 {
+			t.Errorf("RewriteContext cancelled during %v wrote %q", tc.desc, b.String())
+		}
+		if log.calls != 1 {
+			t.Errorf("RewriteContext cancelled during %v continued rewriting (%d log calls)", tc.desc, log.calls)
+		}
+	}
+}
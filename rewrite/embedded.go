@@ -0,0 +1,100 @@
+// Copyright 2022 Daniel Erat.
+// All rights reserved.
+
+package rewrite
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	binHexMediaType = "application/mac-binhex40"
+	yEncMediaType   = "application/x-yenc"
+)
+
+// embeddedBlock describes binary data embedded in a text body.
+type embeddedBlock struct {
+	start, end int    // indexes of first and last lines of the block
+	mediaType  string // binHexMediaType or yEncMediaType
+	name       string // filename if known
+	size       int    // size of the encoded data in bytes
+}
+
+// findEmbeddedBinary returns BinHex and yEnc blocks within lines.
+// Blocks that aren't terminated are ignored.
+func findEmbeddedBinary(lines []string) []embeddedBlock {
+	var blocks []embeddedBlock
+	for i := 0; i < len(lines); i++ {
+		ln := lines[i]
+		switch {
+		case strings.HasPrefix(ln, "(This file must be converted with BinHex"):
+			// RFC 1741: The data starts with a colon on the line after the comment
+			// and ends with a colon.
+			if i+1 >= len(lines) || !strings.HasPrefix(lines[i+1], ":") {
+				continue
+			}
+			b := embeddedBlock{start: i, mediaType: binHexMediaType}
+			for j := i + 1; j < len(lines); j++ {
+				b.size += len(lines[j])
+				if strings.HasSuffix(lines[j], ":") && (j > i+1 || len(lines[j]) > 1) {
+					b.end = j
+					break
+				}
+			}
+			if b.end > 0 {
+				blocks = append(blocks, b)
+				i = b.end
+			}
+		case strings.HasPrefix(ln, "=ybegin "):
+			// See http://www.yenc.org/yenc-draft.1.3.txt. The header line looks like
+			// "=ybegin line=128 size=123456 name=mybinary.dat" and the trailer like
+			// "=yend size=123456".
+			b := embeddedBlock{start: i, mediaType: yEncMediaType}
+			if idx := strings.Index(ln, " name="); idx >= 0 {
+				b.name = strings.TrimSpace(ln[idx+len(" name="):])
+			}
+			for j := i + 1; j < len(lines); j++ {
+				if strings.HasPrefix(lines[j], "=yend") {
+					b.end = j
+					break
+				}
+				if !strings.HasPrefix(lines[j], "=ypart ") {
+					b.size += len(lines[j])
+				}
+			}
+			if b.end > 0 {
+				blocks = append(blocks, b)
+				i = b.end
+			}
+		}
+	}
+	return blocks
+}
+
+// deleteEmbeddedBinary replaces the BinHex and yEnc blocks in s for which del returns
+// true with single-line placeholders. The deleted blocks are returned.
+func deleteEmbeddedBinary(s string, del func(b *embeddedBlock) bool) (string, []embeddedBlock) {
+	lines, term, final := splitTextLines(s)
+	var deleted []embeddedBlock
+	var out []string
+	next := 0
+	for _, b := range findEmbeddedBinary(lines) {
+		if !del(&b) {
+			continue
+		}
+		out = append(out, lines[next:b.start]...)
+		desc := b.mediaType
+		if b.name != "" {
+			desc += fmt.Sprintf(" %q", b.name)
+		}
+		out = append(out, fmt.Sprintf("[Deleted %v (%d bytes)]", desc, b.size))
+		next = b.end + 1
+		deleted = append(deleted, b)
+	}
+	if len(deleted) == 0 {
+		return s, nil
+	}
+	out = append(out, lines[next:]...)
+	return joinTextLines(out, term, final), deleted
+}
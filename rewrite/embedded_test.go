@@ -0,0 +1,49 @@
+// Copyright 2022 Daniel Erat.
+// All rights reserved.
+
+package rewrite
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDeleteEmbeddedBinary(t *testing.T) {
+	const (
+		binhex = "(This file must be converted with BinHex 4.0)\n" +
+			":$f*TEQKPH#jdCA0d,R0TG!\"6594%8dP8)3#3\"!&m!*!%EMa6593K!!%!!!&mFNa\n" +
+			"KG3,r!*!$&[rr$3d,BQ9rN!5!!!!!:\n"
+		yenc = "=ybegin line=128 size=6 name=a b.dat\n" +
+			"\x8b\x8c\x8d\x8e\x8f\x90\n" +
+			"=yend size=6 crc32=12345678\n"
+	)
+	all := func(b *embeddedBlock) bool { return true }
+	for _, tc := range []struct {
+		in   string
+		del  func(b *embeddedBlock) bool
+		want string
+		n    int
+	}{
+		{"Plain text\n", all, "Plain text\n", 0},
+		{"Before\n" + binhex + "After\n", all,
+			"Before\n[Deleted application/mac-binhex40 (94 bytes)]\nAfter\n", 1},
+		{"Before\r\n" + yenc + "After\r\n", all,
+			"Before\r\n[Deleted application/x-yenc \"a b.dat\" (6 bytes)]\r\nAfter\r\n", 1},
+		{binhex + yenc, func(b *embeddedBlock) bool { return b.mediaType == yEncMediaType },
+			binhex + "[Deleted application/x-yenc \"a b.dat\" (6 bytes)]\n", 1},
+		{"=ybegin line=128 size=6 name=x\nunterminated\n", all, "=ybegin line=128 size=6 name=x\nunterminated\n", 0},
+	} {
+		got, deleted := deleteEmbeddedBinary(tc.in, tc.del)
+		if got != tc.want || len(deleted) != tc.n {
+			t.Errorf("deleteEmbeddedBinary(%q) = %q, %v; want %q, %v", tc.in, got, len(deleted), tc.want, tc.n)
+		}
+	}
+}
+
+func TestFindEmbeddedBinary(t *testing.T) {
+	lines := []string{"x", "=ybegin part=1 line=128 size=4 name=f.bin", "=ypart begin=1 end=4", "abcd", "=yend size=4"}
+	want := []embeddedBlock{{start: 1, end: 4, mediaType: yEncMediaType, name: "f.bin", size: 4}}
+	if got := findEmbeddedBinary(lines); !reflect.DeepEqual(got, want) {
+		t.Errorf("findEmbeddedBinary(%q) = %+v; want %+v", lines, got, want)
+	}
+}
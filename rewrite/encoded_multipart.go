@@ -0,0 +1,78 @@
+// Copyright 2022 Daniel Erat.
+// All rights reserved.
+
+package rewrite
+
+import (
+	"bytes"
+	"io"
+)
+
+// copyDecodedMultipart reads the body of the encoded multipart part (see isEncodedMultipart)
+// described by hdata and hdr from lr, decodes it, and writes the part to w with an identity
+// Content-Transfer-Encoding after processing its enclosed parts. If the body can't be decoded
+// or processed, the part is copied unchanged and an EncodedMultipart error is returned.
+// top should be true for the top-level part. The return values and delim have the same
+// meaning as in copyBody.
+func copyDecodedMultipart(lr *lineReader, w io.Writer, hdr []byte, hdata *headerData, delim string,
+	top bool, st *msgState, opts *Options) (end bool, err error) {
+	var body bytes.Buffer
+	delimLine, end, err := readBody(lr, &body, delim)
+	writeAll := func(bufs ...[]byte) error {
+		for _, b := range bufs {
+			if _, err := w.Write(b); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err != nil {
+		if werr := writeAll(hdr, body.Bytes()); werr != nil {
+			return false, werr
+		}
+		return false, err
+	}
+
+	orig := func(err error) (bool, error) {
+		if werr := writeAll(hdr, body.Bytes(), []byte(delimLine)); werr != nil {
+			return false, werr
+		}
+		return false, lr.errorf(EncodedMultipart, "can't decode %v part: %v", hdata.mediaType, err)
+	}
+
+	dec, err := DecodeBody(body.Bytes(), hdata.encoding)
+	if err != nil {
+		return orig(err)
+	}
+	// Encoded data typically uses CRLF, so convert it to match the rest of the message.
+	if hdata.term == "\n" {
+		dec = bytes.ReplaceAll(dec, []byte("\r\n"), []byte("\n"))
+	}
+	if len(dec) > 0 && dec[len(dec)-1] != '\n' && delimLine != "" {
+		dec = append(dec, hdata.term...)
+	}
+
+	enc := "7bit"
+	if !is8BitSafe(dec) {
+		enc = "binary"
+	} else if !isASCII(string(dec)) {
+		enc = "8bit"
+	}
+	origEnc := hdata.encoding
+	hdata.encoding = enc
+
+	var out bytes.Buffer
+	dlr := newLineReader(bytes.NewReader(dec))
+	defer dlr.release()
+	if _, err := copyMultipart(dlr, &out, "", hdata, top, st, opts); err != nil {
+		if merr, ok := err.(*MessageError); !ok || opts.errorAction(merr.Category) == errorFail {
+			return false, err
+		}
+		hdata.encoding = origEnc
+		return orig(err)
+	}
+
+	opts.Logger().Infof("Decoded %v %v part as %v", origEnc, hdata.mediaType, enc)
+	nhdr := replaceHeaderFields(string(hdr), hdata.term, map[string]string{"Content-Transfer-Encoding": enc})
+	return end, writeAll([]byte(nhdr), out.Bytes(), []byte(delimLine))
+}
@@ -0,0 +1,67 @@
+// Copyright 2022 Daniel Erat.
+// All rights reserved.
+
+package rewrite
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRewrite_encodedMultipart(t *testing.T) {
+	const in = "Subject: Hi\n" +
+		"Content-Type: multipart/mixed; boundary=outer\n" +
+		"\n" +
+		"--outer\n" +
+		"Content-Type: multipart/mixed; boundary=b\n" +
+		"Content-Transfer-Encoding: base64\n" +
+		"X-Extra: keep\n" +
+		"\n" +
+		"LS1iDQpDb250ZW50LVR5cGU6IHRleHQvcGxhaW4NCg0KSGVsbG8NCi0tYg0KQ29udGVudC1UeXBl\n" +
+		"OiBpbWFnZS9wbmcNCg0KZGF0YQ0KLS1iLS0NCg==\n" +
+		"--outer--\n"
+	const want = "Subject: Hi\n" +
+		"Content-Type: multipart/mixed; boundary=outer\n" +
+		"\n" +
+		"--outer\n" +
+		"Content-Type: multipart/mixed; boundary=b\n" +
+		"Content-Transfer-Encoding: 7bit\n" +
+		"X-Extra: keep\n" +
+		"\n" +
+		"--b\n" +
+		"Content-Type: text/plain\n" +
+		"\n" +
+		"Hello\n" +
+		"--b\n" +
+		"Content-Type: message/external-body; access-type=x-rendmail-deleted;\n" +
+		"\texpiration=\"Sat, 16 Apr 2022 16:33:34 +0000\"\n" +
+		"\n" +
+		"Content-Type: image/png\n" +
+		"\n" +
+		"--b--\n" +
+		"--outer--\n"
+
+	now := time.Date(2022, 4, 16, 16, 33, 34, 0, time.UTC)
+	var out strings.Builder
+	rep, err := Rewrite(strings.NewReader(in), &out,
+		&Options{DeleteMediaTypes: []string{"image/*"}, OnMultipartCTE: "repair", Now: now})
+	if err != nil {
+		t.Fatal("Rewrite failed:", err)
+	}
+	if got := out.String(); got != want {
+		t.Errorf("Rewrite wrote:\n%s\nwant:\n%s", got, want)
+	}
+	if rep.Malformed || len(rep.Deleted) != 1 || rep.Deleted[0].Path != "1.2" {
+		t.Errorf("Rewrite reported malformed %v and deleted %+v; want false and part 1.2", rep.Malformed, rep.Deleted)
+	}
+
+	// Strict mode doesn't affect encoded multipart parts.
+	out.Reset()
+	if _, err := Rewrite(strings.NewReader(in), &out,
+		&Options{DeleteMediaTypes: []string{"image/*"}, OnMultipartCTE: "repair", Now: now, Strict: true}); err != nil {
+		t.Error("Rewrite failed in strict mode:", err)
+	} else if got := out.String(); got != want {
+		t.Errorf("Rewrite wrote in strict mode:\n%s\nwant:\n%s", got, want)
+	}
+}
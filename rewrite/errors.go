@@ -0,0 +1,163 @@
+// Copyright 2022 Daniel Erat.
+// All rights reserved.
+
+package rewrite
+
+import "fmt"
+
+// ErrorCategory describes the kind of problem reported by a MessageError.
+type ErrorCategory int
+
+const (
+	// MalformedHeader indicates that a header field couldn't be parsed or
+	// that Options.CheckHeaders found problems. It's handled per Options.OnBadHeader.
+	MalformedHeader ErrorCategory = iota + 1
+	// MissingBoundary indicates that a multipart part lacks a boundary parameter.
+	// It's handled per Options.OnMissingBoundary.
+	MissingBoundary
+	// UnexpectedEOF indicates that the message ended within a part's header
+	// or before a multipart part's closing delimiter. It's only returned in strict mode.
+	UnexpectedEOF
+	// BadContentType indicates that a Content-Type field couldn't be parsed.
+	// It's handled per Options.OnBadContentType.
+	BadContentType
+	// EncodedMultipart indicates that a multipart part has a Content-Transfer-Encoding
+	// other than "7bit", "8bit", or "binary". It's handled per Options.OnMultipartCTE.
+	EncodedMultipart
+)
+
+func (c ErrorCategory) String() string {
+	switch c {
+	case MalformedHeader:
+		return "malformed header"
+	case MissingBoundary:
+		return "missing boundary"
+	case UnexpectedEOF:
+		return "unexpected EOF"
+	case BadContentType:
+		return "bad Content-Type"
+	case EncodedMultipart:
+		return "encoded multipart"
+	default:
+		return fmt.Sprintf("unknown (%d)", int(c))
+	}
+}
+
+// MessageError describes a problem with a message's structure. By default, Rewrite
+// reports the message as malformed when it encounters a MessageError and copies the
+// rest of the message unchanged. The error is only returned in strict mode or if the
+// Options field corresponding to its category is "fail".
+//
+// Line and Offset identify the line that was being processed when the problem
+// was detected (i.e. the last line for problems detected at the end of the input).
+// For parts within PGP/MIME-encrypted parts, they're relative to the decrypted data.
+type MessageError struct {
+	Category ErrorCategory
+	Line     int    // 1-based line number
+	Offset   int64  // byte offset of the start of the line
+	Path     string // position of the part in the MIME tree, e.g. "1.2" (empty for top-level part)
+	Text     string // description of the problem
+}
+
+func (err *MessageError) Error() string {
+	loc := fmt.Sprintf("line %d (byte %d)", err.Line, err.Offset)
+	if err.Path != "" {
+		loc = "part " + err.Path + " at " + loc
+	}
+	return loc + ": " + err.Text
+}
+
+// LimitError is returned by Rewrite when a message exceeds one of the limits in
+// Options (e.g. MaxParts). Unlike MessageError, it's returned even in non-strict mode,
+// since the rest of the message can't be copied without exceeding the limit.
+type LimitError struct {
+	Limit  string // name of the exceeded Options field, e.g. "MaxParts"
+	Max    int    // value of the exceeded field
+	Line   int    // 1-based line number
+	Offset int64  // byte offset of the start of the line
+	Path   string // position of the part in the MIME tree, e.g. "1.2" (empty for top-level part)
+}
+
+func (err *LimitError) Error() string {
+	loc := fmt.Sprintf("line %d (byte %d)", err.Line, err.Offset)
+	if err.Path != "" {
+		loc = "part " + err.Path + " at " + loc
+	}
+	return fmt.Sprintf("%v: exceeded %v of %d", loc, err.Limit, err.Max)
+}
+
+// Actions for Options.OnBadHeader, Options.OnMissingBoundary, Options.OnBadContentType,
+// and Options.OnMultipartCTE.
+const (
+	errorIgnore = "ignore" // log the problem and continue
+	errorWarn   = "warn"   // add a warning to the report and mark the message as malformed
+	errorFail   = "fail"   // return a MessageError
+	errorRepair = "repair" // fix the problem if possible or warn otherwise (only for OnMultipartCTE)
+)
+
+// errorAction returns the action to take for a problem of category cat.
+//
+// Strict only applies to the categories that it has always covered (malformed headers,
+// missing boundaries, and unexpected EOF) so that strict mode doesn't start rejecting
+// messages that it used to accept. Other categories must be opted into via their On* fields.
+func (opts *Options) errorAction(cat ErrorCategory) string {
+	var act string
+	switch cat {
+	case MalformedHeader, MissingBoundary, UnexpectedEOF:
+		if opts.Strict {
+			return errorFail
+		}
+	}
+	switch cat {
+	case MalformedHeader:
+		act = opts.OnBadHeader
+	case MissingBoundary:
+		act = opts.OnMissingBoundary
+	case BadContentType:
+		if act = opts.OnBadContentType; act == "" {
+			act = errorIgnore
+		}
+	case EncodedMultipart:
+		act = opts.OnMultipartCTE
+	}
+	if act == "" {
+		act = errorWarn
+	}
+	return act
+}
+
+// failsForErrors returns true if any category of MessageError is returned by Rewrite.
+func (opts *Options) failsForErrors() bool {
+	for _, cat := range []ErrorCategory{MalformedHeader, MissingBoundary, UnexpectedEOF, BadContentType, EncodedMultipart} {
+		if opts.errorAction(cat) == errorFail {
+			return true
+		}
+	}
+	return false
+}
+
+// repairsMultipartCTE returns true if encoded multipart parts should be decoded.
+func (opts *Options) repairsMultipartCTE() bool {
+	return opts.errorAction(EncodedMultipart) == errorRepair
+}
+
+// checkErrorActions returns an error if opts's On* fields contain invalid actions.
+func checkErrorActions(opts *Options) error {
+	for _, f := range []struct {
+		name, val string
+		repair    bool // errorRepair is accepted
+	}{
+		{"bad header", opts.OnBadHeader, false},
+		{"missing boundary", opts.OnMissingBoundary, false},
+		{"bad Content-Type", opts.OnBadContentType, false},
+		{"multipart CTE", opts.OnMultipartCTE, true},
+	} {
+		switch {
+		case f.val == "", f.val == errorIgnore, f.val == errorWarn, f.val == errorFail:
+		case f.val == errorRepair && f.repair:
+		default:
+			return fmt.Errorf("invalid %v action %q", f.name, f.val)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,147 @@
+// Copyright 2022 Daniel Erat.
+// All rights reserved.
+
+package rewrite
+
+import (
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestMessageError(t *testing.T) {
+	for _, tc := range []struct {
+		msg  string
+		want MessageError // Text is ignored
+	}{
+		{
+			"From: me\nbogus\n\nBody\n",
+			MessageError{Category: MalformedHeader, Line: 2, Offset: 9},
+		},
+		{
+			"",
+			MessageError{Category: UnexpectedEOF, Line: 1, Offset: 0},
+		},
+		{
+			"From: me\nSubject: truncated\n",
+			MessageError{Category: UnexpectedEOF, Line: 2, Offset: 9},
+		},
+		{
+			"Content-Type: multipart/mixed\n\nBody\n",
+			MessageError{Category: MissingBoundary, Line: 2, Offset: 30},
+		},
+		{
+			"Content-Type: multipart/mixed; boundary=abc\n" +
+				"\n" +
+				"--abc\n" +
+				"Content-Type: text/plain\n" +
+				"\n" +
+				"Hello\n",
+			MessageError{Category: UnexpectedEOF, Line: 6, Offset: 77, Path: "1"},
+		},
+		{
+			"Content-Type: text/plain; =\n\nBody\n",
+			MessageError{Category: BadContentType, Line: 1, Offset: 0},
+		},
+		{
+			"Content-Type: multipart/mixed; boundary=abc\nContent-Transfer-Encoding: base64\n\nLS1hYmMtLQ==\n",
+			MessageError{Category: EncodedMultipart, Line: 3, Offset: 78},
+		},
+	} {
+		// Strict mode doesn't cover categories that were added later.
+		opts := Options{Strict: true, OnBadContentType: "fail", OnMultipartCTE: "fail"}
+		_, err := Rewrite(strings.NewReader(tc.msg), ioutil.Discard, &opts)
+		merr, ok := err.(*MessageError)
+		if !ok {
+			t.Errorf("Rewrite(%q) returned %v; want MessageError", tc.msg, err)
+			continue
+		}
+		got := *merr
+		got.Text = ""
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("Rewrite(%q) returned %+v; want %+v", tc.msg, got, tc.want)
+		}
+	}
+}
+
+func TestMessageError_Error(t *testing.T) {
+	err := MessageError{Category: UnexpectedEOF, Line: 6, Offset: 82, Path: "1.2", Text: "missing body"}
+	if got, want := err.Error(), "part 1.2 at line 6 (byte 82): missing body"; got != want {
+		t.Errorf("Error() = %q; want %q", got, want)
+	}
+}
+
+func TestRewrite_errorActions(t *testing.T) {
+	const (
+		badHeader      = "From: me\nbogus\n\nBody\n"
+		noBoundary     = "Content-Type: multipart/mixed\n\nBody\n"
+		badContentType = "Content-Type: text/plain; =\n\nBody\n"
+		qpMultipart    = "Content-Type: multipart/mixed; boundary=b\nContent-Transfer-Encoding: quoted-printable\n\n--b\n\n=\n--b--\n"
+		badEncoding    = "Content-Type: multipart/mixed; boundary=b\nContent-Transfer-Encoding: x-bogus\n\n--b\n\n--b--\n"
+	)
+	for _, tc := range []struct {
+		msg       string
+		opts      Options // DeleteMediaTypes is set to disable passthrough
+		fail      bool    // Rewrite should return an error
+		malformed bool    // Report.Malformed should be set
+		warnings  int     // expected len(Report.Warnings)
+	}{
+		{badHeader, Options{}, false, true, 1},
+		{badHeader, Options{OnBadHeader: "ignore"}, false, false, 0},
+		{badHeader, Options{OnBadHeader: "fail"}, true, true, 0},
+		{badHeader, Options{OnMissingBoundary: "fail"}, false, true, 1},
+		{badHeader, Options{OnBadHeader: "ignore", Strict: true}, true, true, 0},
+		{noBoundary, Options{}, false, true, 1},
+		{noBoundary, Options{OnMissingBoundary: "ignore"}, false, false, 0},
+		{noBoundary, Options{OnMissingBoundary: "fail"}, true, true, 0},
+		{badContentType, Options{}, false, false, 0},
+		{badContentType, Options{OnBadContentType: "warn"}, false, true, 1},
+		{badContentType, Options{OnBadContentType: "fail"}, true, true, 0},
+		{badContentType, Options{Strict: true}, false, false, 0},
+		{badContentType, Options{OnBadContentType: "warn", Strict: true}, false, true, 1},
+		{qpMultipart, Options{}, false, true, 1},
+		{qpMultipart, Options{OnMultipartCTE: "ignore"}, false, false, 0},
+		{qpMultipart, Options{OnMultipartCTE: "fail"}, true, true, 0},
+		{qpMultipart, Options{Strict: true}, false, true, 1},
+		{badEncoding, Options{OnMultipartCTE: "repair"}, false, true, 1},
+	} {
+		desc := fmt.Sprintf("Strict=%v OnBadHeader=%q OnMissingBoundary=%q OnBadContentType=%q OnMultipartCTE=%q",
+			tc.opts.Strict, tc.opts.OnBadHeader, tc.opts.OnMissingBoundary, tc.opts.OnBadContentType,
+			tc.opts.OnMultipartCTE)
+		tc.opts.DeleteMediaTypes = []string{"image/*"}
+		var out strings.Builder
+		rep, err := Rewrite(strings.NewReader(tc.msg), &out, &tc.opts)
+		if tc.fail {
+			if err == nil {
+				t.Errorf("Rewrite(%q, %v) unexpectedly succeeded", tc.msg, desc)
+			}
+		} else if err != nil {
+			t.Errorf("Rewrite(%q, %v) failed: %v", tc.msg, desc, err)
+		} else if out.String() != tc.msg {
+			t.Errorf("Rewrite(%q, %v) wrote %q", tc.msg, desc, out.String())
+		}
+		if rep.Malformed != tc.malformed {
+			t.Errorf("Rewrite(%q, %v) reported malformed %v; want %v", tc.msg, desc, rep.Malformed, tc.malformed)
+		}
+		if len(rep.Warnings) != tc.warnings {
+			t.Errorf("Rewrite(%q, %v) reported warnings %q; want %d", tc.msg, desc, rep.Warnings, tc.warnings)
+		}
+	}
+
+	// Strict mode should still accept messages that it accepted before the On* fields were added.
+	const hamPath = "testdata/sa_hard_ham_0188.7fc83c7dcf3fa40cb98e61a8e8661a03.in.txt"
+	if ham, err := ioutil.ReadFile(hamPath); err != nil {
+		t.Error(err)
+	} else if _, err := Rewrite(strings.NewReader(string(ham)), ioutil.Discard, &Options{Strict: true}); err != nil {
+		t.Errorf("Rewrite(%v) failed in strict mode: %v", hamPath, err)
+	}
+
+	if _, err := Rewrite(strings.NewReader(badHeader), ioutil.Discard, &Options{OnBadHeader: "panic"}); err == nil {
+		t.Error("Rewrite unexpectedly succeeded with invalid OnBadHeader")
+	}
+	if _, err := Rewrite(strings.NewReader(badHeader), ioutil.Discard, &Options{OnBadHeader: "repair"}); err == nil {
+		t.Error(`Rewrite unexpectedly succeeded with "repair" OnBadHeader`)
+	}
+}
@@ -0,0 +1,134 @@
+// Copyright 2022 Daniel Erat.
+// All rights reserved.
+
+package rewrite
+
+import (
+	"bytes"
+	"io"
+)
+
+// shouldFlatten returns true if copyFlattenedMultipart should be used
+// for the part described by hdata.
+func shouldFlatten(hdata *headerData, opts *Options) bool {
+	if !isMultipart(hdata) {
+		return false
+	}
+	return opts.FlattenMultipart || (opts.StripAppleDouble && hdata.mediaType == "multipart/appledouble")
+}
+
+// isAppleResourceFork returns true if hdata describes the resource fork within a
+// multipart/appledouble part.
+//
+// RFC 1740 describes MacMIME: the first part of a multipart/appledouble part is an
+// application/applefile part containing the Macintosh resource fork and file information,
+// and the second part contains the data fork that's useful to other systems.
+func isAppleResourceFork(hdata, parent *headerData) bool {
+	return hdata.mediaType == "application/applefile" && parent != nil &&
+		parent.mediaType == "multipart/appledouble"
+}
+
+// copyFlattenedMultipart copies the body of the multipart part described by hdata
+// from lr to w. If deletion leaves the part with a single remaining child, the child
+// is promoted to replace the multipart part: hdr's Content-* fields are replaced by the
+// child's and the child's body is written in place of the multipart body.
+// Otherwise, hdr and the body are written unchanged (but see addPlaceholder).
+// top should be true if the part is the top-level part.
+// The return values and delim have the same meaning as in copyBody.
+func copyFlattenedMultipart(lr *lineReader, w io.Writer, hdr []byte, hdata *headerData,
+	delim string, top bool, st *msgState, opts *Options) (end bool, err error) {
+	subDelim, err := boundaryDelim(lr, hdata)
+	if err != nil {
+		if _, werr := w.Write(hdr); werr != nil {
+			return false, werr
+		}
+		return false, err
+	}
+	outDelim := pushBoundary(lr, subDelim, hdata, st, opts)
+
+	// Buffer the whole multipart body, remembering where each kept child is.
+	var body bytes.Buffer
+	writeAll := func() error {
+		b := body.Bytes()
+		if top {
+			b = addPlaceholder(b, outDelim, hdata.term, st, opts)
+		}
+		for _, b := range [][]byte{hdr, b} {
+			if _, err := w.Write(b); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	type span struct{ start, end int }
+	var kept []span
+	var deleted int
+
+	// Copy the preamble and then each child part (see copyMessagePart).
+	childEnd, err := copyBody(lr, &body, subDelim, false)
+	for err == nil && !childEnd {
+		start := body.Len()
+		var chd headerData
+		if chd, childEnd, err = copyMessagePart(lr, &body, subDelim, hdata, st, opts); err == nil {
+			if chd.deletePart {
+				deleted++
+			} else {
+				kept = append(kept, span{start, body.Len()})
+			}
+		}
+	}
+	popBoundary(lr, st, opts)
+	if err != nil {
+		if werr := writeAll(); werr != nil {
+			return false, werr
+		}
+		return false, err
+	}
+
+	if deleted == 0 || len(kept) != 1 {
+		if err := writeAll(); err != nil {
+			return false, err
+		}
+		return copyEpilogue(lr, w, delim, opts)
+	}
+
+	opts.Logger().Infof("Flattening %v with single remaining part", hdata.mediaType)
+	child := body.Bytes()[kept[0].start:kept[0].end]
+	// Drop the child's trailing delimiter line. The preceding line break is kept
+	// so that the child's body still ends with a line break before the outer delimiter.
+	if i := bytes.LastIndex(child, []byte("\n"+outDelim)); i >= 0 {
+		child = child[:i+1]
+	}
+	chdr, cbody := splitHeader(child)
+	outer, _ := splitContentFields(string(hdr))
+	_, inner := splitContentFields(string(chdr))
+	for _, s := range []string{outer, inner, hdata.term} {
+		if _, err := io.WriteString(w, s); err != nil {
+			return false, err
+		}
+	}
+	if _, err := w.Write(cbody); err != nil {
+		return false, err
+	}
+
+	// The epilogue is dropped since it would otherwise be appended to the child's body.
+	return copyBody(lr, w, delim, true)
+}
+
+// splitHeader splits b, a message part, into its header (including the trailing
+// blank line) and its body.
+func splitHeader(b []byte) (hdr, body []byte) {
+	for i := 0; i < len(b); {
+		j := bytes.IndexByte(b[i:], '\n')
+		if j < 0 {
+			break
+		}
+		ln := b[i : i+j+1]
+		i += j + 1
+		if len(bytes.TrimRight(ln, "\r\n")) == 0 {
+			return b[:i], b[i:]
+		}
+	}
+	return b, nil
+}
@@ -0,0 +1,24 @@
+// Copyright 2022 Daniel Erat.
+// All rights reserved.
+
+package rewrite
+
+import (
+	"testing"
+)
+
+func TestSplitHeader(t *testing.T) {
+	for _, tc := range []struct {
+		in, hdr, body string
+	}{
+		{"A: b\n\nbody\n", "A: b\n\n", "body\n"},
+		{"A: b\r\nC: d\r\n\r\nbody\r\n\r\nmore\r\n", "A: b\r\nC: d\r\n\r\n", "body\r\n\r\nmore\r\n"},
+		{"A: b\n\n", "A: b\n\n", ""},
+		{"A: b\n", "A: b\n", ""},
+	} {
+		hdr, body := splitHeader([]byte(tc.in))
+		if string(hdr) != tc.hdr || string(body) != tc.body {
+			t.Errorf("splitHeader(%q) = %q, %q; want %q, %q", tc.in, hdr, body, tc.hdr, tc.body)
+		}
+	}
+}
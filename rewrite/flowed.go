@@ -0,0 +1,166 @@
+// Copyright 2022 Daniel Erat.
+// All rights reserved.
+
+package rewrite
+
+import (
+	"strings"
+)
+
+// flowedWidth is the maximum line length used by flowText.
+// RFC 3676 4.2 says that lines SHOULD be shorter than 78 characters.
+const flowedWidth = 76
+
+// sigSep is the usual signature separator line, which is never flowed.
+const sigSep = "-- "
+
+// splitTextLines splits s into lines without terminators. The line terminator used by s
+// and whether s ended with a terminator are also returned.
+func splitTextLines(s string) (lines []string, term string, final bool) {
+	term = "\n"
+	if strings.Contains(s, "\r\n") {
+		term = "\r\n"
+		s = strings.ReplaceAll(s, "\r\n", "\n")
+	}
+	if strings.HasSuffix(s, "\n") {
+		final = true
+		s = s[:len(s)-1]
+	}
+	if s == "" && !final {
+		return nil, term, final
+	}
+	return strings.Split(s, "\n"), term, final
+}
+
+// joinTextLines is the inverse of splitTextLines.
+func joinTextLines(lines []string, term string, final bool) string {
+	s := strings.Join(lines, term)
+	if final {
+		s += term
+	}
+	return s
+}
+
+// quotePrefix formats a quote prefix for the supplied depth.
+func quotePrefix(depth int) string {
+	if depth == 0 {
+		return ""
+	}
+	return strings.Repeat(">", depth) + " "
+}
+
+// unflowText converts s, the body of a text/plain part with format=flowed (RFC 3676),
+// to fixed lines. delsp should be true if the part has the delsp=yes parameter.
+func unflowText(s string, delsp bool) string {
+	lines, term, final := splitTextLines(s)
+	var out []string
+	var para strings.Builder // text of the current paragraph
+	paraDepth := -1          // quote depth of para, or -1 if para is empty
+
+	flush := func() {
+		if paraDepth >= 0 {
+			ln := quotePrefix(paraDepth) + para.String()
+			if para.String() != sigSep {
+				ln = strings.TrimRight(ln, " ")
+			}
+			out = append(out, ln)
+		}
+		para.Reset()
+		paraDepth = -1
+	}
+
+	for _, ln := range lines {
+		// RFC 3676 4.5:
+		//  The number of quote indicators (">") at the start of a line specifies the
+		//  quote depth.
+		depth := 0
+		for depth < len(ln) && ln[depth] == '>' {
+			depth++
+		}
+		text := ln[depth:]
+		// RFC 3676 4.4:
+		//  When decoding, if the first character of a line is a space, it is removed
+		//  (after any quote indicators have been removed).
+		text = strings.TrimPrefix(text, " ")
+
+		// RFC 3676 4.3:
+		//  A line that ends in a space is flowed ... a signature separator line is
+		//  not considered flowed.
+		flowed := strings.HasSuffix(text, " ") && text != sigSep
+
+		// A change in quote depth ends the paragraph.
+		if paraDepth >= 0 && depth != paraDepth {
+			flush()
+		}
+		if flowed && delsp {
+			text = text[:len(text)-1]
+		}
+		para.WriteString(text)
+		paraDepth = depth
+		if !flowed {
+			flush()
+		}
+	}
+	flush()
+	return joinTextLines(out, term, final)
+}
+
+// flowText converts s, the fixed body of a text/plain part, to format=flowed (RFC 3676)
+// with delsp=no. Long lines are wrapped at spaces.
+func flowText(s string) string {
+	lines, term, final := splitTextLines(s)
+	var out []string
+	for _, ln := range lines {
+		if ln == sigSep {
+			out = append(out, ln)
+			continue
+		}
+
+		// Treat leading quote indicators (possibly separated by single spaces, e.g. "> > ")
+		// as the line's quote depth.
+		depth := 0
+		for strings.HasPrefix(ln, ">") {
+			depth++
+			ln = ln[1:]
+			if strings.HasPrefix(ln, " >") {
+				ln = ln[1:]
+			}
+		}
+		if depth > 0 {
+			ln = strings.TrimPrefix(ln, " ")
+		}
+		// Trailing spaces would make the line flowed.
+		text := strings.TrimRight(ln, " ")
+
+		for {
+			prefix := quotePrefix(depth)
+			// RFC 3676 4.4:
+			//  a) Any line which starts with a space.
+			//  b) Any line which starts with the string "From ".
+			//  c) Any line which starts with ">" [...]
+			if depth == 0 && (strings.HasPrefix(text, " ") || strings.HasPrefix(text, "From ")) {
+				prefix = " "
+			}
+			max := flowedWidth - len(prefix)
+			if len(text) <= max {
+				out = append(out, prefix+text)
+				break
+			}
+			// Break after the last space that fits, or the first one if none do.
+			i := strings.LastIndexByte(text[:max], ' ')
+			if i <= 0 {
+				if i = strings.IndexByte(text[max:], ' '); i < 0 {
+					out = append(out, prefix+text)
+					break
+				}
+				i += max
+			}
+			out = append(out, prefix+text[:i+1])
+			text = text[i+1:]
+			if text == "" {
+				break
+			}
+		}
+	}
+	return joinTextLines(out, term, final)
+}
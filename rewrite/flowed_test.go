@@ -0,0 +1,53 @@
+// Copyright 2022 Daniel Erat.
+// All rights reserved.
+
+package rewrite
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestUnflowText(t *testing.T) {
+	for _, tc := range []struct {
+		in    string
+		delsp bool
+		want  string
+	}{
+		{"", false, ""},
+		{"Hello\n", false, "Hello\n"},
+		{"This is a \nflowed para.\nFixed.\n", false, "This is a flowed para.\nFixed.\n"},
+		{"This is a \r\nflowed para.\r\n", false, "This is a flowed para.\r\n"},
+		{"abc \ndef\n", true, "abcdef\n"},
+		{" From me\n  indented\n", false, "From me\n indented\n"},
+		{"> quoted \n> text\n>> deeper\n>\nme\n", false, "> quoted text\n>> deeper\n>\nme\n"},
+		{"> flowed \nunquoted\n", false, "> flowed\nunquoted\n"},
+		{"Bye\n-- \nSig\n", false, "Bye\n-- \nSig\n"},
+		{"no final newline", false, "no final newline"},
+	} {
+		if got := unflowText(tc.in, tc.delsp); got != tc.want {
+			t.Errorf("unflowText(%q, %v) = %q; want %q", tc.in, tc.delsp, got, tc.want)
+		}
+	}
+}
+
+func TestFlowText(t *testing.T) {
+	long := strings.Repeat("word ", 20) + "end"
+	for _, tc := range []struct {
+		in, want string
+	}{
+		{"", ""},
+		{"Hello\n", "Hello\n"},
+		{"trailing  \n", "trailing\n"},
+		{"From me\n indented\n", " From me\n  indented\n"},
+		{"> > quoted\n>> also\n", ">> quoted\n>> also\n"},
+		{"Bye\r\n-- \r\nSig\r\n", "Bye\r\n-- \r\nSig\r\n"},
+		{long + "\n", strings.Repeat("word ", 15) + "\n" + strings.Repeat("word ", 5) + "end\n"},
+		{"> " + long + "\n", "> " + strings.Repeat("word ", 14) + "\n> " + strings.Repeat("word ", 6) + "end\n"},
+		{strings.Repeat("x", 100) + " y\n", strings.Repeat("x", 100) + " \ny\n"},
+	} {
+		if got := flowText(tc.in); got != tc.want {
+			t.Errorf("flowText(%q) = %q; want %q", tc.in, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,62 @@
+// Copyright 2022 Daniel Erat.
+// All rights reserved.
+
+package rewrite
+
+import (
+	"html"
+	"regexp"
+	"strings"
+)
+
+// appendTextFooter returns s, a plain-text body with lines terminated by term,
+// with footer appended to it after a blank line. s is returned unchanged if it already
+// ends with footer.
+func appendTextFooter(s, footer, term string) string {
+	footer = strings.TrimRight(strings.ReplaceAll(footer, "\r\n", "\n"), "\n")
+	if footer == "" {
+		return s
+	}
+	footer = strings.ReplaceAll(footer, "\n", term) + term
+	if strings.HasSuffix(s, footer) {
+		return s // already appended
+	}
+	if s != "" && !strings.HasSuffix(s, "\n") {
+		s += term
+	}
+	if s != "" {
+		s += term
+	}
+	return s + footer
+}
+
+// bodyEndRegexp matches the closing tag of an HTML document's body element.
+var bodyEndRegexp = regexp.MustCompile(`(?i)</body\s*>`)
+
+// appendHTMLFooter returns s, an HTML document, with footer (plain text) inserted
+// at the end of its body. s is returned unchanged if it already contains the footer.
+func appendHTMLFooter(s, footer string) string {
+	footer = strings.TrimRight(strings.ReplaceAll(footer, "\r\n", "\n"), "\n")
+	if footer == "" {
+		return s
+	}
+	lines := strings.Split(footer, "\n")
+	for i, ln := range lines {
+		lines[i] = html.EscapeString(ln)
+	}
+	div := `<div class="rendmail-footer"><hr>` + strings.Join(lines, "<br>") + "</div>"
+	if strings.Contains(s, div) {
+		return s // already inserted
+	}
+
+	// Insert the footer before the last </body> tag, or at the end if there isn't one.
+	locs := bodyEndRegexp.FindAllStringIndex(s, -1)
+	if len(locs) == 0 {
+		if strings.HasSuffix(s, "\n") {
+			return s + div + "\n"
+		}
+		return s + div
+	}
+	i := locs[len(locs)-1][0]
+	return s[:i] + div + s[i:]
+}
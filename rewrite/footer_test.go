@@ -0,0 +1,42 @@
+// Copyright 2022 Daniel Erat.
+// All rights reserved.
+
+package rewrite
+
+import (
+	"testing"
+)
+
+func TestAppendTextFooter(t *testing.T) {
+	const footer = "Sent via gateway\n"
+	for _, tc := range []struct {
+		in, term, want string
+	}{
+		{"Hello\n", "\n", "Hello\n\nSent via gateway\n"},
+		{"Hello\r\n", "\r\n", "Hello\r\n\r\nSent via gateway\r\n"},
+		{"Hello", "\n", "Hello\n\nSent via gateway\n"},
+		{"", "\n", "Sent via gateway\n"},
+	} {
+		if got := appendTextFooter(tc.in, footer, tc.term); got != tc.want {
+			t.Errorf("appendTextFooter(%q, %q, %q) = %q; want %q", tc.in, footer, tc.term, got, tc.want)
+		}
+	}
+}
+
+func TestAppendHTMLFooter(t *testing.T) {
+	const (
+		footer = "Line <1>\nLine & 2\n"
+		div    = `<div class="rendmail-footer"><hr>Line &lt;1&gt;<br>Line &amp; 2</div>`
+	)
+	for _, tc := range []struct {
+		in, want string
+	}{
+		{"<html><body><p>Hi</p></body></html>\n", "<html><body><p>Hi</p>" + div + "</body></html>\n"},
+		{"<BODY>Hi</BODY >", "<BODY>Hi" + div + "</BODY >"},
+		{"<p>Hi</p>\n", "<p>Hi</p>\n" + div + "\n"},
+	} {
+		if got := appendHTMLFooter(tc.in, footer); got != tc.want {
+			t.Errorf("appendHTMLFooter(%q, %q) = %q; want %q", tc.in, footer, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,72 @@
+// Copyright 2022 Daniel Erat.
+// All rights reserved.
+
+package rewrite
+
+import (
+	"io"
+	"sort"
+	"strings"
+)
+
+// headerSorter buffers header fields and writes them in a canonical order.
+type headerSorter struct {
+	fields []sortedField
+}
+
+type sortedField struct {
+	rank  int      // from headerFieldRank
+	lines []string // original folded lines
+}
+
+// add buffers a field with the supplied canonicalized key.
+func (hs *headerSorter) add(key string, lines []string) {
+	hs.fields = append(hs.fields, sortedField{headerFieldRank(key), lines})
+}
+
+// write writes all buffered fields to w in sorted order.
+func (hs *headerSorter) write(w io.Writer) error {
+	// The sort needs to be stable so that e.g. Received fields stay in their original order.
+	sort.SliceStable(hs.fields, func(i, j int) bool { return hs.fields[i].rank < hs.fields[j].rank })
+	for _, f := range hs.fields {
+		for _, ln := range f.lines {
+			if _, err := io.WriteString(w, ln); err != nil {
+				return err
+			}
+		}
+	}
+	hs.fields = nil
+	return nil
+}
+
+// sortedKeys lists canonicalized field names in their sorted order. The groups are roughly
+// based on RFC 5322 3.6. Keys with trailing dashes are prefixes.
+var sortedKeys = []string{
+	// Return-Path is added by the final MTA at the top of the header.
+	"Return-Path",
+	// Trace fields (RFC 5322 3.6.6 and 3.6.7) are lumped together, since their relative order is
+	// significant. Various other fields added in transit are also included.
+	"Received Resent- Delivered-To X-Original-To Received-Spf " +
+		"Authentication-Results Arc- Dkim-Signature",
+	// Originator fields (RFC 5322 3.6.1 and 3.6.2).
+	"Date", "From", "Sender", "Reply-To",
+	// Destination address fields (RFC 5322 3.6.3).
+	"To", "Cc", "Bcc",
+	// Identification and informational fields (RFC 5322 3.6.4 and 3.6.5).
+	"Message-Id", "In-Reply-To", "References", "Subject", "Comments", "Keywords",
+	// MIME fields (RFC 2045).
+	"Mime-Version", "Content-",
+}
+
+// headerFieldRank returns the position at which the field with the supplied canonicalized
+// key should be sorted. Unlisted fields (i.e. extensions) are sorted to the end.
+func headerFieldRank(key string) int {
+	for i, keys := range sortedKeys {
+		for _, k := range strings.Fields(keys) {
+			if key == k || (strings.HasSuffix(k, "-") && strings.HasPrefix(key, k)) {
+				return i
+			}
+		}
+	}
+	return len(sortedKeys)
+}
@@ -0,0 +1,62 @@
+// Copyright 2022 Daniel Erat.
+// All rights reserved.
+
+package rewrite
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestHeaderSorter(t *testing.T) {
+	var hs headerSorter
+	for _, f := range []string{
+		"X-Foo: 1\n",
+		"Content-Type: text/plain\n",
+		"Subject: hi\n",
+		"Received: second\n",
+		"Arc-Seal: x\n",
+		"From: me@example.org\n",
+		"Received: first\n",
+		"Return-Path: <me@example.org>\n",
+		"X-Bar: 2\n",
+	} {
+		key, _, _ := ParseHeaderField(trimCRLF(f))
+		hs.add(key, []string{f})
+	}
+	var b bytes.Buffer
+	if err := hs.write(&b); err != nil {
+		t.Fatal("write failed:", err)
+	}
+	const want = "Return-Path: <me@example.org>\n" +
+		"Received: second\n" +
+		"Arc-Seal: x\n" +
+		"Received: first\n" +
+		"From: me@example.org\n" +
+		"Subject: hi\n" +
+		"Content-Type: text/plain\n" +
+		"X-Foo: 1\n" +
+		"X-Bar: 2\n"
+	if got := b.String(); got != want {
+		t.Errorf("write produced:\n%s\nWant:\n%s", got, want)
+	}
+}
+
+func TestRewrite_sortHeadersEarlyReturn(t *testing.T) {
+	for _, tc := range []struct {
+		in, want string
+	}{
+		// Header-only messages are valid per RFC 5322.
+		{"Subject: x\nFrom: a@b\n", "From: a@b\nSubject: x\n"},
+		// Malformed fields are reported after the buffered fields are written.
+		{"Subject: x\nFrom: a@b\nbogus\n\nBody\n", "From: a@b\nSubject: x\nbogus\n\nBody\n"},
+	} {
+		var b bytes.Buffer
+		if _, err := Rewrite(strings.NewReader(tc.in), &b, &Options{SortHeaders: true}); err != nil {
+			t.Errorf("Rewrite(%q) failed: %v", tc.in, err)
+		} else if got := b.String(); got != tc.want {
+			t.Errorf("Rewrite(%q) wrote %q; want %q", tc.in, got, tc.want)
+		}
+	}
+}
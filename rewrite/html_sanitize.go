@@ -0,0 +1,104 @@
+// Copyright 2022 Daniel Erat.
+// All rights reserved.
+
+package rewrite
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// sanitizeHTML removes tracking pixels, external scripts, and prefetch links from the HTML
+// document s. The number of removed elements is also returned.
+func sanitizeHTML(s string) (string, int) {
+	removed := 0
+	remove := func(re *regexp.Regexp, fn func(attrs string) bool) {
+		s = re.ReplaceAllStringFunc(s, func(el string) string {
+			if fn(re.FindStringSubmatch(el)[1]) {
+				removed++
+				return ""
+			}
+			return el
+		})
+	}
+
+	remove(sanitizeImgRegexp, func(attrs string) bool {
+		return isRemoteURL(htmlAttr(attrs, "src")) && isTinyImage(attrs)
+	})
+	remove(sanitizeScriptRegexp, func(attrs string) bool {
+		return htmlAttr(attrs, "src") != ""
+	})
+	remove(sanitizeLinkRegexp, func(attrs string) bool {
+		switch strings.ToLower(htmlAttr(attrs, "rel")) {
+		case "dns-prefetch", "preconnect", "prefetch", "preload", "prerender":
+			return isRemoteURL(htmlAttr(attrs, "href"))
+		}
+		return false
+	})
+	return s, removed
+}
+
+var (
+	// These match elements, capturing their attributes.
+	sanitizeImgRegexp    = regexp.MustCompile(`(?is)<img\b([^>]*)>`)
+	sanitizeScriptRegexp = regexp.MustCompile(`(?is)<script\b([^>]*?)(?:/>|>.*?</script\s*>)`)
+	sanitizeLinkRegexp   = regexp.MustCompile(`(?is)<link\b([^>]*)>`)
+
+	// cssSizeRegexp matches a CSS width or height property, capturing the name and pixel value.
+	cssSizeRegexp = regexp.MustCompile(`(?i)\b(width|height)\s*:\s*(\d+)(?:px)?\b`)
+)
+
+// dataURIRegexp matches a base64-encoded data: URI (RFC 2397), capturing its media type and
+// data. The data may be wrapped across lines.
+var dataURIRegexp = regexp.MustCompile(
+	`(?i)\bdata:([a-z0-9.+-]+/[a-z0-9.+-]+)?(?:;[a-z0-9.+=-]+)*;base64,` +
+		`([a-z0-9+/=%]+(?:[\r\n]+[ \t]*[a-z0-9+/=%]+)*)`)
+
+// stripDataURIs replaces base64-encoded data: URIs with at least minSize bytes of encoded
+// data in the HTML document s with small placeholder URIs. The number of replaced URIs is
+// also returned.
+func stripDataURIs(s string, minSize int) (string, int) {
+	replaced := 0
+	s = dataURIRegexp.ReplaceAllStringFunc(s, func(uri string) string {
+		m := dataURIRegexp.FindStringSubmatch(uri)
+		size := len(m[2])
+		if size < minSize {
+			return uri
+		}
+		mtype := m[1]
+		if mtype == "" {
+			mtype = "text/plain" // RFC 2397 default
+		}
+		replaced++
+		return "data:text/plain," + url.PathEscape(fmt.Sprintf("removed %v (%d bytes)", mtype, size))
+	})
+	return s, replaced
+}
+
+// isRemoteURL returns true if u will be fetched over the network.
+func isRemoteURL(u string) bool {
+	u = strings.ToLower(strings.TrimSpace(u))
+	return strings.HasPrefix(u, "http://") || strings.HasPrefix(u, "https://") ||
+		strings.HasPrefix(u, "//")
+}
+
+// isTinyImage returns true if the supplied <img> attributes specify a width and height
+// of at most 1 pixel, either via attributes or inline CSS.
+func isTinyImage(attrs string) bool {
+	tiny := map[string]bool{}
+	check := func(name, val string) {
+		val = strings.TrimSuffix(strings.TrimSpace(val), "px")
+		if n, err := strconv.Atoi(val); err == nil {
+			tiny[name] = n <= 1
+		}
+	}
+	check("width", htmlAttr(attrs, "width"))
+	check("height", htmlAttr(attrs, "height"))
+	for _, m := range cssSizeRegexp.FindAllStringSubmatch(htmlAttr(attrs, "style"), -1) {
+		check(strings.ToLower(m[1]), m[2])
+	}
+	return tiny["width"] && tiny["height"]
+}
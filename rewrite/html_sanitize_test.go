@@ -0,0 +1,54 @@
+// Copyright 2022 Daniel Erat.
+// All rights reserved.
+
+package rewrite
+
+import "testing"
+
+func TestSanitizeHTML(t *testing.T) {
+	for _, tc := range []struct {
+		in, want string
+		removed  int
+	}{
+		{"<p>Hello</p>", "<p>Hello</p>", 0},
+		{`<p>Hi<img src="https://t.example.com/o.gif" width="1" height="1" alt=""></p>`, "<p>Hi</p>", 1},
+		{`<img src="https://t.example.com/o.gif" style="width:1px;height:1px;border:0">`, "", 1},
+		{`<IMG SRC='//t.example.com/o.gif' WIDTH=0 HEIGHT=0 />x`, "x", 1},
+		{`<img src="https://example.com/logo.png" width="100" height="1">`,
+			`<img src="https://example.com/logo.png" width="100" height="1">`, 0},
+		{`<img src="cid:pixel" width="1" height="1">`, `<img src="cid:pixel" width="1" height="1">`, 0},
+		{`<script src="https://example.com/a.js"></script><script>var a = 1;</script>`,
+			"<script>var a = 1;</script>", 1},
+		{`<script src="https://example.com/a.js" />`, "", 1},
+		{`<link rel="dns-prefetch" href="http://example.com"><link rel="stylesheet" href="http://example.com/a.css">`,
+			`<link rel="stylesheet" href="http://example.com/a.css">`, 1},
+	} {
+		if got, removed := sanitizeHTML(tc.in); got != tc.want || removed != tc.removed {
+			t.Errorf("sanitizeHTML(%q) = %q, %v; want %q, %v", tc.in, got, removed, tc.want, tc.removed)
+		}
+	}
+}
+
+func TestStripDataURIs(t *testing.T) {
+	const png = "iVBORw0KGgoAAAANSUhEUgAAAAEAAAABCAYAAAAfFcSJAAAADUlEQVR42mNkYPhfDwAChwGA60e6kgAAAABJRU5ErkJggg=="
+	const stub = "data:text/plain,removed%20image%2Fpng%20%2896%20bytes%29"
+	for _, tc := range []struct {
+		in      string
+		minSize int
+		want    string
+		removed int
+	}{
+		{`<p>Hello</p>`, 0, `<p>Hello</p>`, 0},
+		{`<img src="data:image/png;base64,` + png + `" alt="dot">`, 0, `<img src="` + stub + `" alt="dot">`, 1},
+		{`<img src="data:image/png;base64,` + png + `">`, 100, `<img src="data:image/png;base64,` + png + `">`, 0},
+		{`<img src="DATA:image/png;name=a.png;base64,` + png[:40] + "\n  " + png[40:] + `">`, 0,
+			`<img src="data:text/plain,removed%20image%2Fpng%20%2899%20bytes%29">`, 1},
+		{`<div style="background:url(data:;base64,aGVsbG8=)">`, 0,
+			`<div style="background:url(data:text/plain,removed%20text%2Fplain%20%288%20bytes%29)">`, 1},
+		{`<a href="data:text/html,hello">x</a>`, 0, `<a href="data:text/html,hello">x</a>`, 0},
+	} {
+		if got, removed := stripDataURIs(tc.in, tc.minSize); got != tc.want || removed != tc.removed {
+			t.Errorf("stripDataURIs(%q, %v) = %q, %v; want %q, %v", tc.in, tc.minSize, got, removed, tc.want, tc.removed)
+		}
+	}
+}
@@ -0,0 +1,208 @@
+// Copyright 2022 Daniel Erat.
+// All rights reserved.
+
+package rewrite
+
+import (
+	"fmt"
+	"html"
+	"regexp"
+	"strings"
+)
+
+// htmlToText renders a rough plain-text version of the HTML document s.
+// Links are replaced by numbered references that are listed at the end of the text.
+func htmlToText(s string) string {
+	s = htmlDropRegexp.ReplaceAllString(s, "")
+
+	var hc htmlConverter
+	for len(s) > 0 {
+		loc := htmlTagRegexp.FindStringSubmatchIndex(s)
+		if loc == nil {
+			hc.text(s)
+			break
+		}
+		hc.text(s[:loc[0]])
+		hc.tag(strings.ToLower(s[loc[2]:loc[3]]), loc[2] > loc[0]+1, s[loc[4]:loc[5]])
+		s = s[loc[1]:]
+	}
+	return hc.finish()
+}
+
+var (
+	// htmlDropRegexp matches comments and elements whose content should be dropped.
+	htmlDropRegexp = regexp.MustCompile(`(?is)<!--.*?-->|<(head|script|style|title)\b.*?</(head|script|style|title)\s*>`)
+	// htmlTagRegexp matches a start or end tag, capturing the tag name and attributes.
+	htmlTagRegexp = regexp.MustCompile(`(?s)</?([A-Za-z][A-Za-z0-9]*)([^>]*)>`)
+	// htmlAttrRegexp matches an attribute, capturing its name and (quoted or unquoted) value.
+	htmlAttrRegexp = regexp.MustCompile(`(?i)([a-z-]+)\s*=\s*(?:"([^"]*)"|'([^']*)'|([^\s"'>]+))`)
+	// htmlSpaceRegexp matches a run of HTML whitespace.
+	htmlSpaceRegexp = regexp.MustCompile(`[ \t\r\n\f]+`)
+)
+
+// htmlAttr returns the value of the named attribute (which must be lowercase) from attrs,
+// the portion of a tag following the tag name.
+func htmlAttr(attrs, name string) string {
+	for _, m := range htmlAttrRegexp.FindAllStringSubmatch(attrs, -1) {
+		if strings.ToLower(m[1]) == name {
+			return html.UnescapeString(m[2] + m[3] + m[4])
+		}
+	}
+	return ""
+}
+
+// htmlConverter accumulates text for htmlToText.
+type htmlConverter struct {
+	lines  []string // completed lines
+	cur    string   // current line
+	pre    int      // depth of <pre> elements
+	lists  []int    // item counts for nested lists; -1 for unordered lists
+	quote  int      // depth of <blockquote> elements
+	href   string   // href of current <a> element
+	links  []string // link URLs
+	blanks bool     // a blank line should be added before the next text
+}
+
+// text handles a run of text between tags.
+func (hc *htmlConverter) text(s string) {
+	if hc.pre > 0 {
+		for i, ln := range strings.Split(html.UnescapeString(s), "\n") {
+			if i > 0 {
+				hc.newline()
+			}
+			hc.write(strings.TrimRight(ln, "\r"))
+		}
+		return
+	}
+	s = htmlSpaceRegexp.ReplaceAllString(s, " ")
+	if strings.TrimSpace(hc.cur) == "" || strings.HasSuffix(hc.cur, " ") {
+		s = strings.TrimLeft(s, " ")
+	}
+	hc.write(html.UnescapeString(s))
+}
+
+// write appends s to the current line.
+func (hc *htmlConverter) write(s string) {
+	if s == "" {
+		return
+	}
+	if hc.blanks {
+		hc.blanks = false
+		if len(hc.lines) > 0 && hc.lines[len(hc.lines)-1] != "" {
+			hc.lines = append(hc.lines, "")
+		}
+	}
+	if hc.cur == "" {
+		hc.cur = strings.Repeat("> ", hc.quote) + strings.Repeat("  ", len(hc.lists))
+	}
+	hc.cur += s
+}
+
+// newline ends the current line.
+func (hc *htmlConverter) newline() {
+	hc.lines = append(hc.lines, strings.TrimRight(hc.cur, " "))
+	hc.cur = ""
+}
+
+// block ends the current line (if non-empty) and optionally requests a blank line.
+func (hc *htmlConverter) block(blank bool) {
+	if strings.TrimSpace(hc.cur) != "" {
+		hc.newline()
+	}
+	hc.cur = ""
+	if blank {
+		hc.blanks = true
+	}
+}
+
+// tag handles a start or end tag with the supplied lowercase name.
+func (hc *htmlConverter) tag(name string, end bool, attrs string) {
+	switch name {
+	case "br":
+		hc.newline()
+	case "p", "h1", "h2", "h3", "h4", "h5", "h6", "table", "hr":
+		hc.block(true)
+	case "div", "tr", "dt", "dd":
+		hc.block(false)
+	case "blockquote":
+		hc.block(true)
+		if end && hc.quote > 0 {
+			hc.quote--
+		} else if !end {
+			hc.quote++
+		}
+	case "pre":
+		hc.block(true)
+		if end && hc.pre > 0 {
+			hc.pre--
+		} else if !end {
+			hc.pre++
+		}
+	case "ul", "ol":
+		hc.block(len(hc.lists) == 0)
+		if end && len(hc.lists) > 0 {
+			hc.lists = hc.lists[:len(hc.lists)-1]
+		} else if !end {
+			n := -1
+			if name == "ol" {
+				n = 0
+			}
+			hc.lists = append(hc.lists, n)
+		}
+	case "li":
+		hc.block(false)
+		if !end {
+			bullet := "* "
+			if n := len(hc.lists); n > 0 && hc.lists[n-1] >= 0 {
+				hc.lists[n-1]++
+				bullet = fmt.Sprintf("%d. ", hc.lists[n-1])
+			}
+			hc.write(bullet)
+		}
+	case "td", "th":
+		if end {
+			hc.write(" ")
+		}
+	case "a":
+		if !end {
+			hc.href = htmlAttr(attrs, "href")
+		} else if hc.href != "" {
+			if !strings.HasPrefix(hc.href, "#") && hc.href != strings.TrimSpace(lastWord(hc.cur)) {
+				hc.links = append(hc.links, hc.href)
+				hc.write(fmt.Sprintf("[%d]", len(hc.links)))
+			}
+			hc.href = ""
+		}
+	case "img":
+		if alt := strings.TrimSpace(htmlAttr(attrs, "alt")); alt != "" {
+			hc.write("[" + alt + "]")
+		}
+	}
+}
+
+// lastWord returns the final space-separated word in s.
+func lastWord(s string) string {
+	return s[strings.LastIndexByte(s, ' ')+1:]
+}
+
+// finish returns the accumulated text, including a list of links.
+func (hc *htmlConverter) finish() string {
+	hc.block(false)
+	if len(hc.links) > 0 {
+		hc.lines = append(hc.lines, "")
+		for i, u := range hc.links {
+			hc.lines = append(hc.lines, fmt.Sprintf("[%d] %s", i+1, u))
+		}
+	}
+	// Trim leading and trailing blank lines.
+	for len(hc.lines) > 0 && hc.lines[0] == "" {
+		hc.lines = hc.lines[1:]
+	}
+	for len(hc.lines) > 0 && hc.lines[len(hc.lines)-1] == "" {
+		hc.lines = hc.lines[:len(hc.lines)-1]
+	}
+	if len(hc.lines) == 0 {
+		return ""
+	}
+	return strings.Join(hc.lines, "\n") + "\n"
+}
@@ -0,0 +1,31 @@
+// Copyright 2022 Daniel Erat.
+// All rights reserved.
+
+package rewrite
+
+import "testing"
+
+func TestHTMLToText(t *testing.T) {
+	for _, tc := range []struct {
+		in, want string
+	}{
+		{"", ""},
+		{"Hello", "Hello\n"},
+		{`<div dir="ltr">My, that&#39;s quite a subject!</div>`, "My, that's quite a subject!\n"},
+		{"<html><head><title>x</title><style>p { color: red; }</style></head>" +
+			"<body><p>First   para\ngraph.</p><p>Second<br>line</p></body></html>",
+			"First para graph.\n\nSecond\nline\n"},
+		{`Visit <a href="https://example.org/">our site</a> or <a href="https://example.org/">` +
+			`https://example.org/</a>.`,
+			"Visit our site[1] or https://example.org/.\n\n[1] https://example.org/\n"},
+		{"<ul><li>One</li><li>Two</li></ul><ol><li>A<li>B</ol>",
+			"  * One\n  * Two\n\n  1. A\n  2. B\n"},
+		{"<blockquote>Quoted<br>text</blockquote>After", "> Quoted\n> text\n\nAfter\n"},
+		{"<pre>  indented\n    code</pre>", "  indented\n    code\n"},
+		{`<!-- comment --><img src="cid:x" alt="Logo"><script>alert(1)</script>`, "[Logo]\n"},
+	} {
+		if got := htmlToText(tc.in); got != tc.want {
+			t.Errorf("htmlToText(%q) = %q; want %q", tc.in, got, tc.want)
+		}
+	}
+}
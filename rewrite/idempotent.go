@@ -0,0 +1,73 @@
+// Copyright 2022 Daniel Erat.
+// All rights reserved.
+
+package rewrite
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// Rewriting a message that was already rewritten with the same options shouldn't change it,
+// so that it's safe to e.g. run rendmail on a Maildir repeatedly or to deliver a message
+// through multiple rendmail invocations. The exception is the X-Rendmail-Backup and
+// X-Rendmail-Backup-Warning fields, which describe each invocation's own backup.
+
+// isDeletedStub returns true if hdata describes a message/external-body part
+// that was written by deletedStub to replace a deleted part.
+func isDeletedStub(hdata *headerData) bool {
+	return hdata.mediaType == "message/external-body" &&
+		strings.ToLower(hdata.contentParams["access-type"]) == "x-rendmail-deleted"
+}
+
+// isDeliveredTo returns true if ln is an unfolded Delivered-To field for addr.
+func isDeliveredTo(ln, addr string) bool {
+	key, val, err := ParseHeaderField(ln)
+	return err == nil && key == "Delivered-To" && strings.TrimSpace(val) == addr
+}
+
+// addsField returns true if opts cause the header field key to be added to
+// the top-level header (if top is true) or to a part's header.
+func (opts *Options) addsField(key string, top bool) bool {
+	switch key {
+	case "X-Rendmail-Subject":
+		return opts.DecodeSubject
+	case "X-Rendmail-List-Id", "X-Rendmail-List-Unsubscribe":
+		return top && opts.ExtractList
+	case "X-Rendmail-Encrypted":
+		return top && opts.MarkEncrypted
+	default:
+		return false
+	}
+}
+
+// verifyIdempotent rewrites out, the output of Rewrite when called with opts (after
+// applying any rules), and returns an error if the second rewrite changes it.
+func verifyIdempotent(out []byte, opts *Options) error {
+	o := *opts
+	o.Rules = nil
+	o.compiled = nil
+	o.BackupRecord = ""
+	o.BackupWarning = ""
+	o.VerifyIdempotent = false
+	// Don't repeat side effects from the first pass.
+	o.Log = nil
+	o.Findings = nil
+	o.TeePart = nil
+	o.Visit = nil
+
+	var b bytes.Buffer
+	if _, err := Rewrite(bytes.NewReader(out), &b, &o); err != nil {
+		return fmt.Errorf("rewriting output failed: %v", err)
+	}
+	if again := b.Bytes(); !bytes.Equal(again, out) {
+		i := 0
+		for i < len(again) && i < len(out) && again[i] == out[i] {
+			i++
+		}
+		line := bytes.Count(out[:i], []byte("\n")) + 1
+		return fmt.Errorf("rewriting output changed it at line %d (offset %d)", line, i)
+	}
+	return nil
+}
@@ -0,0 +1,115 @@
+// Copyright 2022 Daniel Erat.
+// All rights reserved.
+
+package rewrite
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRewrite_idempotent(t *testing.T) {
+	const msg = "Delivered-To: me@example.org\n" +
+		"From: sender@example.org\n" +
+		"To: Me <me@example.org>, other@example.org\n" +
+		"Subject: =?utf-8?q?caf=C3=A9?=\n" +
+		"X-Rendmail-Subject: spoofed\n" +
+		"List-Id: News <news.example.org>\n" +
+		"Content-Type: multipart/mixed; boundary=abc\n" +
+		"\n" +
+		"--abc\n" +
+		"Content-Type: text/plain\n" +
+		"\n" +
+		"See https://example.org/page.\n" +
+		"--abc\n" +
+		"Content-Type: image/png\n" +
+		"Content-Disposition: attachment; filename=a.png\n" +
+		"\n" +
+		"data\n" +
+		"--abc\n" +
+		"Content-Type: application/pdf\n" +
+		"\n" +
+		"%PDF\n" +
+		"--abc--\n"
+
+	opts := Options{
+		AddDeliveredTo:    "me@example.org",
+		DecodeSubject:     true,
+		DeleteMediaTypes:  []string{"image/*", "application/pdf"},
+		ExtractList:       true,
+		Footer:            "Scanned",
+		Now:               time.Date(2022, 4, 16, 16, 33, 34, 0, time.UTC),
+		RedactRecipients:  "hash",
+		RewriteBoundaries: true,
+		URLTemplate:       "https://redirect.example.org/?url={{urlquery .URL}}",
+	}
+	var first bytes.Buffer
+	if _, err := Rewrite(strings.NewReader(msg), &first, &opts); err != nil {
+		t.Fatal("Rewrite failed:", err)
+	}
+	if got := first.String(); strings.Contains(got, "spoofed") {
+		t.Errorf("Rewrite didn't remove existing X-Rendmail-Subject:\n%s", got)
+	}
+
+	// Options that would delete the stub parts by type or by path shouldn't change them.
+	for i, o := range []Options{
+		opts,
+		{DeleteMediaTypes: []string{"message/*"}},
+		{DeleteParts: []string{"2", "3"}},
+		{Policy: PolicyFunc(func(p *PartInfo) (bool, error) { return p.Path != "" && p.MediaType != "text/plain", nil })},
+	} {
+		o.Now = opts.Now.Add(time.Hour)
+		o.VerifyIdempotent = true
+		var second bytes.Buffer
+		if _, err := Rewrite(bytes.NewReader(first.Bytes()), &second, &o); err != nil {
+			t.Errorf("Rewriting output with options #%d failed: %v", i, err)
+		} else if second.String() != first.String() {
+			t.Errorf("Rewriting output with options #%d changed it:\n%s\nwant:\n%s", i, second.String(), first.String())
+		}
+	}
+}
+
+func TestRewrite_idempotentTruncation(t *testing.T) {
+	msg := "Content-Type: text/plain\n\n" + strings.Repeat("This line is repeated.\n", 20)
+	for _, max := range []int{100, 5} {
+		var b bytes.Buffer
+		opts := Options{MaxTextSize: max, VerifyIdempotent: true}
+		if _, err := Rewrite(strings.NewReader(msg), &b, &opts); err != nil {
+			t.Errorf("Rewrite with max %d failed: %v", max, err)
+		} else if got := b.String(); !strings.Contains(got, "[Truncated ") {
+			t.Errorf("Rewrite with max %d didn't truncate message:\n%s", max, got)
+		}
+	}
+}
+
+func TestRewrite_verifyIdempotent(t *testing.T) {
+	const msg = "Content-Type: multipart/mixed; boundary=abc\n" +
+		"\n" +
+		"--abc\n" +
+		"Content-Type: image/png\n" +
+		"\n" +
+		"data\n" +
+		"--abc--\n"
+	// Replacing deleted parts with different parts that will also be deleted isn't idempotent.
+	var b bytes.Buffer
+	var n int
+	_, err := Rewrite(strings.NewReader(msg), &b, &Options{
+		DeleteMediaTypes: []string{"image/*"},
+		ReplaceDeleted: func(p *PartInfo, w io.Writer) error {
+			n++
+			_, err := fmt.Fprintf(w, "Content-Type: image/png\n\nreplacement %d\n", n)
+			return err
+		},
+		VerifyIdempotent: true,
+	})
+	if err == nil {
+		t.Error("Rewrite unexpectedly succeeded")
+	}
+	if b.Len() != 0 {
+		t.Errorf("Rewrite wrote %q after failing", b.String())
+	}
+}
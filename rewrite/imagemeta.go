@@ -0,0 +1,120 @@
+// Copyright 2022 Daniel Erat.
+// All rights reserved.
+
+package rewrite
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+)
+
+// stripImageMetadata removes EXIF, GPS, XMP, and other textual metadata from b, an image of
+// the supplied media type ("image/jpeg" or "image/png"). The image data itself isn't
+// re-encoded. The number of removed segments or chunks is also returned.
+func stripImageMetadata(b []byte, mediaType string) ([]byte, int, error) {
+	switch mediaType {
+	case "image/jpeg", "image/jpg", "image/pjpeg":
+		return stripJPEGMetadata(b)
+	case "image/png":
+		return stripPNGMetadata(b)
+	default:
+		return b, 0, nil
+	}
+}
+
+const (
+	jpegSOI   = 0xd8 // start of image
+	jpegEOI   = 0xd9 // end of image
+	jpegSOS   = 0xda // start of scan; entropy-coded data follows
+	jpegAPP1  = 0xe1 // EXIF (including GPS) and XMP
+	jpegAPP13 = 0xed // Photoshop IRB (including IPTC)
+	jpegCOM   = 0xfe // comment
+)
+
+// stripJPEGMetadata removes APP1, APP13, and COM segments from the JPEG image b.
+// Other application segments (e.g. JFIF in APP0 and ICC profiles in APP2) are kept.
+func stripJPEGMetadata(b []byte) ([]byte, int, error) {
+	if len(b) < 2 || b[0] != 0xff || b[1] != jpegSOI {
+		return nil, 0, errors.New("missing JPEG SOI marker")
+	}
+	var out bytes.Buffer
+	out.Write(b[:2])
+	removed := 0
+	for i := 2; ; {
+		if i == len(b) {
+			return nil, 0, errors.New("missing JPEG SOS marker")
+		}
+		if b[i] != 0xff {
+			return nil, 0, errors.New("bad JPEG marker")
+		}
+		if i+1 < len(b) && b[i+1] == 0xff { // fill byte
+			out.WriteByte(b[i])
+			i++
+			continue
+		}
+		if i+1 < len(b) && (b[i+1] == jpegEOI || (b[i+1] >= 0xd0 && b[i+1] <= 0xd7)) { // no length
+			out.Write(b[i : i+2])
+			i += 2
+			continue
+		}
+		if i+4 > len(b) {
+			return nil, 0, errors.New("truncated JPEG segment")
+		}
+		marker := b[i+1]
+		end := i + 2 + int(binary.BigEndian.Uint16(b[i+2:]))
+		if end > len(b) || end < i+4 {
+			return nil, 0, errors.New("bad JPEG segment length")
+		}
+		switch marker {
+		case jpegAPP1, jpegAPP13, jpegCOM:
+			removed++
+		case jpegSOS:
+			// Copy the scan and everything after it unchanged.
+			out.Write(b[i:])
+			return out.Bytes(), removed, nil
+		default:
+			out.Write(b[i:end])
+		}
+		i = end
+	}
+}
+
+// pngSignature is the 8-byte header at the start of all PNG files.
+const pngSignature = "\x89PNG\r\n\x1a\n"
+
+// pngMetadataChunks contains the types of PNG chunks removed by stripPNGMetadata.
+var pngMetadataChunks = map[string]bool{
+	"eXIf": true, // EXIF (including GPS)
+	"iTXt": true, // international text (including XMP)
+	"tEXt": true, // Latin-1 text
+	"zTXt": true, // compressed Latin-1 text
+	"tIME": true, // last-modification time
+}
+
+// stripPNGMetadata removes the chunks listed in pngMetadataChunks from the PNG image b.
+func stripPNGMetadata(b []byte) ([]byte, int, error) {
+	if !bytes.HasPrefix(b, []byte(pngSignature)) {
+		return nil, 0, errors.New("missing PNG signature")
+	}
+	var out bytes.Buffer
+	out.WriteString(pngSignature)
+	removed := 0
+	for i := len(pngSignature); i < len(b); {
+		// Each chunk consists of a 4-byte length, 4-byte type, data, and 4-byte CRC.
+		if i+8 > len(b) {
+			return nil, 0, errors.New("truncated PNG chunk")
+		}
+		end := i + 12 + int(binary.BigEndian.Uint32(b[i:]))
+		if end > len(b) || end < i+12 {
+			return nil, 0, errors.New("bad PNG chunk length")
+		}
+		if pngMetadataChunks[string(b[i+4:i+8])] {
+			removed++
+		} else {
+			out.Write(b[i:end])
+		}
+		i = end
+	}
+	return out.Bytes(), removed, nil
+}
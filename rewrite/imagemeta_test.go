@@ -0,0 +1,95 @@
+// Copyright 2022 Daniel Erat.
+// All rights reserved.
+
+package rewrite
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestStripJPEGMetadata(t *testing.T) {
+	const (
+		soi  = "\xff\xd8"
+		app0 = "\xff\xe0\x00\x07JFIF\x00"
+		app1 = "\xff\xe1\x00\x0cExif\x00\x00GPS!"
+		app2 = "\xff\xe2\x00\x06ICC!"
+		com  = "\xff\xfe\x00\x05hi!"
+		dqt  = "\xff\xdb\x00\x04\x01\x02"
+		sos  = "\xff\xda\x00\x03\x01\x12\x34\xff\x00\x56\xff\xe1\x00\x02\xff\xd9" // APP1 bytes in scan aren't a segment
+	)
+	for _, tc := range []struct {
+		in, want string
+		removed  int
+	}{
+		{soi + app0 + dqt + sos, soi + app0 + dqt + sos, 0},
+		{soi + app0 + app1 + dqt + sos, soi + app0 + dqt + sos, 1},
+		{soi + app1 + app2 + com + dqt + sos, soi + app2 + dqt + sos, 2},
+		{soi + "\xff" + app1 + sos, soi + "\xff" + sos, 1}, // fill byte
+	} {
+		got, removed, err := stripJPEGMetadata([]byte(tc.in))
+		if err != nil {
+			t.Errorf("stripJPEGMetadata(%q) failed: %v", tc.in, err)
+		} else if string(got) != tc.want || removed != tc.removed {
+			t.Errorf("stripJPEGMetadata(%q) = %q, %v; want %q, %v", tc.in, got, removed, tc.want, tc.removed)
+		}
+	}
+
+	for _, in := range []string{
+		"",
+		"GIF89a",
+		soi + app0,                // no SOS
+		soi + "\xff\xe1\x00\x20x", // segment too long
+		soi + "\x00" + sos,        // missing marker
+	} {
+		if got, _, err := stripJPEGMetadata([]byte(in)); err == nil {
+			t.Errorf("stripJPEGMetadata(%q) = %q; want error", in, got)
+		}
+	}
+}
+
+func TestStripPNGMetadata(t *testing.T) {
+	chunk := func(typ, data string) string {
+		n := len(data)
+		return string([]byte{byte(n >> 24), byte(n >> 16), byte(n >> 8), byte(n)}) + typ + data + "CRC!"
+	}
+	ihdr := chunk("IHDR", "0123456789abc")
+	idat := chunk("IDAT", "compressed")
+	iend := chunk("IEND", "")
+	for _, tc := range []struct {
+		in, want string
+		removed  int
+	}{
+		{pngSignature + ihdr + idat + iend, pngSignature + ihdr + idat + iend, 0},
+		{pngSignature + ihdr + chunk("tEXt", "Author\x00me") + chunk("eXIf", "MM\x00*") + idat +
+			chunk("tIME", "1234567") + iend, pngSignature + ihdr + idat + iend, 3},
+		{pngSignature + ihdr + chunk("iTXt", "XML:com.adobe.xmp\x00...") + chunk("zTXt", "z") + idat + iend,
+			pngSignature + ihdr + idat + iend, 2},
+		{pngSignature + ihdr + chunk("iCCP", "icc") + idat + iend, pngSignature + ihdr + chunk("iCCP", "icc") + idat + iend, 0},
+	} {
+		got, removed, err := stripPNGMetadata([]byte(tc.in))
+		if err != nil {
+			t.Errorf("stripPNGMetadata(%q) failed: %v", tc.in, err)
+		} else if string(got) != tc.want || removed != tc.removed {
+			t.Errorf("stripPNGMetadata(%q) = %q, %v; want %q, %v", tc.in, got, removed, tc.want, tc.removed)
+		}
+	}
+
+	for _, in := range []string{
+		"",
+		"\xff\xd8\xff\xe0",
+		pngSignature + ihdr[:10],
+		pngSignature + ihdr + "\x00\x00\x10\x00IDATshort",
+	} {
+		if got, _, err := stripPNGMetadata([]byte(in)); err == nil {
+			t.Errorf("stripPNGMetadata(%q) = %q; want error", in, got)
+		}
+	}
+}
+
+func TestStripImageMetadata(t *testing.T) {
+	in := []byte("GIF89a...")
+	if got, removed, err := stripImageMetadata(in, "image/gif"); err != nil || !bytes.Equal(got, in) || removed != 0 {
+		t.Errorf("stripImageMetadata(%q, %q) = %q, %v, %v; want %q, 0, nil", in, "image/gif", got, removed, err, in)
+	}
+}
@@ -0,0 +1,67 @@
+// Copyright 2022 Daniel Erat.
+// All rights reserved.
+
+package rewrite
+
+import (
+	"strings"
+
+	"github.com/derat/rendmail/linereader"
+)
+
+// BoundedMemory returns true if opts limit Rewrite's memory usage regardless of the
+// size of the message being rewritten. This requires MaxLineLength, MaxUnfoldedLength,
+// MaxHeaderSize, MaxParts, and MaxDepth to all be positive and no options that buffer
+// entire parts or messages (e.g. Rules, WhenAuth, Visit, ValidateOutput, VerifyIdempotent,
+// LineEndings, or any that rewrite text parts) to be set.
+//
+// When BoundedMemory returns true, Rewrite streams the message from its reader to its
+// writer, holding at most a single part header and a single line in memory at once
+// along with per-part bookkeeping. Messages that exceed the limits produce a *LimitError.
+func (opts *Options) BoundedMemory() bool {
+	return opts.MaxLineLength > 0 && opts.MaxUnfoldedLength > 0 && opts.MaxHeaderSize > 0 &&
+		opts.MaxParts > 0 && opts.MaxDepth > 0 &&
+		len(opts.Rules) == 0 && !opts.rewritesLeaves() && !opts.AddPlaceholder &&
+		!opts.FixBoundaries && !opts.FlattenMultipart && !opts.StripAppleDouble && opts.PGPKeys == nil &&
+		opts.Visit == nil && opts.TeePart == nil && opts.ValidateOutput == "" && !opts.VerifyIdempotent &&
+		!opts.convertsLineEndings() && !opts.checksAuth()
+}
+
+// limitError returns a *LimitError for the named limit positioned at the last line read from lr.
+func (lr *lineReader) limitError(limit string, max int) *LimitError {
+	return &LimitError{Limit: limit, Max: max, Line: lr.line(), Offset: lr.r.LineStart()}
+}
+
+// convertLimitError converts errors returned by linereader for exceeded limits to *LimitError.
+// Other errors are returned unchanged.
+func (lr *lineReader) convertLimitError(err error) error {
+	switch err {
+	case linereader.ErrLineTooLong:
+		return lr.limitError("MaxLineLength", lr.r.MaxLineLength)
+	case linereader.ErrUnfoldedTooLong:
+		return lr.limitError("MaxUnfoldedLength", lr.r.MaxUnfoldedLength)
+	default:
+		return err
+	}
+}
+
+// checkPartLimits returns a *LimitError if the part described by hdata
+// exceeds opts.MaxParts or opts.MaxDepth.
+func checkPartLimits(lr *lineReader, hdata *headerData, st *msgState, opts *Options) error {
+	if opts.MaxParts > 0 && st.parts > opts.MaxParts {
+		return lr.limitError("MaxParts", opts.MaxParts)
+	}
+	if opts.MaxDepth > 0 && partDepth(hdata.path) > opts.MaxDepth {
+		return lr.limitError("MaxDepth", opts.MaxDepth)
+	}
+	return nil
+}
+
+// partDepth returns the nesting depth of the part at path, e.g. 0 for the
+// top-level part, 1 for "2", and 2 for "2.1".
+func partDepth(path string) int {
+	if path == "" {
+		return 0
+	}
+	return strings.Count(path, ".") + 1
+}
@@ -0,0 +1,84 @@
+// Copyright 2022 Daniel Erat.
+// All rights reserved.
+
+package rewrite
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestRewrite_limits(t *testing.T) {
+	const in = "From: a@b.org\n" +
+		"Subject: abc\n" +
+		" def\n" +
+		"Content-Type: multipart/mixed; boundary=outer\n" +
+		"\n" +
+		"--outer\n" +
+		"Content-Type: multipart/alternative; boundary=inner\n" +
+		"\n" +
+		"--inner\n" +
+		"\n" +
+		"0123456789\n" +
+		"--inner--\n" +
+		"--outer--\n"
+	for _, tc := range []struct {
+		opts  Options
+		limit string // expected LimitError.Limit, or empty for success
+		path  string // expected LimitError.Path
+	}{
+		{Options{}, "", ""},
+		{Options{MaxLineLength: 51, MaxUnfoldedLength: 51, MaxHeaderSize: 79, MaxParts: 3, MaxDepth: 2}, "", ""},
+		{Options{MaxLineLength: 50}, "MaxLineLength", "1"},
+		{Options{MaxLineLength: 51, MaxUnfoldedLength: 15}, "MaxUnfoldedLength", ""},
+		{Options{MaxHeaderSize: 78}, "MaxHeaderSize", ""},
+		{Options{MaxParts: 2}, "MaxParts", "1.1"},
+		{Options{MaxDepth: 1}, "MaxDepth", "1.1"},
+	} {
+		desc := limitsDesc(&tc.opts)
+		_, err := Rewrite(strings.NewReader(in), ioutil.Discard, &tc.opts)
+		if tc.limit == "" {
+			if err != nil {
+				t.Errorf("Rewrite with %v failed: %v", desc, err)
+			}
+			continue
+		}
+		if lerr, ok := err.(*LimitError); !ok {
+			t.Errorf("Rewrite with %v returned %v; want LimitError", desc, err)
+		} else if lerr.Limit != tc.limit || lerr.Path != tc.path {
+			t.Errorf("Rewrite with %v exceeded %q at %q; want %q at %q",
+				desc, lerr.Limit, lerr.Path, tc.limit, tc.path)
+		}
+	}
+}
+
+func TestOptions_BoundedMemory(t *testing.T) {
+	limits := Options{MaxLineLength: 1000, MaxUnfoldedLength: 10000, MaxHeaderSize: 100000, MaxParts: 100, MaxDepth: 10}
+	if !limits.BoundedMemory() {
+		t.Errorf("BoundedMemory() = false for %v", limitsDesc(&limits))
+	}
+	for i, fn := range []func(o *Options){
+		func(o *Options) { o.MaxParts = 0 },
+		func(o *Options) { o.SanitizeHTML = true },
+		func(o *Options) { o.AddPlaceholder = true },
+		func(o *Options) { o.Rules = []*Rule{{}} },
+		func(o *Options) { o.ValidateOutput = "internal" },
+		func(o *Options) { o.VerifyIdempotent = true },
+		func(o *Options) { o.LineEndings = "crlf" },
+		func(o *Options) { o.WhenAuth = "fail" },
+	} {
+		o := limits
+		fn(&o)
+		if o.BoundedMemory() {
+			t.Errorf("BoundedMemory() = true for case %d", i)
+		}
+	}
+}
+
+// limitsDesc returns a short description of opts's limits for test failure messages.
+func limitsDesc(opts *Options) string {
+	return fmt.Sprintf("line=%d unfolded=%d header=%d parts=%d depth=%d", opts.MaxLineLength,
+		opts.MaxUnfoldedLength, opts.MaxHeaderSize, opts.MaxParts, opts.MaxDepth)
+}
@@ -0,0 +1,121 @@
+// Copyright 2022 Daniel Erat.
+// All rights reserved.
+
+package rewrite
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/derat/rendmail/linereader"
+)
+
+// lineReader reads an email message line-by-line using linereader.Reader
+// and optionally captures the lines that it reads.
+type lineReader struct {
+	r       *linereader.Reader
+	capture *bytes.Buffer // if non-nil, lines are also appended here
+	delims  []openDelim   // delimiters of multipart parts being read, outermost first
+	stray   *openDelim    // element of delims found within a part that doesn't use it
+}
+
+// newLineReader returns a lineReader that reads from r.
+// release should be called when the lineReader is no longer needed.
+func newLineReader(r io.Reader) *lineReader {
+	lr := lineReaderPool.Get().(*lineReader)
+	lr.r.Reset(r)
+	return lr
+}
+
+// release returns lr to lineReaderPool. lr must not be used afterward.
+func (lr *lineReader) release() {
+	lr.r.Reset(nil)
+	lr.capture = nil
+	lr.delims = lr.delims[:0]
+	lr.stray = nil
+	lineReaderPool.Put(lr)
+}
+
+// readLine reads and returns a single newline-terminated line.
+// See linereader.Reader.ReadLine.
+func (lr *lineReader) readLine() (string, error) {
+	ln, err := lr.r.ReadLine()
+	if ln != "" && lr.capture != nil {
+		lr.capture.WriteString(ln)
+	}
+	return ln, lr.convertLimitError(err)
+}
+
+// copyUntilDelim copies lines to w until it reads a line starting with delim, which is
+// returned. See linereader.Reader.CopyUntilPrefix.
+func (lr *lineReader) copyUntilDelim(w io.Writer, delim []byte) ([]byte, error) {
+	if lr.capture != nil {
+		w = io.MultiWriter(w, lr.capture)
+	}
+	if len(lr.delims) > 0 {
+		w = &strayChecker{w, lr, string(delim)}
+	}
+	ln, err := lr.r.CopyUntilPrefix(w, delim)
+	if len(ln) > 0 && lr.capture != nil {
+		lr.capture.Write(ln)
+	}
+	return ln, lr.convertLimitError(err)
+}
+
+// line returns the 1-based number of the last line that was read.
+// 1 is returned if nothing has been read yet, e.g. for empty input.
+func (lr *lineReader) line() int {
+	if n := lr.r.Line(); n > 0 {
+		return n
+	}
+	return 1
+}
+
+// errorf returns a *MessageError of category cat positioned at the last line that was read.
+func (lr *lineReader) errorf(cat ErrorCategory, format string, args ...interface{}) *MessageError {
+	return &MessageError{Category: cat, Line: lr.line(), Offset: lr.r.LineStart(), Text: fmt.Sprintf(format, args...)}
+}
+
+// readFoldedLine reads and returns a possibly-folded line.
+// See linereader.Reader.ReadFoldedLine.
+func (lr *lineReader) readFoldedLine() (folded []string, unfolded string, err error) {
+	folded, unfolded, err = lr.r.ReadFoldedLine()
+	if lr.capture != nil {
+		for _, ln := range folded {
+			lr.capture.WriteString(ln)
+		}
+	}
+	return folded, unfolded, lr.convertLimitError(err)
+}
+
+// trimCRLF trims a trailing "\r\n" (or just "\n" or "\r") from ln.
+//
+// RFC 5322 2.3 says "CR and LF MUST only occur together as CRLF; they MUST NOT appear
+// independently in the body.", but I think that all bets are off by the time that we're
+// looking at e.g. a Maildir message file. On a Linux system, I always see only "\n"
+// without a preceding "\r", and old messages written on classic Mac OS use only "\r".
+func trimCRLF(ln string) string {
+	if len(ln) > 0 && ln[len(ln)-1] == '\n' {
+		ln = ln[:len(ln)-1]
+		if len(ln) > 0 && ln[len(ln)-1] == '\r' {
+			ln = ln[:len(ln)-1]
+		}
+	} else if len(ln) > 0 && ln[len(ln)-1] == '\r' {
+		ln = ln[:len(ln)-1]
+	}
+	return ln
+}
+
+// lineTerm returns ln's line terminator ("\r\n", "\n", or "\r"), or "\n" if it has none.
+func lineTerm(ln string) string {
+	switch {
+	case strings.HasSuffix(ln, "\r\n"):
+		return "\r\n"
+	case strings.HasSuffix(ln, "\r"):
+		return "\r"
+	default:
+		return "\n"
+	}
+}
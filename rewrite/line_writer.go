@@ -0,0 +1,74 @@
+// Copyright 2022 Daniel Erat.
+// All rights reserved.
+
+package rewrite
+
+import (
+	"bytes"
+	"io"
+)
+
+// lineEndingWriter is an io.Writer that converts line terminators ("\r\n", "\n",
+// and bare "\r" if bareCR is true) to term before writing data to an underlying writer.
+//
+// Close must be called after all data has been written.
+type lineEndingWriter struct {
+	w         io.Writer
+	term      string // "\r\n" or "\n"
+	bareCR    bool   // bare CRs are terminators (see linereader.Reader.BareCR)
+	pendingCR bool   // previous write ended with '\r'
+	buf       bytes.Buffer
+}
+
+func newLineEndingWriter(w io.Writer, term string, bareCR bool) *lineEndingWriter {
+	return &lineEndingWriter{w: w, term: term, bareCR: bareCR}
+}
+
+func (lw *lineEndingWriter) Write(p []byte) (int, error) {
+	lw.buf.Reset()
+	for i, b := range p {
+		if lw.pendingCR {
+			lw.pendingCR = false
+			if b == '\n' {
+				lw.buf.WriteString(lw.term)
+				continue
+			}
+			lw.buf.WriteString(lw.crText())
+		}
+		switch {
+		case b == '\r' && i == len(p)-1:
+			lw.pendingCR = true // wait to see if the next write starts with '\n'
+		case b == '\r' && p[i+1] == '\n':
+			lw.pendingCR = true
+		case b == '\r':
+			lw.buf.WriteString(lw.crText())
+		case b == '\n':
+			lw.buf.WriteString(lw.term)
+		default:
+			lw.buf.WriteByte(b)
+		}
+	}
+	if _, err := lw.buf.WriteTo(lw.w); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// crText returns the text that should be written in place of a bare CR.
+func (lw *lineEndingWriter) crText() string {
+	if lw.bareCR {
+		return lw.term
+	}
+	return "\r"
+}
+
+// Close writes a trailing bare CR (or line terminator) if one is pending.
+// It does not close the underlying writer.
+func (lw *lineEndingWriter) Close() error {
+	if lw.pendingCR {
+		lw.pendingCR = false
+		_, err := io.WriteString(lw.w, lw.crText())
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,47 @@
+// Copyright 2022 Daniel Erat.
+// All rights reserved.
+
+package rewrite
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestLineEndingWriter(t *testing.T) {
+	for _, tc := range []struct {
+		writes []string
+		term   string
+		bareCR bool
+		want   string
+	}{
+		{[]string{"a\nb\n"}, "\r\n", false, "a\r\nb\r\n"},
+		{[]string{"a\r\nb\r\n"}, "\n", false, "a\nb\n"},
+		{[]string{"a\r\nb\n"}, "\r\n", false, "a\r\nb\r\n"},
+		{[]string{"a\r", "\nb\r", "\n"}, "\n", false, "a\nb\n"},
+		{[]string{"a\rb\n"}, "\n", false, "a\rb\n"}, // bare CR is preserved
+		{[]string{"a\r"}, "\n", false, "a\r"},
+		{[]string{"a\r", "b\n"}, "\r\n", false, "a\rb\r\n"},
+		{[]string{"a\rb\r"}, "\r\n", true, "a\r\nb\r\n"}, // bare CR is converted
+		{[]string{"a\r"}, "\n", true, "a\n"},
+		{[]string{"a\r", "b"}, "\n", true, "a\nb"},
+		{[]string{"a\r", "\nb\r"}, "\n", true, "a\nb\n"},
+	} {
+		var b bytes.Buffer
+		lw := newLineEndingWriter(&b, tc.term, tc.bareCR)
+		for _, s := range tc.writes {
+			if n, err := lw.Write([]byte(s)); err != nil {
+				t.Fatalf("Write(%q) failed: %v", s, err)
+			} else if n != len(s) {
+				t.Fatalf("Write(%q) = %v; want %v", s, n, len(s))
+			}
+		}
+		if err := lw.Close(); err != nil {
+			t.Fatal("Close failed:", err)
+		}
+		if got := b.String(); got != tc.want {
+			t.Errorf("Writing %q with %q (bareCR %v) produced %q; want %q",
+				tc.writes, tc.term, tc.bareCR, got, tc.want)
+		}
+	}
+}
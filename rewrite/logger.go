@@ -0,0 +1,232 @@
+// Copyright 2022 Daniel Erat.
+// All rights reserved.
+
+package rewrite
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LogLevel describes the severity of a log message.
+type LogLevel int
+
+const (
+	LogDebug LogLevel = iota
+	LogInfo
+	LogWarning
+	LogError
+)
+
+// logLevelNames maps from LogLevel values to the names used in flags and JSON output.
+var logLevelNames = map[LogLevel]string{
+	LogDebug:   "debug",
+	LogInfo:    "info",
+	LogWarning: "warning",
+	LogError:   "error",
+}
+
+// ParseLogLevel returns the level named by s, e.g. "info".
+func ParseLogLevel(s string) (LogLevel, bool) {
+	for l, n := range logLevelNames {
+		if n == s {
+			return l, true
+		}
+	}
+	return 0, false
+}
+
+// Logger receives diagnostic messages written while rewriting messages.
+// Implementations must be safe for concurrent use.
+type Logger interface {
+	Debugf(format string, args ...interface{})
+	Infof(format string, args ...interface{})
+	Warningf(format string, args ...interface{})
+	Errorf(format string, args ...interface{})
+}
+
+// Logger returns opts.Log, or a Logger that discards messages if opts.Log is nil.
+func (opts *Options) Logger() Logger {
+	if opts.Log == nil {
+		return nopLogger{}
+	}
+	return opts.Log
+}
+
+// LoggerWith returns a logger that includes a field with the supplied key and value
+// in messages written to l. Fields are prefixed to the text of messages written to
+// Logger implementations other than StreamLogger.
+func LoggerWith(l Logger, key, val string) Logger {
+	switch tl := l.(type) {
+	case nil:
+		return nil
+	case *StreamLogger:
+		return tl.With(key, val)
+	}
+	return &fieldLogger{l, key + "=" + val + " "}
+}
+
+// partPos describes the position in a message that is currently being processed.
+type partPos struct {
+	lr   *lineReader // reader of the part's data
+	path string      // part's position in the MIME tree, e.g. "1.2" (empty for top-level part)
+}
+
+// String returns a description of the part and the last line that was read,
+// e.g. "part 1.2, line 3140".
+func (p *partPos) String() string {
+	loc := fmt.Sprintf("line %d", p.lr.line())
+	if p.path != "" {
+		loc = "part " + p.path + ", " + loc
+	}
+	return loc
+}
+
+// withPosition returns a copy of opts whose logger prefixes messages with the position
+// described by lr and path. The position is also included in warnings added to reports.
+func (opts *Options) withPosition(lr *lineReader, path string) *Options {
+	o := *opts
+	o.pos = &partPos{lr, path}
+	if pl, ok := o.Log.(*posLogger); ok {
+		o.Log = pl.l // avoid prefixing the parent part's position
+	}
+	if o.Log != nil {
+		o.Log = &posLogger{o.Log, o.pos}
+	}
+	return &o
+}
+
+// posLogger is a Logger that prefixes messages with the position being processed.
+type posLogger struct {
+	l   Logger
+	pos *partPos
+}
+
+func (pl *posLogger) Debugf(format string, args ...interface{}) {
+	pl.l.Debugf("%v: %s", pl.pos, fmt.Sprintf(format, args...))
+}
+func (pl *posLogger) Infof(format string, args ...interface{}) {
+	pl.l.Infof("%v: %s", pl.pos, fmt.Sprintf(format, args...))
+}
+func (pl *posLogger) Warningf(format string, args ...interface{}) {
+	pl.l.Warningf("%v: %s", pl.pos, fmt.Sprintf(format, args...))
+}
+func (pl *posLogger) Errorf(format string, args ...interface{}) {
+	pl.l.Errorf("%v: %s", pl.pos, fmt.Sprintf(format, args...))
+}
+
+// nopLogger is a Logger that discards all messages.
+type nopLogger struct{}
+
+func (nopLogger) Debugf(format string, args ...interface{})   {}
+func (nopLogger) Infof(format string, args ...interface{})    {}
+func (nopLogger) Warningf(format string, args ...interface{}) {}
+func (nopLogger) Errorf(format string, args ...interface{})   {}
+
+// fieldLogger is a Logger that prefixes messages before passing them to another Logger.
+type fieldLogger struct {
+	l      Logger
+	prefix string // e.g. "message=a.eml "
+}
+
+func (fl *fieldLogger) Debugf(format string, args ...interface{}) {
+	fl.l.Debugf("%s%s", fl.prefix, fmt.Sprintf(format, args...))
+}
+func (fl *fieldLogger) Infof(format string, args ...interface{}) {
+	fl.l.Infof("%s%s", fl.prefix, fmt.Sprintf(format, args...))
+}
+func (fl *fieldLogger) Warningf(format string, args ...interface{}) {
+	fl.l.Warningf("%s%s", fl.prefix, fmt.Sprintf(format, args...))
+}
+func (fl *fieldLogger) Errorf(format string, args ...interface{}) {
+	fl.l.Errorf("%s%s", fl.prefix, fmt.Sprintf(format, args...))
+}
+
+// StreamLogger is a Logger that writes leveled messages as lines of text or JSON objects.
+// All methods are no-ops for a nil logger.
+type StreamLogger struct {
+	w      io.Writer
+	level  LogLevel          // minimum level to write
+	json   bool              // write JSON objects instead of text
+	now    func() time.Time  // returns the time for JSON messages
+	fields map[string]string // additional fields describing the context, e.g. a message's path
+	mu     *sync.Mutex       // shared by derived loggers to serialize writes to w
+}
+
+// DefaultLogger returns a logger that writes info messages and above to stderr as text.
+func DefaultLogger() *StreamLogger { return NewLogger(os.Stderr, LogInfo, false) }
+
+// NewLogger returns a logger that writes messages at level and above to w.
+// If useJSON is true, each message is written as a JSON object with "time",
+// "level", and "text" properties in addition to any context fields.
+func NewLogger(w io.Writer, level LogLevel, useJSON bool) *StreamLogger {
+	return &StreamLogger{w: w, level: level, json: useJSON, now: time.Now, mu: &sync.Mutex{}}
+}
+
+// With returns a logger that includes a field with the supplied key and value in messages.
+func (l *StreamLogger) With(key, val string) *StreamLogger {
+	if l == nil {
+		return nil
+	}
+	nl := *l
+	nl.fields = make(map[string]string, len(l.fields)+1)
+	for k, v := range l.fields {
+		nl.fields[k] = v
+	}
+	nl.fields[key] = val
+	return &nl
+}
+
+// enabled returns true if messages at level would be written.
+func (l *StreamLogger) enabled(level LogLevel) bool {
+	return l != nil && level >= l.level
+}
+
+func (l *StreamLogger) Debugf(format string, args ...interface{}) { l.logf(LogDebug, format, args...) }
+func (l *StreamLogger) Infof(format string, args ...interface{})  { l.logf(LogInfo, format, args...) }
+func (l *StreamLogger) Warningf(format string, args ...interface{}) {
+	l.logf(LogWarning, format, args...)
+}
+func (l *StreamLogger) Errorf(format string, args ...interface{}) { l.logf(LogError, format, args...) }
+
+// logf formats and writes a message at level.
+func (l *StreamLogger) logf(level LogLevel, format string, args ...interface{}) {
+	if !l.enabled(level) {
+		return
+	}
+	text := strings.TrimRight(fmt.Sprintf(format, args...), "\n")
+
+	var ln []byte
+	if l.json {
+		obj := make(map[string]string, len(l.fields)+3)
+		for k, v := range l.fields {
+			obj[k] = v
+		}
+		obj["time"] = l.now().Format(time.RFC3339Nano)
+		obj["level"] = logLevelNames[level]
+		obj["text"] = text
+		ln, _ = json.Marshal(obj) // can't fail for a map of strings
+	} else {
+		keys := make([]string, 0, len(l.fields))
+		for k := range l.fields {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		var sb strings.Builder
+		for _, k := range keys {
+			fmt.Fprintf(&sb, "%s=%s ", k, l.fields[k])
+		}
+		sb.WriteString(text)
+		ln = []byte(sb.String())
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.w.Write(append(ln, '\n'))
+}
@@ -0,0 +1,114 @@
+// Copyright 2022 Daniel Erat.
+// All rights reserved.
+
+package rewrite
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLogger(t *testing.T) {
+	now := time.Date(2022, 4, 16, 16, 33, 34, 0, time.UTC)
+	for _, tc := range []struct {
+		level LogLevel
+		json  bool
+		want  string
+	}{
+		{LogDebug, false, "debug 1\ninfo 2\nmessage=a.eml warning 3\nmessage=a.eml part=1 error 4\n"},
+		{LogWarning, false, "message=a.eml warning 3\nmessage=a.eml part=1 error 4\n"},
+		{LogInfo, true, `{"level":"info","text":"info 2","time":"2022-04-16T16:33:34Z"}` + "\n" +
+			`{"level":"warning","message":"a.eml","text":"warning 3","time":"2022-04-16T16:33:34Z"}` + "\n" +
+			`{"level":"error","message":"a.eml","part":"1","text":"error 4","time":"2022-04-16T16:33:34Z"}` + "\n"},
+	} {
+		var b bytes.Buffer
+		l := NewLogger(&b, tc.level, tc.json)
+		l.now = func() time.Time { return now }
+		l.Debugf("debug %d", 1)
+		l.Infof("info %d\n", 2) // trailing newline should be dropped
+		ml := l.With("message", "a.eml")
+		ml.Warningf("warning %d", 3)
+		ml.With("part", "1").Errorf("error %d", 4)
+		if got := b.String(); got != tc.want {
+			t.Errorf("Level %v with json=%v wrote:\n%s\nwant:\n%s", tc.level, tc.json, got, tc.want)
+		}
+	}
+
+	// Methods should be no-ops for nil loggers.
+	var l *StreamLogger
+	l.With("a", "b").Errorf("foo")
+}
+
+// recordLogger is a Logger that records messages.
+type recordLogger struct{ msgs []string }
+
+func (rl *recordLogger) Debugf(format string, args ...interface{}) { rl.add("D", format, args...) }
+func (rl *recordLogger) Infof(format string, args ...interface{})  { rl.add("I", format, args...) }
+func (rl *recordLogger) Warningf(format string, args ...interface{}) {
+	rl.add("W", format, args...)
+}
+func (rl *recordLogger) Errorf(format string, args ...interface{}) { rl.add("E", format, args...) }
+func (rl *recordLogger) add(level, format string, args ...interface{}) {
+	rl.msgs = append(rl.msgs, level+" "+fmt.Sprintf(format, args...))
+}
+
+func TestLoggerWith(t *testing.T) {
+	var rl recordLogger
+	opts := Options{Log: LoggerWith(&rl, "message", "a.eml"), DeleteMediaTypes: []string{"image/*"}}
+	const msg = "Content-Type: image/png\n\ndata\n"
+	if _, err := Rewrite(strings.NewReader(msg), ioutil.Discard, &opts); err != nil {
+		t.Fatal("Rewrite failed:", err)
+	}
+	if want := []string{"I message=a.eml line 1: Deleting image/png"}; !reflect.DeepEqual(rl.msgs, want) {
+		t.Errorf("Rewrite logged %q; want %q", rl.msgs, want)
+	}
+
+	// Options without a logger should still be usable.
+	(&Options{}).Logger().Errorf("discarded")
+	if l := LoggerWith(nil, "a", "b"); l != nil {
+		t.Errorf("LoggerWith(nil, ...) = %v; want nil", l)
+	}
+}
+
+func TestRewrite_logPositions(t *testing.T) {
+	const msg = "Content-Type: multipart/mixed; boundary=abc\n" +
+		"\n" +
+		"--abc\n" +
+		"Content-Type: text/plain\n" +
+		"\n" +
+		"Hello\n" +
+		"--abc\n" +
+		"Content-Type: multipart/related; boundary=def\n" +
+		"\n" +
+		"--def\n" +
+		"Content-Type: image/png\n" +
+		"\n" +
+		"data\n" +
+		"--def\n" +
+		"Content-Type: text/plain; =\n" +
+		"\n" +
+		"Bye\n" +
+		"--def--\n" +
+		"--abc--\n"
+	var rl recordLogger
+	opts := Options{Log: &rl, DeleteMediaTypes: []string{"image/*"}, OnBadContentType: "warn"}
+	rep, err := Rewrite(strings.NewReader(msg), ioutil.Discard, &opts)
+	if err != nil {
+		t.Fatal("Rewrite failed:", err)
+	}
+	want := []string{
+		"I part 2.1, line 11: Deleting image/png",
+		`W part 2.2, line 15: Ignoring invalid Content-Type "text/plain; =": mime: invalid media parameter`,
+	}
+	if !reflect.DeepEqual(rl.msgs, want) {
+		t.Errorf("Rewrite logged %q; want %q", rl.msgs, want)
+	}
+	if want := []string{want[1][2:]}; !reflect.DeepEqual(rep.Warnings, want) {
+		t.Errorf("Rewrite reported warnings %q; want %q", rep.Warnings, want)
+	}
+}
@@ -0,0 +1,1561 @@
+// Copyright 2022 Daniel Erat.
+// All rights reserved.
+
+// Package rewrite rewrites email messages, e.g. deleting attachments with
+// particular media types while leaving the rest of the message unchanged.
+//
+// Messages are streamed from an io.Reader to an io.Writer by Rewrite, with
+// the changes that are made controlled by Options.
+package rewrite
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/mail"
+	"net/textproto"
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/text/encoding/charmap"
+	"golang.org/x/text/runes"
+	"golang.org/x/text/transform"
+	"golang.org/x/text/unicode/norm"
+)
+
+// BackupField is the name of the header field used to record the backup of the original message.
+const BackupField = "X-Rendmail-Backup"
+
+// BackupWarningField is the name of the header field added when the original message
+// couldn't be backed up.
+const BackupWarningField = "X-Rendmail-Backup-Warning"
+
+// Options contains options used to control Rewrite's behavior.
+type Options struct {
+	AddDeliveredTo    string    `json:"addDeliveredTo"`    // address for Delivered-To field added to top of header
+	AddPlaceholder    bool      `json:"addPlaceholder"`    // add text/plain part describing deletions if nothing displayable is left
+	AddTextAlt        bool      `json:"addTextAlt"`        // add text/plain alternatives to HTML-only messages
+	BackupRecord      string    `json:"backupRecord"`      // value for X-Rendmail-Backup field added to top of header
+	CheckHeaders      bool      `json:"checkHeaders"`      // report RFC 5322 problems in top-level header
+	DataURIMinSize    int       `json:"dataURIMinSize"`    // minimum encoded size of data: URIs removed by stripDataURIs
+	DedupContentType  bool      `json:"dedupContentType"`  // remove Content-Type fields after the first in each part
+	DefangURLs        bool      `json:"defangURLs"`        // defang URLs in text and HTML parts, e.g. "hxxp://"
+	DeleteEncrypted   bool      `json:"deleteEncrypted"`   // delete multipart/encrypted parts
+	DeleteMediaTypes  []string  `json:"deleteMediaTypes"`  // globs for attachment media types to delete
+	DeleteParts       []string  `json:"deleteParts"`       // paths of parts to delete, e.g. "1.2" ("0" for top-level part)
+	DropEpilogue      bool      `json:"dropEpilogue"`      // remove data following multiparts' closing delimiters
+	Encode8BitHeader  bool      `json:"encode8BitHeader"`  // RFC-2047-encode header fields containing 8-bit data
+	EnforceLineLimit  bool      `json:"enforceLineLimit"`  // re-encode parts with overlong lines (quoted-printable for text, base64 otherwise)
+	ExtractList       bool      `json:"extractList"`       // write X-Rendmail-List-* for List-Unsubscribe and List-Id
+	FixBoundaries     bool      `json:"fixBoundaries"`     // regenerate colliding multipart boundaries
+	FlattenMultipart  bool      `json:"flattenMultipart"`  // promote lone remaining child of multipart parts after deletion
+	Footer            string    `json:"footer"`            // text appended to main text/plain and text/html parts
+	FormatFlowed      string    `json:"formatFlowed"`      // "fixed" or "flowed" to convert text/plain parts
+	KeepMediaTypes    []string  `json:"keepMediaTypes"`    // globs that override deleteMediaTypes
+	LineEndings       string    `json:"lineEndings"`       // "crlf" or "lf" to convert line endings (base64-encoding binary parts), or "keep"
+	MarkEncrypted     bool      `json:"markEncrypted"`     // add X-Rendmail-Encrypted to encrypted messages
+	MaxDepth          int       `json:"maxDepth"`          // fail for parts nested more deeply than this (0 for no limit)
+	MaxHeaderSize     int       `json:"maxHeaderSize"`     // fail for part headers larger than this many bytes (0 for no limit)
+	MaxLineLength     int       `json:"maxLineLength"`     // fail for lines longer than this many bytes (0 for no limit)
+	MaxParts          int       `json:"maxParts"`          // fail for messages with more parts than this (0 for no limit)
+	MaxTextSize       int       `json:"maxTextSize"`       // truncate text parts larger than this many bytes (tiny limits leave just a notice)
+	MaxUnfoldedLength int       `json:"maxUnfoldedLength"` // fail for unfolded header fields longer than this many bytes (0 for no limit)
+	NormalizeCTE      string    `json:"normalizeCTE"`      // Content-Transfer-Encoding for text parts
+	Now               time.Time `json:"now"`               // current time
+	OnBadContentType  string    `json:"onBadContentType"`  // "ignore" (default), "warn", or "fail" for unparsable Content-Type
+	OnBadHeader       string    `json:"onBadHeader"`       // "ignore", "warn" (default), or "fail" for malformed header fields
+	OnMissingBoundary string    `json:"onMissingBoundary"` // "ignore", "warn" (default), or "fail" for multipart parts without boundaries
+	OnMultipartCTE    string    `json:"onMultipartCTE"`    // "ignore", "warn" (default), "fail", or "repair" for encoded multipart parts
+	DecodeSubject     bool      `json:"decodeSubject"`     // decode Subject header field to X-Rendmail-Subject
+	PGPOutput         string    `json:"pgpOutput"`         // "decrypted" or "encrypted" output for decrypted PGP/MIME parts
+	RedactKey         string    `json:"redactKey"`         // HMAC key for RedactRecipients "hash" mode (see redactAddressList)
+	RedactRecipients  string    `json:"redactRecipients"`  // "hash" or "placeholder" to redact To/Cc/Bcc
+	RewrapBase64      bool      `json:"rewrapBase64"`      // re-wrap base64 bodies to 76-character lines
+	RewriteBoundaries bool      `json:"rewriteBoundaries"` // replace all multipart boundaries with generated ones
+	Rules             []*Rule   `json:"rules"`             // rules that change these options per message
+	SanitizeHTML      bool      `json:"sanitizeHTML"`      // remove tracking elements from HTML parts
+	ScanEmbedded      bool      `json:"scanEmbedded"`      // apply deleteMediaTypes to BinHex and yEnc data in text parts
+	SortHeaders       bool      `json:"sortHeaders"`       // sort top-level header fields into a canonical order
+	Strict            bool      `json:"strict"`            // fail for bad headers, missing boundaries, and truncation (overrides OnBadHeader and OnMissingBoundary)
+	StripAppleDouble  bool      `json:"stripAppleDouble"`  // delete resource forks from multipart/appledouble parts
+	StripDataURIs     bool      `json:"stripDataURIs"`     // replace base64 data: URIs in HTML parts
+	StripHeaders      []string  `json:"stripHeaders"`      // names of top-level header fields to remove
+	StripImageMeta    bool      `json:"stripImageMeta"`    // remove EXIF, GPS, and XMP metadata from JPEG and PNG parts
+	StripLeadingJunk  bool      `json:"stripLeadingJunk"`  // remove UTF-8 BOM and blank or garbage lines preceding top-level header
+	StripMboxFrom     bool      `json:"stripMboxFrom"`     // remove mbox From_ line preceding top-level header
+	StripReceipts     bool      `json:"stripReceipts"`     // remove header fields requesting read receipts
+	StripSignature    bool      `json:"stripSignature"`    // remove signature blocks from text and HTML parts
+	SubjectTag        string    `json:"subjectTag"`        // text prepended to top-level Subject
+	TranscodeUTF8     bool      `json:"transcodeUTF8"`     // convert text parts to UTF-8
+	URLTemplate       string    `json:"urlTemplate"`       // text/template for rewriting URLs in text and HTML parts
+	ValidateOutput    string    `json:"validateOutput"`    // "internal" or "full" to fail without writing if output can't be re-parsed
+	VerifyIdempotent  bool      `json:"verifyIdempotent"`  // fail without writing if rewriting the output again would change it
+	WhenAuth          string    `json:"whenAuth"`          // only delete parts (by any option or rule) for this auth verdict ("pass", "fail", or "any")
+
+	PGPKeys  openpgp.EntityList `json:"-"` // keys for decrypting PGP/MIME parts
+	Charsets CharsetRegistry    `json:"-"` // charsets for decoding text (nil for defaults)
+	Log      Logger             `json:"-"` // nil to disable logging
+	Findings io.Writer          `json:"-"` // destination for CheckHeaders findings (nil to discard)
+
+	BackupWarning string `json:"-"` // value for BackupWarningField added to top of header
+	Profile       string `json:"-"` // name of the configuration profile used to set options (informational)
+
+	Policy Policy   `json:"-"` // additional policy for deleting parts after their headers are read
+	Visit  WalkFunc `json:"-"` // called for each part if non-nil; see Walk
+
+	// TeePart is called for each non-multipart part (including deleted parts, but excluding
+	// message/rfc822 parts, whose enclosed parts are passed instead) if non-nil.
+	// The part's decoded body (or its encoded body if it couldn't be decoded) is written
+	// to the returned writer, which is then closed. Parts are skipped if nil is returned.
+	TeePart func(part *PartInfo) io.WriteCloser `json:"-"`
+
+	// ReplaceDeleted writes the Content-* header fields, blank line, and body of the part
+	// replacing a deleted part. If nil, a mutt-style message/external-body part is used.
+	// Parts replaced this way can't be restored from backups by the rendmail command.
+	ReplaceDeleted func(part *PartInfo, w io.Writer) error `json:"-"`
+
+	report   *Report          // updated while rewriting
+	pos      *partPos         // set by withPosition
+	ctx      context.Context  // set by RewriteContext
+	compiled *compiledOptions // set by Compile
+}
+
+// Report describes what happened while rewriting a message.
+type Report struct {
+	Parts     int           `json:"parts"`               // number of parts seen, including multipart parts
+	Deleted   []DeletedPart `json:"deleted,omitempty"`   // parts that were deleted
+	Headers   []string      `json:"headers,omitempty"`   // names of top-level header fields that were added, removed, or changed
+	BytesIn   int64         `json:"bytesIn"`             // size of the original message
+	BytesOut  int64         `json:"bytesOut"`            // size of the rewritten message
+	Warnings  []string      `json:"warnings,omitempty"`  // problems that didn't prevent rewriting
+	Malformed bool          `json:"malformed,omitempty"` // true if the message was malformed
+	Rules     []string      `json:"rules,omitempty"`     // names of rules that matched the message
+	Options   *Options      `json:"-"`                   // options used after applying rules
+}
+
+// warnf logs a warning and records it in the report.
+func (opts *Options) warnf(format string, args ...interface{}) {
+	opts.Logger().Warningf(format, args...)
+	if opts.report != nil {
+		text := fmt.Sprintf(format, args...)
+		if opts.pos != nil {
+			text = opts.pos.String() + ": " + text
+		}
+		opts.report.Warnings = append(opts.report.Warnings, text)
+	}
+}
+
+// Rewrite reads an RFC 5322 (or RFC 2822, or RFC 822, sigh) message from r, rewrites
+// it as requested by opts, and writes it to w. The returned Report describes what
+// happened. It's non-nil even if an error is returned, e.g. to indicate that the
+// message was malformed. Memory usage is bounded if opts.BoundedMemory returns true.
+//
+// If opts can't change the message, only the top-level header is parsed before the rest
+// of the message is copied unchanged. Set opts.Strict to always validate the full message.
+//
+// When a problem described by a MessageError is encountered, it's handled as requested by
+// opts.Strict and the On* fields: the error is returned, or the rest of the message is
+// copied unchanged (with a warning added to the Report unless the action is "ignore").
+func Rewrite(r io.Reader, w io.Writer, opts *Options) (rep *Report, err error) {
+	if opts.VerifyIdempotent || opts.ValidateOutput != "" {
+		return rewriteChecked(r, w, opts)
+	}
+	rep = &Report{}
+	o := *opts
+	o.report = rep // Rules is set by applyRules
+	if o.compiled == nil {
+		// Report configuration errors before anything is written.
+		if o.compiled, err = compileOptions(&o); err != nil {
+			return rep, err
+		}
+	}
+	var st msgState
+	if r, opts, err = readForRules(r, &o, &st); err != nil {
+		return rep, err
+	}
+	rep.Options = opts
+	if opts.FixBoundaries || opts.AddTextAlt {
+		b, err := ioutil.ReadAll(r)
+		if err != nil {
+			return rep, err
+		}
+		if opts.FixBoundaries {
+			st.regen = findBoundaryCollisions(b)
+		}
+		if opts.AddTextAlt {
+			st.textAlt = findTextAltParts(b)
+		}
+		r = bytes.NewReader(b)
+	}
+
+	var in byteCounter
+	lr := newLineReader(io.TeeReader(r, &in))
+	defer lr.release()
+	lr.r.MaxLineLength = opts.MaxLineLength
+	lr.r.MaxUnfoldedLength = opts.MaxUnfoldedLength
+	defer func() { rep.BytesIn = int64(in) }()
+
+	var term string
+	switch opts.LineEndings {
+	case "crlf":
+		term = "\r\n"
+	case "lf":
+		term = "\n"
+	case "", "keep":
+	default:
+		return rep, fmt.Errorf("invalid line ending %q", opts.LineEndings)
+	}
+	// Count bytes written by the line-ending writer (if any) so BytesOut reflects the final output.
+	var out byteCounter
+	w = io.MultiWriter(w, &out)
+	defer func() { rep.BytesOut = int64(out) }()
+	if term != "" {
+		lw := newLineEndingWriter(w, term, lr.r.BareCR())
+		defer func() {
+			if cerr := lw.Close(); cerr != nil && err == nil {
+				err = cerr
+			}
+		}()
+		w = lw
+	}
+	// Buffer output so that lines aren't written individually to the underlying writer.
+	bw := writerPool.Get().(*bufio.Writer)
+	bw.Reset(w)
+	defer func() {
+		if ferr := bw.Flush(); ferr != nil && err == nil {
+			err = ferr
+		}
+		bw.Reset(nil)
+		writerPool.Put(bw)
+	}()
+	w = bw
+
+	if opts.passesThrough() {
+		if _, err = copyHeader(lr, w, nil, &st, opts); err == nil {
+			st.parts = 1
+			_, err = io.Copy(w, lr.r)
+		}
+	} else {
+		_, _, err = copyMessagePart(lr, w, "", nil, &st, opts)
+	}
+	rep.Parts = st.parts
+	rep.Deleted = st.deleted
+	rep.Headers = st.headers
+	rep.Malformed = st.malformed
+
+	// If we encountered a tolerated message error, try to copy the rest of the message.
+	if merr, ok := err.(*MessageError); ok {
+		act := opts.errorAction(merr.Category)
+		if act == errorFail {
+			rep.Malformed = true
+			return rep, err
+		}
+		if act != errorIgnore {
+			rep.Malformed = true
+			opts.warnf("Ignoring error: %v", err)
+		} else {
+			opts.Logger().Infof("Ignoring error: %v", err)
+		}
+		if _, err := io.Copy(w, lr.r); err != nil {
+			return rep, err
+		}
+		return rep, nil
+	}
+	return rep, err
+}
+
+// outputBufferSize is the size of the buffer used for Rewrite's output.
+const outputBufferSize = 64 * 1024
+
+// copyMessagePart reads a message part consisting of a header, a blank line,
+// and a body from lr and writes it to w. The part can either be a full RFC 5322/2822/822
+// message or an RFC 2045/2046 message body part terminated by delim.
+// parent describes the enclosing multipart part, or is nil for the top-level part.
+// The part's parsed header is returned.
+func copyMessagePart(lr *lineReader, w io.Writer, delim string, parent *headerData,
+	st *msgState, opts *Options) (hdata headerData, end bool, err error) {
+	if err := opts.checkContext(); err != nil {
+		return hdata, false, err
+	}
+	opts = opts.withPosition(lr, nextPartPath(parent))
+
+	// Attribute message and limit errors to the innermost part in which they occurred.
+	defer func() {
+		if merr, ok := err.(*MessageError); ok && merr.Path == "" {
+			merr.Path = hdata.path
+		} else if lerr, ok := err.(*LimitError); ok && lerr.Path == "" {
+			lerr.Path = hdata.path
+		}
+	}()
+
+	// If we may need to rewrite the body, buffer the header so we can update it later.
+	var hbuf *bytes.Buffer
+	hw := w
+	if opts.rewritesLeaves() || opts.FlattenMultipart || opts.StripAppleDouble || opts.PGPKeys != nil ||
+		opts.Visit != nil || opts.Policy != nil || opts.ReplaceDeleted != nil || opts.TeePart != nil ||
+		opts.repairsMultipartCTE() || opts.convertsLineEndings() {
+		hbuf = getBuffer()
+		defer putBuffer(hbuf)
+		hw = hbuf
+	}
+	if opts.TeePart != nil {
+		lr.capture = &bytes.Buffer{}
+	}
+	hdata, err = copyHeader(lr, hw, parent, st, opts)
+	if lr.capture != nil {
+		hdata.rawHeader = lr.capture.Bytes()
+		lr.capture = nil
+	}
+	if err == nil && hbuf != nil {
+		hdr := hbuf.Bytes()
+		if hdata.deletePart && opts.ReplaceDeleted != nil {
+			// copyHeader leaves deleted parts' headers unchanged when ReplaceDeleted is set.
+			hdr, err = deletedHeader(hdr, &hdata, opts)
+		}
+		if err == nil {
+			hdr, err = applyPolicy(hdr, &hdata, st, opts)
+		}
+		if err == nil {
+			hdr, err = visitMultipart(hdr, &hdata, opts)
+		}
+		hbuf = bytes.NewBuffer(hdr) // the original buffer is still returned to bufferPool
+	}
+	if err == nil {
+		st.parts++
+		err = checkPartLimits(lr, &hdata, st, opts)
+	}
+	if err == nil && !hdata.deletePart && !isMultipart(&hdata) {
+		st.kept++
+	}
+	if hbuf != nil {
+		if err == nil && ((opts.rewritesLeaves() || opts.convertsBinary(hdata.mediaType, hdata.encoding)) &&
+			canRewriteLeaf(&hdata) ||
+			opts.visitsBody(&hdata) || !hdata.deletePart && opts.teesBody(&hdata)) {
+			end, err := copyLeafPart(lr, w, hbuf.Bytes(), &hdata, delim, parent, st, opts)
+			return hdata, end, err
+		}
+		if err == nil && isEncodedMultipart(&hdata) && opts.repairsMultipartCTE() {
+			end, err := copyDecodedMultipart(lr, w, hbuf.Bytes(), &hdata, delim, parent == nil, st, opts)
+			return hdata, end, err
+		}
+		if err == nil && opts.PGPKeys != nil && isPGPEncrypted(&hdata) {
+			end, err := copyDecryptedPart(lr, w, hbuf.Bytes(), &hdata, delim, st, opts)
+			return hdata, end, err
+		}
+		if err == nil && shouldFlatten(&hdata, opts) {
+			end, err := copyFlattenedMultipart(lr, w, hbuf.Bytes(), &hdata, delim, parent == nil, st, opts)
+			return hdata, end, err
+		}
+		if _, err := hbuf.WriteTo(w); err != nil {
+			return hdata, false, err
+		}
+	}
+	if err != nil {
+		return hdata, false, err
+	}
+
+	if isEncodedMultipart(&hdata) {
+		return hdata, false, lr.errorf(EncodedMultipart, "%v part has %q Content-Transfer-Encoding",
+			hdata.mediaType, hdata.encoding)
+	}
+	if isMultipart(&hdata) {
+		end, err := copyMultipart(lr, w, delim, &hdata, parent == nil, st, opts)
+		return hdata, end, err
+	}
+
+	if isEmbeddedMessage(&hdata) {
+		// The body is itself a message, which is processed as the part's only child.
+		_, end, err = copyMessagePart(lr, w, delim, &hdata, st, opts)
+		return hdata, end, err
+	}
+
+	if hdata.deletePart {
+		// Drop the body but remember its size.
+		var size byteCounter
+		var body *bytes.Buffer // only needed for opts.TeePart
+		bw := io.Writer(&size)
+		if opts.teesBody(&hdata) {
+			body = &bytes.Buffer{}
+			bw = io.MultiWriter(&size, body)
+		}
+		delimLine, end, err := readBody(lr, bw, delim)
+		if err != nil {
+			return hdata, false, err
+		}
+		if body != nil {
+			if err := teePart(&hdata, body.Bytes(), opts); err != nil {
+				return hdata, false, err
+			}
+		}
+		st.deleted = append(st.deleted, DeletedPart{hdata.mediaType, int64(size), hdata.decodedFilename(), hdata.path})
+		_, err = io.WriteString(w, delimLine)
+		return hdata, end, err
+	}
+
+	// Read the top-level body until we see the outer boundary.
+	end, err = copyBody(lr, w, delim, false)
+	return hdata, end, err
+}
+
+// copyMultipart reads the body of the multipart part described by hdata from lr and writes it
+// to w, processing each of its enclosed parts. top should be true for the top-level part.
+// The return values and delim have the same meaning as in copyBody.
+func copyMultipart(lr *lineReader, w io.Writer, delim string, hdata *headerData, top bool,
+	st *msgState, opts *Options) (end bool, err error) {
+	subDelim, err := boundaryDelim(lr, hdata)
+	if err != nil {
+		return false, err
+	}
+	outDelim := pushBoundary(lr, subDelim, hdata, st, opts)
+
+	// RFC 2046 5.1:
+	//  In the case of multipart entities, in which one or more different
+	//  sets of data are combined in a single body, a "multipart" media type
+	//  field must appear in the entity's header.  The body must then contain
+	//  one or more body parts, each preceded by a boundary delimiter line,
+	//  and the last one followed by a closing boundary delimiter line.
+	//  After its boundary delimiter line, each body part then consists of a
+	//  header area, a blank line, and a body area.  Thus a body part is
+	//  similar to an RFC 822 message in syntax, but different in meaning.
+
+	// If we may need to add a placeholder part, buffer the top-level body.
+	var bbuf *bytes.Buffer
+	bw := w
+	if top && opts.AddPlaceholder {
+		bbuf = &bytes.Buffer{}
+		bw = bbuf
+	}
+
+	// First, read the preamble (e.g. "This is a multi-part message in MIME format.").
+	end, err = copyBody(lr, bw, subDelim, false)
+	if err == nil && !end {
+		// Next, copy the enclosed parts until we see the closing outer delimiter.
+		// RFC 2046 5.1.1 requires at least one body part, but some mailers and list
+		// servers (e.g. Mailman after removing attachments) produce multiparts whose
+		// preamble is immediately followed by the closing delimiter. copyBody reports
+		// end in that case, so such multiparts are copied unchanged.
+		for err == nil && !end {
+			_, end, err = copyMessagePart(lr, bw, subDelim, hdata, st, opts)
+		}
+	}
+	popBoundary(lr, st, opts)
+	if bbuf != nil {
+		if _, err := w.Write(addPlaceholder(bbuf.Bytes(), outDelim, hdata.term, st, opts)); err != nil {
+			return false, err
+		}
+	}
+	if err != nil {
+		return false, err
+	}
+
+	// Finally, copy the epilogue until we see the outer boundary.
+	return copyEpilogue(lr, w, delim, opts)
+}
+
+// isMultipart returns true if hdata describes a multipart part that isn't being deleted
+// and whose enclosed parts should be processed.
+func isMultipart(hdata *headerData) bool {
+	return strings.HasPrefix(hdata.mediaType, "multipart/") && !hdata.deletePart &&
+		!isEncrypted(hdata) && isIdentityEncoding(hdata.encoding)
+}
+
+// isEncodedMultipart returns true if hdata describes a multipart part that isn't being
+// deleted but that has a Content-Transfer-Encoding other than "7bit", "8bit", or "binary".
+// Some spam uses this to hide its content from filters.
+//
+// RFC 2045 6.4:
+//
+//	If an entity is of type "multipart" the Content-Transfer-Encoding is not
+//	permitted to have any value other than "7bit", "8bit" or "binary".
+func isEncodedMultipart(hdata *headerData) bool {
+	return strings.HasPrefix(hdata.mediaType, "multipart/") && !hdata.deletePart &&
+		!isEncrypted(hdata) && !isIdentityEncoding(hdata.encoding)
+}
+
+// isEncrypted returns true if hdata describes an encrypted part.
+// Encrypted parts are copied unchanged since they can't be meaningfully rewritten.
+//
+// RFC 1847 2.2 defines multipart/encrypted, which contains a control part
+// (e.g. application/pgp-encrypted for PGP/MIME as described by RFC 3156) followed by
+// an application/octet-stream part containing the encrypted data.
+func isEncrypted(hdata *headerData) bool {
+	return hdata.mediaType == "multipart/encrypted"
+}
+
+// boundaryDelim returns the delimiter that separates the parts within the
+// multipart part described by hdata. lr is used to position errors.
+func boundaryDelim(lr *lineReader, hdata *headerData) (string, error) {
+	// RFC 2046 5.1.1:
+	//  The only mandatory global parameter for the "multipart" media type is
+	//  the boundary parameter, which consists of 1 to 70 characters from a
+	//  set of characters known to be very robust through mail gateways, and
+	//  NOT ending with white space. (If a boundary delimiter line appears to
+	//  end with white space, the white space must be presumed to have been
+	//  added by a gateway, and must be deleted.)
+	//
+	// I've seen invalid 71-character boundaries being used in the wild, e.g.
+	// "--=_NextPart_5213_0a55_d6217661_9281_11d9_a2b8_0040529d55d7_alternative",
+	// so I'm choosing to not check the length here.
+	bnd := hdata.contentParams["boundary"]
+	if bnd == "" {
+		return "", lr.errorf(MissingBoundary, "invalid boundary %q", bnd)
+	}
+	return "--" + bnd, nil
+}
+
+// msgState contains state that's tracked while rewriting a single message.
+type msgState struct {
+	auth authVerdict // from the topmost Authentication-Results field (if opts.WhenAuth is set)
+
+	parts   int           // number of parts seen
+	kept    int           // number of non-multipart parts that weren't deleted
+	deleted []DeletedPart // parts that were deleted
+	headers []string      // names of top-level header fields that were changed
+
+	textFooter bool // true if the footer was appended to a text/plain part
+	htmlFooter bool // true if the footer was appended to a text/html part
+	malformed  bool // true if a tolerated problem was found, e.g. per Options.OnBadContentType
+
+	collisions map[string]bool // paths of multipart parts with colliding boundaries
+	regen      map[string]bool // paths of multipart parts whose boundaries should be regenerated
+	textAlt    map[string]bool // paths of text/html parts that should get text alternatives
+}
+
+// changedHeader records that the top-level header field key was added, removed, or changed.
+func (st *msgState) changedHeader(key string) {
+	for _, k := range st.headers {
+		if k == key {
+			return
+		}
+	}
+	st.headers = append(st.headers, key)
+}
+
+// receiptFields contains canonicalized keys of header fields that request read receipts.
+var receiptFields = map[string]struct{}{
+	"Disposition-Notification-To":      {}, // RFC 8098
+	"Disposition-Notification-Options": {}, // RFC 8098
+	"Return-Receipt-To":                {}, // nonstandard
+	"X-Confirm-Reading-To":             {}, // nonstandard
+}
+
+// headerData contains information parsed by copyHeader from a message part.
+type headerData struct {
+	mediaType     string            // media type from Content-Type , e.g. "text/plain" or "multipart/mixed"
+	contentParams map[string]string // additional parameters from Content-Type
+	encoding      string            // lowercase Content-Transfer-Encoding, e.g. "base64"
+	disposition   string            // lowercase disposition from Content-Disposition, e.g. "attachment"
+	filename      string            // "filename" parameter from Content-Disposition
+	deletePart    bool              // true if the message part should be deleted
+	term          string            // line terminator used by the header ("\r\n", "\n", or "\r")
+	path          string            // position in MIME tree, e.g. "1.2" (empty for top-level part)
+	nparts        int               // number of enclosed parts seen so far
+	boundary      string            // regenerated boundary written in place of contentParams["boundary"]
+	rawHeader     []byte            // original header, only captured for opts.TeePart
+}
+
+// decodedFilename returns the part's decoded filename from Content-Disposition
+// or Content-Type, or an empty string if it wasn't supplied.
+func (hdata *headerData) decodedFilename() string {
+	name := hdata.filename
+	if name == "" {
+		name = hdata.contentParams["name"]
+	}
+	if dec, err := headerDecoder.DecodeHeader(name); err == nil {
+		name = dec
+	}
+	return name
+}
+
+// deletedStub returns the start of the header of the message/external-body part that
+// replaces a deleted part, including the blank line that ends the outer header.
+// The deleted part's original header fields should follow it.
+func deletedStub(term string, now time.Time) string {
+	// This is patterned after what mutt does when deleting an attachment.
+	// It adds a header field like the following, followed by a blank line
+	// (to end the header and start the body) and the rest of the original headers:
+	//
+	//  Content-Type: message/external-body; access-type=x-mutt-deleted;
+	//          expiration="Mon, 6 Jan 2020 16:51:39 -0400"; length=340416
+	//
+	// message/external-body is described in RFC 1521 7.3.3 (replacing RFC 1341 7.3.3).
+	return "Content-Type: message/external-body; access-type=x-rendmail-deleted;" + term +
+		"\texpiration=\"" + now.Format(time.RFC1123Z) + "\"" + term +
+		term
+}
+
+// Defaults from RFC 2045 5.2, "Content-Type defaults".
+var defaultMediaType, defaultContentParams, _ = mime.ParseMediaType("text/plain; charset=us-ascii")
+
+// digestMediaType is the default media type for parts within multipart/digest parts.
+const digestMediaType = "message/rfc822"
+
+// defaultContentType returns the media type and parameters of parts within parent
+// (nil for the top-level part) that lack a (valid) Content-Type field.
+func defaultContentType(parent *headerData) (string, map[string]string) {
+	// RFC 2046 5.1.5:
+	//  This document defines a "digest" subtype of the "multipart" Content-
+	//  Type.  This type is syntactically identical to "multipart/mixed", but
+	//  the semantics are different.  In particular, in a digest, the default
+	//  Content-Type value for a body part is changed from "text/plain" to
+	//  "message/rfc822".
+	if isDigest(parent) {
+		return digestMediaType, map[string]string{}
+	}
+	return defaultMediaType, defaultContentParams
+}
+
+// isDigest returns true if hdata is non-nil and describes a multipart/digest part.
+func isDigest(hdata *headerData) bool {
+	return hdata != nil && hdata.mediaType == "multipart/digest"
+}
+
+// isEmbeddedMessage returns true if hdata describes a message/rfc822 part that isn't
+// being deleted and whose enclosed message should be processed.
+func isEmbeddedMessage(hdata *headerData) bool {
+	return hdata.mediaType == "message/rfc822" && !hdata.deletePart && isIdentityEncoding(hdata.encoding)
+}
+
+// isIdentityEncoding returns true if enc (a lowercase Content-Transfer-Encoding)
+// indicates that a part's body isn't encoded.
+func isIdentityEncoding(enc string) bool {
+	// RFC 2046 5.2.1:
+	//  No encoding other than "7bit", "8bit", or "binary" is permitted for the body of a
+	//  "message/rfc822" entity.
+	return enc == "" || enc == "7bit" || enc == "8bit" || enc == "binary"
+}
+
+// mboxFromKey is used in Report.Headers to indicate that an mbox From_ line was removed.
+const mboxFromKey = "From_"
+
+// isMboxFromLine returns true if ln (an unfolded line) is an mbox From_ line
+// (e.g. "From sender@example.org Sat Apr 16 10:00:00 2022") rather than an
+// obsolete-syntax From header field with whitespace before its colon.
+func isMboxFromLine(ln string) bool {
+	return strings.HasPrefix(ln, "From ") && !strings.HasPrefix(strings.TrimLeft(ln[5:], " \t"), ":")
+}
+
+// trimMboxFromLine returns msg without its leading mbox From_ line, if any.
+func trimMboxFromLine(msg []byte) []byte {
+	if i := bytes.IndexByte(msg, '\n'); i >= 0 && isMboxFromLine(string(msg[:i])) {
+		return msg[i+1:]
+	}
+	return msg
+}
+
+// leadingJunkKey is used in Report.Headers to indicate that a UTF-8 BOM or
+// junk lines preceding the top-level header were removed.
+const leadingJunkKey = "Junk_"
+
+// utf8BOM is the UTF-8 encoding of U+FEFF. Some webmail exports start with it.
+const utf8BOM = "\xef\xbb\xbf"
+
+// maxJunkLines is the number of lines following a possible junk line that
+// isLeadingJunk examines when looking for a header field.
+const maxJunkLines = 5
+
+// junkPeekSize is the maximum number of bytes passed to isLeadingJunk.
+const junkPeekSize = 4096
+
+// isLeadingJunk returns true if ln (an unfolded line preceding the top-level
+// header's first field) is a blank or garbage line that should be skipped.
+// next contains (possibly truncated) data following ln.
+//
+// To avoid misinterpreting messages with empty or malformed headers, ln is
+// only considered to be junk if a header field follows it within maxJunkLines lines.
+func isLeadingJunk(ln string, next []byte) bool {
+	if looksLikeField(ln) || isMboxFromLine(ln) {
+		return false
+	}
+	for i := 0; i < maxJunkLines && len(next) > 0; i++ {
+		end := bytes.IndexAny(next, "\r\n")
+		if end < 0 {
+			return false // line may be truncated
+		}
+		if looksLikeField(string(next[:end])) {
+			return true
+		}
+		if end++; end < len(next) && next[end-1] == '\r' && next[end] == '\n' {
+			end++
+		}
+		next = next[end:]
+	}
+	return false
+}
+
+// looksLikeField returns true if ln starts with a header field name and a colon.
+// Whitespace is permitted before the colon per RFC 5322 4.5's obsolete syntax.
+func looksLikeField(ln string) bool {
+	for i := 0; i < len(ln); i++ {
+		switch c := ln[i]; {
+		case c == ':':
+			return i > 0
+		case (c == ' ' || c == '\t') && i > 0:
+			return strings.HasPrefix(strings.TrimLeft(ln[i:], " \t"), ":")
+		case c <= ' ' || c > '~':
+			return false
+		}
+	}
+	return false
+}
+
+// trimLeadingJunk returns msg without a leading UTF-8 BOM, mbox From_ line,
+// or junk lines as described by isLeadingJunk.
+func trimLeadingJunk(msg []byte) []byte {
+	msg = trimMboxFromLine(bytes.TrimPrefix(msg, []byte(utf8BOM)))
+	for {
+		end := bytes.IndexAny(msg, "\r\n")
+		if end < 0 {
+			return msg
+		}
+		n := end + 1
+		if n < len(msg) && msg[end] == '\r' && msg[n] == '\n' {
+			n++
+		}
+		if !isLeadingJunk(string(msg[:end]), msg[n:]) {
+			return msg
+		}
+		msg = msg[n:]
+	}
+}
+
+// nextPartPath returns the path of the next part within parent, numbered the same way as
+// findParts, or an empty string for the top-level part if parent is nil.
+func nextPartPath(parent *headerData) string {
+	if parent == nil {
+		return ""
+	}
+	p := strconv.Itoa(parent.nparts + 1)
+	if parent.path != "" {
+		p = parent.path + "." + p
+	}
+	return p
+}
+
+// copyHeader reads the header portion of a message part from lr and writes it to w.
+// The trailing blank line at the end of the header is written before returning.
+// parent describes the enclosing multipart part, or is nil for the message's top-level header.
+func copyHeader(lr *lineReader, w io.Writer, parent *headerData, st *msgState,
+	opts *Options) (data headerData, err error) {
+	top := parent == nil
+	var term string // header's line terminator ("\r\n", "\n", or "\r")
+
+	if !top {
+		data.path = nextPartPath(parent)
+		parent.nparts++
+	}
+
+	data.mediaType, data.contentParams = defaultContentType(parent)
+	gotContentType := false
+
+	var checker *headerChecker
+	if top && opts.CheckHeaders {
+		checker = newHeaderChecker()
+	}
+
+	// If we're sorting the header, fields are buffered in sorter until the end of the header.
+	var sorter *headerSorter
+	if top && opts.SortHeaders {
+		sorter = &headerSorter{}
+	}
+	flushSorter := func() error {
+		if sorter == nil {
+			return nil
+		}
+		err := sorter.write(w)
+		sorter = nil
+		return err
+	}
+	// Buffered fields also need to be written if we return early, e.g. at the end of a
+	// header-only message or for a malformed field, since the caller may copy the rest
+	// of the message in non-strict mode.
+	defer func() {
+		if ferr := flushSorter(); err == nil {
+			err = ferr
+		}
+	}()
+
+	// startDelete is called once the part's media type is known. If the part should be
+	// deleted, it sets data.deletePart and writes a header for the replacement part.
+	startDelete := func() error {
+		var err error
+		if data.deletePart, err = matchesDeleteRules(&data, parent, opts); err != nil {
+			return err
+		}
+		if data.deletePart && !st.auth.matches(opts.WhenAuth) {
+			opts.Logger().Infof("Not deleting %v due to %q auth verdict", data.mediaType, st.auth)
+			data.deletePart = false
+		}
+		if !data.deletePart {
+			return nil
+		}
+		opts.Logger().Infof("Deleting %v", data.mediaType)
+		if opts.ReplaceDeleted != nil {
+			return nil // copyMessagePart replaces the whole header
+		}
+
+		// Any fields that we've buffered for sorting need to be written first, and
+		// remaining fields end up in the body, so there's no point in sorting them.
+		if err := flushSorter(); err != nil {
+			return err
+		}
+		_, err = io.WriteString(w, deletedStub(term, opts.Now))
+		return err
+	}
+
+	checkBOM := top
+	start := lr.r.Offset()
+	for {
+		if err := opts.checkContext(); err != nil {
+			return data, err
+		}
+		folded, unfolded, err := lr.readFoldedLine()
+		if err == io.EOF {
+			return data, lr.errorf(UnexpectedEOF, "missing body")
+		} else if err != nil {
+			return data, err
+		}
+		if opts.MaxHeaderSize > 0 && lr.r.Offset()-start > int64(opts.MaxHeaderSize) {
+			return data, lr.limitError("MaxHeaderSize", opts.MaxHeaderSize)
+		}
+
+		// Some webmail exports start with a UTF-8 BOM, which would otherwise end up in the
+		// first field's name.
+		if checkBOM {
+			checkBOM = false
+			if strings.HasPrefix(folded[0], utf8BOM) {
+				folded[0] = folded[0][len(utf8BOM):]
+				unfolded = unfolded[len(utf8BOM):]
+				if opts.StripLeadingJunk {
+					opts.Logger().Infof("Removing UTF-8 BOM")
+					st.changedHeader(leadingJunkKey)
+				} else if _, err := io.WriteString(w, utf8BOM); err != nil {
+					return data, err
+				}
+			}
+		}
+
+		// They may also start with blank or garbage lines.
+		if top && term == "" && isLeadingJunk(unfolded, lr.r.Peek(junkPeekSize)) {
+			if opts.StripLeadingJunk {
+				opts.Logger().Infof("Removing junk line %q", unfolded)
+				st.changedHeader(leadingJunkKey)
+			} else if _, err := io.WriteString(w, strings.Join(folded, "")); err != nil {
+				return data, err
+			}
+			continue
+		}
+
+		// Messages extracted from mbox files (e.g. by formail) may start with a From_ line.
+		if top && term == "" && isMboxFromLine(unfolded) {
+			if opts.StripMboxFrom {
+				opts.Logger().Infof("Removing mbox From_ line")
+				st.changedHeader(mboxFromKey)
+			} else if _, err := io.WriteString(w, strings.Join(folded, "")); err != nil {
+				return data, err
+			}
+			continue
+		}
+
+		// Use the first line to determine whether the message is using CRLF, LF, or CR.
+		// Later lines may use different terminators, which are preserved.
+		if term == "" {
+			term = lineTerm(folded[0])
+			data.term = term
+
+			// Like an MDA, add Delivered-To at the very top of the header
+			// (unless it's already there, e.g. because we're rewriting our own output).
+			if top && opts.AddDeliveredTo != "" && !isDeliveredTo(unfolded, opts.AddDeliveredTo) {
+				if _, err := io.WriteString(w, "Delivered-To: "+opts.AddDeliveredTo+term); err != nil {
+					return data, err
+				}
+				st.changedHeader("Delivered-To")
+			}
+			if top && opts.BackupRecord != "" {
+				if _, err := io.WriteString(w, BackupField+": "+opts.BackupRecord+term); err != nil {
+					return data, err
+				}
+				st.changedHeader(BackupField)
+			}
+			if top && opts.BackupWarning != "" {
+				if _, err := io.WriteString(w, BackupWarningField+": "+opts.BackupWarning+term); err != nil {
+					return data, err
+				}
+				st.changedHeader(BackupWarningField)
+			}
+		}
+
+		// A blank line indicates the end of the header.
+		if unfolded == "" {
+			if len(folded) != 1 {
+				return data, errors.New("blank line is folded") // should never happen
+			}
+			// Parts without Content-Type can still be deleted by path (or by
+			// media type within digests, where they're embedded messages).
+			if !gotContentType && (opts.deletesPath(data.path) || isDigest(parent)) {
+				if err := startDelete(); err != nil {
+					return data, err
+				}
+			}
+			if err := flushSorter(); err != nil {
+				return data, err
+			}
+			if _, err := io.WriteString(w, folded[0]); err != nil {
+				return data, err
+			}
+			if checker != nil {
+				if findings := checker.finish(); len(findings) > 0 {
+					if opts.Findings != nil {
+						enc := json.NewEncoder(opts.Findings)
+						for _, f := range findings {
+							enc.Encode(f)
+						}
+					}
+					if opts.errorAction(MalformedHeader) == errorFail {
+						return data, lr.errorf(MalformedHeader, "header has %d problem(s)", len(findings))
+					}
+				}
+			}
+			return data, nil // done
+		}
+		if checker != nil {
+			checker.addField(folded, unfolded)
+		}
+
+		// Raw 8-bit data isn't permitted in header fields, so encode it before we do anything else.
+		if opts.Encode8BitHeader && !isASCII(unfolded) {
+			if key, val, err := ParseHeaderField(unfolded); err == nil {
+				unfolded = key + ": " + encodeHeaderField(key, val)
+				folded = foldHeaderField(unfolded, term)
+				if top {
+					st.changedHeader(key)
+				}
+			}
+		}
+
+		if top && opts.SubjectTag != "" {
+			if key, val, err := ParseHeaderField(unfolded); err == nil && key == "Subject" {
+				if tagged := tagSubject(val, opts.SubjectTag); tagged != val {
+					unfolded = key + ": " + tagged
+					folded = foldHeaderField(unfolded, term)
+					st.changedHeader(key)
+				}
+			}
+		}
+
+		var newLines []string // new lines to write after this one
+
+		var msgErr *MessageError // returned later after writing the folded lines
+		if key, val, err := ParseHeaderField(unfolded); err != nil {
+			// This can happen if the blank line between the header and body is missing, resulting
+			// in us trying to parse a line from the body as a header. The only place that I've seen
+			// this is in some pre-2009 messages where I'd deleted attachments using mutt (did
+			// mutt's MIME implementation have a bug?). It also appears to be mentioned in
+			// https://bugzilla.mozilla.org/show_bug.cgi?id=335189.
+			msgErr = lr.errorf(MalformedHeader, "malformed header field %q: %v", unfolded, err)
+		} else if key == "Content-Type" && !gotContentType {
+			mtype, params, err := parseMediaType(val)
+			if err != nil {
+				switch opts.errorAction(BadContentType) {
+				case errorFail:
+					msgErr = lr.errorf(BadContentType, "invalid Content-Type %q: %v", val, err)
+				case errorWarn:
+					opts.warnf("Ignoring invalid Content-Type %q: %v", val, err)
+					st.malformed = true
+				default:
+					opts.Logger().Infof("Ignoring invalid Content-Type %q: %v", val, err)
+				}
+				// RFC 2045 5.2:
+				//  It is also recommend that this default be assumed when a
+				//  syntactically invalid Content-Type header field is encountered.
+				mtype, params = defaultContentType(parent)
+			}
+
+			data.mediaType = mtype
+			data.contentParams = params
+			gotContentType = true
+
+			if isEncrypted(&data) && !opts.DeleteEncrypted && top && opts.MarkEncrypted {
+				// RFC 3156 4 requires the protocol parameter to be "application/pgp-encrypted".
+				val := "unknown"
+				if strings.ToLower(data.contentParams["protocol"]) == "application/pgp-encrypted" {
+					val = "pgp"
+				}
+				newLines = append(newLines, "X-Rendmail-Encrypted: "+val+term)
+				st.changedHeader("X-Rendmail-Encrypted")
+			}
+			if err := startDelete(); err != nil {
+				return data, err
+			}
+			if isMultipart(&data) && regeneratesBoundary(data.contentParams["boundary"], data.path, st, opts) {
+				folded = regenerateContentType(&data, term, opts)
+				if top {
+					st.changedHeader(key)
+				}
+			}
+		} else if key == "Content-Type" {
+			// Only the first field is honored, but other MUAs may use a later one (e.g. the last),
+			// which could be used to smuggle content past rules that look at the media type.
+			if t, _, err := parseMediaType(val); err == nil && t == data.mediaType {
+				opts.warnf("Ignoring duplicate Content-Type %q", val)
+			} else {
+				opts.warnf("Ignoring conflicting Content-Type %q (using %q)", val, data.mediaType)
+			}
+			if opts.DedupContentType {
+				folded = nil
+				if top {
+					st.changedHeader(key)
+				}
+			}
+		} else if key == "Content-Transfer-Encoding" && data.encoding == "" {
+			data.encoding = strings.ToLower(strings.TrimSpace(val))
+		} else if key == "Content-Disposition" && data.disposition == "" {
+			if disp, params, err := parseMediaType(val); err == nil {
+				data.disposition = disp
+				data.filename = params["filename"]
+			}
+		} else if top && opts.stripsHeader(key) {
+			opts.Logger().Infof("Removing %v", key)
+			folded = nil
+			st.changedHeader(key)
+		} else if opts.addsField(key, top) {
+			// Fields that we add are regenerated rather than being trusted
+			// (and to avoid duplicating them when rewriting our own output).
+			opts.Logger().Infof("Removing existing %v", key)
+			folded = nil
+			if top {
+				st.changedHeader(key)
+			}
+		} else if key == "Subject" && opts.DecodeSubject {
+			if dec, ok := decodeHeaderValue(val, opts.headerDecoder()); ok && dec != "" && dec != val {
+				// Just to mention it, RFC 6648 advocates avoiding "X-" headers, and they were
+				// actually removed for email in RFC 2822 (after being described by RFC 822).
+				newLines = append(newLines, foldHeaderField("X-Rendmail-Subject: "+dec, term)...)
+				if top {
+					st.changedHeader("X-Rendmail-Subject")
+				}
+			}
+		} else if (key == "List-Unsubscribe" || key == "List-Id") && top && opts.ExtractList {
+			for _, v := range extractListValues(key, val) {
+				newLines = append(newLines, foldHeaderField("X-Rendmail-"+key+": "+v, term)...)
+				st.changedHeader("X-Rendmail-" + key)
+			}
+		} else if _, ok := receiptFields[key]; ok && top && opts.StripReceipts {
+			opts.Logger().Infof("Removing %v", key)
+			folded = nil
+			st.changedHeader(key)
+		} else if (key == "To" || key == "Cc" || key == "Bcc") && top && opts.RedactRecipients != "" {
+			// Delivered-To is intentionally left alone so the message can still be sorted and delivered.
+			redacted := redactAddressList(val, opts.RedactRecipients, opts.RedactKey)
+			folded = foldHeaderField(key+": "+redacted, term)
+			if redacted != val {
+				st.changedHeader(key)
+			}
+		}
+
+		if sorter != nil {
+			key, _, _ := ParseHeaderField(unfolded)
+			sorter.add(key, folded)
+			if len(newLines) > 0 {
+				key, _, _ := ParseHeaderField(newLines[0])
+				sorter.add(key, newLines)
+			}
+		} else {
+			for _, ln := range folded {
+				if _, err := io.WriteString(w, ln); err != nil {
+					return data, err
+				}
+			}
+			for _, ln := range newLines {
+				if _, err := io.WriteString(w, ln); err != nil {
+					return data, err
+				}
+			}
+		}
+
+		// So that we'll still write the message in non-strict mode, only return an earlier
+		// message error after we've written the folded lines.
+		if msgErr != nil {
+			return data, msgErr
+		}
+	}
+}
+
+// dashes follows the boundary delimiter in a closing delimiter line.
+var dashes = []byte("--")
+
+// copyBody reads lines from lr and writes them to w until it finds delim
+// at the beginning of a line. The delimiter line is written before returning.
+// If deletePart is true, all lines up to but not including the delimiter are
+// dropped instead of being written to w.
+//
+// The returned end value is true if the delimiter was suffixed by "--" or if delim is empty and
+// EOF was encountered. If delim is non-empty and EOF is encountered, an error is returned.
+func copyBody(lr *lineReader, w io.Writer, delim string, deletePart bool) (end bool, err error) {
+	bw := w
+	if deletePart {
+		bw = ioutil.Discard
+	}
+	delimLine, end, err := readBody(lr, bw, delim)
+	if err != nil {
+		return false, err
+	}
+	_, err = io.WriteString(w, delimLine)
+	return end, err
+}
+
+// copyEpilogue is like copyBody, but it's used to copy the epilogue following a
+// multipart's closing delimiter. RFC 2046 5.1.1 says that the epilogue is to be
+// ignored, so it's dropped if opts.DropEpilogue is set. Otherwise, it's preserved.
+func copyEpilogue(lr *lineReader, w io.Writer, delim string, opts *Options) (end bool, err error) {
+	if !opts.DropEpilogue {
+		return copyBody(lr, w, delim, false)
+	}
+	var size byteCounter
+	delimLine, end, err := readBody(lr, &size, delim)
+	if err != nil {
+		return false, err
+	}
+	if size > 0 {
+		opts.Logger().Infof("Dropping %d-byte epilogue", size)
+	}
+	_, err = io.WriteString(w, delimLine)
+	return end, err
+}
+
+// ParseHeaderField splits ln, e.g. "from: \"Bob\" <user@example.org>", into
+// a canonicalized key and value, e.g. "From" and "\"Bob\" <user@example.org>".
+func ParseHeaderField(ln string) (key, val string, err error) {
+	// TODO: Check that the line doesn't start with whitespace?
+	// https://cs.opensource.google/go/go/+/refs/tags/go1.18:src/net/textproto/reader.go;l=497
+	// checks this for the first line.
+
+	// This is basically strings.Cut, but that wasn't introduced until Go 1.18.
+	idx := strings.IndexByte(ln, ':')
+	if idx < 0 {
+		return "", "", errors.New("missing colon")
+	}
+
+	key = textproto.CanonicalMIMEHeaderKey(ln[:idx])
+
+	// TODO: Is this right?
+	// https://cs.opensource.google/go/go/+/refs/tags/go1.18:src/net/textproto/reader.go;l=526
+	val = strings.TrimLeft(ln[idx+1:], " \t")
+
+	return key, val, nil
+}
+
+// RemoveHeaderField removes the first top-level header field with the supplied
+// canonicalized name from msg. The field's unfolded value is also returned.
+func RemoveHeaderField(msg []byte, name string) ([]byte, string, error) {
+	lr := newLineReader(bytes.NewReader(msg))
+	defer lr.release()
+	pos := 0
+	for {
+		folded, unfolded, err := lr.readFoldedLine()
+		if err == io.EOF || unfolded == "" {
+			return msg, "", nil
+		} else if err != nil {
+			return nil, "", err
+		}
+		n := len(strings.Join(folded, ""))
+		if key, val, err := ParseHeaderField(unfolded); err == nil && key == name {
+			out := append(append([]byte{}, msg[:pos]...), msg[pos+n:]...)
+			return out, val, nil
+		}
+		pos += n
+	}
+}
+
+// decodeHeaderValue attempts to convert an RFC 2047 header value to 7-bit ASCII using wd.
+// The returned bool is false if the conversion failed (e.g. the original value
+// used an unsupported charset). Any non-ASCII characters left after decoding and
+// conversion are dropped.
+func decodeHeaderValue(unfolded string, wd *mime.WordDecoder) (string, bool) {
+	// First, try to decode from the RFC 2047 form (i.e. Quoted-Printable or base64).
+	dec, err := wd.DecodeHeader(unfolded)
+	if err != nil {
+		return "", false
+	}
+	// Next, remove accents and then drop anything that's not 7-bit ASCII.
+	res, _, err := transform.String(headerTransformChain, dec)
+	return res, err == nil
+}
+
+// DecodeHeader decodes RFC 2047 encoded-words in the header field value s.
+func DecodeHeader(s string) (string, error) {
+	return headerDecoder.DecodeHeader(s)
+}
+
+// These are used by decodeHeaderValue and DecodeHeader.
+var headerDecoder = newHeaderDecoder(defaultHeaderCharsets)
+var headerTransformChain = transform.Chain(
+	norm.NFD, // decompose by canonical equivalence
+	runes.Remove(runes.In(unicode.Mn)), // remove "Mark, nonspacing"
+	norm.NFC, // recompose by canonical equivalence
+	runes.Remove(runes.Predicate(func(r rune) bool { // remove non-printable ASCII
+		// From RFC 5322 2.2:
+		//  A field name MUST be composed of printable US-ASCII characters (i.e., characters
+		//  that have values between 33 and 126, inclusive), except colon.  A field body may be
+		//  composed of printable US-ASCII characters as well as the space (SP, ASCII value 32)
+		//  and horizontal tab (HTAB, ASCII value 9) characters (together known as the white
+		//  space characters, WSP).
+		return (r < 32 || r > 126) && r != 9
+	})),
+)
+
+// encodeHeaderField encodes the non-ASCII portions of val, the value of the header field
+// named key (canonicalized). Encoded words can't appear within parameters (RFC 2047 5), so
+// Content-Type and Content-Disposition parameters are rewritten as RFC 2231 extended
+// parameters instead (e.g. "filename*=utf-8”na%C3%AFve.pdf"). Their values are returned
+// unchanged if they can't be parsed. Other fields are encoded by encodeHeaderValue.
+func encodeHeaderField(key, val string) string {
+	if key != "Content-Type" && key != "Content-Disposition" {
+		return encodeHeaderValue(val)
+	}
+	mtype, params, err := parseMediaType(latin1ToUTF8(val))
+	if err != nil {
+		return val
+	}
+	return formatMediaType(mtype, params)
+}
+
+// latin1ToUTF8 returns s unchanged if it's valid UTF-8 and converts it from
+// ISO-8859-1 (Latin-1) otherwise.
+func latin1ToUTF8(s string) string {
+	if !utf8.ValidString(s) {
+		if dec, err := charmap.ISO8859_1.NewDecoder().String(s); err == nil {
+			return dec
+		}
+	}
+	return s
+}
+
+// encodeHeaderValue RFC-2047-encodes the non-ASCII portions of val. Invalid UTF-8 is assumed
+// to be ISO-8859-1 (Latin-1). Quoted strings containing non-ASCII characters are replaced
+// by encoded words since encoded words can't appear within quoted strings (RFC 2047 5).
+// Encoded words are produced by qEncodeWords so they're also valid within phrases.
+// Words containing '@' are left unchanged since encoded words can't appear within
+// addr-specs, which may contain UTF-8 per RFC 6532.
+func encodeHeaderValue(val string) string {
+	val = latin1ToUTF8(val)
+
+	var out, run strings.Builder // run holds consecutive words needing encoding
+	var space string             // whitespace seen after the last word
+	flush := func() {
+		if run.Len() > 0 {
+			out.WriteString(qEncodeWords(run.String()))
+			run.Reset()
+		}
+	}
+	for _, tok := range encodeTokenRegexp.FindAllString(val, -1) {
+		switch {
+		case tok[0] == ' ' || tok[0] == '\t':
+			space += tok
+		case isASCII(tok) || (tok[0] != '"' && strings.ContainsRune(tok, '@')):
+			flush()
+			out.WriteString(space + tok)
+			space = ""
+		default:
+			// Keep comment parens and list punctuation outside of the encoded word.
+			pre := tok[:len(tok)-len(strings.TrimLeft(tok, "("))]
+			suf := tok[len(strings.TrimRight(tok, "),;")):]
+			word := tok[len(pre) : len(tok)-len(suf)]
+			if len(word) >= 2 && word[0] == '"' && word[len(word)-1] == '"' {
+				word = quotedPairRegexp.ReplaceAllString(word[1:len(word)-1], "$1")
+			}
+			if run.Len() > 0 && pre == "" {
+				run.WriteString(space) // whitespace between encoded words is ignored, so include it
+			} else {
+				flush()
+				out.WriteString(space + pre)
+			}
+			run.WriteString(word)
+			if suf != "" {
+				flush()
+				out.WriteString(suf)
+			}
+			space = ""
+		}
+	}
+	flush()
+	out.WriteString(space)
+	return out.String()
+}
+
+// qEncodeWords returns one or more space-separated "Q"-encoded words encoding s.
+//
+// Unlike mime.QEncoding, this only leaves characters unencoded if they're permitted in
+// encoded words that replace phrases (e.g. display names in address fields), since those
+// can't contain RFC 5322 specials like '"'. From RFC 2047 5(3):
+//
+//	In this case the set of characters that may be used in a "Q"-encoded
+//	'encoded-word' is restricted to: <upper and lower case ASCII
+//	letters, decimal digits, "!", "*", "+", "-", "/", "=", and "_"
+//	(underscore, ASCII 95.)>.
+func qEncodeWords(s string) string {
+	const (
+		prefix = "=?utf-8?q?"
+		suffix = "?="
+		maxLen = 75 - len(prefix) - len(suffix) // RFC 2047 2: at most 75 characters long
+	)
+	var words []string
+	var word strings.Builder
+	for _, r := range s {
+		var enc string
+		switch {
+		case r == ' ':
+			enc = "_"
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', strings.ContainsRune("!*+-/", r):
+			enc = string(r)
+		default:
+			var buf [utf8.UTFMax]byte
+			for _, b := range buf[:utf8.EncodeRune(buf[:], r)] {
+				enc += fmt.Sprintf("=%02X", b)
+			}
+		}
+		// Don't split multibyte characters across words.
+		if word.Len() > 0 && word.Len()+len(enc) > maxLen {
+			words = append(words, prefix+word.String()+suffix)
+			word.Reset()
+		}
+		word.WriteString(enc)
+	}
+	if word.Len() > 0 {
+		words = append(words, prefix+word.String()+suffix)
+	}
+	return strings.Join(words, " ")
+}
+
+// encodeTokenRegexp matches quoted strings, runs of non-whitespace, and runs of whitespace.
+var encodeTokenRegexp = regexp.MustCompile(`"(?:[^"\\]|\\.)*"|[^ \t]+|[ \t]+`)
+
+// quotedPairRegexp matches a quoted-pair (i.e. a backslash-escaped character).
+var quotedPairRegexp = regexp.MustCompile(`\\(.)`)
+
+// isASCII returns true if s consists only of 7-bit ASCII characters.
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] > 127 {
+			return false
+		}
+	}
+	return true
+}
+
+// foldHeaderField wraps unfolded across multiple lines, each of which will be terminated
+// with term ("\r\n" or "\n"). See RFC 5322 2.2.3.
+func foldHeaderField(unfolded, term string) []string {
+	var folded []string
+	for _, p := range foldRegexp.FindAllString(unfolded, -1) {
+		if len(folded) == 0 {
+			folded = append(folded, p)
+		} else if len(folded[len(folded)-1])+len(p) <= 78 {
+			folded[len(folded)-1] += p
+		} else {
+			folded[len(folded)-1] += term
+			folded = append(folded, p)
+		}
+	}
+	if len(folded) > 0 {
+		folded[len(folded)-1] += term
+	}
+	return folded
+}
+
+// foldRegexp matches any number of space or tab characters followed by one or more
+// non-space/tab characters.
+var foldRegexp = regexp.MustCompile(`[ \t]*[^ \t]+`)
+
+// extractListValues returns decoded values from val, the value of an RFC 2369 List-Unsubscribe
+// or RFC 2919 List-Id header field with the supplied canonicalized key.
+// Each List-Unsubscribe target is URL-decoded and returned as a separate value.
+// Control and non-ASCII characters are removed from the returned values.
+func extractListValues(key, val string) []string {
+	var vals []string
+	switch key {
+	case "List-Unsubscribe":
+		// RFC 2369 2:
+		//  The contents of the list header fields mostly consist of angle-bracket ('<', '>')
+		//  enclosed URLs, with internal whitespace being ignored.
+		for _, m := range angleRegexp.FindAllStringSubmatch(val, -1) {
+			u := strings.Join(strings.Fields(m[1]), "")
+			if dec, err := url.PathUnescape(u); err == nil {
+				u = dec
+			}
+			vals = append(vals, u)
+		}
+	case "List-Id":
+		// RFC 2919 3:
+		//  list-id-header = "List-ID:" [phrase] "<" list-id ">" CRLF
+		if m := angleRegexp.FindStringSubmatch(val); m != nil {
+			vals = append(vals, strings.TrimSpace(m[1]))
+		}
+	}
+
+	var clean []string
+	for _, v := range vals {
+		if v, _, err := transform.String(headerTransformChain, v); err == nil && v != "" {
+			clean = append(clean, v)
+		}
+	}
+	return clean
+}
+
+// redactedDomain is the domain used for addresses hashed by redactAddressList.
+const redactedDomain = "@redacted.invalid"
+
+// angleRegexp matches an angle-bracket-enclosed string, capturing the string.
+var angleRegexp = regexp.MustCompile(`<([^>]*)>`)
+
+// redactAddressList returns a redacted version of list, an RFC 5322 address-list header value.
+// If mode is "hash", each address is replaced by a hash of its lowercased addr-spec and
+// display names are dropped (addresses that were already hashed are left alone). If mode is
+// "placeholder" (or the list can't be parsed), an empty "undisclosed-recipients" group is
+// returned instead.
+//
+// Addresses are easy to guess, so anyone who sees an unkeyed hash can confirm whether it
+// belongs to a suspected recipient. If key is non-empty, an HMAC-SHA256 keyed by it is used
+// instead so that hashes can only be computed by someone who knows the key. Unkeyed hashes
+// only hide addresses from casual readers while keeping them consistent across messages.
+func redactAddressList(list, mode, key string) string {
+	const placeholder = "undisclosed-recipients:;"
+	if mode != "hash" {
+		return placeholder
+	}
+	addrs, err := mail.ParseAddressList(list)
+	if err != nil || len(addrs) == 0 {
+		return placeholder
+	}
+	hashed := make([]string, len(addrs))
+	for i, a := range addrs {
+		if strings.HasSuffix(a.Address, redactedDomain) {
+			hashed[i] = a.Address // already redacted
+			continue
+		}
+		var sum []byte
+		if key != "" {
+			mac := hmac.New(sha256.New, []byte(key))
+			mac.Write([]byte(strings.ToLower(a.Address)))
+			sum = mac.Sum(nil)
+		} else {
+			s := sha256.Sum256([]byte(strings.ToLower(a.Address)))
+			sum = s[:]
+		}
+		hashed[i] = hex.EncodeToString(sum[:8]) + redactedDomain
+	}
+	return strings.Join(hashed, ", ")
+}
+
+// shouldDelete returns true if attachments of type mtype should be deleted.
+// del and keep correspond to deleteMediaTypes and keepMediaTypes in Options.
+// An error is only returned if an invalid glob is encountered.
+func shouldDelete(mtype string, del, keep []string) (bool, error) {
+	for _, dp := range del {
+		if dm, err := filepath.Match(dp, mtype); err != nil {
+			return false, err
+		} else if dm {
+			for _, kp := range keep {
+				if km, err := filepath.Match(kp, mtype); err != nil {
+					return false, err
+				} else if km {
+					return false, nil // in keep
+				}
+			}
+			return true, nil // matched by del and not by keep
+		}
+	}
+	return false, nil // not matched by del
+}
+
+// matchesDeleteRules returns true if opts request deleting the part described by data.
+// parent describes the enclosing multipart part, or is nil for the top-level part.
+// opts.WhenAuth is not considered.
+func matchesDeleteRules(data, parent *headerData, opts *Options) (bool, error) {
+	if isDeletedStub(data) {
+		return false, nil
+	}
+	mp := MediaTypePolicy{opts.DeleteMediaTypes, opts.KeepMediaTypes}
+	del, err := mp.ShouldDelete(&PartInfo{Path: data.path, MediaType: data.mediaType, Params: data.contentParams})
+	if err != nil {
+		return false, err
+	}
+	if opts.StripAppleDouble && isAppleResourceFork(data, parent) {
+		del = true
+	}
+	if opts.DeleteEncrypted && isEncrypted(data) {
+		del = true
+	}
+	if opts.deletesPath(data.path) {
+		del = true
+	}
+	return del, nil
+}
+
+// MatchesDeleteRules returns true if opts request deleting the part at path within
+// a message whose parts are described by spans, as returned by FindParts.
+// Deletion of enclosing parts isn't considered, and opts.Policy isn't consulted.
+func (opts *Options) MatchesDeleteRules(spans map[string]PartSpan, path string) (bool, error) {
+	hdata := func(p string) *headerData {
+		span := spans[p]
+		return &headerData{
+			mediaType:     span.MediaType,
+			contentParams: span.Params,
+			encoding:      span.Encoding,
+			disposition:   span.Disposition,
+			path:          p,
+		}
+	}
+	var parent *headerData
+	if path != "" {
+		var pp string
+		if i := strings.LastIndexByte(path, '.'); i >= 0 {
+			pp = path[:i]
+		}
+		parent = hdata(pp)
+	}
+	if del, err := matchesDeleteRules(hdata(path), parent, opts); err != nil || !del {
+		return false, err
+	}
+	return parseAuthResults(spans[""].Auth).matches(opts.WhenAuth), nil
+}
+
+// stripsHeader returns true if opts.StripHeaders contains key.
+func (opts *Options) stripsHeader(key string) bool {
+	for _, k := range opts.StripHeaders {
+		if strings.EqualFold(k, key) {
+			return true
+		}
+	}
+	return false
+}
+
+// deletesPath returns true if opts.DeleteParts contains path
+// (as produced by findParts, i.e. empty for the top-level part).
+func (opts *Options) deletesPath(path string) bool {
+	if path == "" {
+		path = "0"
+	}
+	for _, p := range opts.DeleteParts {
+		if p == path {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,692 @@
+// Copyright 2022 Daniel Erat.
+// All rights reserved.
+
+package rewrite
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestRewriteMessage(t *testing.T) {
+	const suf = ".in.txt"
+	inPaths, err := filepath.Glob("testdata/*" + suf)
+	if err != nil {
+		t.Fatal("Failed getting input files:", err)
+	}
+
+	for _, p := range inPaths {
+		t.Run(p, func(t *testing.T) {
+			in, err := ioutil.ReadFile(p)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			base := p[:len(p)-len(suf)]
+
+			opts := Options{}
+			optsPath := base + ".opts.json"
+			if _, err := os.Stat(optsPath); err == nil {
+				if b, err := ioutil.ReadFile(optsPath); err != nil {
+					t.Fatal(err)
+				} else if err := json.Unmarshal(b, &opts); err != nil {
+					t.Fatalf("Failed unmarshaling %v: %v", optsPath, err)
+				}
+			} else if !os.IsNotExist(err) {
+				t.Fatal(err)
+			}
+
+			var b bytes.Buffer
+			rep, err := Rewrite(bytes.NewReader(in), &b, &opts)
+			if opts.Strict {
+				// Use the strict flag as a signal that we expect an error.
+				if err == nil {
+					t.Fatal("Rewrite unexpectedly succeeded in strict mode")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal("Rewrite failed:", err)
+			}
+			got := b.String()
+
+			outPath := base + ".out.txt"
+			want, err := ioutil.ReadFile(outPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got != string(want) {
+				cmd := exec.Command("diff", "-", outPath)
+				cmd.Stdin = &b
+				out, _ := cmd.Output()
+				t.Error("Rewrite produced unexpected output (got vs. want):\n" + string(out))
+			}
+
+			// Rewriting the output again shouldn't change it.
+			if err := verifyIdempotent([]byte(got), rep.Options); err != nil {
+				t.Error("Rewrite isn't idempotent:", err)
+			}
+
+			// If the original message was valid, check that the rewritten one was too.
+			if err := parseStdlib(bytes.NewReader(in)); err == nil {
+				if err := parseStdlib(strings.NewReader(got)); err != nil {
+					t.Error("Rewrite produced invalid message:", err)
+				}
+			}
+		})
+	}
+}
+
+func TestRewrite_report(t *testing.T) {
+	const msg = "Subject: Hi\n" +
+		"Content-Type: multipart/mixed; boundary=abc\n" +
+		"\n" +
+		"--abc\n" +
+		"Content-Type: text/plain\n" +
+		"\n" +
+		"Hello\n" +
+		"--abc\n" +
+		"Content-Type: image/png\n" +
+		"Content-Disposition: attachment; filename=a.png\n" +
+		"\n" +
+		"data\n" +
+		"--abc--\n"
+	var b bytes.Buffer
+	rep, err := Rewrite(strings.NewReader(msg), &b, &Options{
+		DeleteMediaTypes: []string{"image/*"},
+		SubjectTag:       "[tag]",
+		LineEndings:      "crlf",
+	})
+	if err != nil {
+		t.Fatal("Rewrite failed:", err)
+	}
+	rep.Options = nil
+	want := &Report{
+		Parts:    3,
+		Deleted:  []DeletedPart{{"image/png", 5, "a.png", "2"}},
+		Headers:  []string{"Subject"},
+		BytesIn:  int64(len(msg)),
+		BytesOut: int64(b.Len()),
+	}
+	if !reflect.DeepEqual(rep, want) {
+		t.Errorf("Rewrite returned report %+v; want %+v", rep, want)
+	}
+
+	const malformed = "Subject: Hi\nbogus\n\nBody\n"
+	if rep, err = Rewrite(strings.NewReader(malformed), &b, &Options{}); err != nil {
+		t.Fatal("Rewrite failed:", err)
+	}
+	if !rep.Malformed || len(rep.Warnings) != 1 {
+		t.Errorf("Rewrite of malformed message returned Malformed %v and warnings %q; want true and 1 warning",
+			rep.Malformed, rep.Warnings)
+	}
+}
+
+func TestRewrite_digest(t *testing.T) {
+	const msg = "Content-Type: multipart/digest; boundary=abc\n" +
+		"\n" +
+		"--abc\n" +
+		"\n" +
+		"Subject: First\n" +
+		"Content-Type: multipart/mixed; boundary=def\n" +
+		"\n" +
+		"--def\n" +
+		"Content-Type: text/plain\n" +
+		"\n" +
+		"Hello\n" +
+		"--def\n" +
+		"Content-Type: image/png\n" +
+		"\n" +
+		"data\n" +
+		"--def--\n" +
+		"--abc\n" +
+		"Content-Type: text/plain\n" +
+		"\n" +
+		"Not a message\n" +
+		"--abc--\n"
+
+	var b bytes.Buffer
+	rep, err := Rewrite(strings.NewReader(msg), &b, &Options{DeleteMediaTypes: []string{"image/*"}})
+	if err != nil {
+		t.Fatal("Rewrite failed:", err)
+	}
+	if want := []DeletedPart{{"image/png", 5, "", "1.1.2"}}; !reflect.DeepEqual(rep.Deleted, want) {
+		t.Errorf("Rewrite deleted %+v; want %+v", rep.Deleted, want)
+	}
+	if got := b.String(); strings.Contains(got, "\ndata\n") || !strings.HasSuffix(got, "\nNot a message\n--abc--\n") {
+		t.Errorf("Rewrite produced unexpected output:\n%s", got)
+	}
+
+	// Embedded messages are also deletable as a whole.
+	b.Reset()
+	if rep, err = Rewrite(strings.NewReader(msg), &b, &Options{DeleteMediaTypes: []string{"message/rfc822"}}); err != nil {
+		t.Fatal("Rewrite failed:", err)
+	}
+	if len(rep.Deleted) != 1 || rep.Deleted[0].Path != "1" {
+		t.Errorf("Rewrite deleted %+v; want message/rfc822 part 1", rep.Deleted)
+	}
+
+	types := make(map[string]string)
+	for path, p := range FindParts([]byte(msg)) {
+		types[path] = p.MediaType
+	}
+	wantTypes := map[string]string{
+		"":      "multipart/digest",
+		"1":     "message/rfc822",
+		"1.1":   "multipart/mixed",
+		"1.1.1": "text/plain",
+		"1.1.2": "image/png",
+		"2":     "text/plain",
+	}
+	if !reflect.DeepEqual(types, wantTypes) {
+		t.Errorf("FindParts returned types %q; want %q", types, wantTypes)
+	}
+}
+
+func TestRewrite_duplicateContentType(t *testing.T) {
+	const msg = "Content-Type: multipart/mixed; boundary=abc\n" +
+		"\n" +
+		"--abc\n" +
+		"Content-Type: text/plain\n" +
+		"Content-Type: application/x-msdownload\n" +
+		"\n" +
+		"MZ\n" +
+		"--abc--\n"
+	for _, dedup := range []bool{false, true} {
+		var b bytes.Buffer
+		rep, err := Rewrite(strings.NewReader(msg), &b, &Options{DeleteMediaTypes: []string{"image/*"}, DedupContentType: dedup})
+		if err != nil {
+			t.Fatal("Rewrite failed:", err)
+		}
+		if len(rep.Warnings) != 1 || !strings.Contains(rep.Warnings[0], "conflicting") {
+			t.Errorf("Rewrite with dedup=%v reported warnings %q; want conflicting Content-Type", dedup, rep.Warnings)
+		}
+		if got := strings.Contains(b.String(), "x-msdownload"); got == dedup {
+			t.Errorf("Rewrite with dedup=%v wrote:\n%s", dedup, b.String())
+		}
+	}
+}
+
+func TestRewrite_mboxFrom(t *testing.T) {
+	const (
+		from = "From sender@example.org Sat Apr 16 10:00:00 2022\n"
+		msg  = "Subject: Hi\nFrom : obsolete@example.org\n\nBody\n"
+	)
+	for _, tc := range []struct {
+		strip bool
+		want  string
+	}{
+		{false, from + "Subject: [tag] Hi\nFrom : obsolete@example.org\n\nBody\n"},
+		{true, "Subject: [tag] Hi\nFrom : obsolete@example.org\n\nBody\n"},
+	} {
+		var b bytes.Buffer
+		rep, err := Rewrite(strings.NewReader(from+msg), &b, &Options{SubjectTag: "[tag]", StripMboxFrom: tc.strip})
+		if err != nil {
+			t.Errorf("Rewrite with strip=%v failed: %v", tc.strip, err)
+		} else if rep.Malformed || b.String() != tc.want {
+			t.Errorf("Rewrite with strip=%v wrote %q (malformed=%v); want %q", tc.strip, b.String(), rep.Malformed, tc.want)
+		}
+	}
+}
+
+func TestRewrite_emptyMultipart(t *testing.T) {
+	// The preamble is immediately followed by the closing delimiter in both multiparts.
+	const msg = "Subject: Hi\n" +
+		"Content-Type: multipart/mixed; boundary=outer\n" +
+		"\n" +
+		"Preamble\n" +
+		"--outer--\n"
+	const nested = "Subject: Hi\n" +
+		"Content-Type: multipart/mixed; boundary=outer\n" +
+		"\n" +
+		"--outer\n" +
+		"Content-Type: multipart/related; boundary=inner\n" +
+		"\n" +
+		"--inner--\n" +
+		"Epilogue\n" +
+		"--outer--\n"
+	for _, in := range []string{msg, nested} {
+		for _, opts := range []Options{
+			{DeleteMediaTypes: []string{"image/*"}},
+			{DeleteMediaTypes: []string{"image/*"}, AddPlaceholder: true, FlattenMultipart: true},
+			{Strict: true, Visit: func(*PartInfo, io.Reader) Action { return Keep }},
+		} {
+			var b bytes.Buffer
+			if _, err := Rewrite(strings.NewReader(in), &b, &opts); err != nil {
+				t.Errorf("Rewrite(%q) with %+v failed: %v", in, opts, err)
+			} else if b.String() != in {
+				t.Errorf("Rewrite(%q) with %+v wrote %q", in, opts, b.String())
+			}
+		}
+	}
+
+	parts := FindParts([]byte(nested))
+	if len(parts) != 2 || parts["1"].MediaType != "multipart/related" {
+		t.Errorf("FindParts(%q) = %+v; want top-level and multipart/related parts", nested, parts)
+	}
+}
+
+func TestRewrite_epilogue(t *testing.T) {
+	const (
+		start = "Subject: Hi\n" +
+			"Content-Type: multipart/mixed; boundary=outer\n" +
+			"\n" +
+			"--outer\n" +
+			"Content-Type: multipart/alternative; boundary=inner\n" +
+			"\n" +
+			"--inner\n" +
+			"Content-Type: text/plain\n" +
+			"\n" +
+			"Hello\n" +
+			"--inner--\n"
+		inner = "\nInner epilogue\n"
+		mid   = "--outer--\n"
+		outer = "Outer epilogue\r\n\x00junk"
+	)
+	for _, tc := range []struct {
+		drop bool
+		want string
+	}{
+		{false, start + inner + mid + outer},
+		{true, start + mid},
+	} {
+		var b bytes.Buffer
+		opts := Options{DeleteMediaTypes: []string{"image/*"}, DropEpilogue: tc.drop}
+		if _, err := Rewrite(strings.NewReader(start+inner+mid+outer), &b, &opts); err != nil {
+			t.Errorf("Rewrite with drop=%v failed: %v", tc.drop, err)
+		} else if got := b.String(); got != tc.want {
+			t.Errorf("Rewrite with drop=%v wrote %q; want %q", tc.drop, got, tc.want)
+		}
+	}
+}
+
+func TestRewrite_leadingJunk(t *testing.T) {
+	const msg = "Subject: Hi\nContent-Type: text/plain\n\nBody\n"
+	const tagged = "Subject: [tag] Hi\nContent-Type: text/plain\n\nBody\n"
+	for _, tc := range []struct {
+		in    string
+		strip bool
+		want  string
+	}{
+		{utf8BOM + msg, false, utf8BOM + tagged},
+		{utf8BOM + msg, true, tagged},
+		{"\n\r\n" + msg, false, "\n\r\n" + tagged},
+		{"\n\r\n" + msg, true, tagged},
+		{utf8BOM + "junk\n \n" + msg, false, utf8BOM + "junk\n \n" + tagged},
+		{utf8BOM + "junk\n \n" + msg, true, tagged},
+		// Blank lines not closely followed by fields indicate an empty header.
+		{"\nHello\n", true, "\nHello\n"},
+		{"\na\nb\nc\nd\ne\n" + msg, true, "\na\nb\nc\nd\ne\n" + msg},
+	} {
+		var b bytes.Buffer
+		opts := Options{SubjectTag: "[tag]", StripLeadingJunk: tc.strip}
+		if _, err := Rewrite(strings.NewReader(tc.in), &b, &opts); err != nil {
+			t.Errorf("Rewrite(%q) with strip=%v failed: %v", tc.in, tc.strip, err)
+		} else if got := b.String(); got != tc.want {
+			t.Errorf("Rewrite(%q) with strip=%v wrote %q; want %q", tc.in, tc.strip, got, tc.want)
+		}
+	}
+}
+
+func TestTrimLeadingJunk(t *testing.T) {
+	for _, tc := range []struct {
+		in, want string
+	}{
+		{"To: a\n\nBody\n", "To: a\n\nBody\n"},
+		{utf8BOM + "To: a\n\nBody\n", "To: a\n\nBody\n"},
+		{"From a@example.org Sat Apr 16 10:00:00 2022\r\n\r\n--\r\nTo: a\r\n", "To: a\r\n"},
+		{"\rjunk\rTo : a\r", "To : a\r"},
+		{"\nBody\n", "\nBody\n"},
+		{"\n", "\n"},
+	} {
+		if got := string(trimLeadingJunk([]byte(tc.in))); got != tc.want {
+			t.Errorf("trimLeadingJunk(%q) = %q; want %q", tc.in, got, tc.want)
+		}
+	}
+}
+
+func TestRewrite_bareCR(t *testing.T) {
+	// Messages from classic Mac OS use bare CRs.
+	const in = "From: a@example.org\r" +
+		"Content-Type: multipart/mixed; boundary=abc\r" +
+		"\r" +
+		"--abc\r" +
+		"Content-Type: text/plain\r" +
+		"\r" +
+		"Hello\r" +
+		"--abc\r" +
+		"Content-Type: image/png\r" +
+		"\r" +
+		"data\r" +
+		"--abc--\r"
+	for _, tc := range []struct {
+		endings string
+		term    string // expected terminator for lines, or empty to preserve them
+	}{
+		{"keep", ""},
+		{"lf", "\n"},
+		{"crlf", "\r\n"},
+	} {
+		var b bytes.Buffer
+		rep, err := Rewrite(strings.NewReader(in), &b,
+			&Options{DeleteMediaTypes: []string{"image/*"}, LineEndings: tc.endings})
+		if err != nil {
+			t.Errorf("Rewrite with %q failed: %v", tc.endings, err)
+			continue
+		}
+		got := b.String()
+		if len(rep.Deleted) != 1 || strings.Contains(got, "data") || !strings.Contains(got, "Hello") {
+			t.Errorf("Rewrite with %q didn't delete only image part:\n%q", tc.endings, got)
+		}
+		if tc.term == "" {
+			if !strings.HasPrefix(got, in[:strings.Index(in, "--abc\rContent-Type: image")]) ||
+				!strings.Contains(got, "x-rendmail-deleted;\r") {
+				t.Errorf("Rewrite with %q didn't preserve terminators:\n%q", tc.endings, got)
+			}
+		} else if norm := strings.NewReplacer("\r\n", "\n", "\r", "\n").Replace(got); strings.ReplaceAll(norm, "\n", tc.term) != got {
+			t.Errorf("Rewrite with %q didn't normalize terminators:\n%q", tc.endings, got)
+		}
+	}
+}
+
+func TestRewrite_mixedTerminators(t *testing.T) {
+	// Some headers mix CRLF and LF. Stray bare CRs in messages that use LF shouldn't
+	// split lines, since that would make the header malformed and stop parsing before
+	// the attachment is reached.
+	const in = "From: a@example.org\r\n" +
+		"Subject: hello\rworld\n" +
+		"Content-Type: multipart/mixed; boundary=abc\r\n" +
+		"\n" +
+		"--abc\n" +
+		"Content-Type: text/plain\r\n" +
+		"\n" +
+		"Hello\rthere\n" +
+		"--abc\n" +
+		"Content-Type: image/png\n" +
+		"\n" +
+		"data\n" +
+		"--abc--\n"
+	for _, tc := range []struct {
+		endings string
+		want    string // expected start of output
+	}{
+		{"keep", in[:strings.Index(in, "--abc\nContent-Type: image")]},
+		{"lf", "From: a@example.org\nSubject: hello\rworld\n"},
+		{"crlf", "From: a@example.org\r\nSubject: hello\rworld\r\n"},
+	} {
+		var b bytes.Buffer
+		rep, err := Rewrite(strings.NewReader(in), &b,
+			&Options{DeleteMediaTypes: []string{"image/*"}, LineEndings: tc.endings})
+		if err != nil {
+			t.Errorf("Rewrite with %q failed: %v", tc.endings, err)
+			continue
+		}
+		got := b.String()
+		if rep.Malformed || len(rep.Deleted) != 1 || strings.Contains(got, "data") {
+			t.Errorf("Rewrite with %q didn't delete image part:\n%q", tc.endings, got)
+		}
+		if !strings.HasPrefix(got, tc.want) || !strings.Contains(got, "Hello\rthere") {
+			t.Errorf("Rewrite with %q didn't preserve stray CRs:\n%q", tc.endings, got)
+		}
+	}
+}
+
+func TestRewrite_replaceDeleted(t *testing.T) {
+	const in = "From: a@example.org\n" +
+		"Content-Type: multipart/mixed; boundary=abc\n" +
+		"\n" +
+		"--abc\n" +
+		"Content-Type: text/plain\n" +
+		"\n" +
+		"Hello\n" +
+		"--abc\n" +
+		"Content-Type: image/png\n" +
+		"X-Extra: keep\n" +
+		"Content-Disposition: attachment; filename=a.png\n" +
+		"\n" +
+		"data\n" +
+		"--abc--\n"
+	const want = "From: a@example.org\n" +
+		"Content-Type: multipart/mixed; boundary=abc\n" +
+		"\n" +
+		"--abc\n" +
+		"Content-Type: text/plain\n" +
+		"\n" +
+		"Hello\n" +
+		"--abc\n" +
+		"X-Extra: keep\n" +
+		"Content-Type: text/plain\n" +
+		"\n" +
+		"Removed image/png a.png\n" +
+		"--abc--\n"
+	var b bytes.Buffer
+	rep, err := Rewrite(strings.NewReader(in), &b, &Options{
+		DeleteMediaTypes: []string{"image/*"},
+		ReplaceDeleted: func(p *PartInfo, w io.Writer) error {
+			_, err := io.WriteString(w, "Content-Type: text/plain\n\nRemoved "+p.MediaType+" "+p.Filename)
+			return err
+		},
+	})
+	if err != nil {
+		t.Fatal("Rewrite failed:", err)
+	}
+	if got := b.String(); got != want {
+		t.Errorf("Rewrite produced:\n%s\nwant:\n%s", got, want)
+	}
+	if len(rep.Deleted) != 1 {
+		t.Errorf("Rewrite reported deleted parts %+v; want 1 part", rep.Deleted)
+	}
+}
+
+func TestDecodeHeaderValue(t *testing.T) {
+	for _, tc := range []struct {
+		orig string
+		dec  string
+		ok   bool
+	}{
+		{"", "", true},
+		{" ", " ", true},
+		{"regular text", "regular text", true},
+		{"¡confirmación, 再见, hi!", "confirmacion, , hi!", true}, // diacritic removed, non-ASCII dropped
+		// Various examples from RFC 2047:
+		{"=?iso-8859-1?q?this=20is=20some=20text?=", "this is some text", true},
+		{"=?US-ASCII?Q?Keith_Moore?= <moore@cs.utk.edu>", "Keith Moore <moore@cs.utk.edu>", true},
+		{"=?ISO-8859-1?Q?Keld_J=F8rn_Simonsen?= <keld@dkuug.dk>", "Keld Jrn Simonsen <keld@dkuug.dk>", true}, // ø isn't diacritical
+		{"=?ISO-8859-1?Q?Andr=E9?= Pirard <PIRARD@vm1.ulg.ac.be>", "Andre Pirard <PIRARD@vm1.ulg.ac.be>", true},
+		{"=?ISO-8859-1?Q?Olle_J=E4rnefors?= <ojarnef@admin.kth.se>", "Olle Jarnefors <ojarnef@admin.kth.se>", true},
+		{"=?ISO-8859-1?Q?Patrik_F=E4ltstr=F6m?= <paf@nada.kth.se>", "Patrik Faltstrom <paf@nada.kth.se>", true},
+		{"(=?ISO-8859-1?Q?a?=)", "(a)", true},
+		{"(=?ISO-8859-1?Q?a?= b)", "(a b)", true},
+		{"(=?ISO-8859-1?Q?a?= =?ISO-8859-1?Q?b?=)", "(ab)", true},
+		{"(=?ISO-8859-1?Q?a?=  =?ISO-8859-1?Q?b?=)", "(ab)", true},
+		{"(=?ISO-8859-1?Q?a?=\r\n    =?ISO-8859-1?Q?b?=)", "(ab)", true}, // we shouldn't actually pass line breaks
+		{"(=?ISO-8859-1?Q?a_b?=)", "(a b)", true},
+		{"(=?ISO-8859-1?Q?a?= =?ISO-8859-2?Q?_b?=)", "", false}, // unsupported charset
+	} {
+		if dec, ok := decodeHeaderValue(tc.orig, headerDecoder); dec != tc.dec || ok != tc.ok {
+			t.Errorf("decodeHeaderValue(%q) = (%q, %v); want (%q, %v)", tc.orig, dec, ok, tc.dec, tc.ok)
+		}
+	}
+}
+
+func TestFoldHeaderField(t *testing.T) {
+	var (
+		a38 = strings.Repeat("a", 38)
+		a69 = strings.Repeat("a", 69) // 78 chars when preceded by "Subject: "
+		a70 = strings.Repeat("a", 70) // 79 chars when preceded by "Subject: "
+		a78 = strings.Repeat("a", 78) // always exceeds limit when preceded by "Subject: " or " "
+	)
+
+	for _, tc := range []struct {
+		unfolded string
+		term     string
+		want     []string
+	}{
+		{"", "\n", nil},  // we shouldn't pass an empty string
+		{" ", "\n", nil}, // we shouldn't pass just whitespace
+		{"From: me", "\n", []string{"From: me\n"}},
+		{"Subject: Some words", "\r\n", []string{"Subject: Some words\r\n"}},
+		{"Subject: " + a69, "\n", []string{"Subject: " + a69 + "\n"}},
+		{"Subject: " + a70, "\n", []string{"Subject:\n", " " + a70 + "\n"}},
+		{"Subject: " + a69 + "\t" + a38 + " " + a38 + " " + a38, "\n",
+			[]string{"Subject: " + a69 + "\n", "\t" + a38 + " " + a38 + "\n", " " + a38 + "\n"}},
+		{"Subject: " + a78 + " " + a78, "\n", []string{"Subject:\n", " " + a78 + "\n", " " + a78 + "\n"}},
+	} {
+		if got := foldHeaderField(tc.unfolded, tc.term); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("foldHeaderField(%q, %q) = %q; want %q", tc.unfolded, tc.term, got, tc.want)
+		}
+	}
+}
+
+func TestShouldDelete(t *testing.T) {
+	for _, tc := range []struct {
+		mtype     string
+		del, keep []string
+		want      bool
+	}{
+		{"text/plain", nil, nil, false},
+		{"text/plain", []string{"audio/*", "image/*"}, nil, false},
+		{"image/jpeg", []string{"audio/*", "image/*"}, nil, true},
+		{"image/jpeg", []string{"audio/*", "image/*"}, []string{"image/png"}, true},
+		{"image/jpeg", []string{"audio/*", "image/*"}, []string{"image/png", "image/jpeg"}, false},
+	} {
+		if got, err := shouldDelete(tc.mtype, tc.del, tc.keep); err != nil {
+			t.Errorf("shouldDelete(%q, %q, %q) failed: %v", tc.mtype, tc.del, tc.keep, err)
+		} else if got != tc.want {
+			t.Errorf("shouldDelete(%q, %q, %q) = %v; want %v", tc.mtype, tc.del, tc.keep, got, tc.want)
+		}
+	}
+}
+
+func TestRedactAddressList(t *testing.T) {
+	for _, tc := range []struct {
+		list, mode, key, want string
+	}{
+		{"me@example.org", "placeholder", "", "undisclosed-recipients:;"},
+		{"me@example.org", "hash", "", "855c94f3498940b2@redacted.invalid"},
+		{"Me <ME@Example.org>", "hash", "", "855c94f3498940b2@redacted.invalid"},
+		{"a@example.org, b@example.org", "hash", "",
+			"e16bfe08be114c7b@redacted.invalid, c12c6545772a8d88@redacted.invalid"},
+		{"not an address", "hash", "", "undisclosed-recipients:;"},
+		{"Me <ME@Example.org>", "hash", "secret", "2f4389006bf637a3@redacted.invalid"},
+		{"2f4389006bf637a3@redacted.invalid", "hash", "secret", "2f4389006bf637a3@redacted.invalid"},
+	} {
+		if got := redactAddressList(tc.list, tc.mode, tc.key); got != tc.want {
+			t.Errorf("redactAddressList(%q, %q, %q) = %q; want %q", tc.list, tc.mode, tc.key, got, tc.want)
+		}
+	}
+}
+
+func TestEncodeHeaderValue(t *testing.T) {
+	for _, tc := range []struct {
+		val, want string
+	}{
+		{"plain text", "plain text"},
+		{"Café", "=?utf-8?q?Caf=C3=A9?="},
+		{"Caf\xe9", "=?utf-8?q?Caf=C3=A9?="}, // Latin-1
+		{"über alles größer", "=?utf-8?q?=C3=BCber?= alles =?utf-8?q?gr=C3=B6=C3=9Fer?="},
+		{"über größer  x", "=?utf-8?q?=C3=BCber_gr=C3=B6=C3=9Fer?=  x"},
+		{`"José \"Pepe\"" <j@example.org>`, `=?utf-8?q?Jos=C3=A9_=22Pepe=22?= <j@example.org>`},
+		{"Zoë <z@example.org>", "=?utf-8?q?Zo=C3=AB?= <z@example.org>"},
+		{"ü.x=y_z", "=?utf-8?q?=C3=BC=2Ex=3Dy=5Fz?="},
+		{strings.Repeat("é", 12), "=?utf-8?q?" + strings.Repeat("=C3=A9", 10) + "?= =?utf-8?q?=C3=A9=C3=A9?="},
+		{"a (ü), b", "a (=?utf-8?q?=C3=BC?=), b"},
+		{"Zoë <zoë@example.org>", "=?utf-8?q?Zo=C3=AB?= <zoë@example.org>"},
+		{"zoë@example.org, Zoë", "zoë@example.org, =?utf-8?q?Zo=C3=AB?="},
+	} {
+		if got := encodeHeaderValue(tc.val); got != tc.want {
+			t.Errorf("encodeHeaderValue(%q) = %q; want %q", tc.val, got, tc.want)
+		}
+	}
+}
+
+func TestEncodeHeaderField(t *testing.T) {
+	for _, tc := range []struct {
+		key, val, want string
+	}{
+		{"Subject", "Café", "=?utf-8?q?Caf=C3=A9?="},
+		{"Content-Disposition", `attachment; filename="naïve.pdf"`, "attachment; filename*=utf-8''na%C3%AFve.pdf"},
+		{"Content-Disposition", "attachment; filename=\"na\xefve.pdf\"", "attachment; filename*=utf-8''na%C3%AFve.pdf"},
+		{"Content-Type", `Application/PDF; name="naïve.pdf"`, "application/pdf; name*=utf-8''na%C3%AFve.pdf"},
+		{"Content-Type", "text/plain; name=naïve.txt", "text/plain; name=naïve.txt"}, // unparseable
+		{"Content-Description", "Café", "=?utf-8?q?Caf=C3=A9?="},
+	} {
+		if got := encodeHeaderField(tc.key, tc.val); got != tc.want {
+			t.Errorf("encodeHeaderField(%q, %q) = %q; want %q", tc.key, tc.val, got, tc.want)
+		}
+	}
+}
+
+func TestExtractListValues(t *testing.T) {
+	for _, tc := range []struct {
+		key, val string
+		want     []string
+	}{
+		{"List-Unsubscribe", "<mailto:list@example.org?subject=unsubscribe>",
+			[]string{"mailto:list@example.org?subject=unsubscribe"}},
+		{"List-Unsubscribe", "<https://example.org/u?id=a%20b>,\r\n <mailto:u@example.org> (comment)",
+			[]string{"https://example.org/u?id=a b", "mailto:u@example.org"}},
+		{"List-Unsubscribe", "<https://example.org/%0d%0aX-Injected:%20yes>",
+			[]string{"https://example.org/X-Injected: yes"}},
+		{"List-Unsubscribe", "no brackets", nil},
+		{"List-Id", "Example list <list.example.org>", []string{"list.example.org"}},
+		{"List-Id", "<list.example.org>", []string{"list.example.org"}},
+	} {
+		if got := extractListValues(tc.key, tc.val); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("extractListValues(%q, %q) = %q; want %q", tc.key, tc.val, got, tc.want)
+		}
+	}
+}
+
+// makeLargeMessage returns a multipart message containing n base64-encoded
+// attachments of the supplied media type, each with size bytes of data.
+func makeLargeMessage(n, size int, mtype string) []byte {
+	var b bytes.Buffer
+	b.WriteString("From: a@example.org\r\n" +
+		"Content-Type: multipart/mixed; boundary=\"----=_Part_1234_5678.1600000000000\"\r\n" +
+		"\r\n" +
+		"------=_Part_1234_5678.1600000000000\r\n" +
+		"Content-Type: text/plain\r\n" +
+		"\r\n" +
+		"See attached.\r\n")
+	data := make([]byte, size)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	enc, _ := EncodeBody(data, "base64", "\r\n")
+	for i := 0; i < n; i++ {
+		b.WriteString("------=_Part_1234_5678.1600000000000\r\n" +
+			"Content-Type: " + mtype + "\r\n" +
+			"Content-Disposition: attachment; filename=file" + strconv.Itoa(i) + "\r\n" +
+			"Content-Transfer-Encoding: base64\r\n" +
+			"\r\n")
+		b.Write(enc)
+	}
+	b.WriteString("------=_Part_1234_5678.1600000000000--\r\n")
+	return b.Bytes()
+}
+
+func benchmarkRewrite(b *testing.B, mtype string) {
+	msg := makeLargeMessage(4, 4<<20, mtype)
+	opts := Options{DeleteMediaTypes: []string{"image/*"}}
+	b.SetBytes(int64(len(msg)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := Rewrite(bytes.NewReader(msg), ioutil.Discard, &opts); err != nil {
+			b.Fatal("Rewrite failed:", err)
+		}
+	}
+}
+
+func BenchmarkRewrite_keep(b *testing.B)   { benchmarkRewrite(b, "application/pdf") }
+func BenchmarkRewrite_delete(b *testing.B) { benchmarkRewrite(b, "image/png") }
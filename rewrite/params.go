@@ -0,0 +1,234 @@
+// Copyright 2022 Daniel Erat.
+// All rights reserved.
+
+package rewrite
+
+import (
+	"mime"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// parseMediaType is like mime.ParseMediaType, but it also decodes RFC 2231 extended
+// parameters that use charsets other than UTF-8 and US-ASCII (e.g. "filename*=iso-8859-1”caf%E9"),
+// which mime.ParseMediaType drops or (for continuations) mangles.
+func parseMediaType(v string) (mtype string, params map[string]string, err error) {
+	if mtype, params, err = mime.ParseMediaType(v); err != nil || !strings.Contains(v, "*") {
+		return mtype, params, err
+	}
+	for name, val := range decodeExtendedParams(v) {
+		params[name] = val
+	}
+	return mtype, params, nil
+}
+
+// decodeExtendedParams returns the RFC 2231 extended parameters (i.e. ones with names
+// containing '*') from v, a Content-Type or Content-Disposition value. Continuations are
+// joined, and values are converted to UTF-8 using HTMLCharsets. Parameters that can't be
+// decoded are omitted.
+func decodeExtendedParams(v string) map[string]string {
+	type segment struct {
+		val     string
+		encoded bool // value is percent-encoded (and charset-prefixed if first)
+	}
+	segs := make(map[string]map[int]segment) // keyed by lowercase name and then index
+
+	// Skip the media type.
+	for _, p := range splitParams(v)[1:] {
+		i := strings.IndexByte(p, '=')
+		if i < 0 {
+			continue
+		}
+		key := strings.ToLower(strings.TrimSpace(p[:i]))
+		val := strings.TrimSpace(p[i+1:])
+		if !strings.Contains(key, "*") {
+			continue
+		}
+
+		// RFC 2231 3 and 4:
+		//  parameter := regular-parameter / extended-parameter
+		//  regular-parameter-name := attribute [section]
+		//  section := initial-section / other-sections
+		//  extended-parameter := (extended-initial-name "=" extended-initial-value) /
+		//                        (extended-other-names "=" extended-other-values)
+		//  extended-initial-name := attribute [initial-section] "*"
+		var seg segment
+		if strings.HasSuffix(key, "*") {
+			seg.encoded = true
+			key = key[:len(key)-1]
+		}
+		name, idx := key, 0
+		if j := strings.IndexByte(key, '*'); j >= 0 {
+			n, err := strconv.Atoi(key[j+1:])
+			if err != nil || n < 0 {
+				continue
+			}
+			name, idx = key[:j], n
+		}
+		if len(val) >= 2 && val[0] == '"' && val[len(val)-1] == '"' {
+			val = unquoteParam(val[1 : len(val)-1])
+		}
+		seg.val = val
+		if segs[name] == nil {
+			segs[name] = make(map[int]segment)
+		}
+		segs[name][idx] = seg
+	}
+
+	vals := make(map[string]string, len(segs))
+Params:
+	for name, ss := range segs {
+		var raw []byte
+		var charset string
+		for i := 0; i < len(ss); i++ {
+			s, ok := ss[i]
+			if !ok {
+				continue Params // missing section
+			}
+			v := s.val
+			if s.encoded {
+				if i == 0 {
+					// extended-initial-value := [charset] "'" [language] "'" extended-other-values
+					parts := strings.SplitN(v, "'", 3)
+					if len(parts) != 3 {
+						continue Params
+					}
+					charset, v = parts[0], parts[2]
+				}
+				dec, err := url.PathUnescape(v)
+				if err != nil {
+					continue Params
+				}
+				v = dec
+			}
+			raw = append(raw, v...)
+		}
+		enc, err := lookupCharset(charset, nil)
+		if err != nil {
+			continue
+		}
+		if dec, err := enc.NewDecoder().Bytes(raw); err == nil {
+			vals[name] = string(dec)
+		}
+	}
+	return vals
+}
+
+// splitParams splits v at semicolons that aren't within quoted strings.
+func splitParams(v string) []string {
+	var parts []string
+	var quoted, escaped bool
+	start := 0
+	for i := 0; i < len(v); i++ {
+		switch c := v[i]; {
+		case escaped:
+			escaped = false
+		case c == '\\' && quoted:
+			escaped = true
+		case c == '"':
+			quoted = !quoted
+		case c == ';' && !quoted:
+			parts = append(parts, v[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, v[start:])
+}
+
+// unquoteParam removes backslash escapes from the contents of a quoted string.
+func unquoteParam(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) {
+			i++
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+// maxParamLen is the maximum length of a parameter value written by formatMediaType
+// before it's split into RFC 2231 continuations.
+const maxParamLen = 60
+
+// formatMediaType is like mime.FormatMediaType, but values longer than maxParamLen are
+// split into RFC 2231 continuations (e.g. "name*0*=utf-8”...; name*1*=...") so that the
+// result can be folded by foldHeaderField. Non-ASCII values are encoded as UTF-8.
+func formatMediaType(mtype string, params map[string]string) string {
+	var b strings.Builder
+	b.WriteString(strings.ToLower(mtype))
+	for _, k := range sortedMapKeys(params) {
+		v := params[k]
+		k = strings.ToLower(k)
+		if isASCII(v) {
+			if len(v) <= maxParamLen {
+				b.WriteString("; " + k + "=" + quoteParam(v))
+				continue
+			}
+			for i := 0; len(v) > 0; i++ {
+				n := maxParamLen
+				if n > len(v) {
+					n = len(v)
+				}
+				b.WriteString("; " + k + "*" + strconv.Itoa(i) + "=" + quoteParam(v[:n]))
+				v = v[n:]
+			}
+			continue
+		}
+
+		enc := "utf-8''" + encodeParam(v)
+		if len(enc) <= maxParamLen {
+			b.WriteString("; " + k + "*=" + enc)
+			continue
+		}
+		for i := 0; len(enc) > 0; i++ {
+			n := maxParamLen
+			if n >= len(enc) {
+				n = len(enc)
+			} else if j := strings.LastIndexByte(enc[n-2:n], '%'); j >= 0 {
+				n = n - 2 + j // don't split percent-encoded bytes
+			}
+			b.WriteString("; " + k + "*" + strconv.Itoa(i) + "*=" + enc[:n])
+			enc = enc[n:]
+		}
+	}
+	return b.String()
+}
+
+// quoteParam returns v as an RFC 2045 token if possible or as a quoted string otherwise.
+func quoteParam(v string) string {
+	token := v != ""
+	for i := 0; i < len(v) && token; i++ {
+		c := v[i]
+		token = c > ' ' && c < 0x7f && !strings.ContainsRune(`()<>@,;:\"/[]?=`, rune(c))
+	}
+	if token {
+		return v
+	}
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(v) + `"`
+}
+
+// encodeParam percent-encodes v as described by RFC 2231 7:
+//
+//	extended-other-values := *(ext-octet / attribute-char)
+//	ext-octet := "%" 2(DIGIT / "A" / "B" / "C" / "D" / "E" / "F")
+//	attribute-char := <any (US-ASCII) CHAR except SPACE, CTLs, "*", "'", "%", or tspecials>
+func encodeParam(v string) string {
+	const hex = "0123456789ABCDEF"
+	var b strings.Builder
+	for i := 0; i < len(v); i++ {
+		c := v[i]
+		if c > ' ' && c < 0x7f && !strings.ContainsRune(`*'%()<>@,;:\"/[]?=`, rune(c)) {
+			b.WriteByte(c)
+		} else {
+			b.WriteByte('%')
+			b.WriteByte(hex[c>>4])
+			b.WriteByte(hex[c&0xf])
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,65 @@
+// Copyright 2022 Daniel Erat.
+// All rights reserved.
+
+package rewrite
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseMediaType(t *testing.T) {
+	for _, tc := range []struct {
+		in     string
+		mtype  string
+		params map[string]string
+	}{
+		{`text/plain; charset=utf-8`, "text/plain", map[string]string{"charset": "utf-8"}},
+		{`attachment; filename*=UTF-8''caf%C3%A9.txt`, "attachment", map[string]string{"filename": "café.txt"}},
+		{`attachment; filename*=iso-8859-1'fr'caf%E9.txt`, "attachment", map[string]string{"filename": "café.txt"}},
+		{`attachment; filename*0*=windows-1252''%93quoted; filename*1*=%94; filename*2=".txt"`,
+			"attachment", map[string]string{"filename": "“quoted”.txt"}},
+		{`attachment; filename*0="a b"; filename*1="\"c\".txt"`,
+			"attachment", map[string]string{"filename": `a b"c".txt`}},
+		{`application/pdf; name*=bogus-charset''abc`, "application/pdf", map[string]string{}},
+	} {
+		mtype, params, err := parseMediaType(tc.in)
+		if err != nil {
+			t.Errorf("parseMediaType(%q) failed: %v", tc.in, err)
+		} else if mtype != tc.mtype || !reflect.DeepEqual(params, tc.params) {
+			t.Errorf("parseMediaType(%q) = %q, %q; want %q, %q", tc.in, mtype, params, tc.mtype, tc.params)
+		}
+	}
+}
+
+func TestFormatMediaType(t *testing.T) {
+	long := strings.Repeat("é", 40) + ".txt"
+	for _, tc := range []struct {
+		mtype  string
+		params map[string]string
+		want   string
+	}{
+		{"text/plain", map[string]string{"charset": "utf-8", "name": "a b.txt"},
+			`text/plain; charset=utf-8; name="a b.txt"`},
+		{"text/plain", map[string]string{"name": "café.txt"}, `text/plain; name*=utf-8''caf%C3%A9.txt`},
+		{"text/plain", map[string]string{"name": strings.Repeat("a", 70)},
+			"text/plain; name*0=" + strings.Repeat("a", 60) + "; name*1=" + strings.Repeat("a", 10)},
+		{"text/plain", map[string]string{"name": long}, ""}, // checked by round trip
+	} {
+		got := formatMediaType(tc.mtype, tc.params)
+		if tc.want != "" && got != tc.want {
+			t.Errorf("formatMediaType(%q, %q) = %q; want %q", tc.mtype, tc.params, got, tc.want)
+		}
+		for _, p := range splitParams(got) {
+			if len(strings.TrimSpace(p)) > maxParamLen+len("name*10*=") {
+				t.Errorf("formatMediaType(%q, %q) produced long parameter %q", tc.mtype, tc.params, p)
+			}
+		}
+		if mtype, params, err := parseMediaType(got); err != nil {
+			t.Errorf("parseMediaType(%q) failed: %v", got, err)
+		} else if mtype != tc.mtype || !reflect.DeepEqual(params, tc.params) {
+			t.Errorf("parseMediaType(%q) = %q, %q; want %q, %q", got, mtype, params, tc.mtype, tc.params)
+		}
+	}
+}
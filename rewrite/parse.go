@@ -0,0 +1,99 @@
+// Copyright 2022 Daniel Erat.
+// All rights reserved.
+
+package rewrite
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"strconv"
+)
+
+// Message is a message's MIME tree as returned by Parse.
+type Message struct {
+	Root *Part // top-level part
+
+	data  []byte           // original message
+	parts map[string]*Part // keyed by path
+}
+
+// Part is a part within a Message.
+type Part struct {
+	PartInfo         // Header holds the part's parsed header fields
+	Parts    []*Part // enclosed parts (for multipart parts)
+
+	span PartSpan
+	msg  *Message
+}
+
+// Parse reads a message from r and returns its MIME tree without rewriting it.
+//
+// The message is held in memory, but each part's body is only decoded when
+// requested. Parsing is lenient: malformed messages are parsed as well as
+// possible (e.g. a multipart part lacking a closing delimiter extends to the
+// end of the message), so an error is only returned if reading from r fails.
+func Parse(r io.Reader) (*Message, error) {
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	m := &Message{data: b, parts: make(map[string]*Part)}
+	spans := FindParts(b)
+	var add func(path string) *Part
+	add = func(path string) *Part {
+		s := spans[path]
+		hd := headerData{
+			mediaType:     s.MediaType,
+			contentParams: s.Params,
+			encoding:      s.Encoding,
+			disposition:   s.Disposition,
+			filename:      s.DispParams["filename"],
+			path:          path,
+		}
+		p := &Part{PartInfo: *newPartInfo(&hd, b[s.Start:s.BodyStart]), span: s, msg: m}
+		m.parts[path] = p
+		for i := 1; ; i++ {
+			child := strconv.Itoa(i)
+			if path != "" {
+				child = path + "." + child
+			}
+			if _, ok := spans[child]; !ok {
+				break
+			}
+			p.Parts = append(p.Parts, add(child))
+		}
+		return p
+	}
+	m.Root = add("")
+	return m, nil
+}
+
+// Part returns the part at path (e.g. "1.2", or "" for the top-level part),
+// or nil if the message doesn't contain it.
+func (m *Message) Part(path string) *Part { return m.parts[path] }
+
+// WriteTo writes the original message to w.
+func (m *Message) WriteTo(w io.Writer) (int64, error) {
+	n, err := w.Write(m.data)
+	return int64(n), err
+}
+
+// RawHeader returns the part's original header, including the blank line that ends it.
+func (p *Part) RawHeader() []byte { return p.msg.data[p.span.Start:p.span.BodyStart] }
+
+// Body returns a reader over the part's encoded body. The line break preceding
+// the next delimiter is excluded. Multipart parts' bodies include their enclosed parts.
+func (p *Part) Body() io.Reader { return bytes.NewReader(p.rawBody()) }
+
+// DecodedBody returns a reader over the part's body after decoding its
+// Content-Transfer-Encoding.
+func (p *Part) DecodedBody() (io.Reader, error) {
+	b, err := DecodeBody(p.rawBody(), p.Encoding)
+	if err != nil {
+		return nil, err
+	}
+	return bytes.NewReader(b), nil
+}
+
+func (p *Part) rawBody() []byte { return p.span.Body(p.msg.data, p.Path == "") }
@@ -0,0 +1,64 @@
+// Copyright 2022 Daniel Erat.
+// All rights reserved.
+
+package rewrite
+
+import (
+	"bytes"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	msg, err := Parse(strings.NewReader(walkMsg))
+	if err != nil {
+		t.Fatal("Parse failed:", err)
+	}
+
+	var paths []string
+	var visit func(p *Part)
+	visit = func(p *Part) {
+		paths = append(paths, p.Path+" "+p.MediaType)
+		for _, c := range p.Parts {
+			visit(c)
+		}
+	}
+	visit(msg.Root)
+	want := []string{" multipart/mixed", "1 text/plain", "2 multipart/related", "2.1 image/png"}
+	if got := strings.Join(paths, ","); got != strings.Join(want, ",") {
+		t.Errorf("Parse returned parts %q; want %q", paths, want)
+	}
+
+	if got := msg.Root.Header.Get("From"); got != "a@example.org" {
+		t.Errorf("Top-level From is %q; want %q", got, "a@example.org")
+	}
+	img := msg.Part("2.1")
+	if img == nil {
+		t.Fatal("Part 2.1 not found")
+	}
+	if img.Filename != "a.png" {
+		t.Errorf("Part 2.1 has filename %q; want %q", img.Filename, "a.png")
+	}
+	if b, _ := ioutil.ReadAll(img.Body()); string(b) != "YWJj" {
+		t.Errorf("Part 2.1 has encoded body %q; want %q", b, "YWJj")
+	}
+	if r, err := img.DecodedBody(); err != nil {
+		t.Error("DecodedBody failed:", err)
+	} else if b, _ := ioutil.ReadAll(r); string(b) != "abc" {
+		t.Errorf("Part 2.1 has decoded body %q; want %q", b, "abc")
+	}
+	if got, want := string(img.RawHeader()), "Content-Type: image/png\n"; !strings.HasPrefix(got, want) {
+		t.Errorf("Part 2.1 has raw header %q; want prefix %q", got, want)
+	}
+	if p := msg.Part("3"); p != nil {
+		t.Errorf("Part(%q) = %+v; want nil", "3", p)
+	}
+
+	var b bytes.Buffer
+	if n, err := msg.WriteTo(&b); err != nil {
+		t.Error("WriteTo failed:", err)
+	} else if b.String() != walkMsg || n != int64(len(walkMsg)) {
+		t.Errorf("WriteTo wrote %d byte(s) %q; want original message", n, b.String())
+	}
+}
@@ -0,0 +1,174 @@
+// Copyright 2022 Daniel Erat.
+// All rights reserved.
+
+package rewrite
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+)
+
+// PartSpan describes the location of a message part within a message.
+type PartSpan struct {
+	Start, End  int               // offsets of the part's header and end of its body
+	BodyStart   int               // offset of the part's body
+	MediaType   string            // e.g. "text/plain"
+	Params      map[string]string // Content-Type parameters
+	Encoding    string            // lowercase Content-Transfer-Encoding, e.g. "base64"
+	Disposition string            // lowercase disposition from Content-Disposition, e.g. "attachment"
+	DispParams  map[string]string // Content-Disposition parameters
+	Auth        string            // value of first Authentication-Results field
+}
+
+// Body returns the part's body from b, the full message.
+// top should be true for the top-level part. The line break preceding the
+// next delimiter is excluded.
+func (p *PartSpan) Body(b []byte, top bool) []byte {
+	body := b[p.BodyStart:p.End]
+	if !top {
+		if bytes.HasSuffix(body, []byte("\r\n")) {
+			body = body[:len(body)-2]
+		} else if bytes.HasSuffix(body, []byte("\n")) || bytes.HasSuffix(body, []byte("\r")) {
+			body = body[:len(body)-1]
+		}
+	}
+	return body
+}
+
+// FindParts returns the parts of the message in b keyed by path as described by findParts.
+func FindParts(b []byte) map[string]PartSpan {
+	parts := make(map[string]PartSpan)
+	findParts(b, 0, len(b), "", false, parts)
+	return parts
+}
+
+// findParts adds the part spanning b[start:end] and its descendants to parts.
+// The top-level part has an empty path, its children have paths "1", "2", etc.,
+// and their children have paths "1.1", "1.2", etc. A part's span includes the
+// line break preceding the next delimiter. inDigest should be true if the part's
+// parent is a multipart/digest part. The message enclosed by a message/rfc822 part
+// is its only child.
+func findParts(b []byte, start, end int, path string, inDigest bool, parts map[string]PartSpan) {
+	p := PartSpan{Start: start, End: end, MediaType: defaultMediaType, Params: defaultContentParams}
+	if inDigest {
+		p.MediaType, p.Params = digestMediaType, map[string]string{}
+	}
+	lr := newLineReader(bytes.NewReader(b[start:end]))
+	defer lr.release()
+	pos := start
+	gotType, gotEnc, gotDisp, gotAuth := false, false, false, false
+	for {
+		folded, unfolded, err := lr.readFoldedLine()
+		if err != nil {
+			break
+		}
+		for _, ln := range folded {
+			pos += len(ln)
+		}
+		if unfolded == "" {
+			break
+		}
+		key, val, err := ParseHeaderField(unfolded)
+		if err != nil {
+			continue
+		}
+		switch {
+		case key == "Content-Type" && !gotType:
+			if mtype, params, err := parseMediaType(val); err == nil {
+				p.MediaType, p.Params = mtype, params
+			}
+			gotType = true
+		case key == "Content-Transfer-Encoding" && !gotEnc:
+			p.Encoding = strings.ToLower(strings.TrimSpace(val))
+			gotEnc = true
+		case key == "Content-Disposition" && !gotDisp:
+			if disp, params, err := parseMediaType(val); err == nil {
+				p.Disposition, p.DispParams = disp, params
+			}
+			gotDisp = true
+		case key == "Authentication-Results" && !gotAuth:
+			p.Auth = val
+			gotAuth = true
+		}
+	}
+	p.BodyStart = pos
+	parts[path] = p
+
+	if p.MediaType == "message/rfc822" && isIdentityEncoding(p.Encoding) {
+		childPath := "1"
+		if path != "" {
+			childPath = path + ".1"
+		}
+		findParts(b, pos, end, childPath, false, parts)
+		return
+	}
+
+	bnd := p.Params["boundary"]
+	if !strings.HasPrefix(p.MediaType, "multipart/") || bnd == "" {
+		return
+	}
+	delim := []byte("--" + bnd)
+	n := 0
+	childStart := -1
+	for pos < end {
+		lnEnd := end
+		if i := bytes.IndexByte(b[pos:end], '\n'); i >= 0 {
+			lnEnd = pos + i + 1
+		}
+		if ln := b[pos:lnEnd]; bytes.HasPrefix(ln, delim) {
+			if childStart >= 0 {
+				n++
+				childPath := strconv.Itoa(n)
+				if path != "" {
+					childPath = path + "." + childPath
+				}
+				findParts(b, childStart, pos, childPath, p.MediaType == "multipart/digest", parts)
+			}
+			if bytes.HasPrefix(ln[len(delim):], []byte("--")) {
+				return
+			}
+			childStart = lnEnd
+		}
+		pos = lnEnd
+	}
+}
+
+// FindDelimiters returns the offsets within body of the first and last lines beginning
+// with delim and of the closing delimiter line (i.e. delim followed by "--"), or -1 if
+// there are no such lines. Lines following the closing delimiter are not examined.
+func FindDelimiters(body []byte, delim string) (first, last, closing int) {
+	first, last, closing = -1, -1, -1
+	d := []byte(delim)
+	for pos := 0; pos < len(body); {
+		end := len(body)
+		if i := bytes.IndexByte(body[pos:], '\n'); i >= 0 {
+			end = pos + i + 1
+		}
+		if ln := body[pos:end]; bytes.HasPrefix(ln, d) {
+			if first < 0 {
+				first = pos
+			}
+			last = pos
+			if bytes.HasPrefix(ln[len(d):], []byte("--")) {
+				closing = pos
+				break
+			}
+		}
+		pos = end
+	}
+	return first, last, closing
+}
+
+// LessPartPath returns true if part path a (e.g. "1.2") precedes b.
+func LessPartPath(a, b string) bool {
+	as, bs := strings.Split(a, "."), strings.Split(b, ".")
+	for i := 0; i < len(as) && i < len(bs); i++ {
+		an, _ := strconv.Atoi(as[i])
+		bn, _ := strconv.Atoi(bs[i])
+		if an != bn {
+			return an < bn
+		}
+	}
+	return len(as) < len(bs)
+}
@@ -0,0 +1,29 @@
+// Copyright 2022 Daniel Erat.
+// All rights reserved.
+
+package rewrite
+
+// passesThrough returns true if opts can't cause any changes to a message. In that case,
+// Rewrite only parses the top-level header (e.g. to check that it's terminated by a blank
+// line) before copying the rest of the message unchanged.
+//
+// Options that only have an effect when parts are deleted (e.g. AddPlaceholder and
+// ReplaceDeleted), that only configure other options (e.g. KeepMediaTypes), or that are
+// handled while copying the top-level header (StripLeadingJunk and StripMboxFrom) are ignored,
+// as are ValidateOutput and VerifyIdempotent, which check Rewrite's output rather than changing it.
+// Options that inspect or validate the message (e.g. Strict, "fail" for the On* fields,
+// "repair" for OnMultipartCTE, and the Max* limits) disable passthrough, since they
+// require the full message to be parsed.
+func (opts *Options) passesThrough() bool {
+	return opts.AddDeliveredTo == "" && opts.BackupRecord == "" && opts.BackupWarning == "" &&
+		!opts.CheckHeaders && !opts.DedupContentType && !opts.DeleteEncrypted && len(opts.DeleteMediaTypes) == 0 &&
+		len(opts.DeleteParts) == 0 && !opts.DropEpilogue && (opts.LineEndings == "" || opts.LineEndings == "keep") &&
+		!opts.MarkEncrypted && opts.MaxDepth == 0 && opts.MaxHeaderSize == 0 &&
+		opts.MaxLineLength == 0 && opts.MaxParts == 0 && opts.MaxUnfoldedLength == 0 &&
+		!opts.DecodeSubject && !opts.Encode8BitHeader && !opts.ExtractList &&
+		!opts.FixBoundaries && !opts.FlattenMultipart && opts.RedactRecipients == "" && !opts.RewriteBoundaries &&
+		len(opts.Rules) == 0 && !opts.SortHeaders && !opts.failsForErrors() && !opts.repairsMultipartCTE() &&
+		!opts.StripAppleDouble && !opts.StripReceipts &&
+		len(opts.StripHeaders) == 0 && opts.SubjectTag == "" && !opts.rewritesLeaves() &&
+		opts.PGPKeys == nil && opts.Policy == nil && opts.Visit == nil && opts.TeePart == nil
+}
@@ -0,0 +1,117 @@
+// Copyright 2022 Daniel Erat.
+// All rights reserved.
+
+package rewrite
+
+import (
+	"bytes"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestOptions_passesThrough(t *testing.T) {
+	// Fields that can't change messages on their own or that only affect the top-level header,
+	// which is still processed in passthrough mode.
+	ignored := map[string]bool{
+		"AddPlaceholder":   true,
+		"Charsets":         true,
+		"DataURIMinSize":   true,
+		"Findings":         true,
+		"KeepMediaTypes":   true,
+		"Log":              true,
+		"Now":              true,
+		"PGPOutput":        true,
+		"Profile":          true,
+		"RedactKey":        true,
+		"ReplaceDeleted":   true,
+		"StripLeadingJunk": true,
+		"StripMboxFrom":    true,
+		"ValidateOutput":   true,
+		"VerifyIdempotent": true,
+		"WhenAuth":         true,
+	}
+
+	var opts Options
+	if !opts.passesThrough() {
+		t.Error("passesThrough() = false for default options")
+	}
+	for _, v := range []string{"", "keep"} {
+		if opts := (Options{LineEndings: v}); !opts.passesThrough() {
+			t.Errorf("passesThrough() = false for LineEndings %q", v)
+		}
+	}
+
+	if opts := (Options{OnMultipartCTE: errorRepair}); opts.passesThrough() {
+		t.Errorf("passesThrough() = true for OnMultipartCTE %q", errorRepair)
+	}
+
+	// Check that all other exported fields disable passthrough so that new options aren't missed.
+	typ := reflect.TypeOf(opts)
+	for i := 0; i < typ.NumField(); i++ {
+		field := typ.Field(i)
+		if field.PkgPath != "" || ignored[field.Name] {
+			continue
+		}
+		var opts Options
+		fv := reflect.ValueOf(&opts).Elem().Field(i)
+		switch fv.Kind() {
+		case reflect.Bool:
+			fv.SetBool(true)
+		case reflect.Int:
+			fv.SetInt(1)
+		case reflect.String:
+			if strings.HasPrefix(field.Name, "On") {
+				fv.SetString(errorFail) // other actions don't require parsing
+			} else {
+				fv.SetString("x")
+			}
+		case reflect.Slice:
+			fv.Set(reflect.MakeSlice(fv.Type(), 1, 1))
+		case reflect.Func:
+			fv.Set(reflect.MakeFunc(fv.Type(), func([]reflect.Value) []reflect.Value { return nil }))
+		case reflect.Interface:
+			if field.Name != "Policy" {
+				t.Fatalf("Don't know how to set %v", field.Name)
+			}
+			opts.Policy = &MediaTypePolicy{}
+		default:
+			t.Fatalf("Don't know how to set %v of kind %v", field.Name, fv.Kind())
+		}
+		if opts.passesThrough() {
+			t.Errorf("passesThrough() = true with %v set", field.Name)
+		}
+	}
+}
+
+func TestRewrite_passthrough(t *testing.T) {
+	// Passthrough doesn't notice the missing closing delimiter.
+	const in = "From: a@example.org\n" +
+		"Content-Type: multipart/mixed; boundary=abc\n" +
+		"\n" +
+		"--abc\n" +
+		"Content-Type: image/png\n" +
+		"\n" +
+		"data\n"
+	var b bytes.Buffer
+	rep, err := Rewrite(strings.NewReader(in), &b, &Options{})
+	if err != nil {
+		t.Fatal("Rewrite failed:", err)
+	}
+	if got := b.String(); got != in {
+		t.Errorf("Rewrite produced %q; want %q", got, in)
+	}
+	if rep.Parts != 1 || rep.Malformed || rep.BytesIn != int64(len(in)) || rep.BytesOut != int64(len(in)) {
+		t.Errorf("Rewrite reported %+v", rep)
+	}
+
+	// The top-level header is still checked.
+	rep, err = Rewrite(strings.NewReader("From: a@example.org\n"), ioutil.Discard, &Options{})
+	if err != nil {
+		t.Fatal("Rewrite failed:", err)
+	}
+	if !rep.Malformed {
+		t.Error("Rewrite didn't report message without body as malformed")
+	}
+}
@@ -0,0 +1,196 @@
+// Copyright 2022 Daniel Erat.
+// All rights reserved.
+
+package rewrite
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	// x/crypto/openpgp is deprecated and frozen, but it's the only OpenPGP implementation
+	// that works with this module's Go version. Its maintained fork,
+	// github.com/ProtonMail/go-crypto, requires a newer version of Go, as do current
+	// x/crypto releases.
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+	_ "golang.org/x/crypto/ripemd160" // openpgp.Encrypt falls back to RIPEMD-160 for keys without hash preferences
+)
+
+// LoadPGPKeys reads an armored or binary OpenPGP keyring containing secret keys from p.
+// If passphrase is non-empty, it's used to decrypt the private keys.
+func LoadPGPKeys(p string, passphrase []byte) (openpgp.EntityList, error) {
+	b, err := ioutil.ReadFile(p)
+	if err != nil {
+		return nil, err
+	}
+	keys, err := openpgp.ReadArmoredKeyRing(bytes.NewReader(b))
+	if err != nil {
+		if keys, err = openpgp.ReadKeyRing(bytes.NewReader(b)); err != nil {
+			return nil, err
+		}
+	}
+	if len(keys.DecryptionKeys()) == 0 {
+		return nil, errors.New("no decryption keys")
+	}
+	for _, k := range keys.DecryptionKeys() {
+		if k.PrivateKey.Encrypted {
+			if len(passphrase) == 0 {
+				return nil, fmt.Errorf("key %X is encrypted", k.PrivateKey.KeyId)
+			}
+			if err := k.PrivateKey.Decrypt(passphrase); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return keys, nil
+}
+
+// isPGPEncrypted returns true if hdata describes a PGP/MIME encrypted part.
+func isPGPEncrypted(hdata *headerData) bool {
+	// RFC 3156 4:
+	//  The multipart/encrypted MIME body MUST consist of exactly two body parts, the
+	//  first with content type "application/pgp-encrypted". [...] The protocol
+	//  parameter MUST have a value of "application/pgp-encrypted".
+	return isEncrypted(hdata) &&
+		strings.ToLower(hdata.contentParams["protocol"]) == "application/pgp-encrypted"
+}
+
+// copyDecryptedPart reads the body of the PGP/MIME part described by hdata and hdr from lr,
+// decrypts it using opts.PGPKeys, and rewrites the decrypted part per opts. The part is written
+// to w either decrypted or re-encrypted depending on opts.PGPOutput. If the part can't be
+// decrypted, it's copied unchanged. The return values and delim have the same meaning as
+// in copyBody.
+//
+// Re-encrypted parts are only encrypted to opts.PGPKeys, so the sender and other recipients
+// can no longer decrypt them, and any signature within the encrypted data is dropped. To
+// avoid this (and to keep the output stable), the original encrypted data is written if
+// rewriting didn't change the decrypted part.
+func copyDecryptedPart(lr *lineReader, w io.Writer, hdr []byte, hdata *headerData, delim string,
+	st *msgState, opts *Options) (end bool, err error) {
+	var body bytes.Buffer
+	delimLine, end, err := readBody(lr, &body, delim)
+	writeAll := func(bufs ...[]byte) error {
+		for _, b := range bufs {
+			if _, err := w.Write(b); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err != nil {
+		if werr := writeAll(hdr, body.Bytes()); werr != nil {
+			return false, werr
+		}
+		return false, err
+	}
+	orig := func() (bool, error) {
+		return end, writeAll(hdr, body.Bytes(), []byte(delimLine))
+	}
+
+	plain, err := decryptPGPMIME(append(append([]byte{}, hdr...), body.Bytes()...), opts.PGPKeys)
+	if err != nil {
+		opts.Logger().Infof("Not decrypting part: %v", err)
+		return orig()
+	}
+	// RFC 3156 3 requires the encrypted data to use CRLF line endings.
+	if hdata.term == "\n" {
+		plain = bytes.ReplaceAll(plain, []byte("\r\n"), []byte("\n"))
+	}
+
+	var out bytes.Buffer
+	plr := newLineReader(bytes.NewReader(plain))
+	defer plr.release()
+	if _, _, err := copyMessagePart(plr, &out, "", hdata, st, opts); err != nil {
+		if merr, ok := err.(*MessageError); ok && opts.errorAction(merr.Category) == errorFail {
+			return false, err
+		}
+		opts.Logger().Infof("Not rewriting decrypted part: %v", err)
+		return orig()
+	}
+	dec := out.Bytes()
+	if opts.PGPOutput == "encrypted" && bytes.Equal(dec, plain) {
+		return orig()
+	}
+	if len(dec) > 0 && dec[len(dec)-1] != '\n' && delimLine != "" {
+		dec = append(dec, hdata.term...)
+	}
+
+	if opts.PGPOutput == "encrypted" {
+		enc, err := encryptPGPMIME(dec, hdata.contentParams["boundary"], hdata.term, opts.PGPKeys)
+		if err != nil {
+			return false, err
+		}
+		opts.Logger().Infof("Re-encrypting part")
+		return end, writeAll(hdr, enc, []byte(delimLine))
+	}
+
+	// Replace the multipart/encrypted part's Content-* fields with the decrypted part's.
+	opts.Logger().Infof("Decrypting part")
+	dhdr, dbody := splitHeader(dec)
+	outer, _ := splitContentFields(string(hdr))
+	_, inner := splitContentFields(string(dhdr))
+	return end, writeAll([]byte(outer), []byte(inner), []byte(hdata.term), dbody, []byte(delimLine))
+}
+
+// decryptPGPMIME decrypts part, a complete multipart/encrypted PGP/MIME part,
+// and returns the decrypted MIME entity.
+func decryptPGPMIME(part []byte, keys openpgp.EntityList) ([]byte, error) {
+	parts := FindParts(part)
+	p, ok := parts["2"]
+	if !ok {
+		return nil, errors.New("missing encrypted data part")
+	}
+	_, data := splitHeader(part[p.Start:p.End])
+	block, err := armor.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	md, err := openpgp.ReadMessage(block.Body, keys, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(md.UnverifiedBody)
+}
+
+// encryptPGPMIME encrypts plain, a MIME entity, to keys and returns the body of a
+// multipart/encrypted part with the supplied boundary. Lines are terminated by term.
+func encryptPGPMIME(plain []byte, bnd, term string, keys openpgp.EntityList) ([]byte, error) {
+	var armored bytes.Buffer
+	aw, err := armor.Encode(&armored, "PGP MESSAGE", nil)
+	if err != nil {
+		return nil, err
+	}
+	pw, err := openpgp.Encrypt(aw, keys, nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	// Canonicalize line endings to CRLF before encrypting.
+	plain = bytes.ReplaceAll(bytes.ReplaceAll(plain, []byte("\r\n"), []byte("\n")), []byte("\n"), []byte("\r\n"))
+	if _, err := pw.Write(plain); err != nil {
+		return nil, err
+	}
+	if err := pw.Close(); err != nil {
+		return nil, err
+	}
+	if err := aw.Close(); err != nil {
+		return nil, err
+	}
+
+	var b bytes.Buffer
+	b.WriteString("--" + bnd + term)
+	b.WriteString("Content-Type: application/pgp-encrypted" + term)
+	b.WriteString(term)
+	b.WriteString("Version: 1" + term)
+	b.WriteString(term)
+	b.WriteString("--" + bnd + term)
+	b.WriteString("Content-Type: application/octet-stream" + term)
+	b.WriteString(term)
+	b.Write(bytes.ReplaceAll(armored.Bytes(), []byte("\n"), []byte(term)))
+	b.WriteString(term)
+	b.WriteString("--" + bnd + "--" + term)
+	return b.Bytes(), nil
+}
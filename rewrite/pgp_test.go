@@ -0,0 +1,114 @@
+// Copyright 2022 Daniel Erat.
+// All rights reserved.
+
+package rewrite
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/openpgp"
+)
+
+func TestPGPDecrypt(t *testing.T) {
+	ent, err := openpgp.NewEntity("Me", "", "me@example.org", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := openpgp.EntityList{ent}
+
+	const inner = "Content-Type: multipart/mixed; boundary=\"in\"\n" +
+		"\n" +
+		"--in\n" +
+		"Content-Type: text/plain\n" +
+		"\n" +
+		"Secret text\n" +
+		"--in\n" +
+		"Content-Type: image/png\n" +
+		"Content-Transfer-Encoding: base64\n" +
+		"\n" +
+		"iVBORw0KGgo=\n" +
+		"--in--\n"
+	enc, err := encryptPGPMIME([]byte(inner), "enc", "\n", keys)
+	if err != nil {
+		t.Fatal("encryptPGPMIME failed:", err)
+	}
+	msg := "From: sender@example.org\n" +
+		"Subject: ...\n" +
+		"MIME-Version: 1.0\n" +
+		"Content-Type: multipart/encrypted; protocol=\"application/pgp-encrypted\"; boundary=\"enc\"\n" +
+		"\n" + string(enc)
+
+	opts := Options{
+		DeleteMediaTypes: []string{"image/*"},
+		Now:              time.Date(2022, 4, 15, 15, 19, 4, 0, time.UTC),
+		PGPKeys:          keys,
+	}
+	var dec bytes.Buffer
+	if _, err := Rewrite(strings.NewReader(msg), &dec, &opts); err != nil {
+		t.Fatal("Rewrite failed:", err)
+	}
+	want := "From: sender@example.org\n" +
+		"Subject: ...\n" +
+		"MIME-Version: 1.0\n" +
+		"Content-Type: multipart/mixed; boundary=\"in\"\n" +
+		"\n" +
+		"--in\n" +
+		"Content-Type: text/plain\n" +
+		"\n" +
+		"Secret text\n" +
+		"--in\n" +
+		"Content-Type: message/external-body; access-type=x-rendmail-deleted;\n" +
+		"\texpiration=\"Fri, 15 Apr 2022 15:19:04 +0000\"\n" +
+		"\n" +
+		"Content-Type: image/png\n" +
+		"Content-Transfer-Encoding: base64\n" +
+		"\n" +
+		"--in--\n"
+	if got := dec.String(); got != want {
+		t.Errorf("Decrypted message:\n%s\nwant:\n%s", got, want)
+	}
+
+	// With encrypted output, the rewritten part should be re-encrypted.
+	opts.PGPOutput = "encrypted"
+	var reenc bytes.Buffer
+	if _, err := Rewrite(strings.NewReader(msg), &reenc, &opts); err != nil {
+		t.Fatal("Rewrite failed:", err)
+	}
+	if strings.Contains(reenc.String(), "Secret text") {
+		t.Errorf("Re-encrypted message contains plaintext:\n%s", reenc.String())
+	}
+	plain, err := decryptPGPMIME(reenc.Bytes(), keys)
+	if err != nil {
+		t.Fatal("decryptPGPMIME failed:", err)
+	}
+	if got := strings.ReplaceAll(string(plain), "\r\n", "\n"); !strings.Contains(got, "access-type=x-rendmail-deleted") {
+		t.Errorf("Re-encrypted message doesn't contain deleted part:\n%s", got)
+	}
+
+	// If nothing in the decrypted part changes, the original encrypted data should be
+	// written so that other recipients can still decrypt it and the output is idempotent.
+	opts.DeleteMediaTypes = nil
+	opts.VerifyIdempotent = true
+	var same bytes.Buffer
+	if _, err := Rewrite(strings.NewReader(msg), &same, &opts); err != nil {
+		t.Fatal("Rewrite failed:", err)
+	} else if same.String() != msg {
+		t.Errorf("Unchanged encrypted message was changed:\n%s", same.String())
+	}
+
+	// Messages encrypted to other keys should be passed through unchanged.
+	other, err := openpgp.NewEntity("Other", "", "other@example.org", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts.PGPKeys = openpgp.EntityList{other}
+	var out bytes.Buffer
+	if _, err := Rewrite(strings.NewReader(msg), &out, &opts); err != nil {
+		t.Fatal("Rewrite failed:", err)
+	} else if out.String() != msg {
+		t.Errorf("Message encrypted to other key was changed:\n%s", out.String())
+	}
+}
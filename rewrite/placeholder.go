@@ -0,0 +1,64 @@
+// Copyright 2022 Daniel Erat.
+// All rights reserved.
+
+package rewrite
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// DeletedPart describes a message part that was deleted.
+type DeletedPart struct {
+	MediaType string `json:"type"`               // e.g. "audio/wav"
+	Size      int64  `json:"size"`               // size of the part's (encoded) body in bytes
+	Filename  string `json:"filename,omitempty"` // decoded filename, if known
+	Path      string `json:"path"`               // position in MIME tree of the part (or of the part embedding it)
+}
+
+// byteCounter is an io.Writer that discards data but counts the bytes written to it.
+type byteCounter int64
+
+func (bc *byteCounter) Write(p []byte) (int, error) {
+	*bc += byteCounter(len(p))
+	return len(p), nil
+}
+
+// placeholderText returns a plain-text description of the deleted parts.
+// Lines are terminated by term.
+func placeholderText(parts []DeletedPart, now time.Time, term string) string {
+	var b strings.Builder
+	b.WriteString("All displayable parts of this message were deleted on " +
+		now.Format(time.RFC1123Z) + ":" + term)
+	b.WriteString(term)
+	for _, p := range parts {
+		b.WriteString(fmt.Sprintf("  %v (%d bytes)", p.MediaType, p.Size) + term)
+	}
+	return b.String()
+}
+
+// addPlaceholder returns body, the body of the top-level multipart part with delimiter
+// subDelim, with a text/plain part describing the deleted parts inserted before its closing
+// delimiter if no displayable parts remain. body is returned unchanged otherwise.
+func addPlaceholder(body []byte, subDelim, term string, st *msgState, opts *Options) []byte {
+	if !opts.AddPlaceholder || st.kept > 0 || len(st.deleted) == 0 {
+		return body
+	}
+	close := []byte(subDelim + "--")
+	i := bytes.LastIndex(body, close)
+	if i < 0 || (i > 0 && body[i-1] != '\n') {
+		return body // missing closing delimiter
+	}
+
+	var b bytes.Buffer
+	b.Write(body[:i])
+	b.WriteString(subDelim + term)
+	b.WriteString("Content-Type: text/plain; charset=us-ascii" + term)
+	b.WriteString("Content-Disposition: inline" + term)
+	b.WriteString(term)
+	b.WriteString(placeholderText(st.deleted, opts.Now, term))
+	b.Write(body[i:])
+	return b.Bytes()
+}
@@ -0,0 +1,33 @@
+// Copyright 2022 Daniel Erat.
+// All rights reserved.
+
+package rewrite
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAddPlaceholder(t *testing.T) {
+	opts := Options{AddPlaceholder: true, Now: time.Date(2022, 4, 15, 15, 19, 4, 0, time.UTC)}
+	deleted := []DeletedPart{{MediaType: "audio/wav", Size: 1234}, {MediaType: "video/mp4", Size: 5678}}
+	const body = "preamble\n--b\nContent-Type: message/external-body\n\n--b--\n"
+	for _, tc := range []struct {
+		body string
+		st   msgState
+		want string
+	}{
+		{body, msgState{deleted: deleted}, "preamble\n--b\nContent-Type: message/external-body\n\n" +
+			"--b\nContent-Type: text/plain; charset=us-ascii\nContent-Disposition: inline\n\n" +
+			"All displayable parts of this message were deleted on Fri, 15 Apr 2022 15:19:04 +0000:\n\n" +
+			"  audio/wav (1234 bytes)\n  video/mp4 (5678 bytes)\n--b--\n"},
+		{body, msgState{deleted: deleted, kept: 1}, body},
+		{body, msgState{}, body},
+		{"--b\nA: b\n\n", msgState{deleted: deleted}, "--b\nA: b\n\n"},
+	} {
+		st := tc.st
+		if got := string(addPlaceholder([]byte(tc.body), "--b", "\n", &st, &opts)); got != tc.want {
+			t.Errorf("addPlaceholder(%q, ...) with %+v = %q; want %q", tc.body, tc.st, got, tc.want)
+		}
+	}
+}
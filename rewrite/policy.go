@@ -0,0 +1,58 @@
+// Copyright 2022 Daniel Erat.
+// All rights reserved.
+
+package rewrite
+
+// Policy decides whether message parts should be deleted.
+type Policy interface {
+	// ShouldDelete returns true if part should be deleted.
+	// An error aborts rewriting of the message.
+	ShouldDelete(part *PartInfo) (bool, error)
+}
+
+// PolicyFunc adapts an ordinary function to the Policy interface.
+type PolicyFunc func(part *PartInfo) (bool, error)
+
+func (f PolicyFunc) ShouldDelete(part *PartInfo) (bool, error) { return f(part) }
+
+// MediaTypePolicy deletes parts whose media types are matched by a glob
+// in Delete and not matched by any globs in Keep.
+type MediaTypePolicy struct {
+	Delete []string // e.g. "image/*"
+	Keep   []string // overrides Delete, e.g. "image/svg+xml"
+}
+
+func (p *MediaTypePolicy) ShouldDelete(part *PartInfo) (bool, error) {
+	return shouldDelete(part.MediaType, p.Delete, p.Keep)
+}
+
+// AnyPolicy deletes parts that are deleted by any of its policies.
+type AnyPolicy []Policy
+
+func (ps AnyPolicy) ShouldDelete(part *PartInfo) (bool, error) {
+	for _, p := range ps {
+		if del, err := p.ShouldDelete(part); err != nil || del {
+			return del, err
+		}
+	}
+	return false, nil
+}
+
+// applyPolicy evaluates opts.Policy for the part described by hdata, whose full
+// header is hdr. If the part should be deleted, hdata.deletePart is set and the
+// header of the replacement part is returned. Otherwise, hdr is returned.
+func applyPolicy(hdr []byte, hdata *headerData, st *msgState, opts *Options) ([]byte, error) {
+	if opts.Policy == nil || hdata.deletePart || isDeletedStub(hdata) {
+		return hdr, nil
+	}
+	if del, err := opts.Policy.ShouldDelete(newPartInfo(hdata, hdr)); err != nil || !del {
+		return hdr, err
+	}
+	if !st.auth.matches(opts.WhenAuth) {
+		opts.Logger().Infof("Not deleting %v due to %q auth verdict", hdata.mediaType, st.auth)
+		return hdr, nil
+	}
+	opts.Logger().Infof("Deleting %v", hdata.mediaType)
+	hdata.deletePart = true
+	return deletedHeader(hdr, hdata, opts)
+}
@@ -0,0 +1,75 @@
+// Copyright 2022 Daniel Erat.
+// All rights reserved.
+
+package rewrite
+
+import (
+	"bytes"
+	"errors"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPolicy(t *testing.T) {
+	// Content-Disposition follows Content-Type, so the filename is only known
+	// after the full header has been read.
+	const msg = "From: a@example.org\n" +
+		"Content-Type: multipart/mixed; boundary=abc\n" +
+		"\n" +
+		"--abc\n" +
+		"Content-Type: text/plain\n" +
+		"\n" +
+		"Hello\n" +
+		"--abc\n" +
+		"Content-Type: application/octet-stream\n" +
+		"Content-Disposition: attachment; filename=evil.exe\n" +
+		"\n" +
+		"MZ\n" +
+		"--abc--\n"
+
+	byExt := PolicyFunc(func(p *PartInfo) (bool, error) {
+		return path.Ext(p.Filename) == ".exe", nil
+	})
+	var out bytes.Buffer
+	opts := Options{Now: time.Now(), Policy: AnyPolicy{&MediaTypePolicy{Delete: []string{"image/*"}}, byExt}}
+	rep, err := Rewrite(strings.NewReader(msg), &out, &opts)
+	if err != nil {
+		t.Fatal("Rewrite failed:", err)
+	}
+	got := out.String()
+	if strings.Contains(got, "\nMZ\n") || !strings.Contains(got, "access-type=x-rendmail-deleted") {
+		t.Errorf("Rewrite didn't delete .exe part:\n%s", got)
+	}
+	if !strings.Contains(got, "\nHello\n") {
+		t.Errorf("Rewrite deleted text part:\n%s", got)
+	}
+	if want := []DeletedPart{{"application/octet-stream", 3, "evil.exe", "2"}}; !reflect.DeepEqual(rep.Deleted, want) {
+		t.Errorf("Rewrite reported deleted parts %+v; want %+v", rep.Deleted, want)
+	}
+
+	fail := PolicyFunc(func(p *PartInfo) (bool, error) { return false, errors.New("intentional") })
+	if _, err := Rewrite(strings.NewReader(msg), &out, &Options{Now: time.Now(), Policy: fail}); err == nil {
+		t.Error("Rewrite unexpectedly succeeded with failing policy")
+	}
+}
+
+func TestMediaTypePolicy_ShouldDelete(t *testing.T) {
+	p := MediaTypePolicy{Delete: []string{"image/*"}, Keep: []string{"image/svg+xml"}}
+	for _, tc := range []struct {
+		mtype string
+		want  bool
+	}{
+		{"image/png", true},
+		{"image/svg+xml", false},
+		{"text/plain", false},
+	} {
+		if got, err := p.ShouldDelete(&PartInfo{MediaType: tc.mtype}); err != nil {
+			t.Errorf("ShouldDelete(%q) failed: %v", tc.mtype, err)
+		} else if got != tc.want {
+			t.Errorf("ShouldDelete(%q) = %v; want %v", tc.mtype, got, tc.want)
+		}
+	}
+}
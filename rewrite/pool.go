@@ -0,0 +1,39 @@
+// Copyright 2022 Daniel Erat.
+// All rights reserved.
+
+package rewrite
+
+import (
+	"bufio"
+	"bytes"
+	"sync"
+
+	"github.com/derat/rendmail/linereader"
+)
+
+// Pools of objects that would otherwise be allocated for each message or part.
+// These reduce GC pressure when many messages are rewritten by a single process.
+var (
+	lineReaderPool = sync.Pool{New: func() interface{} { return &lineReader{r: linereader.New(nil)} }}
+	writerPool     = sync.Pool{New: func() interface{} { return bufio.NewWriterSize(nil, outputBufferSize) }}
+	bufferPool     = sync.Pool{New: func() interface{} { return &bytes.Buffer{} }}
+)
+
+// maxPooledBufferSize is the capacity of the largest buffer returned to bufferPool.
+// Larger buffers are left for the garbage collector so the pool doesn't pin memory.
+const maxPooledBufferSize = 1024 * 1024
+
+// getBuffer returns an empty buffer from bufferPool.
+// putBuffer should be called when the buffer is no longer needed.
+func getBuffer() *bytes.Buffer {
+	b := bufferPool.Get().(*bytes.Buffer)
+	b.Reset()
+	return b
+}
+
+// putBuffer returns b to bufferPool. b's contents must not be used afterward.
+func putBuffer(b *bytes.Buffer) {
+	if b.Cap() <= maxPooledBufferSize {
+		bufferPool.Put(b)
+	}
+}
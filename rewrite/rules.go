@@ -0,0 +1,182 @@
+// Copyright 2022 Daniel Erat.
+// All rights reserved.
+
+package rewrite
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/mail"
+	"regexp"
+	"strings"
+)
+
+// Rule describes changes to make to Options for messages that satisfy
+// all of the rule's conditions. Unset conditions are ignored.
+type Rule struct {
+	Name string `json:"name"`
+
+	From    string `json:"from"`    // regexp matched against From
+	To      string `json:"to"`      // regexp matched against To, Cc, and Delivered-To
+	ListID  string `json:"listId"`  // regexp matched against List-Id
+	Subject string `json:"subject"` // regexp matched against decoded Subject
+	MinSize int    `json:"minSize"` // minimum message size in bytes
+	MaxSize int    `json:"maxSize"` // maximum message size in bytes
+	Auth    string `json:"auth"`    // Authentication-Results verdict ("pass", "fail", or "any"); see also Options.WhenAuth
+	Sieve   string `json:"sieve"`   // Sieve test, e.g. `header :contains "subject" "foo"`
+
+	DeleteTypes  []string `json:"deleteTypes"`  // globs appended to Options.DeleteMediaTypes
+	KeepTypes    []string `json:"keepTypes"`    // globs appended to Options.KeepMediaTypes
+	StripHeaders []string `json:"stripHeaders"` // appended to Options.StripHeaders
+	TagSubject   string   `json:"tagSubject"`   // appended to Options.SubjectTag
+}
+
+// Check returns an error if r's conditions are invalid.
+func (r *Rule) Check() error {
+	if _, err := compileRule(r); err != nil {
+		return err
+	}
+	switch r.Auth {
+	case "", "any", "pass", "fail":
+	default:
+		return fmt.Errorf("bad auth verdict %q", r.Auth)
+	}
+	if r.MinSize < 0 || r.MaxSize < 0 {
+		return fmt.Errorf("negative size")
+	}
+	return nil
+}
+
+// matches returns true if r's conditions (parsed into cr) are satisfied by
+// a message with the supplied header and size. wd decodes header fields.
+func (r *Rule) matches(cr *compiledRule, wd *mime.WordDecoder, hdr mail.Header, size int) bool {
+	if r.MinSize > 0 && size < r.MinSize {
+		return false
+	}
+	if r.MaxSize > 0 && size > r.MaxSize {
+		return false
+	}
+	if !parseAuthResults(hdr.Get("Authentication-Results")).matches(r.Auth) {
+		return false
+	}
+	if cr.sieve != nil && !cr.sieve.eval(hdr, size) {
+		return false
+	}
+	for _, c := range []struct {
+		re   *regexp.Regexp
+		keys []string
+	}{
+		{cr.from, []string{"From"}},
+		{cr.to, []string{"To", "Cc", "Delivered-To"}},
+		{cr.listID, []string{"List-Id"}},
+		{cr.subject, []string{"Subject"}},
+	} {
+		if c.re == nil {
+			continue
+		}
+		matched := false
+		for _, k := range c.keys {
+			for _, v := range hdr[k] {
+				if dec, err := wd.DecodeHeader(v); err == nil {
+					v = dec
+				}
+				if c.re.MatchString(v) {
+					matched = true
+				}
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	return true
+}
+
+// applyRules returns a copy of opts updated by the rules in opts.Rules
+// that match the message in msg. opts is returned if no rules match.
+func applyRules(msg []byte, opts *Options) (*Options, error) {
+	// The header is parsed separately (rather than by copyHeader)
+	// so that rules can affect how it's written.
+	m, err := mail.ReadMessage(bytes.NewReader(trimLeadingJunk(msg)))
+	if err != nil {
+		// Leave it to Rewrite to complain about malformed messages.
+		return opts, nil
+	}
+	n := *opts
+	matched := false
+	wd := opts.headerDecoder()
+	for _, r := range opts.Rules {
+		if cr, err := opts.compiledRule(r); err != nil {
+			return nil, fmt.Errorf("rule %q: %v", r.Name, err)
+		} else if !r.matches(cr, wd, m.Header, len(msg)) {
+			continue
+		}
+		opts.Logger().Infof("Applying rule %q", r.Name)
+		if opts.report != nil {
+			opts.report.Rules = append(opts.report.Rules, r.Name)
+		}
+		// Make copies to avoid modifying opts's slices.
+		if !matched {
+			n.DeleteMediaTypes = append([]string(nil), opts.DeleteMediaTypes...)
+			n.KeepMediaTypes = append([]string(nil), opts.KeepMediaTypes...)
+			n.StripHeaders = append([]string(nil), opts.StripHeaders...)
+			matched = true
+		}
+		n.DeleteMediaTypes = append(n.DeleteMediaTypes, r.DeleteTypes...)
+		n.KeepMediaTypes = append(n.KeepMediaTypes, r.KeepTypes...)
+		n.StripHeaders = append(n.StripHeaders, r.StripHeaders...)
+		if r.TagSubject != "" {
+			if n.SubjectTag != "" {
+				n.SubjectTag += " "
+			}
+			n.SubjectTag += r.TagSubject
+		}
+	}
+	if !matched {
+		return opts, nil
+	}
+	return &n, nil
+}
+
+// readForRules reads the whole message from r if opts contains rules or a WhenAuth
+// condition that need to be evaluated against the top-level header, returning an updated
+// reader and options. st.auth is also set if needed.
+//
+// WhenAuth is evaluated here rather than while copying the header so that deletion
+// decisions (made as soon as Content-Type is seen) aren't affected by field order.
+// It differs from Rule.Auth, which only controls whether a rule's changes are applied:
+// WhenAuth also prevents deletion by DeleteMediaTypes, DeleteParts, Policy, and so on.
+func readForRules(r io.Reader, opts *Options, st *msgState) (io.Reader, *Options, error) {
+	if len(opts.Rules) == 0 && !opts.checksAuth() {
+		return r, opts, nil
+	}
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	if opts.checksAuth() {
+		st.auth = topAuthVerdict(b)
+	}
+	if opts, err = applyRules(b, opts); err != nil {
+		return nil, nil, err
+	}
+	return bytes.NewReader(b), opts, nil
+}
+
+// tagSubject returns the Subject value val with tag prepended.
+// val is returned unchanged if it already contains tag.
+func tagSubject(val, tag string) string {
+	if dec, err := headerDecoder.DecodeHeader(val); err == nil && strings.Contains(dec, tag) {
+		return val
+	}
+	if !isASCII(tag) {
+		tag = mime.QEncoding.Encode("utf-8", tag)
+	}
+	if val == "" {
+		return tag
+	}
+	return tag + " " + val
+}
@@ -0,0 +1,79 @@
+// Copyright 2022 Daniel Erat.
+// All rights reserved.
+
+package rewrite
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestApplyRules(t *testing.T) {
+	const msg = "From: Alice <alice@example.org>\n" +
+		"To: bob@example.com\n" +
+		"Cc: =?utf-8?q?Caf=C3=A9?= <cafe@example.net>\n" +
+		"List-Id: Friends <friends.lists.example.org>\n" +
+		"Subject: =?utf-8?q?Caf=C3=A9_news?=\n" +
+		"Authentication-Results: mx.example.com; dkim=pass\n" +
+		"\n" +
+		"Body\n"
+
+	base := Options{DeleteMediaTypes: []string{"video/*"}, SubjectTag: "[a]"}
+	for _, tc := range []struct {
+		rule   Rule
+		match  bool
+		expect func(o *Options) bool
+	}{
+		{Rule{From: `alice@`}, true, nil},
+		{Rule{From: `bob@`}, false, nil},
+		{Rule{To: `^Café`}, true, nil}, // matches decoded Cc
+		{Rule{To: `carol@`}, false, nil},
+		{Rule{ListID: `friends\.lists`}, true, nil},
+		{Rule{Subject: `^Café news$`}, true, nil},
+		{Rule{MinSize: 10}, true, nil},
+		{Rule{MinSize: 10000}, false, nil},
+		{Rule{MaxSize: 10}, false, nil},
+		{Rule{Auth: "pass"}, true, nil},
+		{Rule{Auth: "fail"}, false, nil},
+		{Rule{From: `alice@`, Auth: "fail"}, false, nil},
+		{Rule{Sieve: `address :domain :is "from" "example.org"`}, true, nil},
+		{Rule{From: `alice@`, Sieve: `size :over 1M`}, false, nil},
+		{Rule{From: `alice@`, DeleteTypes: []string{"image/*"}, StripHeaders: []string{"Cc"}, TagSubject: "[b]"},
+			true, func(o *Options) bool {
+				return reflect.DeepEqual(o.DeleteMediaTypes, []string{"video/*", "image/*"}) &&
+					reflect.DeepEqual(o.StripHeaders, []string{"Cc"}) && o.SubjectTag == "[a] [b]"
+			}},
+	} {
+		opts := base
+		opts.Rules = []*Rule{&tc.rule}
+		got, err := applyRules([]byte(msg), &opts)
+		if err != nil {
+			t.Errorf("applyRules(..., %+v) failed: %v", tc.rule, err)
+			continue
+		}
+		if matched := got != &opts; matched != tc.match {
+			t.Errorf("applyRules(..., %+v) matched = %v; want %v", tc.rule, matched, tc.match)
+		} else if tc.expect != nil && !tc.expect(got) {
+			t.Errorf("applyRules(..., %+v) returned %+v", tc.rule, got)
+		}
+		if !reflect.DeepEqual(opts.DeleteMediaTypes, base.DeleteMediaTypes) {
+			t.Errorf("applyRules(..., %+v) modified original options", tc.rule)
+		}
+	}
+}
+
+func TestTagSubject(t *testing.T) {
+	for _, tc := range []struct {
+		val, tag, want string
+	}{
+		{"Hello", "[list]", "[list] Hello"},
+		{"Re: [list] Hello", "[list]", "Re: [list] Hello"},
+		{"", "[list]", "[list]"},
+		{"=?utf-8?q?=5Blist=5D_Caf=C3=A9?=", "[list]", "=?utf-8?q?=5Blist=5D_Caf=C3=A9?="},
+		{"Hello", "[café]", "=?utf-8?q?[caf=C3=A9]?= Hello"},
+	} {
+		if got := tagSubject(tc.val, tc.tag); got != tc.want {
+			t.Errorf("tagSubject(%q, %q) = %q; want %q", tc.val, tc.tag, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,489 @@
+// Copyright 2022 Daniel Erat.
+// All rights reserved.
+
+package rewrite
+
+import (
+	"errors"
+	"fmt"
+	"net/mail"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// sieveTest is a test from the Sieve language (RFC 5228) that can be evaluated against a message.
+// Only a subset of the language is supported: the "header", "address", "exists", "size",
+// "allof", "anyof", "not", "true", and "false" tests, the ":is", ":contains", and ":matches"
+// match types, the "i;ascii-casemap" and "i;octet" comparators, and the ":all", ":localpart",
+// and ":domain" address parts. Actions and control commands aren't supported.
+type sieveTest interface {
+	eval(hdr mail.Header, size int) bool
+}
+
+// parseSieveTest parses a single Sieve test from s, e.g.
+// `allof (header :contains "list-id" "example.org", size :over 100K)`.
+func parseSieveTest(s string) (sieveTest, error) {
+	toks, err := lexSieve(s)
+	if err != nil {
+		return nil, err
+	}
+	p := sieveParser{toks: toks}
+	t, err := p.test()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos != len(p.toks) {
+		return nil, fmt.Errorf("unexpected %v after test", p.toks[p.pos])
+	}
+	return t, nil
+}
+
+// sieveTokenType describes the type of a sieveToken.
+type sieveTokenType int
+
+const (
+	sieveIdent  sieveTokenType = iota // e.g. "header"
+	sieveTag                          // e.g. ":contains" (val omits colon)
+	sieveString                       // quoted string (val is unescaped)
+	sieveNumber                       // e.g. "100K" (num contains value)
+	sievePunct                        // "(", ")", "[", "]", or ","
+)
+
+// sieveToken is a token produced by lexSieve.
+type sieveToken struct {
+	typ sieveTokenType
+	val string
+	num int
+}
+
+func (t sieveToken) String() string {
+	switch t.typ {
+	case sieveTag:
+		return ":" + t.val
+	case sieveString:
+		return strconv.Quote(t.val)
+	default:
+		return t.val
+	}
+}
+
+// lexSieve splits s into tokens. Comments are dropped.
+func lexSieve(s string) ([]sieveToken, error) {
+	var toks []sieveToken
+	isIdentChar := func(ch byte) bool {
+		return ch == '_' || ch >= 'a' && ch <= 'z' || ch >= 'A' && ch <= 'Z' || ch >= '0' && ch <= '9'
+	}
+	for i := 0; i < len(s); {
+		ch := s[i]
+		switch {
+		case ch == ' ' || ch == '\t' || ch == '\r' || ch == '\n':
+			i++
+		case ch == '#':
+			for i < len(s) && s[i] != '\n' {
+				i++
+			}
+		case strings.HasPrefix(s[i:], "/*"):
+			end := strings.Index(s[i+2:], "*/")
+			if end < 0 {
+				return nil, errors.New("unterminated comment")
+			}
+			i += end + 4
+		case strings.IndexByte("()[],", ch) >= 0:
+			toks = append(toks, sieveToken{typ: sievePunct, val: string(ch)})
+			i++
+		case ch == '"':
+			var sb strings.Builder
+			i++
+			for ; i < len(s) && s[i] != '"'; i++ {
+				// RFC 5228 2.4.2: A backslash followed by any character is that character.
+				if s[i] == '\\' && i+1 < len(s) {
+					i++
+				}
+				sb.WriteByte(s[i])
+			}
+			if i == len(s) {
+				return nil, errors.New("unterminated string")
+			}
+			toks = append(toks, sieveToken{typ: sieveString, val: sb.String()})
+			i++
+		case ch >= '0' && ch <= '9':
+			start := i
+			for i < len(s) && s[i] >= '0' && s[i] <= '9' {
+				i++
+			}
+			n, err := strconv.Atoi(s[start:i])
+			if err != nil {
+				return nil, err
+			}
+			if i < len(s) {
+				switch s[i] {
+				case 'K', 'k':
+					n <<= 10
+					i++
+				case 'M', 'm':
+					n <<= 20
+					i++
+				case 'G', 'g':
+					n <<= 30
+					i++
+				}
+			}
+			toks = append(toks, sieveToken{typ: sieveNumber, val: s[start:i], num: n})
+		case ch == ':' || isIdentChar(ch):
+			start := i
+			i++
+			for i < len(s) && isIdentChar(s[i]) {
+				i++
+			}
+			if ch == ':' {
+				if i == start+1 {
+					return nil, errors.New("empty tag")
+				}
+				toks = append(toks, sieveToken{typ: sieveTag, val: strings.ToLower(s[start+1 : i])})
+			} else {
+				toks = append(toks, sieveToken{typ: sieveIdent, val: strings.ToLower(s[start:i])})
+			}
+		default:
+			return nil, fmt.Errorf("unexpected character %q", ch)
+		}
+	}
+	return toks, nil
+}
+
+// sieveParser parses tokens produced by lexSieve.
+type sieveParser struct {
+	toks []sieveToken
+	pos  int
+}
+
+// peek returns the next token without consuming it.
+// ok is false if there are no more tokens.
+func (p *sieveParser) peek() (tok sieveToken, ok bool) {
+	if p.pos >= len(p.toks) {
+		return sieveToken{}, false
+	}
+	return p.toks[p.pos], true
+}
+
+// punct consumes the next token if it's the punctuation character ch.
+func (p *sieveParser) punct(ch string) bool {
+	if tok, ok := p.peek(); ok && tok.typ == sievePunct && tok.val == ch {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+// test parses a test.
+func (p *sieveParser) test() (sieveTest, error) {
+	tok, ok := p.peek()
+	if !ok {
+		return nil, errors.New("missing test")
+	} else if tok.typ != sieveIdent {
+		return nil, fmt.Errorf("expected test but got %v", tok)
+	}
+	p.pos++
+
+	switch tok.val {
+	case "true", "false":
+		return sieveConst(tok.val == "true"), nil
+	case "not":
+		t, err := p.test()
+		if err != nil {
+			return nil, err
+		}
+		return &sieveNot{t}, nil
+	case "allof", "anyof":
+		if !p.punct("(") {
+			return nil, fmt.Errorf("expected ( after %v", tok.val)
+		}
+		t := &sieveListTest{all: tok.val == "allof"}
+		for {
+			st, err := p.test()
+			if err != nil {
+				return nil, err
+			}
+			t.tests = append(t.tests, st)
+			if p.punct(")") {
+				return t, nil
+			} else if !p.punct(",") {
+				return nil, fmt.Errorf("expected , or ) in %v", tok.val)
+			}
+		}
+	case "size":
+		t := &sieveSizeTest{}
+		tag, ok := p.peek()
+		if !ok || tag.typ != sieveTag || (tag.val != "over" && tag.val != "under") {
+			return nil, errors.New("size requires :over or :under")
+		}
+		p.pos++
+		t.over = tag.val == "over"
+		num, ok := p.peek()
+		if !ok || num.typ != sieveNumber {
+			return nil, errors.New("size requires number")
+		}
+		p.pos++
+		t.limit = num.num
+		return t, nil
+	case "exists":
+		names, err := p.stringList()
+		if err != nil {
+			return nil, err
+		}
+		return &sieveExistsTest{names}, nil
+	case "header", "address":
+		t := &sieveHeaderTest{address: tok.val == "address", match: "is", comparator: "i;ascii-casemap", part: "all"}
+		if err := p.tags(t); err != nil {
+			return nil, err
+		}
+		var err error
+		if t.names, err = p.stringList(); err != nil {
+			return nil, err
+		}
+		if t.keys, err = p.stringList(); err != nil {
+			return nil, err
+		}
+		if t.match == "matches" {
+			for _, k := range t.keys {
+				t.patterns = append(t.patterns, sieveGlobRegexp(k, t.comparator == "i;ascii-casemap"))
+			}
+		}
+		return t, nil
+	default:
+		return nil, fmt.Errorf("unsupported test %q", tok.val)
+	}
+}
+
+// tags parses optional tagged arguments for a "header" or "address" test.
+func (p *sieveParser) tags(t *sieveHeaderTest) error {
+	for {
+		tok, ok := p.peek()
+		if !ok || tok.typ != sieveTag {
+			return nil
+		}
+		p.pos++
+		switch tok.val {
+		case "is", "contains", "matches":
+			t.match = tok.val
+		case "all", "localpart", "domain":
+			if !t.address {
+				return fmt.Errorf("%v only allowed in address test", tok)
+			}
+			t.part = tok.val
+		case "comparator":
+			c, ok := p.peek()
+			if !ok || c.typ != sieveString {
+				return errors.New(":comparator requires string")
+			}
+			p.pos++
+			if c.val != "i;ascii-casemap" && c.val != "i;octet" {
+				return fmt.Errorf("unsupported comparator %q", c.val)
+			}
+			t.comparator = c.val
+		default:
+			return fmt.Errorf("unsupported tag %v", tok)
+		}
+	}
+}
+
+// stringList parses a single string or a bracketed list of strings.
+func (p *sieveParser) stringList() ([]string, error) {
+	if tok, ok := p.peek(); ok && tok.typ == sieveString {
+		p.pos++
+		return []string{tok.val}, nil
+	}
+	if !p.punct("[") {
+		return nil, errors.New("expected string or string list")
+	}
+	var list []string
+	for {
+		tok, ok := p.peek()
+		if !ok || tok.typ != sieveString {
+			return nil, errors.New("expected string in list")
+		}
+		p.pos++
+		list = append(list, tok.val)
+		if p.punct("]") {
+			return list, nil
+		} else if !p.punct(",") {
+			return nil, errors.New("expected , or ] in string list")
+		}
+	}
+}
+
+// sieveConst is the "true" or "false" test.
+type sieveConst bool
+
+func (t sieveConst) eval(hdr mail.Header, size int) bool { return bool(t) }
+
+// sieveNot is the "not" test.
+type sieveNot struct{ test sieveTest }
+
+func (t *sieveNot) eval(hdr mail.Header, size int) bool { return !t.test.eval(hdr, size) }
+
+// sieveListTest is the "allof" or "anyof" test.
+type sieveListTest struct {
+	tests []sieveTest
+	all   bool // true for "allof", false for "anyof"
+}
+
+func (t *sieveListTest) eval(hdr mail.Header, size int) bool {
+	for _, st := range t.tests {
+		if st.eval(hdr, size) != t.all {
+			return !t.all
+		}
+	}
+	return t.all
+}
+
+// sieveSizeTest is the "size" test.
+type sieveSizeTest struct {
+	over  bool // true for ":over", false for ":under"
+	limit int
+}
+
+func (t *sieveSizeTest) eval(hdr mail.Header, size int) bool {
+	if t.over {
+		return size > t.limit
+	}
+	return size < t.limit
+}
+
+// sieveExistsTest is the "exists" test.
+type sieveExistsTest struct{ names []string }
+
+func (t *sieveExistsTest) eval(hdr mail.Header, size int) bool {
+	for _, n := range t.names {
+		if len(hdr[canonicalSieveName(n)]) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// sieveHeaderTest is the "header" or "address" test.
+type sieveHeaderTest struct {
+	address    bool   // true for "address", false for "header"
+	match      string // "is", "contains", or "matches"
+	comparator string // "i;ascii-casemap" or "i;octet"
+	part       string // "all", "localpart", or "domain" (only for "address")
+	names      []string
+	keys       []string
+	patterns   []*regexp.Regexp // compiled keys for "matches"
+}
+
+func (t *sieveHeaderTest) eval(hdr mail.Header, size int) bool {
+	for _, name := range t.names {
+		for _, val := range hdr[canonicalSieveName(name)] {
+			var vals []string
+			if t.address {
+				addrs, err := mail.ParseAddressList(val)
+				if err != nil {
+					continue
+				}
+				for _, a := range addrs {
+					vals = append(vals, sieveAddressPart(a.Address, t.part))
+				}
+			} else {
+				if dec, err := headerDecoder.DecodeHeader(val); err == nil {
+					val = dec
+				}
+				vals = []string{val}
+			}
+			for _, v := range vals {
+				if t.matches(v) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// matches returns true if val matches any of t's keys.
+func (t *sieveHeaderTest) matches(val string) bool {
+	fold := t.comparator == "i;ascii-casemap"
+	if fold {
+		val = asciiLower(val)
+	}
+	for i, key := range t.keys {
+		if fold {
+			key = asciiLower(key)
+		}
+		switch t.match {
+		case "is":
+			if val == key {
+				return true
+			}
+		case "contains":
+			if strings.Contains(val, key) {
+				return true
+			}
+		case "matches":
+			if t.patterns[i].MatchString(val) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// canonicalSieveName canonicalizes a header field name for looking it up in a mail.Header.
+func canonicalSieveName(name string) string {
+	key, _, _ := ParseHeaderField(name + ":")
+	return key
+}
+
+// sieveAddressPart returns the specified part ("all", "localpart", or "domain") of addr.
+func sieveAddressPart(addr, part string) string {
+	i := strings.LastIndexByte(addr, '@')
+	switch {
+	case part == "localpart" && i >= 0:
+		return addr[:i]
+	case part == "domain" && i >= 0:
+		return addr[i+1:]
+	case part == "domain":
+		return ""
+	default:
+		return addr
+	}
+}
+
+// sieveGlobRegexp converts a ":matches" pattern (using "*" and "?" wildcards)
+// into a regular expression. If fold is true, the pattern is lowercased.
+func sieveGlobRegexp(pat string, fold bool) *regexp.Regexp {
+	if fold {
+		pat = asciiLower(pat)
+	}
+	var sb strings.Builder
+	sb.WriteString(`(?s)^`)
+	var escaped bool
+	for _, ch := range pat {
+		switch {
+		case escaped:
+			sb.WriteString(regexp.QuoteMeta(string(ch)))
+			escaped = false
+		case ch == '\\':
+			escaped = true
+		case ch == '*':
+			sb.WriteString(".*")
+		case ch == '?':
+			sb.WriteString(".")
+		default:
+			sb.WriteString(regexp.QuoteMeta(string(ch)))
+		}
+	}
+	sb.WriteString("$")
+	return regexp.MustCompile(sb.String())
+}
+
+// asciiLower lowercases ASCII letters in s, as done by the "i;ascii-casemap" comparator.
+func asciiLower(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'A' && r <= 'Z' {
+			return r + 'a' - 'A'
+		}
+		return r
+	}, s)
+}
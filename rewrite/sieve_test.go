@@ -0,0 +1,91 @@
+// Copyright 2022 Daniel Erat.
+// All rights reserved.
+
+package rewrite
+
+import (
+	"net/mail"
+	"strings"
+	"testing"
+)
+
+func TestParseSieveTest(t *testing.T) {
+	const msg = "From: \"Alice Smith\" <Alice@Example.org>\n" +
+		"To: bob@example.com, carol@lists.example.net\n" +
+		"List-Id: Friends <friends.lists.example.org>\n" +
+		"Subject: =?utf-8?q?Caf=C3=A9_news?=\n" +
+		"\n" +
+		"Body\n"
+	m, err := mail.ReadMessage(strings.NewReader(msg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	const size = 2048
+
+	for _, tc := range []struct {
+		test string
+		want bool
+	}{
+		{`true`, true},
+		{`false`, false},
+		{`not false`, true},
+		{`header :is "subject" "café news"`, true},
+		{`header :is "Subject" "Café"`, false},
+		{`header :contains "subject" "CAFÉ"`, false}, // only ASCII is case-folded
+		{`header :contains :comparator "i;octet" "subject" "café"`, false},
+		{`header :contains :comparator "i;octet" "subject" "Café"`, true},
+		{`header :contains ["to", "cc"] "carol@"`, true},
+		{`header :contains "list-id" ["foo", "friends."]`, true},
+		{`header :matches "subject" "caf? *"`, true},
+		{`header :matches "subject" "*news"`, true},
+		{`header :matches "subject" "news*"`, false},
+		{`header :matches "from" "*\\*"`, false},
+		{`header :is "x-missing" ""`, false},
+		{`address :is "from" "alice@example.org"`, true},
+		{`address :all :is "from" "Alice Smith"`, false},
+		{`address :domain :is "to" "lists.example.net"`, true},
+		{`address :localpart :is "to" "bob"`, true},
+		{`address :domain :matches "to" "*.example.org"`, false},
+		{`exists ["from", "list-id"]`, true},
+		{`exists ["from", "cc"]`, false},
+		{`size :over 1K`, true},
+		{`size :over 2K`, false},
+		{`size :under 1M`, true},
+		{`allof (exists "from", size :under 10)`, false},
+		{`anyof (exists "cc", # comment
+			/* another comment */ size :under 10K)`, true},
+		{`allof(header :contains "subject" "news", not address :domain :is "from" "example.com")`, true},
+	} {
+		st, err := parseSieveTest(tc.test)
+		if err != nil {
+			t.Errorf("parseSieveTest(%q) failed: %v", tc.test, err)
+			continue
+		}
+		if got := st.eval(m.Header, size); got != tc.want {
+			t.Errorf("%q evaluated to %v; want %v", tc.test, got, tc.want)
+		}
+	}
+
+	for _, bad := range []string{
+		``,
+		`header`,
+		`header "subject"`,
+		`header :regex "subject" "a"`,
+		`header :localpart "from" "a"`,
+		`header :comparator "i;unicode" "subject" "a"`,
+		`header "subject" ["a" "b"]`,
+		`header "subject" "abc`,
+		`size 10`,
+		`size :over`,
+		`allof (true, false`,
+		`anyof true`,
+		`true false`,
+		`discard`,
+		`/* unterminated`,
+		`header "subject" "a" ;`,
+	} {
+		if _, err := parseSieveTest(bad); err == nil {
+			t.Errorf("parseSieveTest(%q) unexpectedly succeeded", bad)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+// Copyright 2022 Daniel Erat.
+// All rights reserved.
+
+package rewrite
+
+import (
+	"regexp"
+	"strings"
+)
+
+// stripTextSignature removes the signature block from s, a plain-text body. The block starts
+// at the last "-- " line and continues until the end of the text or the first quoted line.
+// The second return value is true if a signature was removed.
+func stripTextSignature(s string) (string, bool) {
+	lines, term, final := splitTextLines(s)
+	start := -1
+	for i := len(lines) - 1; i >= 0; i-- {
+		if lines[i] == sigSep {
+			start = i
+			break
+		}
+	}
+	if start < 0 {
+		return s, false
+	}
+	end := start + 1
+	for end < len(lines) && !strings.HasPrefix(lines[end], ">") {
+		end++
+	}
+	lines = append(lines[:start], lines[end:]...)
+	if len(lines) == 0 {
+		return "", true
+	}
+	return joinTextLines(lines, term, final), true
+}
+
+var (
+	// sigTagRegexp matches opening and closing div, pre, and span tags,
+	// capturing the slash, the tag name, and the attributes.
+	sigTagRegexp = regexp.MustCompile(`(?is)<(/?)(div|pre|span)\b([^>]*)>`)
+
+	// sigClasses and sigIDs contain class names and IDs used by mail clients for signatures.
+	sigClasses = map[string]struct{}{
+		"gmail_signature":        {}, // Gmail
+		"gmail_signature_prefix": {}, // Gmail's "-- " before the signature
+		"moz-signature":          {}, // Thunderbird
+	}
+	sigIDs = map[string]struct{}{
+		"signature":    {}, // Outlook
+		"appendonsend": {}, // Outlook's marker after the signature
+	}
+)
+
+// isSigElement returns true if the supplied tag attributes identify a signature element.
+func isSigElement(attrs string) bool {
+	for _, c := range strings.Fields(htmlAttr(attrs, "class")) {
+		if _, ok := sigClasses[strings.ToLower(c)]; ok {
+			return true
+		}
+	}
+	_, ok := sigIDs[strings.ToLower(htmlAttr(attrs, "id"))]
+	return ok
+}
+
+// stripHTMLSignature removes signature elements from s, an HTML document.
+// The number of removed elements is also returned.
+func stripHTMLSignature(s string) (string, int) {
+	var b strings.Builder
+	removed := 0
+	for {
+		// Find the next signature element's opening tag.
+		var loc []int
+		for _, m := range sigTagRegexp.FindAllStringSubmatchIndex(s, -1) {
+			if m[3] == m[2] && isSigElement(s[m[6]:m[7]]) {
+				loc = m
+				break
+			}
+		}
+		if loc == nil {
+			b.WriteString(s)
+			return b.String(), removed
+		}
+		b.WriteString(s[:loc[0]])
+		name := strings.ToLower(s[loc[4]:loc[5]])
+		rest := s[loc[1]:]
+
+		// Skip to the end of the matching closing tag, tracking nested elements with the
+		// same name. If the element is never closed, drop everything after it.
+		depth := 1
+		end := len(rest)
+		for _, m := range sigTagRegexp.FindAllStringSubmatchIndex(rest, -1) {
+			if strings.ToLower(rest[m[4]:m[5]]) != name {
+				continue
+			}
+			if m[3] > m[2] {
+				depth--
+			} else if !strings.HasSuffix(rest[m[6]:m[7]], "/") {
+				depth++
+			}
+			if depth == 0 {
+				end = m[1]
+				break
+			}
+		}
+		s = rest[end:]
+		removed++
+	}
+}
@@ -0,0 +1,48 @@
+// Copyright 2022 Daniel Erat.
+// All rights reserved.
+
+package rewrite
+
+import (
+	"testing"
+)
+
+func TestStripTextSignature(t *testing.T) {
+	for _, tc := range []struct {
+		in, want string
+		changed  bool
+	}{
+		{"Hello\n", "Hello\n", false},
+		{"Hello\n--\nNot a sig\n", "Hello\n--\nNot a sig\n", false},
+		{"Hello\n-- \nMe\nexample.org\n", "Hello\n", true},
+		{"Hello\r\n-- \r\nMe\r\n", "Hello\r\n", true},
+		{"Hi\n-- \nOld\n\nAgain\n-- \nNew\n", "Hi\n-- \nOld\n\nAgain\n", true},
+		{"Reply\n-- \nMe\n\n> Quoted\n> -- \n", "Reply\n> Quoted\n> -- \n", true},
+		{"-- \nMe\n", "", true},
+	} {
+		if got, changed := stripTextSignature(tc.in); got != tc.want || changed != tc.changed {
+			t.Errorf("stripTextSignature(%q) = %q, %v; want %q, %v", tc.in, got, changed, tc.want, tc.changed)
+		}
+	}
+}
+
+func TestStripHTMLSignature(t *testing.T) {
+	for _, tc := range []struct {
+		in, want string
+		removed  int
+	}{
+		{`<div>Hello</div>`, `<div>Hello</div>`, 0},
+		{`<div>Hi</div><div class="gmail_signature" data-smartmail="gmail_signature"><div>Me</div><div>x</div></div><p>After</p>`,
+			`<div>Hi</div><p>After</p>`, 1},
+		{`Hi<span class="gmail_signature_prefix">-- </span><br><div dir="ltr" class="gmail_signature">Me</div>`,
+			`Hi<br>`, 2},
+		{`Hi<pre class="moz-signature" cols="72">-- 
+Me</pre></body>`, `Hi</body>`, 1},
+		{`<DIV ID="Signature"><div>Me<div/></div></DIV>End`, `End`, 1},
+		{`Hi<div class="moz-signature">Unclosed`, `Hi`, 1},
+	} {
+		if got, removed := stripHTMLSignature(tc.in); got != tc.want || removed != tc.removed {
+			t.Errorf("stripHTMLSignature(%q) = %q, %v; want %q, %v", tc.in, got, removed, tc.want, tc.removed)
+		}
+	}
+}
@@ -0,0 +1,28 @@
+// Copyright 2022 Daniel Erat.
+// All rights reserved.
+
+package rewrite
+
+import "strings"
+
+// teesBody returns true if opts.TeePart should receive the body of the part described by hdata.
+func (opts *Options) teesBody(hdata *headerData) bool {
+	return opts.TeePart != nil && !strings.HasPrefix(hdata.mediaType, "multipart/") && !isEmbeddedMessage(hdata)
+}
+
+// teePart writes body, the encoded body of the part described by hdata,
+// to the writer returned by opts.TeePart after decoding it.
+func teePart(hdata *headerData, body []byte, opts *Options) error {
+	w := opts.TeePart(newPartInfo(hdata, hdata.rawHeader))
+	if w == nil {
+		return nil
+	}
+	if dec, err := DecodeBody(body, hdata.encoding); err == nil {
+		body = dec
+	}
+	_, err := w.Write(body)
+	if cerr := w.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
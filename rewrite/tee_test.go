@@ -0,0 +1,71 @@
+// Copyright 2022 Daniel Erat.
+// All rights reserved.
+
+package rewrite
+
+import (
+	"bytes"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// teeBuffer records the data written to it and whether it was closed.
+type teeBuffer struct {
+	bytes.Buffer
+	closed bool
+}
+
+func (b *teeBuffer) Close() error {
+	b.closed = true
+	return nil
+}
+
+func TestRewrite_teePart(t *testing.T) {
+	bufs := make(map[string]*teeBuffer)
+	opts := Options{
+		Now:              time.Now(),
+		DeleteMediaTypes: []string{"image/*"},
+		TeePart: func(p *PartInfo) io.WriteCloser {
+			b := &teeBuffer{}
+			bufs[p.Path+" "+p.MediaType] = b
+			return b
+		},
+	}
+	var out bytes.Buffer
+	if _, err := Rewrite(strings.NewReader(walkMsg), &out, &opts); err != nil {
+		t.Fatal("Rewrite failed:", err)
+	}
+	got := make(map[string]string)
+	for k, b := range bufs {
+		if !b.closed {
+			t.Errorf("Writer for %q wasn't closed", k)
+		}
+		got[k] = b.String()
+	}
+	if want := map[string]string{
+		"1 text/plain":  "Hello\n",
+		"2.1 image/png": "abc",
+	}; !reflect.DeepEqual(got, want) {
+		t.Errorf("TeePart received %q; want %q", got, want)
+	}
+	if strings.Contains(out.String(), "YWJj") {
+		t.Errorf("Rewrite didn't delete image part:\n%s", out.String())
+	}
+
+	// Returning nil should skip the part without affecting the output.
+	var plain bytes.Buffer
+	if _, err := Rewrite(strings.NewReader(walkMsg), &plain, &Options{Now: opts.Now}); err != nil {
+		t.Fatal("Rewrite failed:", err)
+	}
+	var teed bytes.Buffer
+	opts = Options{Now: opts.Now, TeePart: func(*PartInfo) io.WriteCloser { return nil }}
+	if _, err := Rewrite(strings.NewReader(walkMsg), &teed, &opts); err != nil {
+		t.Fatal("Rewrite failed:", err)
+	}
+	if teed.String() != plain.String() {
+		t.Errorf("Rewrite with nil TeePart writers produced:\n%s\nwant:\n%s", teed.String(), plain.String())
+	}
+}
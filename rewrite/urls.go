@@ -0,0 +1,122 @@
+// Copyright 2022 Daniel Erat.
+// All rights reserved.
+
+package rewrite
+
+import (
+	"html"
+	"regexp"
+	"strings"
+	"text/template"
+)
+
+// urlRewriter rewrites URLs in text and HTML.
+type urlRewriter struct {
+	defang bool               // replace schemes with e.g. "hxxp"
+	tmpl   *template.Template // executed with urlTemplateData to produce new URLs
+}
+
+// urlTemplateData is passed to urlRewriter.tmpl.
+type urlTemplateData struct {
+	URL string // original URL
+}
+
+// newURLRewriter returns a new urlRewriter. If tmpl is non-empty, it is parsed as a
+// text/template that is executed with a urlTemplateData.
+func newURLRewriter(defang bool, tmpl string) (*urlRewriter, error) {
+	ur := &urlRewriter{defang: defang}
+	if tmpl != "" {
+		var err error
+		if ur.tmpl, err = template.New("url").Option("missingkey=error").Parse(tmpl); err != nil {
+			return nil, err
+		}
+	}
+	return ur, nil
+}
+
+// CheckURLTemplate returns an error if tmpl isn't a valid Options.URLTemplate value.
+func CheckURLTemplate(tmpl string) error {
+	_, err := newURLRewriter(false, tmpl)
+	return err
+}
+
+// rewrite rewrites all URLs in s. If isHTML is true, s is treated as HTML and character
+// references in URLs are handled appropriately. The number of rewritten URLs is also returned.
+func (ur *urlRewriter) rewrite(s string, isHTML bool) (string, int, error) {
+	var n int
+	var err error
+	prefix := ur.templatePrefix()
+	s = urlRegexp.ReplaceAllStringFunc(s, func(u string) string {
+		// Leave trailing punctuation (e.g. the end of a sentence) alone.
+		trimmed := strings.TrimRight(u, ".,;:!?)")
+		suffix := u[len(trimmed):]
+		u = trimmed
+
+		if ur.tmpl != nil {
+			orig := u
+			if isHTML {
+				orig = html.UnescapeString(orig)
+			}
+			if prefix != "" && strings.HasPrefix(orig, prefix) {
+				return u + suffix // already rewritten
+			}
+			var b strings.Builder
+			if terr := ur.tmpl.Execute(&b, urlTemplateData{URL: orig}); terr != nil {
+				err = terr
+				return u + suffix
+			}
+			u = b.String()
+			if isHTML {
+				u = html.EscapeString(u)
+			}
+		}
+		if ur.defang {
+			u = defangURL(u)
+		}
+		n++
+		return u + suffix
+	})
+	return s, n, err
+}
+
+// templatePrefix returns the constant prefix of URLs produced by ur.tmpl, e.g.
+// "https://redirect.example.org/?url=", so that rewriting a URL that was already
+// rewritten can be avoided. An empty string is returned if there's no such prefix.
+func (ur *urlRewriter) templatePrefix() string {
+	if ur.tmpl == nil {
+		return ""
+	}
+	var a, b strings.Builder
+	if ur.tmpl.Execute(&a, urlTemplateData{URL: ""}) != nil ||
+		ur.tmpl.Execute(&b, urlTemplateData{URL: "\x00"}) != nil {
+		return ""
+	}
+	as, bs := a.String(), b.String()
+	i := 0
+	for i < len(as) && i < len(bs) && as[i] == bs[i] {
+		i++
+	}
+	if prefix := as[:i]; strings.Contains(prefix, "://") {
+		return prefix
+	}
+	return ""
+}
+
+// urlRegexp matches URLs that should be rewritten.
+var urlRegexp = regexp.MustCompile(`(?i)\b(?:https?|ftp)://[^\s<>"']+`)
+
+// defangURL replaces the scheme at the beginning of u, e.g. "http://" becomes "hxxp://".
+func defangURL(u string) string {
+	idx := strings.Index(u, "://")
+	if idx < 0 {
+		return u
+	}
+	scheme := strings.ToLower(u[:idx])
+	switch scheme {
+	case "http", "https":
+		scheme = "hxxp" + scheme[4:]
+	case "ftp":
+		scheme = "fxp"
+	}
+	return scheme + u[idx:]
+}
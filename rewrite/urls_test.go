@@ -0,0 +1,38 @@
+// Copyright 2022 Daniel Erat.
+// All rights reserved.
+
+package rewrite
+
+import "testing"
+
+func TestURLRewriter(t *testing.T) {
+	const tmpl = "https://r.example.org/?u={{urlquery .URL}}"
+	for _, tc := range []struct {
+		in     string
+		defang bool
+		tmpl   string
+		isHTML bool
+		want   string
+	}{
+		{"No URLs here.", true, "", false, "No URLs here."},
+		{"See https://example.com/a?b=c.", true, "", false, "See hxxps://example.com/a?b=c."},
+		{"(http://example.com/) and FTP://example.com/f", true, "", false,
+			"(hxxp://example.com/) and fxp://example.com/f"},
+		{"See https://example.com/a?b=c&d=e!", false, tmpl, false,
+			"See https://r.example.org/?u=https%3A%2F%2Fexample.com%2Fa%3Fb%3Dc%26d%3De!"},
+		{`<a href="https://example.com/a?b=c&amp;d=e">x</a>`, false, tmpl, true,
+			`<a href="https://r.example.org/?u=https%3A%2F%2Fexample.com%2Fa%3Fb%3Dc%26d%3De">x</a>`},
+		{`<a href="http://example.com/">http://example.com/</a>`, true, "", true,
+			`<a href="hxxp://example.com/">hxxp://example.com/</a>`},
+	} {
+		ur, err := newURLRewriter(tc.defang, tc.tmpl)
+		if err != nil {
+			t.Fatalf("newURLRewriter(%v, %q) failed: %v", tc.defang, tc.tmpl, err)
+		}
+		if got, _, err := ur.rewrite(tc.in, tc.isHTML); err != nil {
+			t.Errorf("rewrite(%q, %v) failed: %v", tc.in, tc.isHTML, err)
+		} else if got != tc.want {
+			t.Errorf("rewrite(%q, %v) = %q; want %q", tc.in, tc.isHTML, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,127 @@
+// Copyright 2022 Daniel Erat.
+// All rights reserved.
+
+package rewrite
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"net/textproto"
+	"strings"
+)
+
+// Values for Options.ValidateOutput.
+const (
+	validateInternal = "internal" // re-parse output with Rewrite's own parser
+	validateFull     = "full"     // also re-parse output with net/mail and mime/multipart
+)
+
+// ValidationError is returned by Rewrite when Options.ValidateOutput is set and the
+// rewritten message can't be parsed even though the original message could be.
+// This indicates a bug in Rewrite, so the original message should be delivered
+// or the delivery retried rather than losing the message.
+type ValidationError struct {
+	Parser string // parser that rejected the output, e.g. "internal" or "net/mail"
+	Err    error  // error returned by the parser
+}
+
+func (err *ValidationError) Error() string {
+	return fmt.Sprintf("rewritten message rejected by %v parser: %v", err.Parser, err.Err)
+}
+
+// rewriteChecked implements Rewrite for opts.VerifyIdempotent and opts.ValidateOutput.
+// The output is buffered and only written to w after it's been checked.
+func rewriteChecked(r io.Reader, w io.Writer, opts *Options) (*Report, error) {
+	switch opts.ValidateOutput {
+	case "", validateInternal, validateFull:
+	default:
+		return &Report{}, fmt.Errorf("invalid output validation %q", opts.ValidateOutput)
+	}
+
+	o := *opts
+	o.VerifyIdempotent = false
+	o.ValidateOutput = ""
+	var in, out bytes.Buffer
+	if opts.ValidateOutput != "" {
+		r = io.TeeReader(r, &in)
+	}
+	rep, err := Rewrite(r, &out, &o)
+	if err == nil && opts.VerifyIdempotent {
+		err = verifyIdempotent(out.Bytes(), rep.Options)
+	}
+	if err == nil && opts.ValidateOutput != "" {
+		err = validateOutput(in.Bytes(), out.Bytes(), opts.ValidateOutput == validateFull)
+	}
+	if err != nil {
+		return rep, err
+	}
+	_, err = w.Write(out.Bytes())
+	return rep, err
+}
+
+// validateOutput returns a *ValidationError if out, the result of rewriting in, can't be
+// parsed while in can. If full is true, net/mail and mime/multipart are also used.
+func validateOutput(in, out []byte, full bool) error {
+	type parser struct {
+		name  string
+		parse func(b []byte) error
+	}
+	parsers := []parser{{validateInternal, parseInternal}}
+	if full {
+		parsers = append(parsers, parser{"net/mail", func(b []byte) error {
+			return parseStdlib(bytes.NewReader(b))
+		}})
+	}
+	for _, p := range parsers {
+		if err := p.parse(out); err != nil && p.parse(in) == nil {
+			return &ValidationError{Parser: p.name, Err: err}
+		}
+	}
+	return nil
+}
+
+// parseInternal parses the message msg in strict mode and returns the first problem.
+func parseInternal(msg []byte) error {
+	lr := newLineReader(bytes.NewReader(msg))
+	defer lr.release()
+	var st msgState
+	_, _, err := copyMessagePart(lr, ioutil.Discard, "", nil, &st, &Options{Strict: true, report: &Report{}})
+	return err
+}
+
+// parseStdlib uses the net/mail and mime/multipart packages to read an email message from r.
+// An error is returned if the message is broken (in terms of RFC 5322/6532 and 2046).
+func parseStdlib(r io.Reader) error {
+	var checkPart func(map[string][]string, io.Reader) error
+	checkPart = func(header map[string][]string, body io.Reader) error {
+		mtype, params, err := mime.ParseMediaType(textproto.MIMEHeader(header).Get("Content-Type"))
+		if err != nil {
+			mtype = defaultMediaType
+			params = defaultContentParams
+		}
+		if !strings.HasPrefix(mtype, "multipart/") {
+			return nil // non-multipart body, so we're done
+		}
+		mr := multipart.NewReader(body, params["boundary"])
+		for {
+			if part, err := mr.NextPart(); err == io.EOF {
+				return nil // no more parts in the body
+			} else if err != nil {
+				return err
+			} else if err := checkPart(part.Header, part); err != nil {
+				return err
+			}
+		}
+	}
+
+	msg, err := mail.ReadMessage(r)
+	if err != nil {
+		return err
+	}
+	return checkPart(msg.Header, msg.Body)
+}
@@ -0,0 +1,82 @@
+// Copyright 2022 Daniel Erat.
+// All rights reserved.
+
+package rewrite
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestRewrite_validateOutput(t *testing.T) {
+	const (
+		valid = "Content-Type: multipart/mixed; boundary=abc\n" +
+			"\n" +
+			"--abc\n" +
+			"Content-Type: text/plain\n" +
+			"\n" +
+			"Hello\n" +
+			"--abc\n" +
+			"Content-Type: image/png\n" +
+			"\n" +
+			"data\n" +
+			"--abc--\n"
+		// The closing delimiter is missing.
+		truncated = "Content-Type: multipart/mixed; boundary=abc\n" +
+			"\n" +
+			"--abc\n" +
+			"Content-Type: image/png\n" +
+			"\n" +
+			"data\n"
+	)
+	// Replace deleted parts with multipart parts that lack boundaries.
+	broken := func(p *PartInfo, w io.Writer) error {
+		_, err := io.WriteString(w, "Content-Type: multipart/mixed\n\n")
+		return err
+	}
+
+	for _, tc := range []struct {
+		in       string
+		validate string
+		replace  func(p *PartInfo, w io.Writer) error
+		parser   string // expected ValidationError.Parser, or empty for success
+	}{
+		{valid, validateInternal, nil, ""},
+		{valid, validateFull, nil, ""},
+		{valid, validateInternal, broken, validateInternal},
+		{valid, validateFull, broken, validateInternal},
+		{truncated, validateFull, broken, ""}, // already broken
+	} {
+		opts := Options{DeleteMediaTypes: []string{"image/*"}, ReplaceDeleted: tc.replace}
+		var want bytes.Buffer
+		if _, err := Rewrite(strings.NewReader(tc.in), &want, &opts); err != nil {
+			t.Fatalf("Rewrite failed for %q: %v", tc.in, err)
+		}
+
+		opts.ValidateOutput = tc.validate
+		var b bytes.Buffer
+		_, err := Rewrite(strings.NewReader(tc.in), &b, &opts)
+		if tc.parser == "" {
+			if err != nil {
+				t.Errorf("Rewrite with %q failed for %q: %v", tc.validate, tc.in, err)
+			} else if got := b.String(); got != want.String() {
+				t.Errorf("Rewrite with %q wrote %q for %q; want %q", tc.validate, got, tc.in, want.String())
+			}
+			continue
+		}
+		if verr, ok := err.(*ValidationError); !ok {
+			t.Errorf("Rewrite with %q returned %v for %q; want ValidationError", tc.validate, err, tc.in)
+		} else if verr.Parser != tc.parser {
+			t.Errorf("Rewrite with %q returned error from %q for %q; want %q", tc.validate, verr.Parser, tc.in, tc.parser)
+		}
+		if b.Len() != 0 {
+			t.Errorf("Rewrite with %q wrote %q for %q after failing", tc.validate, b.String(), tc.in)
+		}
+	}
+
+	if _, err := Rewrite(strings.NewReader(valid), &bytes.Buffer{}, &Options{ValidateOutput: "bogus"}); err == nil {
+		t.Error("Rewrite unexpectedly succeeded with bogus ValidateOutput")
+	}
+}
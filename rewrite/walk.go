@@ -0,0 +1,132 @@
+// Copyright 2022 Daniel Erat.
+// All rights reserved.
+
+package rewrite
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net/textproto"
+	"strings"
+	"time"
+)
+
+// PartInfo describes a message part.
+type PartInfo struct {
+	Path        string               // position in MIME tree, e.g. "1.2" (empty for top-level part)
+	MediaType   string               // e.g. "image/png"
+	Params      map[string]string    // Content-Type parameters
+	Encoding    string               // lowercase Content-Transfer-Encoding, e.g. "base64"
+	Disposition string               // lowercase disposition from Content-Disposition, e.g. "attachment"
+	Filename    string               // decoded filename from Content-Disposition or Content-Type
+	Header      textproto.MIMEHeader // part's header fields
+}
+
+// newPartInfo returns a PartInfo describing the part with the supplied header.
+func newPartInfo(hdata *headerData, hdr []byte) *PartInfo {
+	info := &PartInfo{
+		Path:        hdata.path,
+		MediaType:   hdata.mediaType,
+		Params:      hdata.contentParams,
+		Encoding:    hdata.encoding,
+		Disposition: hdata.disposition,
+		Filename:    hdata.decodedFilename(),
+	}
+	// ReadMIMEHeader returns the fields that it was able to parse along with any error.
+	info.Header, _ = textproto.NewReader(bufio.NewReader(bytes.NewReader(hdr))).ReadMIMEHeader()
+	return info
+}
+
+// Action describes what should be done with a message part visited by a WalkFunc.
+type Action struct {
+	op   actionOp
+	body []byte
+	err  error
+}
+
+type actionOp int
+
+const (
+	keepOp actionOp = iota
+	deleteOp
+	replaceOp
+	failOp
+)
+
+var (
+	// Keep leaves the part unchanged.
+	Keep = Action{op: keepOp}
+	// Delete replaces the part with a stub describing it, as is done for
+	// Options.DeleteMediaTypes.
+	Delete = Action{op: deleteOp}
+)
+
+// Replace returns an Action that replaces the decoded body of a non-multipart part
+// with body. The body is encoded using the part's original Content-Transfer-Encoding.
+func Replace(body []byte) Action { return Action{op: replaceOp, body: body} }
+
+// Fail returns an Action that stops rewriting the message and makes Rewrite return err.
+func Fail(err error) Action { return Action{op: failOp, err: err} }
+
+// WalkFunc is called for each part of a message. body contains the part's decoded body
+// (or its encoded body if it couldn't be decoded), or is nil for multipart parts and
+// message/rfc822 parts. Those parts are visited before the parts that they contain, which
+// aren't visited if the containing part is deleted. Replace is treated as Keep for them.
+type WalkFunc func(part *PartInfo, body io.Reader) Action
+
+// Walk copies the message read from r to w, calling fn for each of the message's
+// parts to decide what should be done with it. w may be ioutil.Discard if fn
+// only needs to inspect the message. Options.Visit can be used to combine fn
+// with other rewriting.
+func Walk(r io.Reader, w io.Writer, fn WalkFunc) (*Report, error) {
+	return Rewrite(r, w, &Options{Now: time.Now(), Visit: fn})
+}
+
+// visitsBody returns true if opts.Visit should be passed the body of the part described by hdata.
+func (opts *Options) visitsBody(hdata *headerData) bool {
+	return opts.Visit != nil && !hdata.deletePart && !strings.HasPrefix(hdata.mediaType, "multipart/") &&
+		!isEmbeddedMessage(hdata)
+}
+
+// visitMultipart passes the multipart part or embedded message described by hdata and hdr to opts.Visit.
+// If the part should be deleted, hdata.deletePart is set and a header for the
+// replacement part is returned. Otherwise, hdr is returned.
+func visitMultipart(hdr []byte, hdata *headerData, opts *Options) ([]byte, error) {
+	if opts.Visit == nil || hdata.deletePart ||
+		!strings.HasPrefix(hdata.mediaType, "multipart/") && !isEmbeddedMessage(hdata) {
+		return hdr, nil
+	}
+	act := opts.Visit(newPartInfo(hdata, hdr), nil)
+	if act.op == failOp {
+		return hdr, act.err
+	}
+	if act.op != deleteOp {
+		return hdr, nil
+	}
+	opts.Logger().Infof("Deleting %v", hdata.mediaType)
+	hdata.deletePart = true
+	return deletedHeader(hdr, hdata, opts)
+}
+
+// deletedHeader returns the data replacing the deleted part described by hdata
+// and its header hdr. Fields other than Content-* fields are preserved.
+//
+// By default, this is the header of a message/external-body part with the original
+// Content-* fields moved into its inner header. If opts.ReplaceDeleted is set, its
+// output follows the preserved fields instead.
+func deletedHeader(hdr []byte, hdata *headerData, opts *Options) ([]byte, error) {
+	outer, inner := splitContentFields(string(hdr))
+	if opts.ReplaceDeleted == nil {
+		return []byte(outer + deletedStub(hdata.term, opts.Now) + inner + hdata.term), nil
+	}
+	b := bytes.NewBufferString(outer)
+	if err := opts.ReplaceDeleted(newPartInfo(hdata, hdr), b); err != nil {
+		return nil, err
+	}
+	// The line break preceding the next delimiter is part of the delimiter.
+	if !bytes.HasSuffix(b.Bytes(), []byte("\n")) {
+		b.WriteString(hdata.term)
+	}
+	return b.Bytes(), nil
+}
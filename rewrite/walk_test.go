@@ -0,0 +1,127 @@
+// Copyright 2022 Daniel Erat.
+// All rights reserved.
+
+package rewrite
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const walkMsg = "From: a@example.org\n" +
+	"Content-Type: multipart/mixed; boundary=outer\n" +
+	"\n" +
+	"--outer\n" +
+	"Content-Type: text/plain\n" +
+	"\n" +
+	"Hello\n" +
+	"--outer\n" +
+	"Content-Type: multipart/related; boundary=inner\n" +
+	"\n" +
+	"--inner\n" +
+	"Content-Type: image/png\n" +
+	"Content-Disposition: attachment; filename=a.png\n" +
+	"Content-Transfer-Encoding: base64\n" +
+	"\n" +
+	"YWJj\n" +
+	"--inner--\n" +
+	"--outer--\n"
+
+func TestWalk(t *testing.T) {
+	type visit struct {
+		path, mtype, filename, body string
+	}
+	var visits []visit
+	var out bytes.Buffer
+	rep, err := Walk(strings.NewReader(walkMsg), &out, func(p *PartInfo, body io.Reader) Action {
+		v := visit{path: p.Path, mtype: p.MediaType, filename: p.Filename}
+		if body != nil {
+			b, _ := ioutil.ReadAll(body)
+			v.body = string(b)
+		}
+		visits = append(visits, v)
+		switch p.MediaType {
+		case "text/plain":
+			return Replace([]byte("Goodbye\n"))
+		case "image/png":
+			return Delete
+		}
+		return Keep
+	})
+	if err != nil {
+		t.Fatal("Walk failed:", err)
+	}
+
+	wantVisits := []visit{
+		{"", "multipart/mixed", "", ""},
+		{"1", "text/plain", "", "Hello\n"},
+		{"2", "multipart/related", "", ""},
+		{"2.1", "image/png", "a.png", "abc"},
+	}
+	if !reflect.DeepEqual(visits, wantVisits) {
+		t.Errorf("Walk visited %+v; want %+v", visits, wantVisits)
+	}
+
+	got := out.String()
+	if !strings.Contains(got, "\nGoodbye\n--outer\n") {
+		t.Errorf("Walk didn't replace text part:\n%s", got)
+	}
+	if strings.Contains(got, "YWJj") || !strings.Contains(got, "access-type=x-rendmail-deleted") {
+		t.Errorf("Walk didn't delete image part:\n%s", got)
+	}
+	if want := []DeletedPart{{"image/png", 5, "a.png", "2.1"}}; !reflect.DeepEqual(rep.Deleted, want) {
+		t.Errorf("Walk reported deleted parts %+v; want %+v", rep.Deleted, want)
+	}
+}
+
+func TestWalk_deleteMultipart(t *testing.T) {
+	var paths []string
+	var out bytes.Buffer
+	rep, err := Walk(strings.NewReader(walkMsg), &out, func(p *PartInfo, body io.Reader) Action {
+		paths = append(paths, p.Path)
+		if p.MediaType == "multipart/related" {
+			return Delete
+		}
+		return Keep
+	})
+	if err != nil {
+		t.Fatal("Walk failed:", err)
+	}
+	if want := []string{"", "1", "2"}; !reflect.DeepEqual(paths, want) {
+		t.Errorf("Walk visited %q; want %q", paths, want)
+	}
+	if got := out.String(); strings.Contains(got, "image/png") || !strings.Contains(got, "\nHello\n") {
+		t.Errorf("Walk didn't delete only multipart part:\n%s", got)
+	}
+	if len(rep.Deleted) != 1 || rep.Deleted[0].MediaType != "multipart/related" {
+		t.Errorf("Walk reported deleted parts %+v; want multipart/related", rep.Deleted)
+	}
+}
+
+func TestWalk_fail(t *testing.T) {
+	failErr := errors.New("failed")
+	for _, tc := range []struct{ mtype, path string }{
+		{"multipart/related", "2"},
+		{"image/png", "2.1"},
+	} {
+		var paths []string
+		_, err := Walk(strings.NewReader(walkMsg), ioutil.Discard, func(p *PartInfo, body io.Reader) Action {
+			paths = append(paths, p.Path)
+			if p.MediaType == tc.mtype {
+				return Fail(failErr)
+			}
+			return Keep
+		})
+		if err != failErr {
+			t.Errorf("Walk failing at %v returned %v; want %v", tc.mtype, err, failErr)
+		}
+		if last := paths[len(paths)-1]; last != tc.path {
+			t.Errorf("Walk failing at %v continued to %q", tc.mtype, last)
+		}
+	}
+}
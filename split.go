@@ -0,0 +1,288 @@
+// Copyright 2022 Daniel Erat.
+// All rights reserved.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/derat/rendmail/rewrite"
+)
+
+// splitManifestName is the name of the manifest file written by splitMessage.
+const splitManifestName = "manifest.json"
+
+// splitMain implements the "split" subcommand using the supplied command-line
+// arguments. The process's exit code is returned.
+func splitMain(args []string) int {
+	fs := flag.NewFlagSet("split", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s split -o DIR [file]\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Writes a message's headers and decoded bodies (read from stdin by default)\n")
+		fmt.Fprintf(os.Stderr, "to separate files in DIR so they can be edited and reassembled by \"build\".\n\n")
+		fs.PrintDefaults()
+	}
+	outDir := fs.String("o", "", "Directory to which parts and manifest are written")
+	fs.Parse(args)
+
+	if *outDir == "" || fs.NArg() > 1 {
+		fs.Usage()
+		return 2
+	}
+	b, err := readMessageArg(fs.Args())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Failed reading message:", err)
+		return 1
+	}
+	if err := splitMessage(b, *outDir); err != nil {
+		fmt.Fprintln(os.Stderr, "Failed splitting message:", err)
+		return 1
+	}
+	return 0
+}
+
+// buildMain implements the "build" subcommand using the supplied command-line
+// arguments. The process's exit code is returned.
+func buildMain(args []string) int {
+	fs := flag.NewFlagSet("build", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s build DIR\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Reassembles a message written by \"split\" and writes it to stdout.\n\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+	if err := buildMessage(fs.Arg(0), os.Stdout); err != nil {
+		fmt.Fprintln(os.Stderr, "Failed building message:", err)
+		return 1
+	}
+	return 0
+}
+
+// splitManifest describes a message written by splitMessage.
+type splitManifest struct {
+	LineEnding string     `json:"lineEnding"` // "crlf" or "lf"
+	Root       *splitPart `json:"root"`
+}
+
+// splitPart describes a message part within a splitManifest.
+// File names are relative to the manifest's directory.
+type splitPart struct {
+	Path     string       `json:"path"`               // e.g. "1.2" (empty for top-level part)
+	Header   string       `json:"header"`             // file containing header fields
+	Body     string       `json:"body,omitempty"`     // file containing body of non-multipart part
+	Encoding string       `json:"encoding,omitempty"` // used to re-encode body if decoded is true
+	Decoded  bool         `json:"decoded,omitempty"`  // true if body was decoded per encoding
+	NoBody   bool         `json:"noBody,omitempty"`   // true if header was directly followed by delimiter
+	Boundary string       `json:"boundary,omitempty"` // boundary of multipart part
+	Preamble string       `json:"preamble,omitempty"` // text preceding first delimiter
+	Epilogue string       `json:"epilogue,omitempty"` // text following closing delimiter
+	Parts    []*splitPart `json:"parts,omitempty"`
+
+	// Unterminated is true if the multipart part's closing delimiter was missing.
+	// Epilogue then contains the final delimiter and everything following it.
+	Unterminated bool `json:"unterminated,omitempty"`
+}
+
+// splitMessage writes msg's parts and a manifest describing them to dir.
+// Each part's header is written to a file like "1.2.header" and the bodies of
+// non-multipart parts are decoded and written to files like "1.2.body.txt".
+func splitMessage(msg []byte, dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	spans := rewrite.FindParts(msg)
+
+	var split func(path string) (*splitPart, error)
+	split = func(path string) (*splitPart, error) {
+		span := spans[path]
+		name := path
+		if name == "" {
+			name = "0"
+		}
+		part := &splitPart{Path: path, Header: name + ".header"}
+
+		hdr := msg[span.Start:span.BodyStart]
+		hdr = trimLineBreak(hdr) // drop the blank line
+		if err := ioutil.WriteFile(filepath.Join(dir, part.Header), hdr, 0644); err != nil {
+			return nil, err
+		}
+
+		body := span.Body(msg, path == "")
+		if _, ok := spans[childPath(path, 1)]; ok {
+			part.Boundary = span.Params["boundary"]
+			delim := "--" + part.Boundary
+			pre, last, post := rewrite.FindDelimiters(body, delim)
+			part.Preamble = string(body[:pre])
+			if post >= 0 {
+				part.Epilogue = string(body[post+len(delim)+2:])
+			} else {
+				// FindParts doesn't report the part following the last delimiter
+				// if the closing delimiter is missing, so preserve it verbatim.
+				part.Unterminated = true
+				part.Epilogue = string(body[last:])
+			}
+			for i := 1; ; i++ {
+				cp := childPath(path, i)
+				if _, ok := spans[cp]; !ok {
+					break
+				}
+				child, err := split(cp)
+				if err != nil {
+					return nil, err
+				}
+				part.Parts = append(part.Parts, child)
+			}
+			return part, nil
+		}
+
+		part.Encoding = span.Encoding
+		part.NoBody = path != "" && span.BodyStart == span.End
+		if dec, err := rewrite.DecodeBody(body, span.Encoding); err == nil {
+			body = dec
+			part.Decoded = true
+		}
+		part.Body = name + ".body" + filepath.Ext(extractName(path, &span))
+		if err := ioutil.WriteFile(filepath.Join(dir, part.Body), body, 0644); err != nil {
+			return nil, err
+		}
+		return part, nil
+	}
+
+	root, err := split("")
+	if err != nil {
+		return err
+	}
+	man := splitManifest{LineEnding: "lf", Root: root}
+	if i := bytes.IndexByte(msg, '\n'); i > 0 && msg[i-1] == '\r' {
+		man.LineEnding = "crlf"
+	}
+	b, err := json.MarshalIndent(&man, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(dir, splitManifestName), append(b, '\n'), 0644)
+}
+
+// buildMessage reassembles the message described by the manifest
+// in dir (as written by splitMessage) and writes it to w.
+func buildMessage(dir string, w io.Writer) error {
+	b, err := ioutil.ReadFile(filepath.Join(dir, splitManifestName))
+	if err != nil {
+		return err
+	}
+	var man splitManifest
+	if err := json.Unmarshal(b, &man); err != nil {
+		return fmt.Errorf("bad manifest: %v", err)
+	}
+	if man.Root == nil {
+		return errors.New("manifest has no root part")
+	}
+	var term string
+	switch man.LineEnding {
+	case "crlf":
+		term = "\r\n"
+	case "lf":
+		term = "\n"
+	default:
+		return fmt.Errorf("bad line ending %q", man.LineEnding)
+	}
+
+	var build func(part *splitPart, top bool) ([]byte, error)
+	build = func(part *splitPart, top bool) ([]byte, error) {
+		var out bytes.Buffer
+		hdr, err := ioutil.ReadFile(filepath.Join(dir, filepath.Base(part.Header)))
+		if err != nil {
+			return nil, err
+		}
+		if hdr = trimLineBreak(hdr); len(hdr) > 0 {
+			out.Write(hdr)
+			out.WriteString(term)
+		}
+		out.WriteString(term)
+
+		if len(part.Parts) > 0 {
+			if part.Boundary == "" {
+				return nil, fmt.Errorf("multipart part %q has no boundary", part.Path)
+			}
+			delim := "--" + part.Boundary
+			out.WriteString(part.Preamble)
+			for _, child := range part.Parts {
+				cb, err := build(child, false)
+				if err != nil {
+					return nil, err
+				}
+				if containsDelim(cb, delim) {
+					return nil, fmt.Errorf("part %q contains boundary %q", child.Path, part.Boundary)
+				}
+				out.WriteString(delim + term)
+				out.Write(cb)
+				if !child.NoBody {
+					out.WriteString(term)
+				}
+			}
+			if !part.Unterminated {
+				out.WriteString(delim + "--")
+			}
+			out.WriteString(part.Epilogue)
+			return out.Bytes(), nil
+		}
+
+		body, err := ioutil.ReadFile(filepath.Join(dir, filepath.Base(part.Body)))
+		if err != nil {
+			return nil, err
+		}
+		if part.Decoded && !rewrite.IsIdentityEncoding(part.Encoding) {
+			if body, err = rewrite.EncodeBody(body, part.Encoding, term); err != nil {
+				return nil, err
+			}
+			// encodeBody terminates the final base64 line, but the line break
+			// preceding the next delimiter is added by the parent.
+			if !top && part.Encoding == "base64" {
+				body = trimLineBreak(body)
+			}
+		}
+		out.Write(body)
+		return out.Bytes(), nil
+	}
+
+	msg, err := build(man.Root, true)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(msg)
+	return err
+}
+
+// childPath returns the path of the n-th (1-based) child of the part at path.
+func childPath(path string, n int) string {
+	if path == "" {
+		return fmt.Sprint(n)
+	}
+	return fmt.Sprintf("%s.%d", path, n)
+}
+
+// trimLineBreak removes a single trailing "\r\n" or "\n" from b.
+func trimLineBreak(b []byte) []byte {
+	if bytes.HasSuffix(b, []byte("\r\n")) {
+		return b[:len(b)-2]
+	}
+	return bytes.TrimSuffix(b, []byte("\n"))
+}
+
+// containsDelim returns true if b contains a line starting with delim.
+func containsDelim(b []byte, delim string) bool {
+	return bytes.HasPrefix(b, []byte(delim)) || bytes.Contains(b, []byte("\n"+delim))
+}
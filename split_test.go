@@ -0,0 +1,84 @@
+// Copyright 2022 Daniel Erat.
+// All rights reserved.
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestSplitAndBuildMessage(t *testing.T) {
+	const msg = "From: me@example.org\r\n" +
+		"Content-Type: multipart/mixed; boundary=abc\r\n" +
+		"\r\n" +
+		"Preamble\r\n" +
+		"--abc\r\n" +
+		"Content-Type: multipart/alternative; boundary=def\r\n" +
+		"\r\n" +
+		"--def\r\n" +
+		"Content-Type: text/plain\r\n" +
+		"Content-Transfer-Encoding: quoted-printable\r\n" +
+		"\r\n" +
+		"caf=C3=A9\r\n" +
+		"--def\r\n" +
+		"Content-Type: text/html\r\n" +
+		"\r\n" +
+		"--def--\r\n" +
+		"\r\n" +
+		"--abc\r\n" +
+		"Content-Type: application/octet-stream\r\n" +
+		"Content-Transfer-Encoding: base64\r\n" +
+		"\r\n" +
+		"AAECAw==\r\n" +
+		"--abc--\r\n" +
+		"Epilogue\r\n"
+
+	dir := t.TempDir()
+	if err := splitMessage([]byte(msg), dir); err != nil {
+		t.Fatal("splitMessage failed:", err)
+	}
+	for fn, want := range map[string]string{
+		"0.header":      "From: me@example.org\r\nContent-Type: multipart/mixed; boundary=abc\r\n",
+		"1.1.header":    "Content-Type: text/plain\r\nContent-Transfer-Encoding: quoted-printable\r\n",
+		"1.1.body.txt":  "café",
+		"1.2.body.html": "",
+		"2.body.bin":    "\x00\x01\x02\x03",
+	} {
+		if got, err := ioutil.ReadFile(filepath.Join(dir, fn)); err != nil {
+			t.Error(err)
+		} else if string(got) != want {
+			t.Errorf("%v contains %q; want %q", fn, got, want)
+		}
+	}
+
+	var b bytes.Buffer
+	if err := buildMessage(dir, &b); err != nil {
+		t.Fatal("buildMessage failed:", err)
+	}
+	if got := b.String(); got != msg {
+		t.Errorf("buildMessage wrote %q; want %q", got, msg)
+	}
+
+	// Edit a part and check that it's re-encoded.
+	if err := ioutil.WriteFile(filepath.Join(dir, "1.1.body.txt"), []byte("thé"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	b.Reset()
+	if err := buildMessage(dir, &b); err != nil {
+		t.Fatal("buildMessage failed after edit:", err)
+	}
+	if got, want := b.String(), bytes.Replace([]byte(msg), []byte("caf=C3=A9"), []byte("th=C3=A9"), 1); got != string(want) {
+		t.Errorf("buildMessage wrote %q after edit; want %q", got, want)
+	}
+
+	// Parts containing their parent's boundary should be rejected.
+	if err := ioutil.WriteFile(filepath.Join(dir, "1.1.body.txt"), []byte("a\n--def\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := buildMessage(dir, &b); err == nil {
+		t.Error("buildMessage unexpectedly succeeded with boundary in body")
+	}
+}
@@ -0,0 +1,159 @@
+// Copyright 2022 Daniel Erat.
+// All rights reserved.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/derat/rendmail/rewrite"
+)
+
+// watchMain implements the "watch" subcommand using the supplied command-line
+// arguments. The process's exit code is returned.
+func watchMain(args []string) int {
+	opts := rewrite.Options{Now: time.Now()}
+	fs := flag.NewFlagSet("watch", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s watch -maildir=DIR [flag]...\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Rewrites messages in place as they are delivered to a Maildir's new/ subdirectory.\n\n")
+		fs.PrintDefaults()
+	}
+	maildir := fs.String("maildir", "", "Maildir whose new/ subdirectory should be watched")
+	pprofAddr := fs.String("pprof", "", `"host:port" on which to serve net/http/pprof profiles`)
+	preserveMtime := fs.Bool("preserve-mtime", false, "Keep original modification times of rewritten messages")
+	var bk backupOptions
+	addBackupFlags(fs, &bk)
+	rf := addRewriteFlags(fs, &opts)
+	fs.Parse(args)
+
+	if err := rf.finish(&opts); err != nil {
+		fmt.Fprintln(os.Stderr, "Invalid flags:", err)
+		return 2
+	}
+	if *maildir == "" || fs.NArg() > 0 {
+		fs.Usage()
+		return 2
+	}
+	if err := bk.check(); err != nil {
+		fmt.Fprintln(os.Stderr, "Invalid flags:", err)
+		return 2
+	}
+
+	if *pprofAddr != "" {
+		if err := servePprof(*pprofAddr, opts.Logger()); err != nil {
+			opts.Logger().Errorf("Failed serving pprof: %v", err)
+			return 1
+		}
+	}
+
+	w, err := newDirWatcher(filepath.Join(*maildir, "new"))
+	if err != nil {
+		opts.Logger().Errorf("Failed watching Maildir: %v", err)
+		return 1
+	}
+	sc := make(chan os.Signal, 1)
+	signal.Notify(sc, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-sc
+		w.close()
+	}()
+
+	bo := batchOptions{
+		backup:    bk,
+		keepMtime: *preserveMtime,
+	}
+	if err := watchMaildir(*maildir, w, &bo, &opts, *rf.fakeNow != ""); err != nil {
+		opts.Logger().Errorf("Failed watching Maildir: %v", err)
+		return 1
+	}
+	return 0
+}
+
+// watchMaildir rewrites the messages already in the new/ subdirectory of the Maildir
+// at dir and then rewrites additional messages as they are reported by w, which must
+// be watching new/. It returns after w is closed. Failures for individual messages
+// are logged and processing continues. If fakeNow is false, opts.Now is updated
+// before each message is rewritten.
+func watchMaildir(dir string, w *dirWatcher, bo *batchOptions, opts *rewrite.Options, fakeNow bool) error {
+	newDir := filepath.Join(dir, "new")
+	tmpDir := filepath.Join(dir, "tmp")
+	if err := os.MkdirAll(tmpDir, 0700); err != nil {
+		return err
+	}
+
+	// Files that we wrote, keyed by name. Our own renames produce events that should be
+	// ignored, but a file with the same name may be delivered again later. Entries are
+	// retained until the file is changed or removed since a rescan (e.g. after the watcher
+	// lost events) may occur before the event for our rename is received.
+	replaced := make(map[string]os.FileInfo)
+
+	rewriteFile := func(name string) {
+		// Maildir readers ignore dotfiles.
+		if name == "" || name[0] == '.' {
+			return
+		}
+		p := filepath.Join(newDir, name)
+		fi, err := os.Lstat(p)
+		if err != nil || !fi.Mode().IsRegular() {
+			delete(replaced, name)
+			return // already moved to cur/ by a mail client
+		}
+		if old, ok := replaced[name]; ok {
+			if os.SameFile(old, fi) && old.ModTime().Equal(fi.ModTime()) && old.Size() == fi.Size() {
+				return
+			}
+			delete(replaced, name)
+		}
+		if !fakeNow {
+			opts.Now = time.Now()
+		}
+		dst, err := rewriteMaildirMessage(p, tmpDir, bo, opts)
+		if err != nil {
+			opts.Logger().Errorf("Failed rewriting %v: %v", p, err)
+		} else if dst != "" {
+			if fi, err := os.Lstat(dst); err == nil {
+				replaced[filepath.Base(dst)] = fi
+			}
+		}
+	}
+	rescan := func() error {
+		fis, err := ioutil.ReadDir(newDir)
+		if err != nil {
+			return err
+		}
+		present := make(map[string]bool, len(fis))
+		for _, fi := range fis {
+			present[fi.Name()] = true
+			rewriteFile(fi.Name())
+		}
+		for name := range replaced {
+			if !present[name] {
+				delete(replaced, name)
+			}
+		}
+		return nil
+	}
+
+	if err := rescan(); err != nil {
+		return err
+	}
+	for name := range w.names {
+		if name == "" {
+			// The watcher lost events, so check everything.
+			if err := rescan(); err != nil {
+				return err
+			}
+			continue
+		}
+		rewriteFile(name)
+	}
+	return w.err()
+}
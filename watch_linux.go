@@ -0,0 +1,118 @@
+// Copyright 2022 Daniel Erat.
+// All rights reserved.
+
+package main
+
+import (
+	"bytes"
+	"os"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// linkedFileDelay is how long dirWatcher waits after a file is created without being
+// modified or closed before assuming that it was linked into the directory.
+const linkedFileDelay = time.Second
+
+// dirWatcher uses inotify to report files that are added to a directory.
+type dirWatcher struct {
+	// names receives the names of files that are added to the directory.
+	// An empty string is sent if events were lost and the directory should
+	// be rescanned. The channel is closed when the watcher is closed.
+	names chan string
+
+	f       *os.File // inotify instance
+	readErr error    // error encountered while reading events
+}
+
+// newDirWatcher starts watching dir.
+func newDirWatcher(dir string) (*dirWatcher, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, os.NewSyscallError("inotify_init1", err)
+	}
+	// The Maildir spec requires messages to be written to tmp/ and then linked or renamed
+	// into new/, but some delivery agents write files directly in new/, so files are
+	// reported after they're closed for writing or renamed into new/. Linking a file only
+	// produces IN_CREATE, though, so created files are also reported if they aren't
+	// modified for a while (see read).
+	const mask = syscall.IN_CREATE | syscall.IN_MODIFY | syscall.IN_CLOSE_WRITE |
+		syscall.IN_MOVED_TO | syscall.IN_ONLYDIR
+	if _, err := syscall.InotifyAddWatch(fd, dir, mask); err != nil {
+		syscall.Close(fd)
+		return nil, &os.PathError{Op: "inotify_add_watch", Path: dir, Err: err}
+	}
+	// Using an os.File for the nonblocking FD lets close interrupt reads.
+	w := &dirWatcher{names: make(chan string, 16), f: os.NewFile(uintptr(fd), "inotify")}
+	go w.read()
+	return w, nil
+}
+
+// read reads events and sends names to w.names until w.f is closed.
+//
+// Names of created files are held until IN_CLOSE_WRITE is received, or until
+// linkedFileDelay has elapsed since the file was created or last modified.
+func (w *dirWatcher) read() {
+	defer close(w.names)
+	buf := make([]byte, 64*1024)
+	pending := make(map[string]time.Time) // created files, keyed to last activity
+	for {
+		var deadline time.Time
+		for _, t := range pending {
+			if d := t.Add(linkedFileDelay); deadline.IsZero() || d.Before(deadline) {
+				deadline = d
+			}
+		}
+		w.f.SetReadDeadline(deadline)
+		n, err := w.f.Read(buf)
+		if os.IsTimeout(err) {
+			now := time.Now()
+			for name, t := range pending {
+				if now.Sub(t) >= linkedFileDelay {
+					delete(pending, name)
+					w.names <- name
+				}
+			}
+			continue
+		}
+		if err != nil {
+			if pe, ok := err.(*os.PathError); !ok || pe.Err != os.ErrClosed {
+				w.readErr = err
+			}
+			return
+		}
+		for off := 0; off+syscall.SizeofInotifyEvent <= n; {
+			ev := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[off]))
+			start := off + syscall.SizeofInotifyEvent
+			name := string(bytes.TrimRight(buf[start:start+int(ev.Len)], "\x00"))
+			off = start + int(ev.Len)
+
+			switch {
+			case ev.Mask&syscall.IN_Q_OVERFLOW != 0:
+				w.names <- ""
+			case ev.Mask&syscall.IN_ISDIR != 0 || name == "":
+			case ev.Mask&syscall.IN_CREATE != 0:
+				pending[name] = time.Now()
+			case ev.Mask&syscall.IN_MODIFY != 0:
+				if _, ok := pending[name]; ok {
+					pending[name] = time.Now()
+				}
+			default: // IN_CLOSE_WRITE or IN_MOVED_TO
+				delete(pending, name)
+				w.names <- name
+			}
+		}
+	}
+}
+
+// close stops watching the directory.
+func (w *dirWatcher) close() error {
+	return w.f.Close()
+}
+
+// err returns the error, if any, that stopped the watcher.
+// It should only be called after names has been closed.
+func (w *dirWatcher) err() error {
+	return w.readErr
+}
@@ -0,0 +1,81 @@
+// Copyright 2022 Daniel Erat.
+// All rights reserved.
+
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"io/ioutil"
+	"time"
+)
+
+// watchPollInterval is the interval at which dirWatcher checks for new files.
+const watchPollInterval = time.Second
+
+// dirWatcher polls a directory to report files that are added to it,
+// since inotify is only available on Linux.
+type dirWatcher struct {
+	// names receives the names of files that are added to the directory.
+	// An empty string is sent if events were lost and the directory should
+	// be rescanned. The channel is closed when the watcher is closed.
+	names chan string
+
+	done    chan struct{}
+	readErr error
+}
+
+// newDirWatcher starts watching dir.
+func newDirWatcher(dir string) (*dirWatcher, error) {
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]time.Time, len(fis))
+	for _, fi := range fis {
+		seen[fi.Name()] = fi.ModTime()
+	}
+	w := &dirWatcher{names: make(chan string, 16), done: make(chan struct{})}
+	go w.poll(dir, seen)
+	return w, nil
+}
+
+// poll sends names of new or modified files to w.names until w.done is closed.
+func (w *dirWatcher) poll(dir string, seen map[string]time.Time) {
+	defer close(w.names)
+	t := time.NewTicker(watchPollInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-w.done:
+			return
+		case <-t.C:
+		}
+		fis, err := ioutil.ReadDir(dir)
+		if err != nil {
+			w.readErr = err
+			return
+		}
+		cur := make(map[string]time.Time, len(fis))
+		for _, fi := range fis {
+			cur[fi.Name()] = fi.ModTime()
+			if old, ok := seen[fi.Name()]; !ok || !old.Equal(fi.ModTime()) {
+				w.names <- fi.Name()
+			}
+		}
+		seen = cur
+	}
+}
+
+// close stops watching the directory.
+func (w *dirWatcher) close() error {
+	close(w.done)
+	return nil
+}
+
+// err returns the error, if any, that stopped the watcher.
+// It should only be called after names has been closed.
+func (w *dirWatcher) err() error {
+	return w.readErr
+}
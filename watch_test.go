@@ -0,0 +1,176 @@
+// Copyright 2022 Daniel Erat.
+// All rights reserved.
+
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/derat/rendmail/rewrite"
+)
+
+func TestWatchMaildir(t *testing.T) {
+	const (
+		orig = "X-Strip: 1\nSubject: Hi\n\nBody\n"
+		want = "Subject: Hi\n\nBody\n"
+	)
+
+	dir := t.TempDir()
+	for _, sub := range []string{"cur", "new", "tmp"} {
+		if err := os.Mkdir(filepath.Join(dir, sub), 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// This message should be rewritten by the initial scan.
+	existing := filepath.Join(dir, "new/existing")
+	if err := ioutil.WriteFile(existing, []byte(orig), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	w, err := newDirWatcher(filepath.Join(dir, "new"))
+	if err != nil {
+		t.Fatal("newDirWatcher failed:", err)
+	}
+	opts := rewrite.Options{StripHeaders: []string{"X-Strip"}}
+	done := make(chan error, 1)
+	go func() { done <- watchMaildir(dir, w, &batchOptions{}, &opts, true) }()
+
+	// Deliver one message by linking it and another by renaming it.
+	d, err := newMaildirDelivery(dir, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Write([]byte(orig)); err != nil {
+		t.Fatal(err)
+	}
+	delivered, err := d.commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	renamed := filepath.Join(dir, "new/renamed")
+	if err := ioutil.WriteFile(filepath.Join(dir, "tmp/renamed"), []byte(orig), 0600); err != nil {
+		t.Fatal(err)
+	} else if err := os.Rename(filepath.Join(dir, "tmp/renamed"), renamed); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, p := range []string{existing, delivered, renamed} {
+		var got string
+		for start := time.Now(); time.Since(start) < 10*time.Second; time.Sleep(10 * time.Millisecond) {
+			if b, err := ioutil.ReadFile(p); err != nil {
+				t.Fatal(err)
+			} else if got = string(b); got == want {
+				break
+			}
+		}
+		if got != want {
+			t.Errorf("%v contains %q; want %q", p, got, want)
+		}
+	}
+
+	if err := w.close(); err != nil {
+		t.Error("close failed:", err)
+	}
+	if err := <-done; err != nil {
+		t.Error("watchMaildir failed:", err)
+	}
+}
+
+func TestWatchMaildir_directWrite(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("Polling can't tell when files are fully written")
+	}
+	const (
+		orig = "X-Strip: 1\nSubject: Hi\n\nBody\n"
+		want = "Subject: Hi\n\nBody\n"
+	)
+	dir := t.TempDir()
+	for _, sub := range []string{"cur", "new", "tmp"} {
+		if err := os.Mkdir(filepath.Join(dir, sub), 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+	w, err := newDirWatcher(filepath.Join(dir, "new"))
+	if err != nil {
+		t.Fatal("newDirWatcher failed:", err)
+	}
+	opts := rewrite.Options{StripHeaders: []string{"X-Strip"}}
+	done := make(chan error, 1)
+	go func() { done <- watchMaildir(dir, w, &batchOptions{}, &opts, true) }()
+
+	// Some delivery agents write messages directly to new/, so the message shouldn't
+	// be rewritten until it's been closed.
+	p := filepath.Join(dir, "new/direct")
+	f, err := os.Create(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{orig[:5], orig[5:15], orig[15:]} {
+		if _, err := io.WriteString(f, s); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	var got string
+	for start := time.Now(); time.Since(start) < 10*time.Second; time.Sleep(10 * time.Millisecond) {
+		if b, err := ioutil.ReadFile(p); err != nil {
+			t.Fatal(err)
+		} else if got = string(b); got == want {
+			break
+		}
+	}
+	if got != want {
+		t.Errorf("%v contains %q; want %q", p, got, want)
+	}
+
+	if err := w.close(); err != nil {
+		t.Error("close failed:", err)
+	}
+	if err := <-done; err != nil {
+		t.Error("watchMaildir failed:", err)
+	}
+}
+
+func TestWatchMaildir_rescan(t *testing.T) {
+	dir := t.TempDir()
+	for _, sub := range []string{"cur", "new", "tmp"} {
+		if err := os.Mkdir(filepath.Join(dir, sub), 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+	const name = "msg"
+	if err := ioutil.WriteFile(filepath.Join(dir, "new", name), []byte("X-Strip: 1\n\nBody\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// Count the number of times that the message is rewritten.
+	var n int
+	opts := rewrite.Options{
+		StripHeaders: []string{"X-Strip"},
+		Visit: func(p *rewrite.PartInfo, r io.Reader) rewrite.Action {
+			n++
+			return rewrite.Keep
+		},
+	}
+	// Use a fake watcher that reports that events were lost before reporting our own rename.
+	w := &dirWatcher{names: make(chan string, 2)}
+	w.names <- ""
+	w.names <- name
+	close(w.names)
+	if err := watchMaildir(dir, w, &batchOptions{}, &opts, true); err != nil {
+		t.Fatal("watchMaildir failed:", err)
+	}
+	if n != 1 {
+		t.Errorf("Message was rewritten %d times; want 1", n)
+	}
+}